@@ -0,0 +1,346 @@
+package main
+
+import (
+	"backend/db"
+	"backend/service"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const testTimeout = 5 * time.Second
+
+// testConfig is the config of the tests, only the required variables are
+// set so everything else has its default.
+func testConfig(tb testing.TB) *types.Config {
+	tb.Helper()
+	var conf types.Config
+	err := env.ParseWithOptions(&conf, env.Options{
+		Environment: map[string]string{
+			"COOKIE_EXPIRATION":          "1h",
+			"ROOM_INACTIVITY_THRESHOLD":  "1h",
+			"MAX_ROOMS_HOSTED":           "3",
+			"GOOGLE_OAUTH_REDIRECT_URL":  "http://localhost/callback",
+			"GOOGLE_OAUTH_CLIENT_ID":     "id",
+			"GOOGLE_OAUTH_CLIENT_SECRET": "secret",
+			"POSTGRES_URL":               "postgres://localhost/test",
+			"REDIS_URL":                  "redis://localhost:6379",
+			"WEB_URL":                    "http://localhost:5173",
+			"GEMINI_API_KEY":             "key",
+			"GEMINI_AI_MODEL":            "model",
+		},
+	})
+	if err != nil {
+		tb.Fatalf("failed to parse config: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		tb.Fatalf("invalid default config: %v", err)
+	}
+	// the tests run offline
+	conf.RTC.STUNURLs = nil
+	conf.Recording.Dir = tb.TempDir()
+	return &conf
+}
+
+type testApp struct {
+	*application
+	store *db.MemoryStore
+	srv   *httptest.Server
+}
+
+// newTestApp starts the socket server and the API on top of repo, which is
+// usually a MemoryStore. change can tweak the config before it's used.
+func newTestApp(tb testing.TB, repo db.Store, change func(conf *types.Config)) *testApp {
+	tb.Helper()
+	conf := testConfig(tb)
+	if change != nil {
+		change(conf)
+	}
+	webrtcAPI, err := newWebRTCAPI(conf)
+	if err != nil {
+		tb.Fatalf("failed to create webrtc api: %v", err)
+	}
+
+	svc := service.NewService(conf, repo)
+	bot := &types.User{Username: "Cybertown Bot"}
+	app := &application{
+		repo: repo,
+		svc:  svc,
+		conf: conf,
+		ss:   newSocketServer(repo, svc, webrtcAPI, conf, bot, map[string]struct{}{"👍": {}}),
+	}
+	go app.ss.run()
+	go app.ss.runJobs()
+
+	ta := &testApp{application: app, srv: httptest.NewServer(app.router())}
+	ta.store, _ = repo.(*db.MemoryStore)
+	tb.Cleanup(ta.srv.Close)
+	return ta
+}
+
+// user creates a user and returns it with the ID of its session.
+func (ta *testApp) user(tb testing.TB, name string) (*types.User, string) {
+	tb.Helper()
+	ctx := context.Background()
+	id, err := ta.repo.CreateUser(ctx, &types.GoogleUserInfo{ID: name, Name: name, Email: name + "@example.com"})
+	if err != nil {
+		tb.Fatalf("failed to create user: %v", err)
+	}
+	session, err := ta.repo.CreateSession(ctx, id, time.Now().Add(time.Hour))
+	if err != nil {
+		tb.Fatalf("failed to create session: %v", err)
+	}
+	return &types.User{ID: id, Username: name}, session
+}
+
+func (ta *testApp) room(tb testing.TB, host *types.User, change func(r *types.Room)) int {
+	tb.Helper()
+	r := &types.Room{
+		Topic:           "test",
+		Languages:       []string{"english"},
+		MaxParticipants: 10,
+		CreatedBy:       host.ID,
+	}
+	if change != nil {
+		change(r)
+	}
+	id, err := ta.repo.CreateRoom(context.Background(), r)
+	if err != nil {
+		tb.Fatalf("failed to create room: %v", err)
+	}
+	return id
+}
+
+// get sends an API request with the session, if any.
+func (ta *testApp) get(tb testing.TB, path, session string) *http.Response {
+	tb.Helper()
+	req, err := http.NewRequest(http.MethodGet, ta.srv.URL+"/api/v1"+path, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+type testEvent struct {
+	Seq  uint64          `json:"seq"`
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// testClient is a websocket client which keeps every event it receives.
+type testClient struct {
+	ws *websocket.Conn
+
+	mu     sync.Mutex
+	events []*testEvent
+	closed bool
+	// closeErr is why the connection was closed
+	closeErr error
+	notify   chan struct{}
+	ids      int
+}
+
+// dial opens a websocket with the session, query is added to the URL.
+func (ta *testApp) dial(tb testing.TB, session, query string) *testClient {
+	tb.Helper()
+	url := "ws" + strings.TrimPrefix(ta.srv.URL, "http") + "/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	opts := &websocket.DialOptions{}
+	if session != "" {
+		opts.HTTPHeader = http.Header{"Cookie": {"session=" + session}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, url, opts)
+	if err != nil {
+		tb.Fatalf("failed to dial: %v", err)
+	}
+
+	c := &testClient{ws: ws, notify: make(chan struct{}, 1)}
+	go c.readLoop()
+	tb.Cleanup(func() { ws.Close(websocket.StatusNormalClosure, "") })
+	return c
+}
+
+func (c *testClient) readLoop() {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		c.closed = true
+		c.closeErr = err
+		c.mu.Unlock()
+		c.wake()
+	}()
+	for {
+		var e testEvent
+		if err = wsjson.Read(context.Background(), c.ws, &e); err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.events = append(c.events, &e)
+		c.mu.Unlock()
+		c.wake()
+	}
+}
+
+func (c *testClient) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// send sends the event without waiting for its reply, it returns the ID
+// of the event.
+func (c *testClient) send(tb testing.TB, name string, data any) string {
+	tb.Helper()
+	c.mu.Lock()
+	c.ids++
+	id := fmt.Sprintf("%s-%d", strings.ToLower(name), c.ids)
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := wsjson.Write(ctx, c.ws, &types.Event{ID: id, Name: name, Data: data}); err != nil {
+		tb.Fatalf("failed to send %s: %v", name, err)
+	}
+	return id
+}
+
+// call sends the event and waits for its ACK, it fails the test if an
+// ERROR is sent instead.
+func (c *testClient) call(tb testing.TB, name string, data any) json.RawMessage {
+	tb.Helper()
+	ack, evErr := c.reply(tb, name, data)
+	if evErr != nil {
+		tb.Fatalf("%s failed: %s: %s", name, evErr.Code, evErr.Message)
+	}
+	return ack
+}
+
+// callErr sends the event and waits for its ERROR, it fails the test if
+// the event succeeds.
+func (c *testClient) callErr(tb testing.TB, name string, data any) *eventError {
+	tb.Helper()
+	_, evErr := c.reply(tb, name, data)
+	if evErr == nil {
+		tb.Fatalf("%s succeeded, expected an error", name)
+	}
+	return evErr
+}
+
+func (c *testClient) reply(tb testing.TB, name string, data any) (json.RawMessage, *eventError) {
+	tb.Helper()
+	id := c.send(tb, name, data)
+	type replyData struct {
+		ID   string          `json:"id"`
+		Data json.RawMessage `json:"data"`
+		eventError
+	}
+	var reply replyData
+	c.waitFor(tb, name+" reply", func(e *testEvent) bool {
+		if e.Name != "ACK" && e.Name != "ERROR" {
+			return false
+		}
+		var r replyData
+		if json.Unmarshal(e.Data, &r) != nil || r.ID != id {
+			return false
+		}
+		reply = r
+		return true
+	})
+	if reply.Code != "" {
+		return nil, &reply.eventError
+	}
+	return reply.Data, nil
+}
+
+// waitFor waits for an event matching match, including the ones received
+// already.
+func (c *testClient) waitFor(tb testing.TB, what string, match func(e *testEvent) bool) *testEvent {
+	tb.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		c.mu.Lock()
+		for _, e := range c.events {
+			if match(e) {
+				c.mu.Unlock()
+				return e
+			}
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			tb.Fatalf("connection closed while waiting for %s", what)
+		}
+
+		select {
+		case <-c.notify:
+		case <-deadline:
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitEvent waits for an event by name.
+func (c *testClient) waitEvent(tb testing.TB, name string) *testEvent {
+	tb.Helper()
+	return c.waitFor(tb, name, func(e *testEvent) bool {
+		return e.Name == name
+	})
+}
+
+// count returns the number of events received by name.
+func (c *testClient) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, e := range c.events {
+		if e.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// has reports whether an event by name was received.
+func (c *testClient) has(name string) bool {
+	return c.count(name) > 0
+}
+
+// eventually polls cond until it's true or the test times out.
+func eventually(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
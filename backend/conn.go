@@ -0,0 +1,256 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lithammer/shortuuid/v4"
+	"nhooyr.io/websocket"
+)
+
+var (
+	droppedEvents  = expvar.NewInt("ws_dropped_events")
+	slowDisconnect = expvar.NewInt("ws_slow_disconnects")
+	resumedConns   = expvar.NewInt("ws_resumed_sessions")
+)
+
+type seqEvent struct {
+	seq uint64
+	b   []byte
+}
+
+// socketConn is a client session. It outlives the websocket while the
+// client is reconnecting, the session is keyed by its first websocket in the
+// socket server.
+type socketConn struct {
+	pID  string
+	peer *Peer
+	// roomID is the last room joined by the connection
+	roomID int
+	// token lets the client resume the session after a dropped connection
+	token string
+	// expiry ends the session once the resume grace period is over
+	expiry *time.Timer
+	// muted is the microphone state last sent by the client
+	muted bool
+	// stats is the last measure of the peer's connection
+	stats *t.PeerStats
+	// recovery is set while the peer is disconnected
+	recovery *peerRecovery
+
+	mu sync.Mutex
+	// ws is nil while the client is reconnecting
+	ws      *websocket.Conn
+	out     chan []byte
+	done    chan struct{}
+	closing bool
+	seq     uint64
+	// sent holds the most recent events, so the ones missed while
+	// reconnecting can be replayed
+	sent []seqEvent
+
+	queueSize    int
+	bufferSize   int
+	writeTimeout time.Duration
+	overflow     string
+}
+
+func newSocketConn(ws *websocket.Conn, pID string, cfg *t.Config) *socketConn {
+	return &socketConn{
+		pID:          pID,
+		token:        shortuuid.New(),
+		muted:        true,
+		ws:           ws,
+		out:          make(chan []byte, cfg.Socket.QueueSize),
+		done:         make(chan struct{}),
+		queueSize:    cfg.Socket.QueueSize,
+		bufferSize:   cfg.Socket.ResumeBufferSize,
+		writeTimeout: cfg.Socket.WriteTimeout,
+		overflow:     cfg.Socket.OverflowPolicy,
+	}
+}
+
+// send queues the event for the connection's writer. It never blocks, so a
+// slow client can't hold up the run loop or a broadcast.
+func (c *socketConn) send(event *t.Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal %q event: %v", event.Name, err)
+		return
+	}
+	c.enqueue(event.Name, b)
+}
+
+// enqueue numbers the event and queues it. While the client is reconnecting
+// the event is only kept for replay.
+func (c *socketConn) enqueue(name string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	b = withSeq(c.seq, b)
+	c.sent = append(c.sent, seqEvent{seq: c.seq, b: b})
+	if len(c.sent) > c.bufferSize {
+		c.sent = c.sent[len(c.sent)-c.bufferSize:]
+	}
+
+	if c.ws == nil {
+		return
+	}
+
+	select {
+	case c.out <- b:
+		return
+	default:
+	}
+
+	droppedEvents.Add(1)
+	if c.overflow == t.OverflowDrop {
+		log.Printf("outbound queue full, dropped %q event for %s", name, c.pID)
+		return
+	}
+
+	log.Printf("outbound queue full, disconnecting %s", c.pID)
+	if !c.closing {
+		c.closing = true
+		slowDisconnect.Add(1)
+		go c.ws.Close(websocket.StatusTryAgainLater, "outbound queue full")
+	}
+}
+
+// withSeq adds the sequence number to the marshalled event, the events are
+// shared between connections so they aren't marshalled again.
+func withSeq(seq uint64, b []byte) []byte {
+	prefix := fmt.Sprintf(`{"seq":%d,`, seq)
+	out := make([]byte, 0, len(prefix)+len(b))
+	out = append(out, prefix...)
+	return append(out, b[1:]...)
+}
+
+// writeLoop is the only goroutine writing to the websocket. It stops when
+// the connection is closed or a write fails.
+func (c *socketConn) writeLoop(ws *websocket.Conn, out <-chan []byte, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case b := <-out:
+			ctx, cancel := context.WithTimeout(context.Background(), c.writeTimeout)
+			err := ws.Write(ctx, websocket.MessageText, b)
+			cancel()
+			if err != nil {
+				log.Printf("failed to write to socket %s: %v", c.pID, err)
+				ws.CloseNow()
+				return
+			}
+		}
+	}
+}
+
+func (c *socketConn) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	go c.writeLoop(c.ws, c.out, c.done)
+}
+
+// stop detaches the websocket and returns it, the events sent after that
+// are only kept for replay.
+func (c *socketConn) stop() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws := c.ws
+	if ws == nil {
+		return nil
+	}
+	close(c.done)
+	c.ws = nil
+	return ws
+}
+
+// attach resumes the session on ws and replays the events after lastSeq.
+// It fails if some of those events are no longer kept.
+func (c *socketConn) attach(ws *websocket.Conn, lastSeq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ws != nil || lastSeq > c.seq {
+		return false
+	}
+	var missed []seqEvent
+	if lastSeq < c.seq {
+		if len(c.sent) == 0 || c.sent[0].seq > lastSeq+1 {
+			return false
+		}
+		missed = c.sent[len(c.sent)-int(c.seq-lastSeq):]
+	}
+
+	c.ws = ws
+	c.out = make(chan []byte, c.queueSize+len(missed))
+	c.done = make(chan struct{})
+	c.closing = false
+	for _, e := range missed {
+		c.out <- e.b
+	}
+	go c.writeLoop(c.ws, c.out, c.done)
+	return true
+}
+
+// close closes the websocket, the session itself is closed once the read
+// loop notices.
+func (c *socketConn) close(code websocket.StatusCode, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil || c.closing {
+		return
+	}
+	c.closing = true
+	go c.ws.Close(code, reason)
+}
+
+// isAttached reports whether ws is the current websocket of the session.
+func (c *socketConn) isAttached(ws *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws != nil && c.ws == ws
+}
+
+func (c *socketConn) queueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil {
+		return 0
+	}
+	return len(c.out)
+}
+
+// publishMetrics exposes the outbound queue depths through expvar.
+func (s *socketServer) publishMetrics() {
+	expvar.Publish("ws_queues", expvar.Func(func() any {
+		var (
+			total   int
+			deepest int
+			conns   int
+		)
+		s.do(func() {
+			conns = len(s.conns)
+			for _, c := range s.conns {
+				d := c.queueDepth()
+				total += d
+				if d > deepest {
+					deepest = d
+				}
+			}
+		})
+		return map[string]int{
+			"conns":    conns,
+			"total":    total,
+			"maxDepth": deepest,
+		}
+	}))
+}
@@ -7,6 +7,12 @@ import (
 	"time"
 )
 
+const (
+	heartbeatInterval = 10 * time.Second
+	instanceMaxAge    = 30 * time.Second
+	messagesInterval  = 1 * time.Hour
+)
+
 func (a *application) deleteInactiveRooms(ctx context.Context, threshold time.Duration) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
@@ -16,9 +22,41 @@ func (a *application) deleteInactiveRooms(ctx context.Context, threshold time.Du
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			// only one instance has to clean up the rooms
+			ok, err := a.repo.AcquireLock(ctx, "delete-inactive-rooms", a.ss.instanceID, 50*time.Second)
+			if err != nil || !ok {
+				continue
+			}
+
+			var ids []int
+			a.ss.do(func() {
+				for rID := range a.ss.rooms {
+					ids = append(ids, rID)
+				}
+			})
+			if len(ids) == 0 {
+				continue
+			}
+
+			participants, err := a.ss.getParticipantsInRooms(ids)
+			if err != nil {
+				log.Printf("failed to get participants in rooms: %v", err)
+				continue
+			}
+			activity, err := a.repo.GetRoomActivity(ctx, ids)
+			if err != nil {
+				log.Printf("failed to get room activity: %v", err)
+				continue
+			}
+
 			var roomIDs []int
-			for rID, r := range a.ss.rooms {
-				if len(r.conns) == 0 && time.Now().UTC().After(r.lastActivity.Add(threshold)) {
+			for _, rID := range ids {
+				lastActivity, ok := activity[rID]
+				if !ok {
+					a.repo.TouchRoom(ctx, rID)
+					continue
+				}
+				if len(participants[rID]) == 0 && time.Now().UTC().After(lastActivity.Add(threshold)) {
 					roomIDs = append(roomIDs, rID)
 				}
 			}
@@ -31,17 +69,74 @@ func (a *application) deleteInactiveRooms(ctx context.Context, threshold time.Du
 				}
 
 				for _, rID := range roomIDs {
-					delete(a.ss.rooms, rID)
 					a.repo.DeleteAIReplies(ctx, rID)
 				}
+				if err := a.repo.DeleteRoomPresence(ctx, roomIDs); err != nil {
+					log.Printf("failed to delete room presence: %v", err)
+				}
 
-				a.ss.broadcastEvent(&types.Event{
-					Name: "ROOMS_DELETED_BROADCAST",
-					Data: map[string]any{
-						"roomIDs": roomIDs,
-					},
+				a.ss.do(func() {
+					for _, rID := range roomIDs {
+						a.ss.closeRoomExternal(rID)
+						delete(a.ss.rooms, rID)
+					}
+					a.ss.publish(&types.ClusterEvent{
+						Kind:    types.ClusterRoomsDeleted,
+						RoomIDs: roomIDs,
+					})
+					a.ss.broadcastEvent(&types.Event{
+						Name: "ROOMS_DELETED_BROADCAST",
+						Data: map[string]any{
+							"roomIDs": roomIDs,
+						},
+					})
 				})
 			}
 		}
 	}
 }
+
+// deleteExpiredMessages deletes the room messages which are older than their
+// room's retention.
+func (a *application) deleteExpiredMessages(ctx context.Context) {
+	ticker := time.NewTicker(messagesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// only one instance has to delete them
+			ok, err := a.repo.AcquireLock(ctx, "delete-expired-messages", a.ss.instanceID, messagesInterval-time.Minute)
+			if err != nil || !ok {
+				continue
+			}
+			if err := a.repo.DeleteExpiredRoomMessages(ctx, a.conf.Messages.Retention); err != nil {
+				log.Printf("failed to delete expired messages: %v", err)
+			}
+		}
+	}
+}
+
+// heartbeat keeps this instance's presence in redis alive and purges the
+// presence of instances which stopped sending theirs.
+func (a *application) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.repo.TouchInstance(ctx, a.ss.instanceID); err != nil {
+			log.Printf("failed to send heartbeat: %v", err)
+		}
+		if err := a.repo.PurgeStaleInstances(ctx, instanceMaxAge); err != nil {
+			log.Printf("failed to purge stale instances: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -29,7 +29,39 @@ CREATE TABLE IF NOT EXISTS room_settings (
   room_id INT REFERENCES rooms (id) ON DELETE CASCADE,
   host INT REFERENCES users(id),
   co_hosts INT[],
-  welcome_message varchar(512)
+  welcome_message varchar(512),
+  video_publishers VARCHAR(16) NOT NULL DEFAULT 'everyone',
+  screen_publishers VARCHAR(16) NOT NULL DEFAULT 'coHosts',
+  stage BOOLEAN NOT NULL DEFAULT FALSE,
+  speakers INT[],
+  ingest_token VARCHAR(64),
+  message_retention INT,
+  locked BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS video_publishers VARCHAR(16) NOT NULL DEFAULT 'everyone';
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS screen_publishers VARCHAR(16) NOT NULL DEFAULT 'coHosts';
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS stage BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS speakers INT[];
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS ingest_token VARCHAR(64);
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS message_retention INT;
+ALTER TABLE room_settings ADD COLUMN IF NOT EXISTS locked BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- max_uses and expired_at are NULL for invites without a limit
+CREATE TABLE IF NOT EXISTS room_invites (
+  code VARCHAR(32) PRIMARY KEY,
+  room_id INT REFERENCES rooms (id) ON DELETE CASCADE,
+  created_by INT REFERENCES users (id) ON DELETE CASCADE,
+  max_uses INT,
+  expired_at TIMESTAMP WITHOUT TIME ZONE,
+  created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT NOW()
+);
+
+-- the users who joined with an invite, they may join again with it
+CREATE TABLE IF NOT EXISTS room_invite_uses (
+  code VARCHAR(32) REFERENCES room_invites (code) ON DELETE CASCADE,
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  PRIMARY KEY (code, user_id)
 );
 
 CREATE TABLE IF NOT EXISTS room_kicks (
@@ -67,3 +99,20 @@ CREATE TABLE IF NOT EXISTS messages (
   reactions JSONB,
   created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL
 );
+
+-- room messages and whispers, participant_id is who a whisper is sent to
+CREATE TABLE IF NOT EXISTS room_messages (
+  id VARCHAR(32) PRIMARY KEY,
+  room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+  "from" INT REFERENCES users(id) ON DELETE CASCADE,
+  participant_id INT REFERENCES users(id) ON DELETE CASCADE,
+  content VARCHAR(1024) NOT NULL,
+  is_deleted BOOLEAN DEFAULT FALSE,
+  is_edited BOOLEAN DEFAULT FALSE,
+  is_cleared BOOLEAN DEFAULT FALSE,
+  reply_to VARCHAR(64),
+  reactions JSONB,
+  created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS room_messages_room_id_created_at_id_idx ON room_messages (room_id, created_at, id);
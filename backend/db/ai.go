@@ -13,11 +13,17 @@ import (
 
 const (
 	maxAIMessages = 25
+
+	pendingAIRequestsKey = "ai-pending-requests"
 )
 
+func aiReplyKey(roomID int, msgID string) string {
+	return fmt.Sprintf("ai-reply:%d:%s", roomID, msgID)
+}
+
 // contents[0] - user message, contens[1] - reply from ai
 func (r *Repo) SetAIReply(ctx context.Context, roomID int, msgID string, userID int, contents []string) {
-	key := fmt.Sprintf("ai-reply:%d:%s", roomID, msgID)
+	key := aiReplyKey(roomID, msgID)
 	_, err := r.rdb.Set(ctx, key, contents[1], 0).Result()
 	if err != nil {
 		log.Printf("failed to set ai reply: %v", err)
@@ -86,7 +92,7 @@ func (r *Repo) GetAIMessages(ctx context.Context, roomID, userID int) ([]*t.AIMe
 }
 
 func (r *Repo) IsReplyToAI(ctx context.Context, roomID int, msgID string) (string, error) {
-	key := fmt.Sprintf("ai-reply:%d:%s", roomID, msgID)
+	key := aiReplyKey(roomID, msgID)
 	value, err := r.rdb.Get(ctx, key).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
@@ -126,3 +132,42 @@ func (r *Repo) DeleteAIReplies(ctx context.Context, roomID int) {
 
 	log.Printf("deleted all keys for key %q", match)
 }
+
+func (r *Repo) SavePendingAIRequests(ctx context.Context, reqs []*t.AIMessageRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	values := make([]any, 0, len(reqs))
+	for _, req := range reqs {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		values = append(values, b)
+	}
+	return r.rdb.RPush(ctx, pendingAIRequestsKey, values...).Err()
+}
+
+// PopPendingAIRequests returns and removes the persisted ai requests.
+func (r *Repo) PopPendingAIRequests(ctx context.Context) ([]*t.AIMessageRequest, error) {
+	var values *redis.StringSliceCmd
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.LRange(ctx, pendingAIRequestsKey, 0, -1)
+		pipe.Del(ctx, pendingAIRequestsKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]*t.AIMessageRequest, 0, len(values.Val()))
+	for _, v := range values.Val() {
+		var req t.AIMessageRequest
+		if err := json.Unmarshal([]byte(v), &req); err != nil {
+			log.Printf("failed to unmarshal pending ai request: %v", err)
+			continue
+		}
+		reqs = append(reqs, &req)
+	}
+	return reqs, nil
+}
@@ -3,10 +3,12 @@ package db
 import (
 	t "backend/types"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
@@ -148,10 +150,11 @@ func (r *Repo) CreateRoom(ctx context.Context, room *t.Room) (int, error) {
 	}
 
 	query = `
-	 INSERT INTO room_settings(room_id, host)
-	 VALUES ($1, $2);
+	 INSERT INTO room_settings(room_id, host, stage, message_retention, locked)
+	 VALUES ($1, $2, $3, $4, $5);
   `
-	_, err = tx.Exec(ctx, query, roomID, room.CreatedBy)
+	_, err = tx.Exec(ctx, query, roomID, room.CreatedBy, room.Settings.Stage,
+		room.Settings.MessageRetention, room.Settings.Locked)
 	if err != nil {
 		return 0, err
 	}
@@ -167,7 +170,9 @@ func (r *Repo) CreateRoom(ctx context.Context, room *t.Room) (int, error) {
 func (r *Repo) GetRooms(ctx context.Context) ([]*t.Room, error) {
 	query := `
 	  SELECT r.id, r.topic, r.max_participants, r.languages, r.created_at,
-	  u.id, u.username, u.avatar, s.co_hosts, s.welcome_message
+	  u.id, u.username, u.avatar, s.co_hosts, s.welcome_message,
+	  s.video_publishers, s.screen_publishers, s.stage, s.speakers,
+	  s.message_retention, s.locked
 	  FROM rooms r 
 	  INNER JOIN room_settings s ON s.room_id = r.id
 	  INNER JOIN users u ON u.id = s.host
@@ -193,6 +198,12 @@ func (r *Repo) GetRooms(ctx context.Context) ([]*t.Room, error) {
 			&room.Settings.Host.Avatar,
 			&room.Settings.CoHosts,
 			&room.Settings.WelcomeMessage,
+			&room.Settings.VideoPublishers,
+			&room.Settings.ScreenPublishers,
+			&room.Settings.Stage,
+			&room.Settings.Speakers,
+			&room.Settings.MessageRetention,
+			&room.Settings.Locked,
 		)
 		if err != nil {
 			log.Printf("failed to scan room: %v", err)
@@ -230,18 +241,40 @@ func (r *Repo) GetKick(ctx context.Context, roomID, userID int) (*t.Kick, error)
 }
 
 func (r *Repo) UpdateRoom(ctx context.Context, room *t.Room) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
 	query := `
 	  UPDATE rooms 
 	  SET topic = $1, max_participants = $2, languages = $3
 	  WHERE id = $4;
 	`
-	_, err := r.pool.Exec(ctx, query, room.Topic, room.MaxParticipants, room.Languages, room.ID)
-	return err
+	_, err = tx.Exec(ctx, query, room.Topic, room.MaxParticipants, room.Languages, room.ID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+	  UPDATE room_settings SET stage = $1, message_retention = $2, locked = $3
+	  WHERE room_id = $4;
+	`
+	_, err = tx.Exec(ctx, query, room.Settings.Stage, room.Settings.MessageRetention,
+		room.Settings.Locked, room.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (r *Repo) GetRoomSettings(ctx context.Context, roomID int) (*t.RoomSettings, error) {
 	query := `
-	  SELECT s.room_id, u.id, u.username, u.avatar, s.co_hosts, s.welcome_message
+	  SELECT s.room_id, u.id, u.username, u.avatar, s.co_hosts, s.welcome_message,
+	  s.video_publishers, s.screen_publishers, s.stage, s.speakers,
+	  s.message_retention, s.locked
 	  FROM room_settings s INNER JOIN users u on u.id = s.host
 	  WHERE room_id = $1;
 	`
@@ -254,6 +287,12 @@ func (r *Repo) GetRoomSettings(ctx context.Context, roomID int) (*t.RoomSettings
 		&s.Host.Avatar,
 		&s.CoHosts,
 		&s.WelcomeMessage,
+		&s.VideoPublishers,
+		&s.ScreenPublishers,
+		&s.Stage,
+		&s.Speakers,
+		&s.MessageRetention,
+		&s.Locked,
 	)
 	if err != nil {
 		return nil, err
@@ -271,6 +310,106 @@ func (r *Repo) KickParticipant(ctx context.Context, k *t.Kick) error {
 	return err
 }
 
+func (r *Repo) CreateInvite(ctx context.Context, inv *t.RoomInvite) error {
+	query := `
+	  INSERT INTO room_invites(code, room_id, created_by, max_uses, expired_at)
+	  VALUES ($1, $2, $3, $4, $5)
+	  RETURNING created_at;
+	`
+	return r.pool.QueryRow(ctx, query, inv.Code, inv.RoomID, inv.CreatedBy,
+		inv.MaxUses, inv.ExpiredAt).Scan(&inv.CreatedAt)
+}
+
+func (r *Repo) GetInvites(ctx context.Context, roomID int) ([]*t.RoomInvite, error) {
+	query := `
+	  SELECT i.code, i.created_by, i.max_uses, i.expired_at, i.created_at,
+	  (SELECT COUNT(*) FROM room_invite_uses u WHERE u.code = i.code)
+	  FROM room_invites i
+	  WHERE i.room_id = $1
+	  ORDER BY i.created_at DESC;
+	`
+	rows, err := r.pool.Query(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]*t.RoomInvite, 0)
+	for rows.Next() {
+		inv := t.RoomInvite{RoomID: roomID}
+		err := rows.Scan(&inv.Code, &inv.CreatedBy, &inv.MaxUses,
+			&inv.ExpiredAt, &inv.CreatedAt, &inv.Uses)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, &inv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (r *Repo) DeleteInvite(ctx context.Context, roomID int, code string) error {
+	query := `DELETE FROM room_invites WHERE room_id = $1 AND code = $2;`
+	tag, err := r.pool.Exec(ctx, query, roomID, code)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RedeemInvite records that the user joins the room with the invite, it
+// reports false if the invite doesn't exist, expired or was used by as many
+// users as it may be. A user who redeemed it already may redeem it again.
+func (r *Repo) RedeemInvite(ctx context.Context, roomID int, code string, userID int) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the invite is locked so concurrent joins can't go over max_uses
+	query := `
+	  SELECT max_uses FROM room_invites
+	  WHERE room_id = $1 AND code = $2
+	  AND (expired_at IS NULL OR expired_at > (NOW() AT TIME ZONE 'UTC'))
+	  FOR UPDATE;
+	`
+	var maxUses *int
+	err = tx.QueryRow(ctx, query, roomID, code).Scan(&maxUses)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	query = `
+	  SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id = $2)
+	  FROM room_invite_uses WHERE code = $1;
+	`
+	var uses, own int
+	if err := tx.QueryRow(ctx, query, code, userID).Scan(&uses, &own); err != nil {
+		return false, err
+	}
+	if own > 0 {
+		return true, nil
+	}
+	if maxUses != nil && uses >= *maxUses {
+		return false, nil
+	}
+
+	query = `INSERT INTO room_invite_uses(code, user_id) VALUES ($1, $2);`
+	if _, err := tx.Exec(ctx, query, code, userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
 func (r *Repo) Follow(ctx context.Context, followerID, followeeID int) error {
 	query := `
 	  INSERT INTO follows(follower_id, followee_id)
@@ -292,22 +431,43 @@ func (r *Repo) Unfollow(ctx context.Context, followerID, followeeID int) error {
 func (r *Repo) UpdateRoomSettings(ctx context.Context, s *t.RoomSettings) error {
 	query := `
 	  UPDATE room_settings
-	  SET host = $1, co_hosts = $2, welcome_message = $3
-	  WHERE room_id = $4;
+	  SET host = $1, co_hosts = $2, welcome_message = $3,
+	  video_publishers = $4, screen_publishers = $5, stage = $6, speakers = $7,
+	  message_retention = $8, locked = $9
+	  WHERE room_id = $10;
 	`
-	_, err := r.pool.Exec(ctx, query, s.Host.ID, s.CoHosts, s.WelcomeMessage, s.RoomID)
+	_, err := r.pool.Exec(ctx, query, s.Host.ID, s.CoHosts, s.WelcomeMessage,
+		s.VideoPublishers, s.ScreenPublishers, s.Stage, s.Speakers,
+		s.MessageRetention, s.Locked, s.RoomID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (r *Repo) SetIngestToken(ctx context.Context, roomID int, hash *string) error {
+	query := `UPDATE room_settings SET ingest_token = $1 WHERE room_id = $2;`
+	_, err := r.pool.Exec(ctx, query, hash, roomID)
+	return err
+}
+
+func (r *Repo) GetIngestToken(ctx context.Context, roomID int) (*string, error) {
+	query := `SELECT ingest_token FROM room_settings WHERE room_id = $1;`
+	var hash *string
+	if err := r.pool.QueryRow(ctx, query, roomID).Scan(&hash); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
 func (r *Repo) getRoom(ctx context.Context, filter RoomFilter) (*t.Room, error) {
 	var values []any
 
 	query := `
 	  SELECT r.id, r.topic, r.max_participants, r.languages, r.created_at,
-	  u.id, u.username, u.avatar, s.co_hosts, s.welcome_message
+	  u.id, u.username, u.avatar, s.co_hosts, s.welcome_message,
+	  s.video_publishers, s.screen_publishers, s.stage, s.speakers,
+	  s.message_retention, s.locked
 	  FROM rooms r 
 	  INNER JOIN room_settings s ON s.room_id = r.id
 	  INNER JOIN users u ON u.id = s.host
@@ -336,6 +496,12 @@ func (r *Repo) getRoom(ctx context.Context, filter RoomFilter) (*t.Room, error)
 		&room.Settings.Host.Avatar,
 		&room.Settings.CoHosts,
 		&room.Settings.WelcomeMessage,
+		&room.Settings.VideoPublishers,
+		&room.Settings.ScreenPublishers,
+		&room.Settings.Stage,
+		&room.Settings.Speakers,
+		&room.Settings.MessageRetention,
+		&room.Settings.Locked,
 	)
 	if err != nil {
 		return nil, err
@@ -676,21 +842,11 @@ func (r *Repo) GetMessages(ctx context.Context, userID, participantID int, curso
 			&msg.IsDeleted, &msg.ReplyTo, &reactions, &msg.CreatedAt,
 			&msg.From.ID, &msg.From.Username, &msg.From.Avatar)
 
-		if reactions != nil {
-			rMap := make(map[string]map[int]struct{})
-			for r, pIDs := range *reactions {
-				rMap[r] = make(map[int]struct{})
-				for _, pID := range pIDs {
-					rMap[r][pID] = struct{}{}
-				}
-			}
-			msg.Reactions = &rMap
-		}
-
 		if err != nil {
 			return nil, err
 		}
 
+		msg.Reactions = reactionSets(reactions)
 		messages = append(messages, &msg)
 	}
 
@@ -719,3 +875,189 @@ func (r *Repo) UpdateUser(ctx context.Context, id int, bio string) error {
 	_, err := r.pool.Exec(ctx, query, id, bio)
 	return err
 }
+
+func (r *Repo) CreateRoomMessage(ctx context.Context, msg *t.Message) error {
+	var participantID *int
+	if msg.Participant != nil {
+		participantID = &msg.Participant.ID
+	}
+	query := `
+	  INSERT INTO room_messages (id, room_id, "from", participant_id, content, reply_to, created_at)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`
+	_, err := r.pool.Exec(ctx, query, msg.ID, msg.RoomID, msg.From.ID, participantID,
+		msg.Content, msg.ReplyTo, msg.CreatedAt)
+	return err
+}
+
+func (r *Repo) GetRoomMessage(ctx context.Context, roomID int, msgID string, userID int, isReaction bool) (*t.Message, error) {
+	query := `
+	 SELECT m.id, m.content, m.is_edited, m.is_deleted, m.reactions,
+	        u.id, u.avatar, u.username
+	 FROM room_messages m
+	 INNER JOIN users u ON u.id = m."from"
+	 WHERE m.room_id = $1 AND m.id = $2 AND (m."from" = $3 OR
+	   ($4 = True AND (m.participant_id IS NULL OR m.participant_id = $3)))
+	`
+	m := t.Message{RoomID: &roomID}
+	err := r.pool.QueryRow(ctx, query, roomID, msgID, userID, isReaction).Scan(
+		&m.ID,
+		&m.Content,
+		&m.IsEdited,
+		&m.IsDeleted,
+		&m.Reactions,
+		&m.From.ID,
+		&m.From.Avatar,
+		&m.From.Username,
+	)
+	return &m, err
+}
+
+func (r *Repo) UpdateRoomMessage(ctx context.Context, msg *t.Message, isReaction bool) error {
+	query := `
+	 UPDATE room_messages
+	 SET
+	   content = $5,
+	   is_edited = $6,
+	   is_deleted = $7,
+	   reactions = $8
+	 WHERE id = $1 AND room_id = $2 AND ("from" = $3 OR $4 = True)
+	`
+	_, err := r.pool.Exec(
+		ctx,
+		query,
+		msg.ID,
+		msg.RoomID,
+		msg.From.ID,
+		isReaction,
+		msg.Content,
+		msg.IsEdited,
+		msg.IsDeleted,
+		msg.Reactions,
+	)
+	return err
+}
+
+func (r *Repo) GetKeptRoomMessageRef(ctx context.Context, roomID int, msgID string) (*t.RoomMessageRef, error) {
+	query := `
+	 SELECT m.id, m.participant_id, u.id, u.avatar, u.username
+	 FROM room_messages m
+	 INNER JOIN users u ON u.id = m."from"
+	 WHERE m.room_id = $1 AND m.id = $2
+	`
+	var ref t.RoomMessageRef
+	err := r.pool.QueryRow(ctx, query, roomID, msgID).Scan(
+		&ref.ID,
+		&ref.ParticipantID,
+		&ref.From.ID,
+		&ref.From.Avatar,
+		&ref.From.Username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (r *Repo) GetRoomMessages(ctx context.Context, roomID, userID int, cursor *t.MessageCursor) ([]*t.MessageResponse, error) {
+	var (
+		isCursored bool
+		cursorAt   time.Time
+		cursorID   string
+	)
+	if cursor != nil {
+		isCursored = true
+		cursorAt, cursorID = cursor.CreatedAt, cursor.ID
+	}
+
+	// whispers are only returned to their two participants
+	query := `
+	  SELECT * FROM (
+			SELECT m.id, m.content, m.is_edited, m.is_deleted, m.reply_to,
+				m.reactions, m.created_at, u.id, u.username, u.avatar,
+				p.id, p.username, p.avatar
+			FROM room_messages m
+			JOIN users u ON u.id = m."from"
+			LEFT JOIN users p ON p.id = m.participant_id
+			WHERE m.room_id = $1 AND m.is_cleared = FALSE
+			AND (m.participant_id IS NULL OR m."from" = $2 OR m.participant_id = $2)
+			AND ($3 = FALSE OR (m.created_at, m.id) < ($4, $5))
+			ORDER BY m.created_at DESC, m.id DESC LIMIT 50
+	  ) ORDER BY created_at ASC, id ASC;
+	`
+
+	rows, err := r.pool.Query(ctx, query, roomID, userID, isCursored, cursorAt, cursorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*t.MessageResponse, 0)
+	for rows.Next() {
+		var (
+			msg       t.MessageResponse
+			reactions *map[string][]int
+			pID       *int
+			pUsername *string
+			pAvatar   *string
+		)
+
+		err := rows.Scan(&msg.ID, &msg.Content, &msg.IsEdited,
+			&msg.IsDeleted, &msg.ReplyTo, &reactions, &msg.CreatedAt,
+			&msg.From.ID, &msg.From.Username, &msg.From.Avatar,
+			&pID, &pUsername, &pAvatar)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.RoomID = &roomID
+		if pID != nil {
+			msg.Participant = &t.User{ID: *pID, Username: *pUsername, Avatar: *pAvatar}
+		}
+		msg.Reactions = reactionSets(reactions)
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (r *Repo) ClearRoomMessages(ctx context.Context, roomID, userID int) error {
+	query := `
+	  UPDATE room_messages SET is_cleared = TRUE
+	  WHERE room_id = $1 AND "from" = $2;
+	`
+	_, err := r.pool.Exec(ctx, query, roomID, userID)
+	return err
+}
+
+// DeleteExpiredRoomMessages deletes the messages older than their room's
+// retention, retention is the one of the rooms which don't set theirs.
+func (r *Repo) DeleteExpiredRoomMessages(ctx context.Context, retention int) error {
+	query := `
+	  DELETE FROM room_messages m USING room_settings s
+	  WHERE s.room_id = m.room_id
+	  AND m.created_at < (NOW() AT TIME ZONE 'UTC') - make_interval(days => COALESCE(s.message_retention, $1));
+	`
+	_, err := r.pool.Exec(ctx, query, retention)
+	return err
+}
+
+// reactionSets turns the users who reacted with each emoji into sets, which
+// is how the messages are sent to the clients.
+func reactionSets(reactions *map[string][]int) *map[string]map[int]struct{} {
+	if reactions == nil {
+		return nil
+	}
+	rMap := make(map[string]map[int]struct{})
+	for r, pIDs := range *reactions {
+		rMap[r] = make(map[int]struct{})
+		for _, pID := range pIDs {
+			rMap[r][pID] = struct{}{}
+		}
+	}
+	return &rMap
+}
@@ -0,0 +1,1423 @@
+package db
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+type memoryUser struct {
+	t.User
+	oauthID string
+	email   string
+	bio     *string
+}
+
+type memorySession struct {
+	userID    int
+	expiredAt time.Time
+}
+
+type memoryKick struct {
+	t.Kick
+	createdAt time.Time
+}
+
+type memoryMessage struct {
+	dmID int
+	t.Message
+}
+
+type memoryRoomMessage struct {
+	t.Message
+	isCleared bool
+}
+
+type memoryInvite struct {
+	t.RoomInvite
+	users map[int]struct{}
+}
+
+type memoryViolations struct {
+	count     int
+	expiredAt time.Time
+}
+
+type memoryPeerStats struct {
+	stats     []byte
+	expiredAt time.Time
+}
+
+type memoryLock struct {
+	owner     string
+	expiredAt time.Time
+}
+
+// MemoryStore keeps everything in memory, it behaves like Repo without
+// needing postgres or redis. Missing rows are reported with pgx.ErrNoRows,
+// just like Repo.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users    map[int]*memoryUser
+	sessions map[string]*memorySession
+	rooms    map[int]*t.Room
+	kicks    []*memoryKick
+	follows  map[[2]int]struct{}
+	dms      map[int][]int
+	lastRead map[[2]int]time.Time
+	messages map[string]*memoryMessage
+	nextID   int
+
+	roomMessages map[string]*memoryRoomMessage
+	invites      map[string]*memoryInvite
+
+	aiReplies  map[string]string
+	aiMessages map[[2]int][]*t.AIMessage
+	aiPending  []*t.AIMessageRequest
+
+	subscribers      []chan *t.ClusterEvent
+	userSessions     map[int]map[string]*t.Participant
+	roomParticipants map[int]map[string]*t.Participant
+	roomActivity     map[int]time.Time
+	roomHands        map[int][]int
+	ingestTokens     map[int]string
+	roomMedia        map[int][]byte
+	roomMessageRefs  map[int][]t.RoomMessageRef
+	instances        map[string]time.Time
+	instanceMembers  map[string]map[[3]any]struct{}
+	peerStats        map[string]*memoryPeerStats
+	locks            map[string]*memoryLock
+	violations       map[int]*memoryViolations
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:            make(map[int]*memoryUser),
+		sessions:         make(map[string]*memorySession),
+		rooms:            make(map[int]*t.Room),
+		follows:          make(map[[2]int]struct{}),
+		dms:              make(map[int][]int),
+		lastRead:         make(map[[2]int]time.Time),
+		messages:         make(map[string]*memoryMessage),
+		roomMessages:     make(map[string]*memoryRoomMessage),
+		invites:          make(map[string]*memoryInvite),
+		aiReplies:        make(map[string]string),
+		aiMessages:       make(map[[2]int][]*t.AIMessage),
+		userSessions:     make(map[int]map[string]*t.Participant),
+		roomParticipants: make(map[int]map[string]*t.Participant),
+		roomActivity:     make(map[int]time.Time),
+		roomHands:        make(map[int][]int),
+		ingestTokens:     make(map[int]string),
+		roomMedia:        make(map[int][]byte),
+		roomMessageRefs:  make(map[int][]t.RoomMessageRef),
+		instances:        make(map[string]time.Time),
+		instanceMembers:  make(map[string]map[[3]any]struct{}),
+		peerStats:        make(map[string]*memoryPeerStats),
+		locks:            make(map[string]*memoryLock),
+		violations:       make(map[int]*memoryViolations),
+	}
+}
+
+func (m *MemoryStore) id() int {
+	m.nextID++
+	return m.nextID
+}
+
+func (m *MemoryStore) user(userID int) t.User {
+	if u, ok := m.users[userID]; ok {
+		return u.User
+	}
+	return t.User{ID: userID}
+}
+
+// room returns a copy of the room with its host filled in
+func (m *MemoryStore) room(r *t.Room) *t.Room {
+	room := *r
+	room.Languages = append([]string(nil), r.Languages...)
+	room.Settings.CoHosts = append([]int(nil), r.Settings.CoHosts...)
+	room.Settings.Speakers = append([]int(nil), r.Settings.Speakers...)
+	room.Settings.MessageRetention = copyPtr(r.Settings.MessageRetention)
+	room.Settings.Host = m.user(r.Settings.Host.ID)
+	return &room
+}
+
+func (m *MemoryStore) isFollowing(followerID, followeeID int) bool {
+	_, ok := m.follows[[2]int{followerID, followeeID}]
+	return ok
+}
+
+func (m *MemoryStore) isFriends(userID, participantID int) bool {
+	return m.isFollowing(userID, participantID) && m.isFollowing(participantID, userID)
+}
+
+func (m *MemoryStore) dmID(userID, participantID int) (int, bool) {
+	for id, participants := range m.dms {
+		if len(participants) == 2 &&
+			((participants[0] == userID && participants[1] == participantID) ||
+				(participants[0] == participantID && participants[1] == userID)) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (m *MemoryStore) CreateUser(_ context.Context, u *t.GoogleUserInfo) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.oauthID == u.ID {
+			user.email = u.Email
+			user.Avatar = u.Picture
+			user.Username = u.Name
+			return user.ID, nil
+		}
+	}
+
+	id := m.id()
+	m.users[id] = &memoryUser{
+		User: t.User{
+			ID:       id,
+			Username: u.Name,
+			Avatar:   u.Picture,
+		},
+		oauthID: u.ID,
+		email:   u.Email,
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) CreateSession(_ context.Context, userID int, expiredAt time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := shortuuid.New()
+	m.sessions[id] = &memorySession{
+		userID:    userID,
+		expiredAt: expiredAt,
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) GetUserFromSession(_ context.Context, sessionID string) (*t.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[sessionID]
+	if !ok || !s.expiredAt.After(time.Now().UTC()) {
+		return nil, pgx.ErrNoRows
+	}
+	u, ok := m.users[s.userID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	user := u.User
+	return &user, nil
+}
+
+func (m *MemoryStore) GetUserByName(_ context.Context, username string) (*t.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Username == username {
+			user := u.User
+			return &user, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (m *MemoryStore) DeleteSessionForUser(_ context.Context, sessionID string, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[sessionID]; ok && s.userID == userID {
+		delete(m.sessions, sessionID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(_ context.Context, id int, bio string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[id]; ok {
+		u.bio = &bio
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetProfile(_ context.Context, userID int, profileID int) (*t.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[profileID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	p := t.Profile{
+		User:        u.User,
+		Bio:         u.bio,
+		IsMe:        userID == profileID,
+		IsFollowing: m.isFollowing(userID, profileID),
+		IsFriend:    m.isFriends(userID, profileID),
+	}
+	for f := range m.follows {
+		if f[1] == profileID {
+			p.FollowersCount++
+		}
+		if f[0] == profileID {
+			p.FollowingCount++
+			if m.isFollowing(f[1], profileID) {
+				p.FriendsCount++
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (m *MemoryStore) CreateRoom(_ context.Context, room *t.Room) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := *room
+	r.ID = m.id()
+	r.CreatedAt = time.Now().UTC()
+	r.Settings = t.RoomSettings{
+		RoomID:           r.ID,
+		Host:             t.User{ID: room.CreatedBy},
+		VideoPublishers:  t.PublishEveryone,
+		ScreenPublishers: t.PublishCoHosts,
+		Stage:            room.Settings.Stage,
+		MessageRetention: copyPtr(room.Settings.MessageRetention),
+		Locked:           room.Settings.Locked,
+	}
+	m.rooms[r.ID] = &r
+	return r.ID, nil
+}
+
+func (m *MemoryStore) GetRooms(_ context.Context) ([]*t.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rooms []*t.Room
+	for _, r := range m.rooms {
+		rooms = append(rooms, m.room(r))
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt.After(rooms[j].CreatedAt)
+	})
+	return rooms, nil
+}
+
+func (m *MemoryStore) GetRoom(_ context.Context, roomID int) (*t.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return m.room(r), nil
+}
+
+func (m *MemoryStore) GetRoomForUser(_ context.Context, roomID, userID int) (*t.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok || r.Settings.Host.ID != userID {
+		return nil, pgx.ErrNoRows
+	}
+	return m.room(r), nil
+}
+
+func (m *MemoryStore) UpdateRoom(_ context.Context, room *t.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[room.ID]
+	if !ok {
+		return nil
+	}
+	r.Topic = room.Topic
+	r.MaxParticipants = room.MaxParticipants
+	r.Languages = append([]string(nil), room.Languages...)
+	r.Settings.Stage = room.Settings.Stage
+	r.Settings.MessageRetention = copyPtr(room.Settings.MessageRetention)
+	r.Settings.Locked = room.Settings.Locked
+	return nil
+}
+
+func (m *MemoryStore) DeleteRooms(_ context.Context, roomIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range roomIDs {
+		delete(m.rooms, id)
+		delete(m.ingestTokens, id)
+	}
+	for id, msg := range m.roomMessages {
+		if _, ok := m.rooms[*msg.RoomID]; !ok {
+			delete(m.roomMessages, id)
+		}
+	}
+	for code, inv := range m.invites {
+		if _, ok := m.rooms[inv.RoomID]; !ok {
+			delete(m.invites, code)
+		}
+	}
+	m.kicks = filterSlice(m.kicks, func(k *memoryKick) bool {
+		_, ok := m.rooms[k.RoomID]
+		return ok
+	})
+	return nil
+}
+
+func (m *MemoryStore) GetRoomSettings(_ context.Context, roomID int) (*t.RoomSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return &m.room(r).Settings, nil
+}
+
+func (m *MemoryStore) UpdateRoomSettings(_ context.Context, s *t.RoomSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[s.RoomID]
+	if !ok {
+		return nil
+	}
+	r.Settings.Host = t.User{ID: s.Host.ID}
+	r.Settings.CoHosts = append([]int(nil), s.CoHosts...)
+	r.Settings.WelcomeMessage = s.WelcomeMessage
+	r.Settings.VideoPublishers = s.VideoPublishers
+	r.Settings.ScreenPublishers = s.ScreenPublishers
+	r.Settings.Stage = s.Stage
+	r.Settings.Speakers = append([]int(nil), s.Speakers...)
+	r.Settings.MessageRetention = copyPtr(s.MessageRetention)
+	r.Settings.Locked = s.Locked
+	return nil
+}
+
+func (m *MemoryStore) SetIngestToken(_ context.Context, roomID int, hash *string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if hash == nil {
+		delete(m.ingestTokens, roomID)
+	} else {
+		m.ingestTokens[roomID] = *hash
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetIngestToken(_ context.Context, roomID int) (*string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rooms[roomID]; !ok {
+		return nil, pgx.ErrNoRows
+	}
+	hash, ok := m.ingestTokens[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &hash, nil
+}
+
+func (m *MemoryStore) CountRoomsHosted(_ context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for _, r := range m.rooms {
+		if r.Settings.Host.ID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryStore) CreateInvite(_ context.Context, inv *t.RoomInvite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv.CreatedAt = time.Now().UTC()
+	stored := *inv
+	stored.MaxUses = copyPtr(inv.MaxUses)
+	stored.ExpiredAt = copyPtr(inv.ExpiredAt)
+	m.invites[inv.Code] = &memoryInvite{
+		RoomInvite: stored,
+		users:      make(map[int]struct{}),
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetInvites(_ context.Context, roomID int) ([]*t.RoomInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invites := make([]*t.RoomInvite, 0)
+	for _, inv := range m.invites {
+		if inv.RoomID != roomID {
+			continue
+		}
+		res := inv.RoomInvite
+		res.MaxUses = copyPtr(inv.MaxUses)
+		res.ExpiredAt = copyPtr(inv.ExpiredAt)
+		res.Uses = len(inv.users)
+		invites = append(invites, &res)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.After(invites[j].CreatedAt)
+	})
+	return invites, nil
+}
+
+func (m *MemoryStore) DeleteInvite(_ context.Context, roomID int, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invites[code]
+	if !ok || inv.RoomID != roomID {
+		return pgx.ErrNoRows
+	}
+	delete(m.invites, code)
+	return nil
+}
+
+func (m *MemoryStore) RedeemInvite(_ context.Context, roomID int, code string, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invites[code]
+	if !ok || inv.RoomID != roomID ||
+		(inv.ExpiredAt != nil && !inv.ExpiredAt.After(time.Now().UTC())) {
+		return false, nil
+	}
+	if _, ok := inv.users[userID]; ok {
+		return true, nil
+	}
+	if inv.MaxUses != nil && len(inv.users) >= *inv.MaxUses {
+		return false, nil
+	}
+	inv.users[userID] = struct{}{}
+	return true, nil
+}
+
+func (m *MemoryStore) GetKick(_ context.Context, roomID, userID int) (*t.Kick, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latest *memoryKick
+	for _, k := range m.kicks {
+		if k.RoomID != roomID || k.UserID != userID || !k.ExpiredAt.After(time.Now().UTC()) {
+			continue
+		}
+		if latest == nil || k.createdAt.After(latest.createdAt) {
+			latest = k
+		}
+	}
+	if latest == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return &t.Kick{ExpiredAt: latest.ExpiredAt}, nil
+}
+
+func (m *MemoryStore) KickParticipant(_ context.Context, k *t.Kick) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.kicks = append(m.kicks, &memoryKick{
+		Kick:      *k,
+		createdAt: time.Now().UTC(),
+	})
+	return nil
+}
+
+func (m *MemoryStore) Follow(_ context.Context, followerID, followeeID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.follows[[2]int{followerID, followeeID}] = struct{}{}
+	return nil
+}
+
+func (m *MemoryStore) Unfollow(_ context.Context, followerID, followeeID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.follows, [2]int{followerID, followeeID})
+	return nil
+}
+
+func (m *MemoryStore) GetRelations(_ context.Context, userID int, relation t.Relation) ([]*t.RelationRes, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make([]*t.RelationRes, 0)
+	for id, u := range m.users {
+		var ok bool
+		switch relation {
+		case t.RelationFollowers:
+			ok = m.isFollowing(id, userID)
+		case t.RelationFollowing:
+			ok = m.isFollowing(userID, id)
+		case t.RelationFriends:
+			ok = m.isFriends(userID, id)
+		}
+		if ok {
+			users = append(users, &t.RelationRes{
+				User:     u.User,
+				IsFriend: m.isFriends(userID, id),
+			})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+func (m *MemoryStore) IsFriends(_ context.Context, userID, participantID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.isFriends(userID, participantID), nil
+}
+
+func (m *MemoryStore) GetDM(_ context.Context, userID, participantID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.dmID(userID, participantID)
+	if !ok {
+		return 0, pgx.ErrNoRows
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) CreateDM(_ context.Context, userID, participantID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.id()
+	m.dms[id] = []int{userID, participantID}
+	return id, nil
+}
+
+func (m *MemoryStore) GetDMs(_ context.Context, userID int) ([]*t.DMResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dms := make([]*t.DMResponse, 0)
+	for id, participants := range m.dms {
+		var participantID int
+		switch userID {
+		case participants[0]:
+			participantID = participants[1]
+		case participants[1]:
+			participantID = participants[0]
+		default:
+			continue
+		}
+		if !m.isFriends(userID, participantID) {
+			continue
+		}
+
+		var last *memoryMessage
+		for _, msg := range m.messages {
+			if msg.dmID == id && (last == nil || msg.CreatedAt.After(last.CreatedAt)) {
+				last = msg
+			}
+		}
+		if last == nil {
+			continue
+		}
+
+		lastRead, ok := m.lastRead[[2]int{id, userID}]
+		dms = append(dms, &t.DMResponse{
+			DmID: id,
+			User: m.user(participantID),
+			LastMessage: map[string]any{
+				"content":   last.Content,
+				"isDeleted": last.IsDeleted,
+				"createdAt": last.CreatedAt,
+				"from":      m.user(last.From.ID),
+				"isUnread":  (!ok || lastRead.Before(last.CreatedAt)) && last.From.ID != userID,
+			},
+		})
+	}
+	sort.Slice(dms, func(i, j int) bool {
+		a := dms[i].LastMessage["createdAt"].(time.Time)
+		b := dms[j].LastMessage["createdAt"].(time.Time)
+		return a.After(b)
+	})
+	return dms, nil
+}
+
+func (m *MemoryStore) UpdateDMs(_ context.Context, userID int, participantID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, ok := m.dmID(userID, participantID); ok {
+		m.lastRead[[2]int{id, userID}] = time.Now().UTC()
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateMessage(_ context.Context, dmID int, msg *t.Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message := *msg
+	message.ID = shortuuid.New()
+	message.From = t.User{ID: msg.From.ID}
+	m.messages[message.ID] = &memoryMessage{
+		dmID:    dmID,
+		Message: message,
+	}
+	return message.ID, nil
+}
+
+func (m *MemoryStore) GetMessage(_ context.Context, msgID string, userID, pID int, isReaction bool) (*t.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dmID, ok := m.dmID(userID, pID)
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	msg, ok := m.messages[msgID]
+	if !ok || msg.dmID != dmID || (msg.From.ID != userID && !isReaction) {
+		return nil, pgx.ErrNoRows
+	}
+
+	message := msg.Message
+	message.From = m.user(msg.From.ID)
+	message.Reactions = copyReactions(msg.Reactions)
+	return &message, nil
+}
+
+func (m *MemoryStore) UpdateMessage(_ context.Context, msg *t.Message, isReaction bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.messages[msg.ID]
+	if !ok || (stored.From.ID != msg.From.ID && !isReaction) {
+		return nil
+	}
+	stored.Content = msg.Content
+	stored.IsEdited = msg.IsEdited
+	stored.IsDeleted = msg.IsDeleted
+	stored.Reactions = msg.Reactions
+	return nil
+}
+
+func (m *MemoryStore) GetMessages(_ context.Context, userID, participantID int, cursor *time.Time) ([]*t.MessageResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := make([]*t.MessageResponse, 0)
+	dmID, ok := m.dmID(userID, participantID)
+	if !ok {
+		return messages, nil
+	}
+
+	for _, msg := range m.messages {
+		if msg.dmID != dmID || (cursor != nil && !msg.CreatedAt.Before(*cursor)) {
+			continue
+		}
+		res := t.MessageResponse{Message: msg.Message}
+		res.From = m.user(msg.From.ID)
+		res.Reactions = reactionSets(msg.Reactions)
+		messages = append(messages, &res)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+	if len(messages) > 50 {
+		messages = messages[len(messages)-50:]
+	}
+	return messages, nil
+}
+
+func (m *MemoryStore) CreateRoomMessage(_ context.Context, msg *t.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message := *msg
+	message.From = t.User{ID: msg.From.ID}
+	if msg.Participant != nil {
+		message.Participant = &t.User{ID: msg.Participant.ID}
+	}
+	m.roomMessages[message.ID] = &memoryRoomMessage{Message: message}
+	return nil
+}
+
+func (m *MemoryStore) GetRoomMessage(_ context.Context, roomID int, msgID string, userID int, isReaction bool) (*t.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.roomMessages[msgID]
+	if !ok || *msg.RoomID != roomID {
+		return nil, pgx.ErrNoRows
+	}
+	visible := msg.Participant == nil || msg.Participant.ID == userID
+	if msg.From.ID != userID && !(isReaction && visible) {
+		return nil, pgx.ErrNoRows
+	}
+
+	message := msg.Message
+	message.From = m.user(msg.From.ID)
+	message.Participant = nil
+	message.Reactions = copyReactions(msg.Reactions)
+	return &message, nil
+}
+
+func (m *MemoryStore) UpdateRoomMessage(_ context.Context, msg *t.Message, isReaction bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.roomMessages[msg.ID]
+	if !ok || *stored.RoomID != *msg.RoomID || (stored.From.ID != msg.From.ID && !isReaction) {
+		return nil
+	}
+	stored.Content = msg.Content
+	stored.IsEdited = msg.IsEdited
+	stored.IsDeleted = msg.IsDeleted
+	stored.Reactions = msg.Reactions
+	return nil
+}
+
+func (m *MemoryStore) GetKeptRoomMessageRef(_ context.Context, roomID int, msgID string) (*t.RoomMessageRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.roomMessages[msgID]
+	if !ok || *msg.RoomID != roomID {
+		return nil, pgx.ErrNoRows
+	}
+	ref := &t.RoomMessageRef{ID: msg.ID, From: m.user(msg.From.ID)}
+	if msg.Participant != nil {
+		ref.ParticipantID = &msg.Participant.ID
+	}
+	return ref, nil
+}
+
+func (m *MemoryStore) GetRoomMessages(_ context.Context, roomID, userID int, cursor *t.MessageCursor) ([]*t.MessageResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := make([]*t.MessageResponse, 0)
+	for _, msg := range m.roomMessages {
+		if *msg.RoomID != roomID || msg.isCleared ||
+			(cursor != nil && !roomMessageBefore(&msg.Message, cursor.CreatedAt, cursor.ID)) {
+			continue
+		}
+		// whispers are only returned to their two participants
+		if msg.Participant != nil && msg.From.ID != userID && msg.Participant.ID != userID {
+			continue
+		}
+		res := t.MessageResponse{Message: msg.Message}
+		res.From = m.user(msg.From.ID)
+		if msg.Participant != nil {
+			participant := m.user(msg.Participant.ID)
+			res.Participant = &participant
+		}
+		res.Reactions = reactionSets(msg.Reactions)
+		messages = append(messages, &res)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return roomMessageBefore(&messages[i].Message, messages[j].CreatedAt, messages[j].ID)
+	})
+	if len(messages) > 50 {
+		messages = messages[len(messages)-50:]
+	}
+	return messages, nil
+}
+
+// roomMessageBefore orders the room messages by when they were sent, then by
+// ID, like the (created_at, id) comparison of postgres.
+func roomMessageBefore(msg *t.Message, createdAt time.Time, id string) bool {
+	if !msg.CreatedAt.Equal(createdAt) {
+		return msg.CreatedAt.Before(createdAt)
+	}
+	return msg.ID < id
+}
+
+func (m *MemoryStore) ClearRoomMessages(_ context.Context, roomID, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, msg := range m.roomMessages {
+		if *msg.RoomID == roomID && msg.From.ID == userID {
+			msg.isCleared = true
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredRoomMessages(_ context.Context, retention int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	for id, msg := range m.roomMessages {
+		r, ok := m.rooms[*msg.RoomID]
+		if !ok {
+			continue
+		}
+		days := retention
+		if r.Settings.MessageRetention != nil {
+			days = *r.Settings.MessageRetention
+		}
+		if msg.CreatedAt.Before(now.AddDate(0, 0, -days)) {
+			delete(m.roomMessages, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetAIReply(ctx context.Context, roomID int, msgID string, userID int, contents []string) {
+	m.mu.Lock()
+	m.aiReplies[aiReplyKey(roomID, msgID)] = contents[1]
+	m.mu.Unlock()
+
+	m.SetAIReplies(ctx, roomID, userID, contents)
+}
+
+func (m *MemoryStore) SetAIReplies(_ context.Context, roomID, userID int, contents []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]int{roomID, userID}
+	for i, content := range contents {
+		role := "user"
+		if i == 1 {
+			role = "model"
+		}
+		m.aiMessages[key] = append(m.aiMessages[key], &t.AIMessage{
+			Role:    role,
+			Content: content,
+		})
+	}
+	if len(m.aiMessages[key]) > maxAIMessages {
+		m.aiMessages[key] = m.aiMessages[key][len(m.aiMessages[key])-maxAIMessages:]
+	}
+}
+
+func (m *MemoryStore) GetAIMessages(_ context.Context, roomID, userID int) ([]*t.AIMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	aiMessages := []*t.AIMessage{}
+	for _, msg := range m.aiMessages[[2]int{roomID, userID}] {
+		aiMessage := *msg
+		aiMessages = append(aiMessages, &aiMessage)
+	}
+	return aiMessages, nil
+}
+
+func (m *MemoryStore) IsReplyToAI(_ context.Context, roomID int, msgID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.aiReplies[aiReplyKey(roomID, msgID)], nil
+}
+
+func (m *MemoryStore) DeleteAIReplies(_ context.Context, roomID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := aiReplyKey(roomID, "")
+	for k := range m.aiReplies {
+		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+			delete(m.aiReplies, k)
+		}
+	}
+	for k := range m.aiMessages {
+		if k[0] == roomID {
+			delete(m.aiMessages, k)
+		}
+	}
+}
+
+func (m *MemoryStore) SavePendingAIRequests(_ context.Context, reqs []*t.AIMessageRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.aiPending = append(m.aiPending, reqs...)
+	return nil
+}
+
+func (m *MemoryStore) PopPendingAIRequests(_ context.Context) ([]*t.AIMessageRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reqs := m.aiPending
+	m.aiPending = nil
+	return reqs, nil
+}
+
+// PublishEvent delivers the event to every subscriber, like redis pub/sub
+// it doesn't wait for slow subscribers.
+func (m *MemoryStore) PublishEvent(_ context.Context, e *t.ClusterEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sub := range m.subscribers {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SubscribeEvents(ctx context.Context) <-chan *t.ClusterEvent {
+	m.mu.Lock()
+	sub := make(chan *t.ClusterEvent, 1000)
+	m.subscribers = append(m.subscribers, sub)
+	m.mu.Unlock()
+
+	events := make(chan *t.ClusterEvent)
+	go func() {
+		defer close(events)
+		defer func() {
+			m.mu.Lock()
+			m.subscribers = filterSlice(m.subscribers, func(c chan *t.ClusterEvent) bool {
+				return c != sub
+			})
+			m.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-sub:
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func (m *MemoryStore) addInstanceMember(instanceID, kind string, id int, sid string) {
+	if _, ok := m.instanceMembers[instanceID]; !ok {
+		m.instanceMembers[instanceID] = make(map[[3]any]struct{})
+	}
+	m.instanceMembers[instanceID][[3]any{kind, id, sid}] = struct{}{}
+}
+
+func (m *MemoryStore) AddUserSession(_ context.Context, instanceID string, p *t.Participant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.userSessions[p.ID]; !ok {
+		m.userSessions[p.ID] = make(map[string]*t.Participant)
+	}
+	participant := *p
+	m.userSessions[p.ID][p.SID] = &participant
+	m.addInstanceMember(instanceID, "user", p.ID, p.SID)
+	return nil
+}
+
+func (m *MemoryStore) RemoveUserSession(_ context.Context, instanceID string, userID int, sid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.userSessions[userID], sid)
+	delete(m.instanceMembers[instanceID], [3]any{"user", userID, sid})
+	return nil
+}
+
+func (m *MemoryStore) GetUserSessions(_ context.Context, userID int) ([]*t.Participant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyParticipants(m.userSessions[userID]), nil
+}
+
+func (m *MemoryStore) GetUsersSessions(_ context.Context, userIDs []int) (map[int][]*t.Participant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make(map[int][]*t.Participant, len(userIDs))
+	for _, userID := range userIDs {
+		sessions[userID] = copyParticipants(m.userSessions[userID])
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) AddRoomParticipant(_ context.Context, instanceID string, roomID int, p *t.Participant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roomParticipants[roomID]; !ok {
+		m.roomParticipants[roomID] = make(map[string]*t.Participant)
+	}
+	participant := *p
+	m.roomParticipants[roomID][p.SID] = &participant
+	m.addInstanceMember(instanceID, "room", roomID, p.SID)
+	m.roomActivity[roomID] = time.Now().UTC()
+	return nil
+}
+
+func (m *MemoryStore) UpdateRoomParticipant(_ context.Context, roomID int, p *t.Participant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roomParticipants[roomID][p.SID]; ok {
+		participant := *p
+		m.roomParticipants[roomID][p.SID] = &participant
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveRoomParticipant(_ context.Context, instanceID string, roomID int, sid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.roomParticipants[roomID], sid)
+	delete(m.instanceMembers[instanceID], [3]any{"room", roomID, sid})
+	m.roomActivity[roomID] = time.Now().UTC()
+	return nil
+}
+
+func (m *MemoryStore) GetRoomParticipants(_ context.Context, roomIDs []int) (map[int][]*t.Participant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	participants := make(map[int][]*t.Participant, len(roomIDs))
+	for _, roomID := range roomIDs {
+		participants[roomID] = copyParticipants(m.roomParticipants[roomID])
+	}
+	return participants, nil
+}
+
+func (m *MemoryStore) TouchRoom(_ context.Context, roomID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roomActivity[roomID]; !ok {
+		m.roomActivity[roomID] = time.Now().UTC()
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetRoomActivity(_ context.Context, roomIDs []int) (map[int]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	activity := make(map[int]time.Time, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if ts, ok := m.roomActivity[roomID]; ok {
+			activity[roomID] = ts
+		}
+	}
+	return activity, nil
+}
+
+func (m *MemoryStore) DeleteRoomPresence(_ context.Context, roomIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, roomID := range roomIDs {
+		delete(m.roomParticipants, roomID)
+		delete(m.roomActivity, roomID)
+		delete(m.roomHands, roomID)
+		delete(m.roomMedia, roomID)
+		delete(m.roomMessageRefs, roomID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) RaiseHand(_ context.Context, roomID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if slices.Contains(m.roomHands[roomID], userID) {
+		return false, nil
+	}
+	m.roomHands[roomID] = append(m.roomHands[roomID], userID)
+	return true, nil
+}
+
+func (m *MemoryStore) LowerHand(_ context.Context, roomID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hands := m.roomHands[roomID]
+	i := slices.Index(hands, userID)
+	if i < 0 {
+		return false, nil
+	}
+	m.roomHands[roomID] = slices.Delete(hands, i, i+1)
+	return true, nil
+}
+
+func (m *MemoryStore) GetRaisedHands(_ context.Context, roomID int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]int{}, m.roomHands[roomID]...), nil
+}
+
+// GetMediaState and UpdateMediaState keep the state marshalled, like redis,
+// so the callers never share it.
+func (m *MemoryStore) GetMediaState(_ context.Context, roomID int) (*t.MediaState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.roomMedia[roomID]
+	if !ok {
+		return nil, nil
+	}
+	var media t.MediaState
+	if err := json.Unmarshal(b, &media); err != nil {
+		return nil, err
+	}
+	return &media, nil
+}
+
+// UpdateMediaState holds the store's lock while update runs, update mustn't
+// use the store.
+func (m *MemoryStore) UpdateMediaState(_ context.Context, roomID int, update func(media *t.MediaState) (*t.MediaState, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var media *t.MediaState
+	if b, ok := m.roomMedia[roomID]; ok {
+		media = &t.MediaState{}
+		if err := json.Unmarshal(b, media); err != nil {
+			return err
+		}
+	}
+	media, err := update(media)
+	if err != nil {
+		return err
+	}
+	if media == nil {
+		delete(m.roomMedia, roomID)
+		return nil
+	}
+	b, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+	m.roomMedia[roomID] = b
+	return nil
+}
+
+func (m *MemoryStore) IndexRoomMessage(_ context.Context, roomID int, ref *t.RoomMessageRef, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := *ref
+	r.ParticipantID = copyPtr(ref.ParticipantID)
+	refs := append(m.roomMessageRefs[roomID], r)
+	if extra := len(refs) - max; extra > 0 {
+		refs = slices.Delete(refs, 0, extra)
+	}
+	m.roomMessageRefs[roomID] = refs
+	return nil
+}
+
+func (m *MemoryStore) GetRoomMessageRef(_ context.Context, roomID int, msgID string) (*t.RoomMessageRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	refs := m.roomMessageRefs[roomID]
+	i := slices.IndexFunc(refs, func(r t.RoomMessageRef) bool {
+		return r.ID == msgID
+	})
+	if i < 0 {
+		return nil, nil
+	}
+	ref := refs[i]
+	ref.ParticipantID = copyPtr(ref.ParticipantID)
+	return &ref, nil
+}
+
+// SetPeerStats and GetPeerStats keep the stats marshalled, like redis, so
+// the callers never share them.
+func (m *MemoryStore) SetPeerStats(_ context.Context, instanceID string, stats []*t.PeerStats, ttl time.Duration) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerStats[instanceID] = &memoryPeerStats{
+		stats:     b,
+		expiredAt: time.Now().UTC().Add(ttl),
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetPeerStats(_ context.Context) ([]*t.PeerStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := []*t.PeerStats{}
+	for id, s := range m.peerStats {
+		// like redis only the stats of the live instances are read
+		if _, ok := m.instances[id]; !ok || !s.expiredAt.After(time.Now().UTC()) {
+			continue
+		}
+		var ps []*t.PeerStats
+		if err := json.Unmarshal(s.stats, &ps); err != nil {
+			return nil, err
+		}
+		stats = append(stats, ps...)
+	}
+	return stats, nil
+}
+
+func (m *MemoryStore) TouchInstance(_ context.Context, instanceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.instances[instanceID] = time.Now().UTC()
+	return nil
+}
+
+func (m *MemoryStore) PurgeStaleInstances(ctx context.Context, maxAge time.Duration) error {
+	m.mu.Lock()
+	var stale []string
+	for id, ts := range m.instances {
+		if ts.Before(time.Now().UTC().Add(-maxAge)) {
+			stale = append(stale, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range stale {
+		if err := m.RemoveInstance(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveInstance(_ context.Context, instanceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for member := range m.instanceMembers[instanceID] {
+		id, sid := member[1].(int), member[2].(string)
+		switch member[0] {
+		case "room":
+			delete(m.roomParticipants[id], sid)
+			m.roomActivity[id] = time.Now().UTC()
+		case "user":
+			delete(m.userSessions[id], sid)
+		}
+	}
+	delete(m.instanceMembers, instanceID)
+	delete(m.instances, instanceID)
+	delete(m.peerStats, instanceID)
+	return nil
+}
+
+func (m *MemoryStore) AcquireLock(_ context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.locks[key]; ok && l.expiredAt.After(time.Now().UTC()) {
+		return false, nil
+	}
+	m.locks[key] = &memoryLock{
+		owner:     owner,
+		expiredAt: time.Now().UTC().Add(ttl),
+	}
+	return true, nil
+}
+
+func copyParticipants(participants map[string]*t.Participant) []*t.Participant {
+	res := make([]*t.Participant, 0, len(participants))
+	for _, p := range participants {
+		participant := *p
+		res = append(res, &participant)
+	}
+	return res
+}
+
+func copyReactions(reactions *map[string][]int) *map[string][]int {
+	if reactions == nil {
+		return nil
+	}
+	c := make(map[string][]int, len(*reactions))
+	for r, ids := range *reactions {
+		c[r] = append([]int(nil), ids...)
+	}
+	return &c
+}
+
+func copyPtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func filterSlice[T any](slice []T, keep func(T) bool) []T {
+	var result []T
+	for _, v := range slice {
+		if keep(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (m *MemoryStore) AddRateLimitViolation(_ context.Context, userID int, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	v, ok := m.violations[userID]
+	if !ok || !v.expiredAt.After(now) {
+		v = &memoryViolations{expiredAt: now.Add(window)}
+		m.violations[userID] = v
+	}
+	v.count++
+	return v.count, nil
+}
+
+func (m *MemoryStore) GetRateLimitViolations(_ context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.violations[userID]
+	if !ok || !v.expiredAt.After(time.Now().UTC()) {
+		return 0, nil
+	}
+	return v.count, nil
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func rateLimitViolationsKey(userID int) string {
+	return fmt.Sprintf("rate-limit-violations:%d", userID)
+}
+
+// AddRateLimitViolation counts a violation for the user and returns the
+// violations within the window, which starts at the first one.
+func (r *Repo) AddRateLimitViolation(ctx context.Context, userID int, window time.Duration) (int, error) {
+	key := rateLimitViolationsKey(userID)
+	var incr *redis.IntCmd
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireNX(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (r *Repo) GetRateLimitViolations(ctx context.Context, userID int) (int, error) {
+	n, err := r.rdb.Get(ctx, rateLimitViolationsKey(userID)).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
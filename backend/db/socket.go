@@ -0,0 +1,517 @@
+package db
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	socketEventsChannel = "ws-events"
+	instancesKey        = "ws-instances"
+	roomActivityKey     = "room-activity"
+	// maxMediaRetries is how many times a watch party update runs before it
+	// gives up on the others changing it
+	maxMediaRetries = 10
+)
+
+func roomParticipantsKey(roomID int) string {
+	return fmt.Sprintf("room-participants:%d", roomID)
+}
+
+func userSessionsKey(userID int) string {
+	return fmt.Sprintf("user-sessions:%d", userID)
+}
+
+func roomHandsKey(roomID int) string {
+	return fmt.Sprintf("room-hands:%d", roomID)
+}
+
+func roomMediaKey(roomID int) string {
+	return fmt.Sprintf("room-media:%d", roomID)
+}
+
+func roomMessagesKey(roomID int) string {
+	return fmt.Sprintf("room-messages:%d", roomID)
+}
+
+// the IDs of the indexed room messages, the oldest first
+func roomMessageIDsKey(roomID int) string {
+	return fmt.Sprintf("room-message-ids:%d", roomID)
+}
+
+func instanceKey(instanceID string) string {
+	return fmt.Sprintf("ws-instance:%s", instanceID)
+}
+
+func peerStatsKey(instanceID string) string {
+	return fmt.Sprintf("ws-peer-stats:%s", instanceID)
+}
+
+func (r *Repo) PublishEvent(ctx context.Context, e *t.ClusterEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.rdb.Publish(ctx, socketEventsChannel, b).Err()
+}
+
+// SubscribeEvents delivers cluster events to the returned channel until ctx is
+// done, the channel is closed after that.
+func (r *Repo) SubscribeEvents(ctx context.Context) <-chan *t.ClusterEvent {
+	events := make(chan *t.ClusterEvent)
+	sub := r.rdb.Subscribe(ctx, socketEventsChannel)
+
+	go func() {
+		defer close(events)
+		defer sub.Close()
+
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var e t.ClusterEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+					log.Printf("failed to unmarshal cluster event: %v", err)
+					continue
+				}
+				select {
+				case events <- &e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+func (r *Repo) AddUserSession(ctx context.Context, instanceID string, p *t.Participant) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, userSessionsKey(p.ID), p.SID, b)
+		pipe.SAdd(ctx, instanceKey(instanceID), fmt.Sprintf("user:%d:%s", p.ID, p.SID))
+		return nil
+	})
+	return err
+}
+
+func (r *Repo) RemoveUserSession(ctx context.Context, instanceID string, userID int, sid string) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, userSessionsKey(userID), sid)
+		pipe.SRem(ctx, instanceKey(instanceID), fmt.Sprintf("user:%d:%s", userID, sid))
+		return nil
+	})
+	return err
+}
+
+// GetUserSessions returns the sessions of the user across all instances.
+func (r *Repo) GetUserSessions(ctx context.Context, userID int) ([]*t.Participant, error) {
+	values, err := r.rdb.HVals(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalParticipants(values), nil
+}
+
+// GetUsersSessions returns the sessions of every given user across all
+// instances.
+func (r *Repo) GetUsersSessions(ctx context.Context, userIDs []int) (map[int][]*t.Participant, error) {
+	cmds := make([]*redis.StringSliceCmd, len(userIDs))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			cmds[i] = pipe.HVals(ctx, userSessionsKey(userID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[int][]*t.Participant, len(userIDs))
+	for i, userID := range userIDs {
+		sessions[userID] = unmarshalParticipants(cmds[i].Val())
+	}
+	return sessions, nil
+}
+
+func (r *Repo) AddRoomParticipant(ctx context.Context, instanceID string, roomID int, p *t.Participant) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, roomParticipantsKey(roomID), p.SID, b)
+		pipe.SAdd(ctx, instanceKey(instanceID), fmt.Sprintf("room:%d:%s", roomID, p.SID))
+		pipe.HSet(ctx, roomActivityKey, roomID, time.Now().UTC().Unix())
+		return nil
+	})
+	return err
+}
+
+// UpdateRoomParticipant overwrites the participant if it's still in the room.
+func (r *Repo) UpdateRoomParticipant(ctx context.Context, roomID int, p *t.Participant) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	key := roomParticipantsKey(roomID)
+	ok, err := r.rdb.HExists(ctx, key, p.SID).Result()
+	if err != nil || !ok {
+		return err
+	}
+	return r.rdb.HSet(ctx, key, p.SID, b).Err()
+}
+
+func (r *Repo) RemoveRoomParticipant(ctx context.Context, instanceID string, roomID int, sid string) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, roomParticipantsKey(roomID), sid)
+		pipe.SRem(ctx, instanceKey(instanceID), fmt.Sprintf("room:%d:%s", roomID, sid))
+		pipe.HSet(ctx, roomActivityKey, roomID, time.Now().UTC().Unix())
+		return nil
+	})
+	return err
+}
+
+// GetRoomParticipants returns the participants of every given room across
+// all instances.
+func (r *Repo) GetRoomParticipants(ctx context.Context, roomIDs []int) (map[int][]*t.Participant, error) {
+	cmds := make([]*redis.StringSliceCmd, len(roomIDs))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, roomID := range roomIDs {
+			cmds[i] = pipe.HVals(ctx, roomParticipantsKey(roomID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make(map[int][]*t.Participant, len(roomIDs))
+	for i, roomID := range roomIDs {
+		participants[roomID] = unmarshalParticipants(cmds[i].Val())
+	}
+	return participants, nil
+}
+
+// TouchRoom records activity for the room, unless it already has some.
+func (r *Repo) TouchRoom(ctx context.Context, roomID int) error {
+	return r.rdb.HSetNX(ctx, roomActivityKey, strconv.Itoa(roomID), time.Now().UTC().Unix()).Err()
+}
+
+// GetRoomActivity returns the time of the last join or leave for each room.
+func (r *Repo) GetRoomActivity(ctx context.Context, roomIDs []int) (map[int]time.Time, error) {
+	fields := make([]string, len(roomIDs))
+	for i, roomID := range roomIDs {
+		fields[i] = strconv.Itoa(roomID)
+	}
+
+	values, err := r.rdb.HMGet(ctx, roomActivityKey, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	activity := make(map[int]time.Time, len(roomIDs))
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		activity[roomIDs[i]] = time.Unix(ts, 0).UTC()
+	}
+	return activity, nil
+}
+
+func (r *Repo) DeleteRoomPresence(ctx context.Context, roomIDs []int) error {
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, roomID := range roomIDs {
+			pipe.Del(ctx, roomParticipantsKey(roomID))
+			pipe.Del(ctx, roomHandsKey(roomID))
+			pipe.Del(ctx, roomMediaKey(roomID))
+			pipe.Del(ctx, roomMessagesKey(roomID), roomMessageIDsKey(roomID))
+			pipe.HDel(ctx, roomActivityKey, strconv.Itoa(roomID))
+		}
+		return nil
+	})
+	return err
+}
+
+// RaiseHand queues the user in the room's raised hands, it reports false if
+// the hand is raised already.
+func (r *Repo) RaiseHand(ctx context.Context, roomID, userID int) (bool, error) {
+	n, err := r.rdb.ZAddNX(ctx, roomHandsKey(roomID), redis.Z{
+		Score:  float64(time.Now().UTC().UnixMilli()),
+		Member: userID,
+	}).Result()
+	return n > 0, err
+}
+
+// LowerHand removes the user from the room's raised hands, it reports false
+// if the hand wasn't raised.
+func (r *Repo) LowerHand(ctx context.Context, roomID, userID int) (bool, error) {
+	n, err := r.rdb.ZRem(ctx, roomHandsKey(roomID), userID).Result()
+	return n > 0, err
+}
+
+// GetRaisedHands returns the users with a raised hand in the room, the
+// earliest first.
+func (r *Repo) GetRaisedHands(ctx context.Context, roomID int) ([]int, error) {
+	members, err := r.rdb.ZRange(ctx, roomHandsKey(roomID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]int, 0, len(members))
+	for _, m := range members {
+		userID, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// GetMediaState returns the watch party of the room, nil if there's none.
+func (r *Repo) GetMediaState(ctx context.Context, roomID int) (*t.MediaState, error) {
+	b, err := r.rdb.Get(ctx, roomMediaKey(roomID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m t.MediaState
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpdateMediaState saves the watch party update makes of the current one,
+// nil if there's none. The state is watched, update runs again if it changed
+// meanwhile. Nothing is saved if update fails, a nil state removes it.
+func (r *Repo) UpdateMediaState(ctx context.Context, roomID int, update func(m *t.MediaState) (*t.MediaState, error)) error {
+	key := roomMediaKey(roomID)
+	txf := func(tx *redis.Tx) error {
+		var m *t.MediaState
+		b, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			m = &t.MediaState{}
+			if err := json.Unmarshal(b, m); err != nil {
+				return err
+			}
+		}
+
+		m, err = update(m)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if b, err = json.Marshal(m); err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if m == nil {
+				pipe.Del(ctx, key)
+			} else {
+				pipe.Set(ctx, key, b, 0)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxMediaRetries; i++ {
+		err := r.rdb.Watch(ctx, txf, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("media state of room %d kept changing", roomID)
+}
+
+func (r *Repo) IndexRoomMessage(ctx context.Context, roomID int, ref *t.RoomMessageRef, max int) error {
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	var n *redis.IntCmd
+	_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, roomMessagesKey(roomID), ref.ID, b)
+		n = pipe.RPush(ctx, roomMessageIDsKey(roomID), ref.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	extra := int(n.Val()) - max
+	if extra <= 0 {
+		return nil
+	}
+	ids, err := r.rdb.LPopCount(ctx, roomMessageIDsKey(roomID), extra).Result()
+	if err != nil {
+		return err
+	}
+	return r.rdb.HDel(ctx, roomMessagesKey(roomID), ids...).Err()
+}
+
+func (r *Repo) GetRoomMessageRef(ctx context.Context, roomID int, msgID string) (*t.RoomMessageRef, error) {
+	b, err := r.rdb.HGet(ctx, roomMessagesKey(roomID), msgID).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ref t.RoomMessageRef
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (r *Repo) SetPeerStats(ctx context.Context, instanceID string, stats []*t.PeerStats, ttl time.Duration) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return r.rdb.Set(ctx, peerStatsKey(instanceID), b, ttl).Err()
+}
+
+func (r *Repo) GetPeerStats(ctx context.Context) ([]*t.PeerStats, error) {
+	ids, err := r.rdb.ZRange(ctx, instancesKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats := []*t.PeerStats{}
+	if len(ids) == 0 {
+		return stats, nil
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, peerStatsKey(id))
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		// the stats of the instance expired or were never set
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var ps []*t.PeerStats
+		if err := json.Unmarshal([]byte(s), &ps); err != nil {
+			log.Printf("failed to unmarshal peer stats: %v", err)
+			continue
+		}
+		stats = append(stats, ps...)
+	}
+	return stats, nil
+}
+
+func (r *Repo) TouchInstance(ctx context.Context, instanceID string) error {
+	return r.rdb.ZAdd(ctx, instancesKey, redis.Z{
+		Score:  float64(time.Now().UTC().Unix()),
+		Member: instanceID,
+	}).Err()
+}
+
+// PurgeStaleInstances removes the sessions and room participants of
+// instances which haven't sent a heartbeat within maxAge, e.g. crashed ones.
+func (r *Repo) PurgeStaleInstances(ctx context.Context, maxAge time.Duration) error {
+	before := strconv.FormatInt(time.Now().UTC().Add(-maxAge).Unix(), 10)
+	ids, err := r.rdb.ZRangeByScore(ctx, instancesKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: before,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := r.RemoveInstance(ctx, id); err != nil {
+			return err
+		}
+		log.Printf("purged stale socket instance %q", id)
+	}
+	return nil
+}
+
+// RemoveInstance removes every session and room participant owned by the
+// instance.
+func (r *Repo) RemoveInstance(ctx context.Context, instanceID string) error {
+	members, err := r.rdb.SMembers(ctx, instanceKey(instanceID)).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, m := range members {
+			parts := strings.SplitN(m, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			id, err := strconv.Atoi(parts[1])
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "room":
+				pipe.HDel(ctx, roomParticipantsKey(id), parts[2])
+				pipe.HSet(ctx, roomActivityKey, id, time.Now().UTC().Unix())
+			case "user":
+				pipe.HDel(ctx, userSessionsKey(id), parts[2])
+			}
+		}
+		pipe.Del(ctx, instanceKey(instanceID), peerStatsKey(instanceID))
+		pipe.ZRem(ctx, instancesKey, instanceID)
+		return nil
+	})
+	return err
+}
+
+func unmarshalParticipants(values []string) []*t.Participant {
+	participants := make([]*t.Participant, 0, len(values))
+	for _, v := range values {
+		var p t.Participant
+		if err := json.Unmarshal([]byte(v), &p); err != nil {
+			log.Printf("failed to unmarshal participant: %v", err)
+			continue
+		}
+		participants = append(participants, &p)
+	}
+	return participants
+}
+
+// AcquireLock reports whether the owner got the lock, it's released
+// automatically after ttl.
+func (r *Repo) AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, "lock:"+key, owner, ttl).Result()
+}
@@ -0,0 +1,482 @@
+package db
+
+import (
+	"backend/types"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const testTimeout = 5 * time.Second
+
+type presenceStore struct {
+	PresenceStore
+	// subscribers returns the number of live event subscriptions
+	subscribers func() int
+}
+
+// presenceStores returns the MemoryStore and, if REDIS_TEST_ADDR is set, the
+// redis Repo. The redis keys are unique to the test, nothing is flushed.
+func presenceStores(tb testing.TB) map[string]presenceStore {
+	tb.Helper()
+	m := NewMemoryStore()
+	stores := map[string]presenceStore{
+		"memory": {
+			PresenceStore: m,
+			subscribers: func() int {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				return len(m.subscribers)
+			},
+		},
+	}
+
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		tb.Log("REDIS_TEST_ADDR isn't set, skipping redis")
+		return stores
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		tb.Fatalf("failed to ping redis: %v", err)
+	}
+	tb.Cleanup(func() { rdb.Close() })
+	stores["redis"] = presenceStore{
+		PresenceStore: NewRepo(nil, rdb, nil),
+		subscribers: func() int {
+			n, err := rdb.PubSubNumSub(context.Background(), socketEventsChannel).Result()
+			if err != nil {
+				tb.Fatalf("failed to count subscribers: %v", err)
+			}
+			return int(n[socketEventsChannel])
+		},
+	}
+	return stores
+}
+
+// uniqueID keeps the rooms and users of the test runs apart in redis.
+func uniqueID() int {
+	return int(time.Now().UnixNano()%1e9) + 1e9
+}
+
+func eventually(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sids(participants []*types.Participant) []string {
+	var s []string
+	for _, p := range participants {
+		s = append(s, p.SID)
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestRoomParticipants(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			instance := fmt.Sprint("instance-", uniqueID())
+			roomID, other := uniqueID(), uniqueID()+1
+			t.Cleanup(func() { store.DeleteRoomPresence(ctx, []int{roomID, other}) })
+
+			for _, sid := range []string{"a", "b"} {
+				p := newParticipant(1, sid)
+				if err := store.AddRoomParticipant(ctx, instance, roomID, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.AddRoomParticipant(ctx, instance, other, newParticipant(2, "c")); err != nil {
+				t.Fatal(err)
+			}
+
+			updated := newParticipant(1, "a")
+			updated.Status = "AFK"
+			if err := store.UpdateRoomParticipant(ctx, roomID, updated); err != nil {
+				t.Fatal(err)
+			}
+			// a participant who left isn't added back by an update
+			if err := store.UpdateRoomParticipant(ctx, roomID, newParticipant(3, "gone")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RemoveRoomParticipant(ctx, instance, roomID, "b"); err != nil {
+				t.Fatal(err)
+			}
+
+			participants, err := store.GetRoomParticipants(ctx, []int{roomID, other, uniqueID() + 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tests := []struct {
+				roomID int
+				want   []string
+			}{
+				{roomID: roomID, want: []string{"a"}},
+				{roomID: other, want: []string{"c"}},
+			}
+			for _, tt := range tests {
+				if got := sids(participants[tt.roomID]); !slices.Equal(got, tt.want) {
+					t.Errorf("room %d: got participants %v, want %v", tt.roomID, got, tt.want)
+				}
+			}
+			if got := participants[roomID][0].Status; got != "AFK" {
+				t.Errorf("got status %q, want the update", got)
+			}
+
+			activity, err := store.GetRoomActivity(ctx, []int{roomID, other})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(activity) != 2 {
+				t.Errorf("got activity of %d rooms, want 2", len(activity))
+			}
+
+			if err := store.DeleteRoomPresence(ctx, []int{roomID}); err != nil {
+				t.Fatal(err)
+			}
+			participants, err = store.GetRoomParticipants(ctx, []int{roomID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(participants[roomID]); n != 0 {
+				t.Errorf("got %d participants after deleting the room, want 0", n)
+			}
+		})
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			instance := fmt.Sprint("instance-", uniqueID())
+			userID, other, unknown := uniqueID(), uniqueID()+1, uniqueID()+2
+			t.Cleanup(func() { store.RemoveInstance(ctx, instance) })
+
+			for _, p := range []*types.Participant{
+				newParticipant(userID, "a"),
+				newParticipant(userID, "b"),
+				newParticipant(other, "c"),
+			} {
+				if err := store.AddUserSession(ctx, instance, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.RemoveUserSession(ctx, instance, userID, "b"); err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err := store.GetUserSessions(ctx, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sids(sessions); !slices.Equal(got, []string{"a"}) {
+				t.Errorf("got sessions %v, want [a]", got)
+			}
+
+			all, err := store.GetUsersSessions(ctx, []int{userID, other, unknown})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sids(all[other]); !slices.Equal(got, []string{"c"}) {
+				t.Errorf("got sessions %v of the other user, want [c]", got)
+			}
+			if n := len(all[unknown]); n != 0 {
+				t.Errorf("got %d sessions of an unknown user, want 0", n)
+			}
+		})
+	}
+}
+
+func TestRemoveInstance(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			crashed := fmt.Sprint("instance-", uniqueID())
+			live := fmt.Sprint("instance-", uniqueID()+1)
+			userID, roomID := uniqueID(), uniqueID()
+			t.Cleanup(func() {
+				store.RemoveInstance(ctx, live)
+				store.DeleteRoomPresence(ctx, []int{roomID})
+			})
+
+			for instance, sid := range map[string]string{crashed: "a", live: "b"} {
+				p := newParticipant(userID, sid)
+				if err := store.AddUserSession(ctx, instance, p); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.AddRoomParticipant(ctx, instance, roomID, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.TouchInstance(ctx, crashed); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RemoveInstance(ctx, crashed); err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err := store.GetUserSessions(ctx, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sids(sessions); !slices.Equal(got, []string{"b"}) {
+				t.Errorf("got sessions %v, want the live instance's [b]", got)
+			}
+			participants, err := store.GetRoomParticipants(ctx, []int{roomID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sids(participants[roomID]); !slices.Equal(got, []string{"b"}) {
+				t.Errorf("got participants %v, want the live instance's [b]", got)
+			}
+		})
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first := fmt.Sprint("instance-", uniqueID())
+			second := fmt.Sprint("instance-", uniqueID()+1)
+			expired := fmt.Sprint("instance-", uniqueID()+2)
+			roomID := uniqueID()
+			t.Cleanup(func() {
+				for _, id := range []string{first, second, expired} {
+					store.RemoveInstance(ctx, id)
+				}
+			})
+
+			// roomSIDs returns the participants of the room with stats
+			roomSIDs := func() []string {
+				stats, err := store.GetPeerStats(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, ps := range stats {
+					if ps.RoomID == roomID {
+						got = append(got, ps.ParticipantID)
+					}
+				}
+				sort.Strings(got)
+				return got
+			}
+			set := func(instance string, ttl time.Duration, sids ...string) {
+				t.Helper()
+				var stats []*types.PeerStats
+				for _, sid := range sids {
+					stats = append(stats, &types.PeerStats{ParticipantID: sid, RoomID: roomID})
+				}
+				if err := store.TouchInstance(ctx, instance); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.SetPeerStats(ctx, instance, stats, ttl); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			set(first, time.Minute, "a", "b")
+			set(second, time.Minute, "c")
+			set(expired, 50*time.Millisecond, "d")
+			eventually(t, "the stats to expire", func() bool {
+				return slices.Equal(roomSIDs(), []string{"a", "b", "c"})
+			})
+
+			// the stats of an instance are replaced, not merged
+			set(first, time.Minute, "a")
+			if got := roomSIDs(); !slices.Equal(got, []string{"a", "c"}) {
+				t.Errorf("got stats of %v, want [a c]", got)
+			}
+
+			if err := store.RemoveInstance(ctx, second); err != nil {
+				t.Fatal(err)
+			}
+			if got := roomSIDs(); !slices.Equal(got, []string{"a"}) {
+				t.Errorf("got stats of %v, want the live instance's [a]", got)
+			}
+		})
+	}
+}
+
+func TestRaisedHands(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			roomID := uniqueID()
+			t.Cleanup(func() { store.DeleteRoomPresence(ctx, []int{roomID}) })
+
+			steps := []struct {
+				raise  bool
+				userID int
+				want   bool
+			}{
+				{raise: true, userID: 1, want: true},
+				{raise: true, userID: 2, want: true},
+				{raise: true, userID: 1, want: false},
+				{raise: true, userID: 3, want: true},
+				{raise: false, userID: 2, want: true},
+				{raise: false, userID: 2, want: false},
+			}
+			for _, s := range steps {
+				var (
+					ok  bool
+					err error
+				)
+				if s.raise {
+					ok, err = store.RaiseHand(ctx, roomID, s.userID)
+				} else {
+					ok, err = store.LowerHand(ctx, roomID, s.userID)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != s.want {
+					t.Errorf("raise %v of user %d: got %v, want %v", s.raise, s.userID, ok, s.want)
+				}
+				// the hands are ordered by when they were raised
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			hands, err := store.GetRaisedHands(ctx, roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{1, 3}; !slices.Equal(hands, want) {
+				t.Errorf("got hands %v, want %v", hands, want)
+			}
+		})
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			before := store.subscribers()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := store.SubscribeEvents(ctx)
+			eventually(t, "the subscription", func() bool {
+				return store.subscribers() > before
+			})
+
+			origin := fmt.Sprint("instance-", uniqueID())
+			publish := func() {
+				t.Helper()
+				err := store.PublishEvent(context.Background(), &types.ClusterEvent{
+					Origin: origin,
+					Kind:   types.ClusterAll,
+					Name:   "TEST",
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			publish()
+			select {
+			case e := <-events:
+				if e.Origin != origin || e.Name != "TEST" {
+					t.Fatalf("got event %+v", e)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("timed out waiting for the event")
+			}
+
+			// nobody reads the next event, the subscription mustn't be stuck
+			// delivering it once ctx is done
+			publish()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			eventually(t, "the subscription to end", func() bool {
+				return store.subscribers() == before
+			})
+		})
+	}
+}
+
+func TestUpdateMediaState(t *testing.T) {
+	for name, store := range presenceStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			roomID := uniqueID()
+			t.Cleanup(func() { store.DeleteRoomPresence(ctx, []int{roomID}) })
+
+			// every update must see the ones before it, redis runs them
+			// again if they raced
+			const updates = 8
+			var wg sync.WaitGroup
+			for i := 0; i < updates; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := store.UpdateMediaState(ctx, roomID, func(m *types.MediaState) (*types.MediaState, error) {
+						if m == nil {
+							m = &types.MediaState{}
+						}
+						m.Queue = append(m.Queue, &types.MediaItem{ID: fmt.Sprint(i)})
+						return m, nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			m, err := store.GetMediaState(ctx, roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m == nil || len(m.Queue) != updates {
+				t.Fatalf("got state %+v, want %d queued", m, updates)
+			}
+
+			// a failed update saves nothing
+			errFailed := errors.New("failed")
+			err = store.UpdateMediaState(ctx, roomID, func(m *types.MediaState) (*types.MediaState, error) {
+				m.Queue = nil
+				return m, errFailed
+			})
+			if !errors.Is(err, errFailed) {
+				t.Fatalf("got error %v, want the update's", err)
+			}
+			if m, _ := store.GetMediaState(ctx, roomID); m == nil || len(m.Queue) != updates {
+				t.Errorf("got state %+v after a failed update", m)
+			}
+
+			err = store.UpdateMediaState(ctx, roomID, func(*types.MediaState) (*types.MediaState, error) {
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, _ := store.GetMediaState(ctx, roomID); m != nil {
+				t.Errorf("got state %+v, want it removed", m)
+			}
+		})
+	}
+}
+
+func newParticipant(userID int, sid string) *types.Participant {
+	return &types.Participant{
+		User:     types.User{ID: userID, Username: fmt.Sprint("user", userID)},
+		SID:      sid,
+		JoinedAt: time.Now().UTC(),
+	}
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	t "backend/types"
+	"context"
+	"time"
+)
+
+type RoomStore interface {
+	CreateRoom(ctx context.Context, room *t.Room) (int, error)
+	GetRooms(ctx context.Context) ([]*t.Room, error)
+	GetRoom(ctx context.Context, roomID int) (*t.Room, error)
+	GetRoomForUser(ctx context.Context, roomID, userID int) (*t.Room, error)
+	UpdateRoom(ctx context.Context, room *t.Room) error
+	DeleteRooms(ctx context.Context, roomIDs []int) error
+	GetRoomSettings(ctx context.Context, roomID int) (*t.RoomSettings, error)
+	UpdateRoomSettings(ctx context.Context, s *t.RoomSettings) error
+	CountRoomsHosted(ctx context.Context, userID int) (int, error)
+	// the ingest token is stored hashed, nil revokes it
+	SetIngestToken(ctx context.Context, roomID int, hash *string) error
+	GetIngestToken(ctx context.Context, roomID int) (*string, error)
+}
+
+type UserStore interface {
+	CreateUser(ctx context.Context, u *t.GoogleUserInfo) (int, error)
+	CreateSession(ctx context.Context, userID int, expiredAt time.Time) (string, error)
+	GetUserFromSession(ctx context.Context, sessionID string) (*t.User, error)
+	GetUserByName(ctx context.Context, username string) (*t.User, error)
+	DeleteSessionForUser(ctx context.Context, sessionID string, userID int) error
+	UpdateUser(ctx context.Context, id int, bio string) error
+	GetProfile(ctx context.Context, userID int, profileID int) (*t.Profile, error)
+}
+
+type SocialStore interface {
+	Follow(ctx context.Context, followerID, followeeID int) error
+	Unfollow(ctx context.Context, followerID, followeeID int) error
+	GetRelations(ctx context.Context, userID int, relation t.Relation) ([]*t.RelationRes, error)
+	IsFriends(ctx context.Context, userID, participantID int) (bool, error)
+}
+
+type DMStore interface {
+	GetDM(ctx context.Context, userID, participantID int) (int, error)
+	CreateDM(ctx context.Context, userID, participantID int) (int, error)
+	GetDMs(ctx context.Context, userID int) ([]*t.DMResponse, error)
+	UpdateDMs(ctx context.Context, userID int, participantID int) error
+	CreateMessage(ctx context.Context, dmID int, msg *t.Message) (string, error)
+	GetMessage(ctx context.Context, msgID string, userID, pID int, isReaction bool) (*t.Message, error)
+	UpdateMessage(ctx context.Context, msg *t.Message, isReaction bool) error
+	GetMessages(ctx context.Context, userID, participantID int, cursor *time.Time) ([]*t.MessageResponse, error)
+}
+
+// RoomMessageStore keeps the room messages, whispers included, for as long
+// as their room's retention.
+type RoomMessageStore interface {
+	CreateRoomMessage(ctx context.Context, msg *t.Message) error
+	// GetRoomMessage returns the message if the user sent it, any message
+	// the user can see when isReaction is set
+	GetRoomMessage(ctx context.Context, roomID int, msgID string, userID int, isReaction bool) (*t.Message, error)
+	UpdateRoomMessage(ctx context.Context, msg *t.Message, isReaction bool) error
+	// GetKeptRoomMessageRef returns who sent the saved message and who to,
+	// pgx.ErrNoRows if it isn't saved
+	GetKeptRoomMessageRef(ctx context.Context, roomID int, msgID string) (*t.RoomMessageRef, error)
+	// GetRoomMessages returns the 50 messages before the cursor, whispers
+	// only to their two participants
+	GetRoomMessages(ctx context.Context, roomID, userID int, cursor *t.MessageCursor) ([]*t.MessageResponse, error)
+	// ClearRoomMessages hides the messages the user sent, whispers
+	// included
+	ClearRoomMessages(ctx context.Context, roomID, userID int) error
+	DeleteExpiredRoomMessages(ctx context.Context, retention int) error
+}
+
+type InviteStore interface {
+	CreateInvite(ctx context.Context, inv *t.RoomInvite) error
+	GetInvites(ctx context.Context, roomID int) ([]*t.RoomInvite, error)
+	DeleteInvite(ctx context.Context, roomID int, code string) error
+	RedeemInvite(ctx context.Context, roomID int, code string, userID int) (bool, error)
+}
+
+type KickStore interface {
+	GetKick(ctx context.Context, roomID, userID int) (*t.Kick, error)
+	KickParticipant(ctx context.Context, k *t.Kick) error
+}
+
+type AIStore interface {
+	SetAIReply(ctx context.Context, roomID int, msgID string, userID int, contents []string)
+	SetAIReplies(ctx context.Context, roomID, userID int, contents []string)
+	GetAIMessages(ctx context.Context, roomID, userID int) ([]*t.AIMessage, error)
+	IsReplyToAI(ctx context.Context, roomID int, msgID string) (string, error)
+	DeleteAIReplies(ctx context.Context, roomID int)
+	SavePendingAIRequests(ctx context.Context, reqs []*t.AIMessageRequest) error
+	PopPendingAIRequests(ctx context.Context) ([]*t.AIMessageRequest, error)
+}
+
+// PresenceStore shares the socket server state between backend instances.
+type PresenceStore interface {
+	PublishEvent(ctx context.Context, e *t.ClusterEvent) error
+	SubscribeEvents(ctx context.Context) <-chan *t.ClusterEvent
+	AddUserSession(ctx context.Context, instanceID string, p *t.Participant) error
+	RemoveUserSession(ctx context.Context, instanceID string, userID int, sid string) error
+	GetUserSessions(ctx context.Context, userID int) ([]*t.Participant, error)
+	GetUsersSessions(ctx context.Context, userIDs []int) (map[int][]*t.Participant, error)
+	AddRoomParticipant(ctx context.Context, instanceID string, roomID int, p *t.Participant) error
+	UpdateRoomParticipant(ctx context.Context, roomID int, p *t.Participant) error
+	RemoveRoomParticipant(ctx context.Context, instanceID string, roomID int, sid string) error
+	GetRoomParticipants(ctx context.Context, roomIDs []int) (map[int][]*t.Participant, error)
+	TouchRoom(ctx context.Context, roomID int) error
+	GetRoomActivity(ctx context.Context, roomIDs []int) (map[int]time.Time, error)
+	DeleteRoomPresence(ctx context.Context, roomIDs []int) error
+	RaiseHand(ctx context.Context, roomID, userID int) (bool, error)
+	LowerHand(ctx context.Context, roomID, userID int) (bool, error)
+	GetRaisedHands(ctx context.Context, roomID int) ([]int, error)
+	// IndexRoomMessage remembers the room message, only the latest max
+	// messages of the room are kept
+	IndexRoomMessage(ctx context.Context, roomID int, ref *t.RoomMessageRef, max int) error
+	// GetRoomMessageRef returns nil if the message isn't in the index
+	GetRoomMessageRef(ctx context.Context, roomID int, msgID string) (*t.RoomMessageRef, error)
+	GetMediaState(ctx context.Context, roomID int) (*t.MediaState, error)
+	// UpdateMediaState saves the watch party update makes of the current
+	// one, atomically
+	UpdateMediaState(ctx context.Context, roomID int, update func(m *t.MediaState) (*t.MediaState, error)) error
+	// SetPeerStats replaces the stats of the peers connected to the
+	// instance, they expire after ttl unless set again
+	SetPeerStats(ctx context.Context, instanceID string, stats []*t.PeerStats, ttl time.Duration) error
+	// GetPeerStats returns the stats of the peers of every instance
+	GetPeerStats(ctx context.Context) ([]*t.PeerStats, error)
+	TouchInstance(ctx context.Context, instanceID string) error
+	PurgeStaleInstances(ctx context.Context, maxAge time.Duration) error
+	RemoveInstance(ctx context.Context, instanceID string) error
+	AcquireLock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+}
+
+type RateLimitStore interface {
+	AddRateLimitViolation(ctx context.Context, userID int, window time.Duration) (int, error)
+	GetRateLimitViolations(ctx context.Context, userID int) (int, error)
+}
+
+// Store is everything the service and the socket server need to persist,
+// it's implemented by Repo (postgres and redis) and MemoryStore.
+type Store interface {
+	RoomStore
+	UserStore
+	SocialStore
+	DMStore
+	RoomMessageStore
+	InviteStore
+	KickStore
+	AIStore
+	PresenceStore
+	RateLimitStore
+}
+
+var (
+	_ Store = (*Repo)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"backend/service"
+	t "backend/types"
+	"backend/utils"
+	v "backend/validator"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"nhooyr.io/websocket"
+)
+
+// machine readable codes sent in the ERROR event
+const (
+	codeBadRequest       = "bad_request"
+	codeValidationFailed = "validation_failed"
+	codeUnauthenticated  = "unauthenticated"
+	codePermissionDenied = "permission_denied"
+	codeNotFound         = "not_found"
+	codeNotInRoom        = "not_in_room"
+	codeRoomFull         = "room_full"
+	codeConflict         = "conflict"
+	codeMaxRoomsHosted   = "max_rooms_hosted"
+	codeShuttingDown     = "shutting_down"
+	codeUnknownEvent     = "unknown_event"
+	codeInternal         = "internal"
+)
+
+var (
+	errNotInRoom  = errors.New("participants not in room")
+	errConnClosed = errors.New("connection closed")
+	errDetached   = errors.New("websocket is no longer attached to its session")
+)
+
+// eventError is sent to the client in the ERROR event. Title is set when
+// the client is expected to show the error to the user.
+type eventError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Title   string            `json:"title,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+func (e *eventError) Error() string {
+	return e.Message
+}
+
+// toEventError maps the errors returned by the handlers to the ones sent to
+// the client. Unknown errors aren't exposed.
+func toEventError(err error) *eventError {
+	var (
+		ee *eventError
+		vd *v.Validator
+	)
+	switch {
+	case errors.As(err, &ee):
+		return ee
+	case errors.As(err, &vd):
+		return &eventError{Code: codeValidationFailed, Message: "validation failed", Errors: vd.Errors}
+	case errors.Is(err, roomFullErr), errors.Is(err, stageFullErr):
+		return &eventError{Code: codeRoomFull, Message: err.Error(), Title: "Room Full"}
+	case errors.Is(err, service.ErrPermissionDenied):
+		return &eventError{Code: codePermissionDenied, Message: err.Error()}
+	case errors.Is(err, service.ErrRoomLocked), errors.Is(err, service.ErrInvalidInvite):
+		return &eventError{Code: codePermissionDenied, Message: err.Error(), Title: "Locked Room"}
+	case errors.Is(err, service.ErrInvalidRole):
+		return &eventError{Code: codeValidationFailed, Message: err.Error()}
+	case errors.Is(err, service.ErrAlreadyKicked), errors.Is(err, service.ErrNotStage):
+		return &eventError{Code: codeConflict, Message: err.Error()}
+	case errors.Is(err, errOfferCollision), errors.Is(err, errUnexpectedAnswer):
+		return &eventError{Code: codeConflict, Message: err.Error()}
+	case errors.Is(err, errNotInRoom):
+		return &eventError{Code: codeNotInRoom, Message: err.Error()}
+	case errors.Is(err, errShuttingDown):
+		return &eventError{Code: codeShuttingDown, Message: err.Error()}
+	case errors.Is(err, pgx.ErrNoRows):
+		return &eventError{Code: codeNotFound, Message: "not found"}
+	default:
+		return &eventError{Code: codeInternal, Message: "something went wrong"}
+	}
+}
+
+// eventHandler parses and handles the data of a socket event, the result is
+// sent back in the ACK event. It's called outside of the run loop, so it
+// must call do to read or change the socket server state.
+type eventHandler func(s *socketServer, conn *websocket.Conn, b []byte) (any, error)
+
+// handle wraps a typed handler, the data is parsed into T and validated,
+// when T has a Validate method, before fn is called.
+func handle[T any](fn func(s *socketServer, conn *websocket.Conn, data *T) (any, error)) eventHandler {
+	return func(s *socketServer, conn *websocket.Conn, b []byte) (any, error) {
+		data, err := utils.ParseJSON[T](b)
+		if err != nil {
+			return nil, &eventError{Code: codeBadRequest, Message: "invalid data"}
+		}
+		if d, ok := any(data).(interface{ Validate() (bool, error) }); ok {
+			if ok, err := d.Validate(); !ok {
+				return nil, err
+			}
+		}
+		return fn(s, conn, data)
+	}
+}
+
+// onLoop wraps a handler which only reads and changes the socket server
+// state, it's run on the run loop as a whole. Such a handler must not call
+// redis or postgres, other than through async.
+func onLoop[T any](fn func(s *socketServer, conn *websocket.Conn, data *T) (any, error)) func(s *socketServer, conn *websocket.Conn, data *T) (any, error) {
+	return func(s *socketServer, conn *websocket.Conn, data *T) (res any, err error) {
+		s.do(func() {
+			res, err = fn(s, conn, data)
+		})
+		return res, err
+	}
+}
+
+var socketEvents = map[string]eventHandler{
+	"JOIN_ROOM":               handle((*socketServer).joinRoomHandler),
+	"NEW_MESSAGE":             handle((*socketServer).newMessageHandler),
+	"EDIT_MESSAGE":            handle((*socketServer).editMessageHandler),
+	"DELETE_MESSAGE":          handle((*socketServer).deleteMessageHandler),
+	"REACTION_TO_MESSAGE":     handle((*socketServer).reactionToMsgHandler),
+	"CLEAR_CHAT":              handle((*socketServer).clearChatHandler),
+	"ASSIGN_ROLE":             handle((*socketServer).assignRoleHandler),
+	"UPDATE_WELCOME_MESSAGE":  handle((*socketServer).updateWelcomeMsgHandler),
+	"SET_STATUS":              handle(onLoop((*socketServer).setStatusHandler)),
+	"SET_PRESENCE":            handle((*socketServer).setPresenceHandler),
+	"KICK_PARTICIPANT":        handle((*socketServer).kickParticipantHandler),
+	"PEER_ICE_CANDIDATE":      handle(onLoop((*socketServer).peerICECandidateHandler)),
+	"PEER_OFFER":              handle((*socketServer).peerOfferHandler),
+	"PEER_ANSWER":             handle(onLoop((*socketServer).peerAnswerHandler)),
+	"PEER_MUTE":               handle(onLoop((*socketServer).peerMuteHandler)),
+	"FORCE_MUTE":              handle((*socketServer).forceMuteHandler),
+	"START_RECORDING":         handle((*socketServer).startRecordingHandler),
+	"STOP_RECORDING":          handle((*socketServer).stopRecordingHandler),
+	"UPDATE_PUBLISH_SETTINGS": handle((*socketServer).updatePublishSettingsHandler),
+	"RAISE_HAND":              handle((*socketServer).raiseHandHandler),
+	"APPROVE_HAND":            handle((*socketServer).approveHandHandler),
+	"DISMISS_HAND":            handle((*socketServer).dismissHandHandler),
+	"SET_SPEAKER":             handle((*socketServer).setSpeakerHandler),
+	"MEDIA_LOAD":              handle((*socketServer).mediaLoadHandler),
+	"MEDIA_PLAY":              handle((*socketServer).mediaPlayHandler),
+	"MEDIA_PAUSE":             handle((*socketServer).mediaPauseHandler),
+	"MEDIA_SEEK":              handle((*socketServer).mediaSeekHandler),
+	"MEDIA_QUEUE":             handle((*socketServer).mediaQueueHandler),
+	"MEDIA_DEQUEUE":           handle((*socketServer).mediaDequeueHandler),
+	"MEDIA_VOTE_SKIP":         handle((*socketServer).mediaVoteSkipHandler),
+}
+
+// handleEvent dispatches a socket event of the session keyed by conn, it's
+// called from the read loop of ws, the session's websocket. The client gets
+// an ACK if it sent an ID with the event, and an ERROR whenever the event
+// fails. errDetached is returned, and the event dropped, once the session
+// is gone or resumed on another websocket.
+func (s *socketServer) handleEvent(conn, ws *websocket.Conn, user *t.User, event *t.Event, b []byte) error {
+	var (
+		c          *socketConn
+		retryAfter time.Duration
+		allowed    = true
+	)
+	_, known := socketEvents[event.Name]
+	s.do(func() {
+		var ok bool
+		if c, ok = s.conns[conn]; !ok || !c.isAttached(ws) {
+			c = nil
+			return
+		}
+		if user == nil || !known {
+			return
+		}
+		retryAfter, allowed = s.allow(user.ID, event.Name)
+	})
+	if c == nil {
+		return errDetached
+	}
+
+	// only users who are authenticated can send event
+	if user == nil {
+		s.sendError(c, event, b, &eventError{
+			Code:    codeUnauthenticated,
+			Message: "only authenticated users can send socket event",
+		})
+		return nil
+	}
+
+	h, ok := socketEvents[event.Name]
+	if !ok {
+		s.sendError(c, event, b, &eventError{Code: codeUnknownEvent, Message: "unknown event"})
+		return nil
+	}
+
+	if !allowed {
+		s.rateLimited(c, user.ID, event, retryAfter)
+		return nil
+	}
+
+	res, err := h(s, conn, b)
+	if err != nil {
+		log.Printf("%s event failed: %v", event.Name, err)
+		s.sendError(c, event, b, err)
+		return nil
+	}
+
+	if event.ID == "" {
+		return nil
+	}
+	c.send(&t.Event{
+		Name: "ACK",
+		Data: map[string]any{
+			"id":    event.ID,
+			"event": event.Name,
+			"data":  res,
+		},
+	})
+	return nil
+}
+
+func (s *socketServer) sendError(c *socketConn, event *t.Event, b []byte, err error) {
+	ee := toEventError(err)
+	d := map[string]any{
+		"id":      event.ID,
+		"event":   event.Name,
+		"code":    ee.Code,
+		"message": ee.Message,
+	}
+	if ee.Title != "" {
+		d["title"] = ee.Title
+	}
+	if len(ee.Errors) > 0 {
+		d["errors"] = ee.Errors
+	}
+
+	// let the client know which room the error belongs to
+	var data struct {
+		RoomID *int `json:"roomID"`
+	}
+	if b != nil && json.Unmarshal(b, &data) == nil && data.RoomID != nil {
+		d["roomID"] = *data.RoomID
+	}
+
+	c.send(&t.Event{
+		Name: "ERROR",
+		Data: d,
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"backend/db"
+	"backend/service"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestToEventError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:        "event error is kept",
+			err:         &eventError{Code: codeConflict, Message: "joined room already"},
+			wantCode:    codeConflict,
+			wantMessage: "joined room already",
+		},
+		{
+			name:        "room full",
+			err:         fmt.Errorf("join: %w", roomFullErr),
+			wantCode:    codeRoomFull,
+			wantMessage: "join: max participants limit reached",
+		},
+		{
+			name:        "permission denied",
+			err:         service.ErrPermissionDenied,
+			wantCode:    codePermissionDenied,
+			wantMessage: service.ErrPermissionDenied.Error(),
+		},
+		{
+			name:        "unknown errors aren't exposed",
+			err:         errors.New("dial tcp 10.0.0.1:5432: connection refused"),
+			wantCode:    codeInternal,
+			wantMessage: "something went wrong",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toEventError(tt.err)
+			if got.Code != tt.wantCode || got.Message != tt.wantMessage {
+				t.Errorf("got %s: %q, want %s: %q", got.Code, got.Message, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+}
+
+// errorFor returns the data of the ERROR sent for the event by id.
+func errorFor(tb testing.TB, c *testClient, id string) map[string]any {
+	tb.Helper()
+	var data map[string]any
+	c.waitFor(tb, "ERROR of "+id, func(e *testEvent) bool {
+		var d map[string]any
+		if e.Name != "ERROR" || json.Unmarshal(e.Data, &d) != nil || d["id"] != id {
+			return false
+		}
+		data = d
+		return true
+	})
+	return data
+}
+
+func TestHandleEvent(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	c := ta.dial(t, hostSession, "")
+
+	t.Run("ack carries the result", func(t *testing.T) {
+		ack := c.call(t, "JOIN_ROOM", map[string]any{"roomID": roomID})
+		var res struct {
+			RoomID int    `json:"roomID"`
+			SID    string `json:"sid"`
+		}
+		if err := json.Unmarshal(ack, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.RoomID != roomID || res.SID == "" {
+			t.Errorf("got ack %s, want the room and the session", ack)
+		}
+	})
+
+	t.Run("errors carry the code and the room", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			event    string
+			data     any
+			wantCode string
+			// wantErrors are the fields which failed validation
+			wantErrors []string
+		}{
+			{name: "unknown event", event: "DANCE", data: map[string]any{}, wantCode: codeUnknownEvent},
+			{name: "malformed data", event: "NEW_MESSAGE", data: map[string]any{"roomID": "lobby"}, wantCode: codeBadRequest},
+			{
+				name:       "invalid data",
+				event:      "NEW_MESSAGE",
+				data:       map[string]any{"roomID": roomID, "content": ""},
+				wantCode:   codeValidationFailed,
+				wantErrors: []string{"content"},
+			},
+			{name: "room doesn't exist", event: "JOIN_ROOM", data: map[string]any{"roomID": roomID + 100}, wantCode: codeNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				id := c.send(t, tt.event, tt.data)
+				data := errorFor(t, c, id)
+				if data["code"] != tt.wantCode || data["event"] != tt.event {
+					t.Fatalf("got error %v, want %s for %s", data, tt.wantCode, tt.event)
+				}
+				if tt.wantErrors == nil {
+					return
+				}
+				errs, _ := data["errors"].(map[string]any)
+				for _, field := range tt.wantErrors {
+					if _, ok := errs[field]; !ok {
+						t.Errorf("got errors %v, want %q", errs, field)
+					}
+				}
+				if data["roomID"] != float64(roomID) {
+					t.Errorf("got room %v, want %d", data["roomID"], roomID)
+				}
+			})
+		}
+	})
+
+	t.Run("events without an id aren't acked", func(t *testing.T) {
+		before := c.count("ACK")
+		err := wsjson.Write(context.Background(), c.ws, &types.Event{
+			Name: "SET_PRESENCE",
+			Data: map[string]any{"idle": true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reply comes after the one of the event before
+		c.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		if got := c.count("ACK") - before; got != 1 {
+			t.Errorf("got %d ACKs, want 1", got)
+		}
+	})
+
+	t.Run("guests can't send events", func(t *testing.T) {
+		guest := ta.dial(t, "", "")
+		if e := guest.callErr(t, "JOIN_ROOM", map[string]any{"roomID": roomID}); e.Code != codeUnauthenticated {
+			t.Errorf("got error %s: %s, want %s", e.Code, e.Message, codeUnauthenticated)
+		}
+	})
+}
@@ -8,11 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v5"
-	"nhooyr.io/websocket"
 )
 
 func (app *application) authCallbackHandler(w http.ResponseWriter, r *http.Request) {
@@ -139,6 +139,11 @@ func (app *application) createRoomHandler(w http.ResponseWriter, r *http.Request
 		MaxParticipants: req.MaxParticipants,
 		Languages:       req.Languages,
 		CreatedBy:       u.ID,
+		Settings: t.RoomSettings{
+			Stage:            req.Stage,
+			Locked:           req.Locked,
+			MessageRetention: req.MessageRetention,
+		},
 	})
 
 	if err != nil {
@@ -146,39 +151,51 @@ func (app *application) createRoomHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	go func(roomID int) {
-		app.ss.rooms[roomID] = &socketRoom{
-			lastActivity: time.Now().UTC(),
-			conns:        make(map[*websocket.Conn]struct{}),
-			tracks:       make(map[string]*roomTrack),
-		}
-
+	app.ss.do(func() {
+		app.ss.addRoom(roomID)
+		app.ss.publish(&t.ClusterEvent{
+			Kind:   t.ClusterRoomCreated,
+			RoomID: roomID,
+		})
 		app.ss.broadcastEvent(&t.Event{
 			Name: "NEW_ROOM_BROADCAST",
 			Data: map[string]any{
 				"roomID": roomID,
 			},
 		})
-	}(roomID)
+	})
 
 	jsonResponse(w, http.StatusOK, map[string]any{
 		"roomID": roomID,
 	})
 }
 
-func (app *application) getRoomsHandler(w http.ResponseWriter, _ *http.Request) {
+func (app *application) getRoomsHandler(w http.ResponseWriter, r *http.Request) {
 	rooms, err := app.repo.GetRooms(context.Background())
 	if err != nil {
 		serverError(w, err)
 		return
 	}
 
+	roomIDs := make([]int, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID
+	}
+	participants, err := app.ss.getParticipantsInRooms(roomIDs)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	// the user is optional, rooms are listed to guests too
+	u, _ := r.Context().Value("user").(*t.User)
 	res := make([]*t.RoomsResponse, 0)
 	for _, room := range rooms {
 		roomRes := t.RoomsResponse{
 			Room:         room,
-			Participants: app.ss.getParticipantsInRoom(room.ID),
+			Participants: participants[room.ID],
 		}
+		redactRoom(&roomRes, u)
 		res = append(res, &roomRes)
 	}
 
@@ -206,9 +223,16 @@ func (app *application) joinRoomHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	participants := app.ss.getParticipantsInRoom(room.ID)
-	if len(participants) >= room.MaxParticipants {
-		badRequest(w, err)
+	participants, err := app.ss.getParticipantsInRoom(room.ID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if err := app.ss.checkRoomLimit(room, u.ID, participants); err != nil {
+		errorsResponse(w, http.StatusBadRequest, map[string]any{
+			"full":   true,
+			"reason": err.Error(),
+		})
 		return
 	}
 
@@ -219,6 +243,9 @@ func (app *application) joinRoomHandler(w http.ResponseWriter, r *http.Request)
 		})
 		return
 	}
+	if !app.canJoin(w, r, room, u.ID) {
+		return
+	}
 
 	roomRes := t.RoomsResponse{
 		Room:         room,
@@ -260,6 +287,10 @@ func (app *application) updateRoomHandler(w http.ResponseWriter, r *http.Request
 	room.Topic = req.Topic
 	room.MaxParticipants = req.MaxParticipants
 	room.Languages = req.Languages
+	stageChanged := room.Settings.Stage != req.Stage
+	room.Settings.Stage = req.Stage
+	room.Settings.Locked = req.Locked
+	room.Settings.MessageRetention = req.MessageRetention
 
 	err = app.repo.UpdateRoom(context.Background(), room)
 	if err != nil {
@@ -267,14 +298,17 @@ func (app *application) updateRoomHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	go func(roomID int) {
+	if stageChanged {
+		app.ss.updateStage(room.ID)
+	}
+	app.ss.do(func() {
 		app.ss.broadcastEvent(&t.Event{
 			Name: "UPDATE_ROOM_BROADCAST",
 			Data: map[string]any{
 				"roomID": room.ID,
 			},
 		})
-	}(room.ID)
+	})
 
 	msgResponse(w, "ok")
 }
@@ -354,6 +388,19 @@ func (app *application) getRelationsHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	userIDs := make([]int, 0, len(users))
+	for _, u := range users {
+		userIDs = append(userIDs, u.ID)
+	}
+	presences, err := app.getPresences(u.ID, userIDs)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	for _, u := range users {
+		u.Presence = presences[u.ID]
+	}
+
 	jsonResponse(w, http.StatusOK, map[string]any{
 		"users": users,
 	})
@@ -416,6 +463,57 @@ func (app *application) getMessagesHandler(w http.ResponseWriter, r *http.Reques
 	})
 }
 
+// getRoomMessagesHandler returns the room's messages sent before the
+// cursor, to the participants of the room. The cursor is the createdAt and
+// the id of the oldest message the client has.
+func (app *application) getRoomMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(r.PathValue("roomID"))
+	if err != nil {
+		notFoundError(w, err)
+		return
+	}
+
+	var cursor *t.MessageCursor
+	query := r.URL.Query()
+	if c := query.Get("cursor"); c != "" {
+		at, err := time.Parse(time.RFC3339Nano, c)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		id := query.Get("cursorID")
+		if id == "" {
+			badRequest(w, errors.New("cursorID is required with cursor"))
+			return
+		}
+		cursor = &t.MessageCursor{CreatedAt: at, ID: id}
+	}
+
+	u := r.Context().Value("user").(*t.User)
+	participants, err := app.ss.getParticipantsInRoom(roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	inRoom := slices.ContainsFunc(participants, func(p *t.Participant) bool {
+		return p.ID == u.ID
+	})
+	if !inRoom {
+		forbiddenError(w, fmt.Errorf("user %d isn't in room %d", u.ID, roomID))
+		return
+	}
+
+	messages, err := app.repo.GetRoomMessages(context.Background(), roomID, u.ID, cursor)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"messages": messages,
+	})
+}
+
 func (app *application) getLanguagesHandler(w http.ResponseWriter, _ *http.Request) {
 	jsonResponse(w, http.StatusOK, map[string]any{
 		"languages": t.AllowedLanguages,
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// addIngest adds a WHIP publisher to the participants of the room.
+func addIngest(tb testing.TB, ta *testApp, roomID int) {
+	tb.Helper()
+	sid := fmt.Sprint("whip-", time.Now().UnixNano())
+	p := &types.Participant{
+		User:     types.User{Username: "obs"},
+		SID:      sid,
+		JoinedAt: time.Now().UTC(),
+		RoomID:   roomID,
+	}
+	if err := ta.repo.AddRoomParticipant(context.Background(), ta.ss.instanceID, roomID, p); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestJoinRoomLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage bool
+		// joined is the number of guests in the room besides the host
+		joined int
+		// ingest is the number of WHIP publishers in the room
+		ingest     int
+		wantStatus int
+	}{
+		{name: "room has a spot", joined: 0, wantStatus: http.StatusOK},
+		{name: "room is full", joined: 1, wantStatus: http.StatusBadRequest},
+		{name: "stage has listener spots", stage: true, joined: 1, wantStatus: http.StatusOK},
+		{name: "stage listeners are full", stage: true, joined: 2, wantStatus: http.StatusBadRequest},
+		{name: "whip publishers don't take a spot", ingest: 2, wantStatus: http.StatusOK},
+		{name: "whip publishers aren't listeners", stage: true, joined: 1, ingest: 1, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+				conf.Stage.MaxListeners = 2
+			})
+			host, hostSession := ta.user(t, "host")
+			roomID := ta.room(t, host, func(r *types.Room) {
+				r.MaxParticipants = 2
+				r.Settings.Stage = tt.stage
+			})
+			joinRoom(t, ta.dial(t, hostSession, ""), roomID)
+			for i := 0; i < tt.joined; i++ {
+				_, session := ta.user(t, fmt.Sprint("guest", i))
+				joinRoom(t, ta.dial(t, session, ""), roomID)
+			}
+			for i := 0; i < tt.ingest; i++ {
+				addIngest(t, ta, roomID)
+			}
+
+			_, session := ta.user(t, "late")
+			res := ta.get(t, fmt.Sprintf("/rooms/%d/join", roomID), session)
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if res.StatusCode == http.StatusOK {
+				return
+			}
+			var body struct {
+				Errors struct {
+					Full   bool   `json:"full"`
+					Reason string `json:"reason"`
+				} `json:"errors"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !body.Errors.Full || body.Errors.Reason == "" {
+				t.Errorf("got errors %+v, want the reason the room is full", body.Errors)
+			}
+		})
+	}
+}
+
+func TestGetRoomMessages(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	ctx := context.Background()
+	host, hostSession := ta.user(t, "host")
+	guest, guestSession := ta.user(t, "guest")
+	other, otherSession := ta.user(t, "other")
+	roomID := ta.room(t, host, nil)
+	hostC := ta.dial(t, hostSession, "")
+	for _, c := range []*testClient{hostC, ta.dial(t, guestSession, ""), ta.dial(t, otherSession, "")} {
+		joinRoom(t, c, roomID)
+	}
+
+	// messages are sent 7 at a time so the pages end between messages sent
+	// at once
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	create := func(id string, at time.Time, from *types.User, to *types.User) {
+		t.Helper()
+		msg := &types.Message{ID: id, Content: id, From: *from, CreatedAt: at, RoomID: &roomID}
+		if to != nil {
+			msg.Participant = to
+		}
+		if err := ta.repo.CreateRoomMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want []string
+	for i := 0; i < 120; i++ {
+		id := fmt.Sprintf("m%03d", i)
+		create(id, base.Add(time.Duration(i/7)*time.Second), host, nil)
+		want = append(want, id)
+	}
+
+	// page returns the messages the user gets
+	page := func(session, query string) []*types.MessageResponse {
+		t.Helper()
+		res := ta.get(t, fmt.Sprintf("/rooms/%d/messages%s", roomID, query), session)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		var body struct {
+			Messages []*types.MessageResponse `json:"messages"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Messages
+	}
+	// messages returns the IDs of the latest messages the user gets
+	messages := func(session string) []string {
+		t.Helper()
+		var ids []string
+		for _, m := range page(session, "") {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	t.Run("pages cover every message once", func(t *testing.T) {
+		var (
+			got   []string
+			sizes []int
+			query string
+		)
+		for {
+			msgs := page(hostSession, query)
+			if len(msgs) == 0 {
+				break
+			}
+			sizes = append(sizes, len(msgs))
+			var ids []string
+			for _, m := range msgs {
+				ids = append(ids, m.ID)
+			}
+			got = append(ids, got...)
+			// like the client, the oldest message is the cursor
+			first := msgs[0]
+			query = fmt.Sprintf("?cursor=%s&cursorID=%s", url.QueryEscape(first.CreatedAt.Format(time.RFC3339Nano)), first.ID)
+		}
+		if !slices.Equal(sizes, []int{50, 50, 20}) {
+			t.Errorf("got pages of %v, want [50 50 20]", sizes)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got messages %v, want %v", got, want)
+		}
+	})
+
+	t.Run("cursor needs the id", func(t *testing.T) {
+		query := "?cursor=" + url.QueryEscape(base.Format(time.RFC3339Nano))
+		res := ta.get(t, fmt.Sprintf("/rooms/%d/messages%s", roomID, query), hostSession)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	later := base.Add(time.Hour)
+	create("whisper", later, host, guest)
+	create("guest-public", later.Add(time.Second), guest, nil)
+	create("guest-whisper", later.Add(2*time.Second), guest, other)
+
+	t.Run("whispers go to their participants only", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			session string
+			want    []string
+		}{
+			{name: "sender", session: hostSession, want: []string{"whisper", "guest-public"}},
+			{name: "recipient", session: guestSession, want: []string{"whisper", "guest-public", "guest-whisper"}},
+			{name: "someone else", session: otherSession, want: []string{"guest-public", "guest-whisper"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				page := messages(tt.session)
+				if got := page[len(page)-len(tt.want):]; !slices.Equal(got, tt.want) || slices.Contains(page[:len(page)-len(tt.want)], "whisper") {
+					t.Errorf("got latest messages %v, want %v", page[len(page)-3:], tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("cleared chat hides the whispers too", func(t *testing.T) {
+		hostC.call(t, "CLEAR_CHAT", map[string]any{"roomID": roomID, "participantId": guest.ID})
+		for _, session := range []string{hostSession, guestSession, otherSession} {
+			page := messages(session)
+			if slices.Contains(page, "guest-public") || slices.Contains(page, "guest-whisper") {
+				t.Errorf("got messages %v, want the guest's cleared", page[len(page)-3:])
+			}
+		}
+		if page := messages(guestSession); page[len(page)-1] != "whisper" {
+			t.Errorf("got latest message %s, want the host's whisper kept", page[len(page)-1])
+		}
+	})
+}
+
+func TestDeleteExpiredRoomMessages(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	ctx := context.Background()
+	host, _ := ta.user(t, "host")
+	oneDay := 1
+	rooms := map[string]int{
+		"default": ta.room(t, host, nil),
+		"one day": ta.room(t, host, func(r *types.Room) {
+			r.Settings.MessageRetention = &oneDay
+		}),
+	}
+	now := time.Now().UTC()
+	for name, roomID := range rooms {
+		for _, age := range []int{0, 2, 10} {
+			msg := &types.Message{
+				ID:        fmt.Sprintf("%s-%d", name, age),
+				Content:   "hi",
+				From:      *host,
+				CreatedAt: now.AddDate(0, 0, -age),
+				RoomID:    &roomID,
+			}
+			if err := ta.repo.CreateRoomMessage(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := ta.repo.DeleteExpiredRoomMessages(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"default": {"default-2", "default-0"},
+		"one day": {"one day-0"},
+	}
+	for name, roomID := range rooms {
+		messages, err := ta.repo.GetRoomMessages(ctx, roomID, host.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.ID)
+		}
+		if !slices.Equal(got, want[name]) {
+			t.Errorf("%s: got messages %v, want %v", name, got, want[name])
+		}
+	}
+}
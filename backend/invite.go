@@ -0,0 +1,134 @@
+package main
+
+import (
+	"backend/service"
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// createInviteHandler creates an invite link of a locked room, it can expire
+// and be limited to a number of users.
+func (app *application) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var req t.CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		badRequest(w, err)
+		return
+	}
+	if ok, err := req.Validate(); !ok {
+		badRequest(w, err)
+		return
+	}
+
+	u := r.Context().Value("user").(*t.User)
+	inv := &t.RoomInvite{
+		Code:      shortuuid.New(),
+		RoomID:    roomID,
+		CreatedBy: u.ID,
+	}
+	if req.MaxUses > 0 {
+		inv.MaxUses = &req.MaxUses
+	}
+	if req.ExpiresIn != "" {
+		// it's validated already
+		d, _ := time.ParseDuration(req.ExpiresIn)
+		expiredAt := time.Now().UTC().Add(d)
+		inv.ExpiredAt = &expiredAt
+	}
+	if err := app.repo.CreateInvite(context.Background(), inv); err != nil {
+		serverError(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusCreated, map[string]any{
+		"invite": inv,
+	})
+}
+
+func (app *application) getInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+	invites, err := app.repo.GetInvites(context.Background(), roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"invites": invites,
+	})
+}
+
+// deleteInviteHandler revokes the invite, the users who joined with it have
+// to be invited again.
+func (app *application) deleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+	err := app.repo.DeleteInvite(context.Background(), roomID, r.PathValue("code"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		notFoundError(w, err)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	msgResponse(w, "invite revoked")
+}
+
+// canJoin checks the invite key of the request when the room is locked, it
+// writes the error response if the user can't join.
+func (app *application) canJoin(w http.ResponseWriter, r *http.Request, room *t.Room, userID int) bool {
+	err := app.svc.CanJoin(context.Background(), room, userID, r.URL.Query().Get("key"))
+	switch {
+	case errors.Is(err, service.ErrRoomLocked), errors.Is(err, service.ErrInvalidInvite):
+		errorsResponse(w, http.StatusForbidden, map[string]any{
+			"locked": true,
+			"reason": err.Error(),
+		})
+		return false
+	case err != nil:
+		serverError(w, err)
+		return false
+	}
+	return true
+}
+
+// redactRoom hides who is in a locked room and what it says to them from
+// the users who aren't part of it.
+func redactRoom(res *t.RoomsResponse, u *t.User) {
+	if !res.Settings.Locked {
+		return
+	}
+	if u != nil {
+		if res.Settings.Host.ID == u.ID || slices.Contains(res.Settings.CoHosts, u.ID) {
+			return
+		}
+		for _, p := range res.Participants {
+			if p.ID == u.ID {
+				return
+			}
+		}
+	}
+
+	room := *res.Room
+	room.Settings.WelcomeMessage = nil
+	room.Settings.CoHosts = nil
+	room.Settings.Speakers = nil
+	res.Room = &room
+	res.Participants = make([]*t.Participant, 0)
+}
@@ -6,16 +6,19 @@ import (
 	"backend/types"
 	"backend/utils"
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
-	"github.com/pion/webrtc/v3"
 )
 
 type application struct {
-	repo *db.Repo
+	repo db.Store
 	svc  *service.Service
 	conf *types.Config
 	ss   *socketServer
@@ -28,6 +31,9 @@ func main() {
 	if err := env.Parse(&conf); err != nil {
 		log.Fatalf("failed to parse config: %v", err)
 	}
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
 
 	pool := db.NewPool(conf.PostgresURL)
 	defer pool.Close()
@@ -47,11 +53,10 @@ func main() {
 		log.Fatalf("failed to get bot: %v", err)
 	}
 
-	settingEngine := webrtc.SettingEngine{}
-	mediaEngine := webrtc.MediaEngine{}
-	mediaEngine.RegisterDefaultCodecs()
-	settingEngine.SetAnsweringDTLSRole(webrtc.DTLSRoleServer)
-	webrtcAPI := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(&mediaEngine))
+	webrtcAPI, err := newWebRTCAPI(&conf)
+	if err != nil {
+		log.Fatalf("failed to create webrtc api: %v", err)
+	}
 
 	app := application{
 		repo: repo,
@@ -65,13 +70,47 @@ func main() {
 		Handler: app.enableCORS(app.router()),
 	}
 
-	app.ss.populateRooms()
-	go app.deleteInactiveRooms(context.Background(), conf.RoomInactivityThreshold)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go app.ss.processAIMsgRequest()
+	// cancelled only after the socket server is drained
+	bgCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	log.Println("server starting at port 6969")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("server destroyed: %v", err)
+	go app.ss.run()
+	go app.ss.runJobs()
+	app.ss.publishMetrics()
+	if err := app.ss.populateRooms(); err != nil {
+		log.Fatalf("failed to populate rooms: %v", err)
 	}
+	go app.deleteInactiveRooms(bgCtx, conf.RoomInactivityThreshold)
+	go app.heartbeat(bgCtx)
+	go app.deleteExpiredMessages(bgCtx)
+	go app.ss.detectActiveSpeakers(bgCtx)
+	go app.ss.pollStats(bgCtx)
+	go app.ss.syncMedia(bgCtx)
+
+	go app.ss.publishEvents()
+	go app.ss.subscribeEvents(bgCtx)
+
+	go app.ss.processAIMsgRequest()
+	app.ss.resumeAIRequests()
+
+	go func() {
+		log.Println("server starting at port 6969")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server destroyed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down, waiting up to %s", conf.ShutdownTimeout)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancelShutdown()
+
+	app.shutdown(shutdownCtx, &server)
+	cancel()
+	log.Println("server stopped")
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lithammer/shortuuid/v4"
+	"nhooyr.io/websocket"
+)
+
+var (
+	errNothingLoaded = &eventError{Code: codeConflict, Message: "nothing is playing"}
+	// errMediaUnchanged is returned by an update which has nothing to save
+	errMediaUnchanged = errors.New("media state is unchanged")
+)
+
+// updateMedia changes the watch party of the room and sends it to the room.
+// It's kept in redis so the participants on every instance see the same
+// playback, update runs again if it was changed meanwhile and returns what
+// it changed. by is who did it, nil when the server did.
+func (s *socketServer) updateMedia(roomID int, by *t.User, update func(m *t.MediaState) (string, error)) error {
+	var (
+		saved     *t.MediaState
+		action    string
+		updateErr error
+	)
+	err := s.repo.UpdateMediaState(context.Background(), roomID, func(m *t.MediaState) (*t.MediaState, error) {
+		if m == nil {
+			m = &t.MediaState{Rate: 1, UpdatedAt: time.Now().UTC()}
+		}
+		action, updateErr = update(m)
+		if updateErr != nil {
+			return nil, updateErr
+		}
+		saved = m
+		return m, nil
+	})
+	if updateErr != nil {
+		if errors.Is(updateErr, errMediaUnchanged) {
+			return nil
+		}
+		return updateErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save media state: %w", err)
+	}
+
+	event := &t.Event{
+		Name: "MEDIA_STATE",
+		Data: map[string]any{
+			"roomID": roomID,
+			"action": action,
+			"by":     by,
+			"media":  mediaSnapshot(saved),
+		},
+	}
+	s.do(func() {
+		s.broadcastRoomEvent(roomID, event)
+	})
+	return nil
+}
+
+// mediaSnapshot settles the state to now, the clients take its position as
+// the one at the time they receive it.
+func mediaSnapshot(m *t.MediaState) *t.MediaState {
+	snapshot := *m
+	snapshot.Settle(time.Now().UTC())
+	return &snapshot
+}
+
+// controlMedia returns the host or co-host who wants to change the watch
+// party of the room.
+func (s *socketServer) controlMedia(conn *websocket.Conn, roomID int) (*t.Participant, error) {
+	p, err := s.member(conn, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.svc.CanModerate(context.Background(), roomID, p.ID); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *socketServer) mediaLoadHandler(conn *websocket.Conn, data *t.MediaLoad) (any, error) {
+	p, err := s.controlMedia(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var item *t.MediaItem
+	if data.URL != "" {
+		item = &t.MediaItem{
+			ID:       shortuuid.New(),
+			URL:      data.URL,
+			Title:    data.Title,
+			Duration: data.Duration,
+			AddedBy:  p.User,
+		}
+	}
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		// the loaded video jumps the queue
+		if item != nil {
+			m.Queue = slices.Insert(m.Queue, 0, item)
+		}
+		if len(m.Queue) == 0 {
+			return "", &eventError{Code: codeConflict, Message: "queue is empty"}
+		}
+		m.Next(time.Now().UTC())
+		return "load", nil
+	})
+}
+
+func (s *socketServer) mediaPlayHandler(conn *websocket.Conn, data *t.MediaPlay) (any, error) {
+	p, err := s.controlMedia(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		if m.Current == nil {
+			return "", errNothingLoaded
+		}
+		m.Settle(time.Now().UTC())
+		if data.Position != nil {
+			m.Position = *data.Position
+		}
+		if data.Rate != nil {
+			m.Rate = *data.Rate
+		}
+		m.Paused = false
+		return "play", nil
+	})
+}
+
+func (s *socketServer) mediaPauseHandler(conn *websocket.Conn, data *t.MediaPause) (any, error) {
+	p, err := s.controlMedia(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		if m.Current == nil {
+			return "", errNothingLoaded
+		}
+		m.Settle(time.Now().UTC())
+		if data.Position != nil {
+			m.Position = *data.Position
+		}
+		m.Paused = true
+		return "pause", nil
+	})
+}
+
+func (s *socketServer) mediaSeekHandler(conn *websocket.Conn, data *t.MediaSeek) (any, error) {
+	p, err := s.controlMedia(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		if m.Current == nil {
+			return "", errNothingLoaded
+		}
+		m.Settle(time.Now().UTC())
+		m.Position = data.Position
+		return "seek", nil
+	})
+}
+
+// mediaQueueHandler queues a video, any participant may suggest one but
+// only the host and co-hosts play it.
+func (s *socketServer) mediaQueueHandler(conn *websocket.Conn, data *t.MediaQueue) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &t.MediaItem{
+		ID:       shortuuid.New(),
+		URL:      data.URL,
+		Title:    data.Title,
+		Duration: data.Duration,
+		AddedBy:  p.User,
+	}
+	err = s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		if len(m.Queue) >= s.cfg.Media.MaxQueue {
+			return "", &eventError{Code: codeConflict, Message: "queue is full"}
+		}
+		m.Queue = append(m.Queue, item)
+		return "queue", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": item.ID}, nil
+}
+
+// mediaDequeueHandler removes a queued video, it's done by the participant
+// who queued it or the host and co-hosts.
+func (s *socketServer) mediaDequeueHandler(conn *websocket.Conn, data *t.MediaDequeue) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	// the store isn't used while the state is updated
+	moderateErr := s.svc.CanModerate(context.Background(), data.RoomID, p.ID)
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		i := slices.IndexFunc(m.Queue, func(item *t.MediaItem) bool {
+			return item.ID == data.ID
+		})
+		if i < 0 {
+			return "", &eventError{Code: codeNotFound, Message: "item isn't queued"}
+		}
+		if m.Queue[i].AddedBy.ID != p.ID && moderateErr != nil {
+			return "", moderateErr
+		}
+		m.Queue = slices.Delete(m.Queue, i, i+1)
+		return "dequeue", nil
+	})
+}
+
+// mediaVoteSkipHandler counts the participant's vote to skip the current
+// video. It's skipped once enough of the room voted, or right away by the
+// host and co-hosts.
+func (s *socketServer) mediaVoteSkipHandler(conn *websocket.Conn, data *t.MediaVoteSkip) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	// the votes are counted against the participants present now, the
+	// store isn't used while the state is updated
+	moderator := s.svc.CanModerate(context.Background(), data.RoomID, p.ID) == nil
+	present := make(map[int]struct{})
+	if !moderator {
+		participants, err := s.getParticipantsInRoom(data.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		// a user might be in the room from several tabs, the ingest
+		// participants don't vote and left users' votes don't count
+		for _, participant := range participants {
+			if !isIngest(participant) {
+				present[participant.ID] = struct{}{}
+			}
+		}
+	}
+
+	return nil, s.updateMedia(data.RoomID, &p.User, func(m *t.MediaState) (string, error) {
+		if m.Current == nil {
+			return "", errNothingLoaded
+		}
+		if !slices.Contains(m.Skips, p.ID) {
+			m.Skips = append(m.Skips, p.ID)
+		}
+
+		skip := moderator
+		if !skip {
+			var votes int
+			for _, userID := range m.Skips {
+				if _, ok := present[userID]; ok {
+					votes++
+				}
+			}
+			skip = float64(votes) >= float64(len(present))*s.cfg.Media.SkipRatio
+		}
+		if !skip {
+			return "voteSkip", nil
+		}
+		m.Next(time.Now().UTC())
+		return "skip", nil
+	})
+}
+
+// syncMedia sends the playing position of the watch parties to the local
+// participants so they correct their drift, and plays the next queued video
+// once the current one ends.
+func (s *socketServer) syncMedia(ctx context.Context) {
+	interval := s.cfg.Media.SyncInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var roomIDs []int
+			s.do(func() {
+				for roomID, room := range s.rooms {
+					if len(room.conns) > 0 {
+						roomIDs = append(roomIDs, roomID)
+					}
+				}
+			})
+			for _, roomID := range roomIDs {
+				s.syncRoomMedia(roomID, interval)
+			}
+		}
+	}
+}
+
+// syncRoomMedia reads the watch party outside of the run loop, the loop is
+// only entered to send the position.
+func (s *socketServer) syncRoomMedia(roomID int, interval time.Duration) {
+	m, err := s.repo.GetMediaState(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get media state: %v", err)
+		return
+	}
+	if m == nil || m.Current == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	if m.Ended(now) {
+		// every instance with participants in the room sees it end, only
+		// one of them plays the next one
+		key := fmt.Sprintf("media-ended:%d:%s", roomID, m.Current.ID)
+		ok, err := s.repo.AcquireLock(context.Background(), key, s.instanceID, 2*interval)
+		if err != nil {
+			log.Printf("failed to acquire media lock: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		itemID := m.Current.ID
+		err = s.updateMedia(roomID, nil, func(m *t.MediaState) (string, error) {
+			// a moderator might have played another one or sought back
+			// meanwhile
+			if m.Current == nil || m.Current.ID != itemID || !m.Ended(now) {
+				return "", errMediaUnchanged
+			}
+			m.Next(now)
+			return "ended", nil
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if m.Paused {
+		return
+	}
+
+	b, err := json.Marshal(&t.Event{
+		Name: "MEDIA_SYNC",
+		Data: map[string]any{
+			"roomID":   roomID,
+			"itemID":   m.Current.ID,
+			"position": m.PositionAt(now),
+			"rate":     m.Rate,
+		},
+	})
+	if err != nil {
+		log.Printf("failed to marshal media sync: %v", err)
+		return
+	}
+	// every instance ticks for its own participants
+	s.do(func() {
+		s.deliverRoomEvent(roomID, "MEDIA_SYNC", b)
+	})
+}
+
+// roomMedia returns the watch party sent to a participant joining the
+// room, nil if there's none.
+func (s *socketServer) roomMedia(roomID int) *t.MediaState {
+	m, err := s.repo.GetMediaState(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get media state: %v", err)
+		return nil
+	}
+	if m == nil || (m.Current == nil && len(m.Queue) == 0) {
+		return nil
+	}
+	return mediaSnapshot(m)
+}
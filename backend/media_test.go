@@ -0,0 +1,72 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestConcurrentMediaQueue queues videos from several participants at once,
+// none of them may be lost and the queue mustn't outgrow its limit.
+func TestConcurrentMediaQueue(t *testing.T) {
+	const (
+		users    = 6
+		videos   = 4
+		maxQueue = 15
+	)
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		conf.Media.MaxQueue = maxQueue
+	})
+	host, _ := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+
+	clients := make([]*testClient, users)
+	for i := range clients {
+		_, session := ta.user(t, fmt.Sprint("user", i))
+		clients[i] = ta.dial(t, session, "")
+		joinRoom(t, clients[i], roomID)
+	}
+
+	// the subtests wouldn't overlap with a single cpu
+	var (
+		wg           sync.WaitGroup
+		queued, full atomic.Int32
+	)
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < videos; j++ {
+				_, evErr := c.reply(t, "MEDIA_QUEUE", map[string]any{
+					"roomID":   roomID,
+					"url":      fmt.Sprintf("https://example.com/%d/%d", i, j),
+					"duration": 60,
+				})
+				switch {
+				case evErr == nil:
+					queued.Add(1)
+				case evErr.Code == codeConflict:
+					full.Add(1)
+				default:
+					t.Errorf("MEDIA_QUEUE failed: %s: %s", evErr.Code, evErr.Message)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	m, err := ta.repo.GetMediaState(context.Background(), roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued.Load() != maxQueue || full.Load() != users*videos-maxQueue {
+		t.Errorf("got %d videos queued and %d refused, want %d and %d", queued.Load(), full.Load(), maxQueue, users*videos-maxQueue)
+	}
+	if len(m.Queue) != int(queued.Load()) {
+		t.Errorf("got %d videos in the queue, want the %d queued", len(m.Queue), queued.Load())
+	}
+}
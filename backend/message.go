@@ -0,0 +1,32 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"fmt"
+)
+
+var (
+	errUnknownMessage = &eventError{Code: codeNotFound, Message: "message doesn't exist"}
+	errNotAuthor      = &eventError{Code: codePermissionDenied, Message: "message was sent by someone else"}
+)
+
+// roomMessage returns the room message an event of the user refers to. A
+// room message has to be sent to the whole room and a whisper has to be
+// between the user and the participant, the user can't see it otherwise.
+func (s *socketServer) roomMessage(roomID int, msgID string, msgType t.MsgType, userID int, participantID *int) (*t.RoomMessageRef, error) {
+	ref, err := s.svc.RoomMessageRef(context.Background(), roomID, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	if ref == nil {
+		return nil, errUnknownMessage
+	}
+	if msgType == t.RoomMsg && ref.ParticipantID != nil {
+		return nil, errUnknownMessage
+	}
+	if msgType == t.PrivateRoomMsg && !ref.IsPartOf(userID, *participantID) {
+		return nil, errUnknownMessage
+	}
+	return ref, nil
+}
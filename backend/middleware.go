@@ -3,8 +3,11 @@ package main
 import (
 	"backend/types"
 	"context"
+	"crypto/subtle"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -84,6 +87,25 @@ func (app *application) isAuthenticated(next http.Handler) http.Handler {
 	})
 }
 
+// isOperator authorizes the operator endpoints by the STATS_OPERATOR_TOKEN
+// bearer token, they don't exist when the token isn't set.
+func (app *application) isOperator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := app.conf.Stats.OperatorToken
+		if token == "" {
+			notFoundError(w, nil)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			unauthRequest(w, errors.New("invalid operator token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
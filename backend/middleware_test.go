@@ -0,0 +1,47 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"net/http"
+	"testing"
+)
+
+func TestOperatorEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "no operator token", header: "Bearer secret", want: http.StatusNotFound},
+		{name: "no authorization", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "not a bearer", token: "secret", header: "secret", want: http.StatusUnauthorized},
+		{name: "operator", token: "secret", header: "Bearer secret", want: http.StatusOK},
+	}
+	for _, path := range []string{"/stats", "/debug/vars"} {
+		for _, tt := range tests {
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+					conf.Stats.OperatorToken = tt.token
+				})
+				req, err := http.NewRequest(http.MethodGet, ta.srv.URL+"/api/v1"+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.header != "" {
+					req.Header.Set("Authorization", tt.header)
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != tt.want {
+					t.Errorf("got status %d, want %d", res.StatusCode, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -2,20 +2,139 @@ package main
 
 import (
 	t "backend/types"
-	"backend/utils"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
-	"nhooyr.io/websocket"
+)
+
+var (
+	errOfferCollision   = errors.New("offer collided with the server's offer")
+	errUnexpectedAnswer = errors.New("answer without an offer in flight")
 )
 
 type Peer struct {
 	roomID int
-	conn   *websocket.Conn
+	conn   *socketConn
+	// sources labels the tracks published by the peer, the client sends
+	// them with its offer
+	sources map[string]t.TrackSource
+	// subscribed are the room tracks forwarded to the peer, by track ID
+	subscribed map[string]*roomTrack
+	senders    map[string]*webrtc.RTPSender
+	// pendingOffer is set when the peer has to renegotiate once the
+	// offer in flight is answered
+	pendingOffer bool
+	// candidates arrived before the remote description
+	candidates []webrtc.ICECandidateInit
+	// iceRestart is set when the next offer restarts ICE
+	iceRestart bool
+	// stats records the stream stats of the peer, prevStats is only used
+	// by the stats poller
+	stats     stats.Getter
+	prevStats *statsSample
 	*webrtc.PeerConnection
 }
 
+// trackSource returns the label of the published track, unlabelled tracks
+// are taken as microphone or camera by their kind.
+func (p *Peer) trackSource(tr *webrtc.TrackRemote) t.TrackSource {
+	source, ok := p.sources[tr.ID()]
+	isAudio := tr.Kind() == webrtc.RTPCodecTypeAudio
+	if ok && (source == t.TrackMicrophone) == isAudio {
+		return source
+	}
+	if isAudio {
+		return t.TrackMicrophone
+	}
+	return t.TrackCamera
+}
+
+// subscribe forwards the room track to the peer. The RTCP sent by the peer
+// for the track is routed back to its publisher.
+func (p *Peer) subscribe(rt *roomTrack) error {
+	sender, err := p.AddTrack(rt.track)
+	if err != nil {
+		return err
+	}
+	p.subscribed[rt.track.ID()] = rt
+	p.senders[rt.track.ID()] = sender
+	go rt.readRTCP(sender)
+	return nil
+}
+
+// unsubscribe stops forwarding the room track to the peer, it reports
+// whether the peer has to renegotiate. The transceiver of the track is
+// reused by the next subscription of the same kind.
+func (p *Peer) unsubscribe(rt *roomTrack) (bool, error) {
+	id := rt.track.ID()
+	sender, ok := p.senders[id]
+	if !ok || p.subscribed[id] != rt {
+		return false, nil
+	}
+	delete(p.subscribed, id)
+	delete(p.senders, id)
+	if p.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return false, nil
+	}
+	if err := p.RemoveTrack(sender); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// requestKeyframes asks the publishers of the subscribed video tracks for a
+// keyframe, so the peer doesn't wait for the next one to start decoding.
+func (p *Peer) requestKeyframes() {
+	for _, rt := range p.subscribed {
+		rt.requestKeyframe()
+	}
+}
+
+// keyframeInterval is the minimum time between the keyframe requests sent to
+// a publisher for a track
+const keyframeInterval = 500 * time.Millisecond
+
+func (rt *roomTrack) requestKeyframe() {
+	if rt.remote.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := rt.lastKeyframeReq.Load()
+	if now-last < int64(keyframeInterval) || !rt.lastKeyframeReq.CompareAndSwap(last, now) {
+		return
+	}
+	err := rt.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(rt.remote.SSRC())},
+	})
+	if err != nil {
+		log.Printf("failed to request keyframe: %v", err)
+	}
+}
+
+// readRTCP reads the RTCP of a subscriber until the sender is stopped. The
+// interceptors answer the NACKs and consume the reports, keyframe requests
+// are passed on to the publisher.
+func (rt *roomTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				rt.requestKeyframe()
+			}
+		}
+	}
+}
+
 func (p *Peer) sendAnswer() error {
 	answer, err := p.CreateAnswer(nil)
 	if err != nil {
@@ -31,7 +150,7 @@ func (p *Peer) sendAnswer() error {
 		return err
 	}
 
-	utils.WriteEvent(p.conn, &t.Event{
+	p.conn.send(&t.Event{
 		Name: "PEER_ANSWER",
 		Data: map[string]any{
 			"answer": string(b),
@@ -41,11 +160,23 @@ func (p *Peer) sendAnswer() error {
 	return nil
 }
 
+// negotiate makes an offer, or queues one if an offer is in flight already.
+// The queued offers are coalesced and made once the answer arrives.
+func (p *Peer) negotiate() error {
+	if p.SignalingState() != webrtc.SignalingStateStable {
+		p.pendingOffer = true
+		return nil
+	}
+	p.pendingOffer = false
+	return p.makeOffer()
+}
+
 func (p *Peer) makeOffer() error {
-	offer, err := p.CreateOffer(nil)
+	offer, err := p.CreateOffer(&webrtc.OfferOptions{ICERestart: p.iceRestart})
 	if err != nil {
 		return err
 	}
+	p.iceRestart = false
 	err = p.SetLocalDescription(offer)
 	if err != nil {
 		return err
@@ -56,7 +187,7 @@ func (p *Peer) makeOffer() error {
 		return err
 	}
 
-	utils.WriteEvent(p.conn, &t.Event{
+	p.conn.send(&t.Event{
 		Name: "PEER_OFFER",
 		Data: map[string]any{
 			"offer":  string(b),
@@ -66,73 +197,90 @@ func (p *Peer) makeOffer() error {
 	return nil
 }
 
-func (p *Peer) addICECandidate(b []byte) {
-	data, err := utils.ParseJSON[t.ICECandiate](b)
-	if err != nil {
-		log.Printf("ice candidate event: failed to parse: %v", err)
-		return
+// setRemoteDescription applies the description and the ICE candidates which
+// arrived before it.
+func (p *Peer) setRemoteDescription(d webrtc.SessionDescription) error {
+	if err := p.SetRemoteDescription(d); err != nil {
+		return err
+	}
+	for _, i := range p.candidates {
+		if err := p.AddICECandidate(i); err != nil {
+			log.Printf("failed to add buffered ice candidate: %v", err)
+		}
 	}
+	p.candidates = nil
+	return nil
+}
 
+func (p *Peer) addICECandidate(data *t.ICECandiate) error {
 	var i webrtc.ICECandidateInit
-	err = json.Unmarshal([]byte(data.Candidate), &i)
+	err := json.Unmarshal([]byte(data.Candidate), &i)
 	if err != nil {
-		log.Printf("ice candidate event: failed to unmarshal ice candidate: %v", err)
-		return
+		return fmt.Errorf("failed to unmarshal ice candidate: %w", err)
+	}
+
+	if p.RemoteDescription() == nil {
+		p.candidates = append(p.candidates, i)
+		return nil
 	}
 
 	err = p.AddICECandidate(i)
 	if err != nil {
-		log.Printf("ice candidate event: failed to add ice candidate: %v", err)
-		return
+		return fmt.Errorf("failed to add ice candidate: %w", err)
 	}
 
 	log.Println("added ice candidate")
+	return nil
 }
 
-func (p *Peer) acceptOffer(b []byte) {
-	data, err := utils.ParseJSON[t.PeerOffer](b)
+// acceptOffer answers an offer of the client. The server is the impolite
+// peer, when the offers collide the client's offer is ignored and the
+// client rolls back to answer the server's offer instead.
+func (p *Peer) acceptOffer(data *t.PeerOffer) error {
+	var d webrtc.SessionDescription
+	err := json.Unmarshal([]byte(data.Offer), &d)
 	if err != nil {
-		log.Printf("peer offer event: failed to parse data: %v", err)
-		return
+		return fmt.Errorf("failed to unmarshal offer: %w", err)
 	}
 
-	var d webrtc.SessionDescription
-	err = json.Unmarshal([]byte(data.Offer), &d)
-	if err != nil {
-		log.Printf("peer offer event: failed to unmarshal offer: %v", err)
-		return
+	if p.SignalingState() != webrtc.SignalingStateStable {
+		return errOfferCollision
 	}
 
-	err = p.SetRemoteDescription(d)
+	err = p.setRemoteDescription(d)
 	if err != nil {
-		log.Printf("peer answer event: failed to set remote desc: %v", err)
-		return
+		return fmt.Errorf("failed to set remote desc: %w", err)
 	}
 
 	err = p.sendAnswer()
 	if err != nil {
-		log.Printf("peer answer event: failed to send answer: %v", err)
-		return
+		return fmt.Errorf("failed to send answer: %w", err)
 	}
-}
 
-func (p *Peer) acceptAnswer(b []byte) {
-	data, err := utils.ParseJSON[t.PeerAnswer](b)
-	if err != nil {
-		log.Printf("peer answer event: failed to parse data: %v", err)
-		return
+	if p.pendingOffer {
+		return p.negotiate()
 	}
+	return nil
+}
 
+func (p *Peer) acceptAnswer(data *t.PeerAnswer) error {
 	var d webrtc.SessionDescription
-	err = json.Unmarshal([]byte(data.Answer), &d)
+	err := json.Unmarshal([]byte(data.Answer), &d)
 	if err != nil {
-		log.Printf("peer answer event: failed to unmarshal answer: %v", err)
-		return
+		return fmt.Errorf("failed to unmarshal answer: %w", err)
+	}
+
+	if p.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return errUnexpectedAnswer
 	}
 
-	err = p.SetRemoteDescription(d)
+	err = p.setRemoteDescription(d)
 	if err != nil {
-		log.Printf("peer answer event: failed to set remote desc: %v", err)
-		return
+		return fmt.Errorf("failed to set remote desc: %w", err)
+	}
+
+	if p.pendingOffer {
+		return p.negotiate()
 	}
+	return nil
 }
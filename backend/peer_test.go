@@ -0,0 +1,409 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// rtcClient is a participant with a pion peer connection which answers the
+// offers of the server, like the web client.
+type rtcClient struct {
+	*testClient
+	sid string
+	pc  *webrtc.PeerConnection
+	// next is the index of the first event not handled yet
+	next int
+}
+
+func (ta *testApp) rtcClient(tb testing.TB, session string, roomID int) *rtcClient {
+	tb.Helper()
+	c := &rtcClient{testClient: ta.dial(tb, session, "")}
+	var s struct {
+		SID string `json:"sid"`
+	}
+	if err := json.Unmarshal(c.waitEvent(tb, "SESSION").Data, &s); err != nil {
+		tb.Fatal(err)
+	}
+	c.sid = s.SID
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatalf("failed to create peer connection: %v", err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	c.pc = pc
+
+	joinRoom(tb, c.testClient, roomID)
+	return c
+}
+
+// serverPeer returns the session key and the peer of the client on the
+// server, it's called outside of the run loop.
+func (ta *testApp) serverPeer(sid string) (*websocket.Conn, *Peer) {
+	var (
+		key *websocket.Conn
+		p   *Peer
+	)
+	ta.ss.do(func() {
+		for conn, c := range ta.ss.conns {
+			if c.pID == sid {
+				key, p = conn, c.peer
+			}
+		}
+	})
+	return key, p
+}
+
+// settle answers the offers of the server until both ends are stable.
+func (c *rtcClient) settle(tb testing.TB, ta *testApp) {
+	tb.Helper()
+	_, p := ta.serverPeer(c.sid)
+	if p == nil {
+		tb.Fatal("client has no peer")
+	}
+	eventually(tb, "the negotiation to settle", func() bool {
+		c.mu.Lock()
+		events := c.events[c.next:]
+		c.next = len(c.events)
+		c.mu.Unlock()
+
+		for _, e := range events {
+			if e.Name == "PEER_OFFER" {
+				c.answer(tb, e)
+			}
+		}
+
+		var stable bool
+		ta.ss.do(func() {
+			stable = p.SignalingState() == webrtc.SignalingStateStable && !p.pendingOffer
+		})
+		return stable && c.pc.SignalingState() == webrtc.SignalingStateStable
+	})
+}
+
+func (c *rtcClient) answer(tb testing.TB, e *testEvent) {
+	tb.Helper()
+	var data struct {
+		Offer  string `json:"offer"`
+		RoomID int    `json:"roomID"`
+	}
+	var offer webrtc.SessionDescription
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(data.Offer), &offer); err != nil {
+		tb.Fatal(err)
+	}
+	if err := c.pc.SetRemoteDescription(offer); err != nil {
+		tb.Fatalf("failed to set offer: %v", err)
+	}
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		tb.Fatalf("failed to create answer: %v", err)
+	}
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		tb.Fatalf("failed to set answer: %v", err)
+	}
+	b, err := json.Marshal(answer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c.call(tb, "PEER_ANSWER", map[string]any{"roomID": data.RoomID, "answer": string(b)})
+}
+
+// publish adds a microphone and a camera track of the publisher to the
+// room, as if they were received from its peer.
+func (ta *testApp) publish(tb testing.TB, roomID int, sid string) []*webrtc.TrackLocalStaticRTP {
+	tb.Helper()
+	key, p := ta.serverPeer(sid)
+	if p == nil {
+		tb.Fatal("publisher has no peer")
+	}
+
+	var tracks []*webrtc.TrackLocalStaticRTP
+	for _, codec := range []struct {
+		mimeType string
+		source   types.TrackSource
+	}{
+		{webrtc.MimeTypeOpus, types.TrackMicrophone},
+		{webrtc.MimeTypeVP8, types.TrackCamera},
+	} {
+		track, err := webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{MimeType: codec.mimeType},
+			fmt.Sprintf("%s-%s", sid, codec.source), sid,
+		)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tracks = append(tracks, track)
+		ta.ss.do(func() {
+			ta.ss.publishTrack(roomID, key, &roomTrack{
+				pID:    sid,
+				source: codec.source,
+				track:  track,
+				// nothing is received, the kind of the remote is
+				// unknown so no keyframes are asked for
+				remote:    &webrtc.TrackRemote{},
+				publisher: p,
+			}, false)
+		})
+	}
+	return tracks
+}
+
+func (ta *testApp) transceivers(sid string) int {
+	_, p := ta.serverPeer(sid)
+	var n int
+	ta.ss.do(func() {
+		n = len(p.GetTransceivers())
+	})
+	return n
+}
+
+// TestTransceiversAreReused checks that the subscriber's peer doesn't grow
+// a transceiver for every track it was ever sent.
+func TestTransceiversAreReused(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		conf.Socket.ResumeGrace = 0
+	})
+	host, _ := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	_, session := ta.user(t, "subscriber")
+	sub := ta.rtcClient(t, session, roomID)
+	sub.settle(t, ta)
+
+	const cycles = 5
+	baseline := -1
+	check := func(t *testing.T, i int) {
+		t.Helper()
+		n := ta.transceivers(sub.sid)
+		if baseline < 0 {
+			baseline = n
+			return
+		}
+		if n != baseline {
+			t.Fatalf("cycle %d: got %d transceivers, want %d", i, n, baseline)
+		}
+	}
+
+	t.Run("unpublish", func(t *testing.T) {
+		_, s := ta.user(t, "publisher")
+		pub := ta.rtcClient(t, s, roomID)
+		for i := 0; i < cycles; i++ {
+			tracks := ta.publish(t, roomID, pub.sid)
+			sub.settle(t, ta)
+			ta.ss.do(func() {
+				ta.ss.removeTracks(roomID, tracks...)
+			})
+			sub.settle(t, ta)
+			check(t, i)
+		}
+	})
+
+	t.Run("join and leave", func(t *testing.T) {
+		for i := 0; i < cycles; i++ {
+			_, s := ta.user(t, fmt.Sprint("visitor", i))
+			pub := ta.rtcClient(t, s, roomID)
+			ta.publish(t, roomID, pub.sid)
+			sub.settle(t, ta)
+
+			// leaving closes the peer of the publisher, which removes its
+			// tracks
+			pub.ws.Close(websocket.StatusNormalClosure, "")
+			eventually(t, "the publisher to leave", func() bool {
+				key, _ := ta.serverPeer(pub.sid)
+				return key == nil
+			})
+			sub.settle(t, ta)
+			check(t, i)
+		}
+	})
+
+	var tracks int
+	ta.ss.do(func() {
+		tracks = len(ta.ss.rooms[roomID].tracks)
+	})
+	if tracks != 0 {
+		t.Errorf("got %d tracks left in the room", tracks)
+	}
+}
+
+// TestPeerStreamsLabelsTracks checks that the subscribers are told the kind
+// and the source of every published track.
+func TestPeerStreamsLabelsTracks(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	sub := ta.rtcClient(t, hostSession, roomID)
+	_, s := ta.user(t, "publisher")
+	pub := ta.rtcClient(t, s, roomID)
+
+	tracks := ta.publish(t, roomID, pub.sid)
+	type peerStreams struct {
+		Streams map[string]string `json:"streams"`
+		Tracks  []struct {
+			ParticipantID string            `json:"participantID"`
+			TrackID       string            `json:"trackID"`
+			Kind          string            `json:"kind"`
+			Source        types.TrackSource `json:"source"`
+		} `json:"tracks"`
+	}
+	var data peerStreams
+	sub.waitFor(t, "the camera stream", func(e *testEvent) bool {
+		var d peerStreams
+		if e.Name != "PEER_STREAMS" || json.Unmarshal(e.Data, &d) != nil {
+			return false
+		}
+		data = d
+		return len(d.Tracks) == 1 && d.Tracks[0].Source == types.TrackCamera
+	})
+
+	want := tracks[1]
+	got := data.Tracks[0]
+	if got.ParticipantID != pub.sid || got.TrackID != want.ID() || got.Kind != "video" {
+		t.Errorf("got track %+v, want the video of %s", got, pub.sid)
+	}
+	// only the microphone is listed in streams
+	if len(data.Streams) != 0 {
+		t.Errorf("got streams %v for the camera, want none", data.Streams)
+	}
+}
+
+// offer creates an offer of the client without applying it.
+func (c *rtcClient) offer(tb testing.TB) string {
+	tb.Helper()
+	if _, err := c.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		tb.Fatal(err)
+	}
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := json.Marshal(offer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNegotiation(t *testing.T) {
+	newRoom := func(t *testing.T) (*testApp, int, *rtcClient) {
+		ta := newTestApp(t, db.NewMemoryStore(), nil)
+		host, hostSession := ta.user(t, "host")
+		roomID := ta.room(t, host, nil)
+		// the server offers as soon as the client joins
+		return ta, roomID, ta.rtcClient(t, hostSession, roomID)
+	}
+
+	t.Run("offers are coalesced", func(t *testing.T) {
+		ta, roomID, sub := newRoom(t)
+		for i := 0; i < 2; i++ {
+			_, s := ta.user(t, fmt.Sprint("publisher", i))
+			pub := ta.rtcClient(t, s, roomID)
+			ta.publish(t, roomID, pub.sid)
+		}
+		// the reply comes after the offers sent before
+		sub.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		if n := sub.count("PEER_OFFER"); n != 1 {
+			t.Fatalf("got %d offers before the first answer, want 1", n)
+		}
+
+		// the tracks published meanwhile are offered at once when the
+		// first offer is answered
+		sub.settle(t, ta)
+		if n := sub.count("PEER_OFFER"); n != 2 {
+			t.Errorf("got %d offers to settle, want 2", n)
+		}
+		_, p := ta.serverPeer(sub.sid)
+		ta.ss.do(func() {
+			if len(p.subscribed) != 4 {
+				t.Errorf("got %d subscribed tracks, want 4", len(p.subscribed))
+			}
+		})
+	})
+
+	t.Run("client offer collides", func(t *testing.T) {
+		ta, roomID, sub := newRoom(t)
+		e := sub.callErr(t, "PEER_OFFER", map[string]any{"roomID": roomID, "offer": sub.offer(t)})
+		if e.Code != codeConflict {
+			t.Fatalf("got error %s: %s, want %s", e.Code, e.Message, codeConflict)
+		}
+
+		// the client answers the server's offer and offers again
+		sub.settle(t, ta)
+		offer, err := sub.pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.pc.SetLocalDescription(offer); err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.call(t, "PEER_OFFER", map[string]any{"roomID": roomID, "offer": string(b)})
+		var data struct {
+			Answer string `json:"answer"`
+		}
+		if err := json.Unmarshal(sub.waitEvent(t, "PEER_ANSWER").Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal([]byte(data.Answer), &answer); err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.pc.SetRemoteDescription(answer); err != nil {
+			t.Fatalf("failed to set answer: %v", err)
+		}
+	})
+
+	t.Run("answer without an offer", func(t *testing.T) {
+		ta, roomID, sub := newRoom(t)
+		sub.settle(t, ta)
+		answer := sub.pc.LocalDescription()
+		b, err := json.Marshal(answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := sub.callErr(t, "PEER_ANSWER", map[string]any{"roomID": roomID, "answer": string(b)})
+		if e.Code != codeConflict {
+			t.Fatalf("got error %s: %s, want %s", e.Code, e.Message, codeConflict)
+		}
+	})
+
+	t.Run("early candidates are buffered", func(t *testing.T) {
+		ta, roomID, sub := newRoom(t)
+		candidate, err := json.Marshal(webrtc.ICECandidateInit{
+			Candidate:     "candidate:1 1 udp 2130706431 127.0.0.1 50000 typ host",
+			SDPMid:        new(string),
+			SDPMLineIndex: new(uint16),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.call(t, "PEER_ICE_CANDIDATE", map[string]any{"roomID": roomID, "candidate": string(candidate)})
+
+		_, p := ta.serverPeer(sub.sid)
+		candidates := func() int {
+			var n int
+			ta.ss.do(func() {
+				n = len(p.candidates)
+			})
+			return n
+		}
+		if n := candidates(); n != 1 {
+			t.Fatalf("got %d buffered candidates, want 1", n)
+		}
+		sub.settle(t, ta)
+		if n := candidates(); n != 0 {
+			t.Errorf("got %d candidates left once the answer was set", n)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"log"
+
+	"nhooyr.io/websocket"
+)
+
+// getPresence collapses the user's sessions across every instance.
+func (s *socketServer) getPresence(userID int) t.Presence {
+	sessions, err := s.repo.GetUserSessions(context.Background(), userID)
+	if err != nil {
+		log.Printf("failed to get user sessions: %v", err)
+		return t.Presence{Status: t.PresenceOffline}
+	}
+	return t.PresenceOf(sessions)
+}
+
+// changePresence runs change, which updates the sessions of the user, and
+// tells the user's followers if the presence changed because of it. It
+// calls redis and postgres, so the run loop queues it with async.
+func (s *socketServer) changePresence(user t.User, change func()) {
+	before := s.getPresence(user.ID)
+	change()
+	after := s.getPresence(user.ID)
+	if before == after {
+		return
+	}
+
+	// friends follow the user too
+	followers, err := s.repo.GetRelations(context.Background(), user.ID, t.RelationFollowers)
+	if err != nil {
+		log.Printf("failed to get followers: %v", err)
+		return
+	}
+	if len(followers) == 0 {
+		return
+	}
+	// the followers outside of a locked room aren't told the user is in it
+	var userIDs, outsiders []int
+	members := s.lockedRoomMembers(after.RoomID)
+	for _, f := range followers {
+		if _, ok := members[f.ID]; members != nil && !ok {
+			outsiders = append(outsiders, f.ID)
+		} else {
+			userIDs = append(userIDs, f.ID)
+		}
+	}
+
+	s.do(func() {
+		for _, group := range []struct {
+			userIDs  []int
+			presence t.Presence
+		}{
+			{userIDs, after},
+			{outsiders, t.Presence{Status: after.Status}},
+		} {
+			if len(group.userIDs) == 0 {
+				continue
+			}
+			s.broadcastMsgEvent(group.userIDs, &t.Event{
+				Name: "PRESENCE_UPDATE",
+				Data: map[string]any{
+					"user":     user,
+					"presence": group.presence,
+				},
+			})
+		}
+	})
+}
+
+// lockedRoomMembers returns the users who may know who is in the room if
+// it's locked, its host, co-hosts and participants. It's nil if the room
+// isn't locked, and empty if that can't be told. It's called outside of the
+// run loop.
+func (s *socketServer) lockedRoomMembers(roomID int) map[int]struct{} {
+	if roomID == 0 {
+		return nil
+	}
+	members := make(map[int]struct{})
+	settings, err := s.repo.GetRoomSettings(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get room settings: %v", err)
+		return members
+	}
+	if !settings.Locked {
+		return nil
+	}
+	participants, err := s.getParticipantsInRoom(roomID)
+	if err != nil {
+		log.Printf("failed to get room participants: %v", err)
+		return members
+	}
+
+	members[settings.Host.ID] = struct{}{}
+	for _, userID := range settings.CoHosts {
+		members[userID] = struct{}{}
+	}
+	for _, p := range participants {
+		members[p.ID] = struct{}{}
+	}
+	return members
+}
+
+// saveSession queues the change of the participant's session, p is copied
+// so the job doesn't read the participant while the run loop changes it.
+// It must be called from the run loop.
+func (s *socketServer) saveSession(p *t.Participant) <-chan struct{} {
+	session := *p
+	return s.async(func() {
+		s.changePresence(session.User, func() {
+			if err := s.repo.AddUserSession(context.Background(), s.instanceID, &session); err != nil {
+				log.Printf("failed to update user session: %v", err)
+			}
+		})
+	})
+}
+
+func (s *socketServer) setPresenceHandler(conn *websocket.Conn, data *t.SetPresence) (any, error) {
+	s.do(func() {
+		c, ok := s.conns[conn]
+		if !ok {
+			return
+		}
+		p := s.participants[c.pID]
+		if p.Idle == data.Idle {
+			return
+		}
+		p.Idle = data.Idle
+		s.saveSession(p)
+	})
+	return nil, nil
+}
+
+// getPresences returns the presence of every given user as the viewer sees
+// it, the viewer isn't told who is in a locked room it's not part of.
+func (app *application) getPresences(viewerID int, userIDs []int) (map[int]t.Presence, error) {
+	sessions, err := app.repo.GetUsersSessions(context.Background(), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	presences := make(map[int]t.Presence, len(userIDs))
+	// hidden caches whether the room is hidden from the viewer
+	hidden := make(map[int]bool)
+	for _, userID := range userIDs {
+		p := t.PresenceOf(sessions[userID])
+		if p.RoomID != 0 {
+			h, ok := hidden[p.RoomID]
+			if !ok {
+				members := app.ss.lockedRoomMembers(p.RoomID)
+				_, member := members[viewerID]
+				h = members != nil && !member
+				hidden[p.RoomID] = h
+			}
+			if h {
+				p.RoomID = 0
+			}
+		}
+		presences[userID] = p
+	}
+	return presences, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// TestPresenceHidesLockedRoom checks that the followers of a user in a
+// locked room aren't told which room it is, unless they are part of it.
+func TestPresenceHidesLockedRoom(t *testing.T) {
+	for _, locked := range []bool{false, true} {
+		t.Run(fmt.Sprint("locked ", locked), func(t *testing.T) {
+			ctx := context.Background()
+			ta := newTestApp(t, db.NewMemoryStore(), nil)
+			host, hostSession := ta.user(t, "host")
+			coHost, coHostSession := ta.user(t, "cohost")
+			fan, fanSession := ta.user(t, "fan")
+			roomID := ta.room(t, host, func(r *types.Room) {
+				r.Settings.Locked = locked
+			})
+			settings, err := ta.repo.GetRoomSettings(ctx, roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings.CoHosts = []int{coHost.ID}
+			if err := ta.repo.UpdateRoomSettings(ctx, settings); err != nil {
+				t.Fatal(err)
+			}
+			for _, follower := range []int{coHost.ID, fan.ID} {
+				if err := ta.repo.Follow(ctx, follower, host.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			followers := map[string]struct {
+				session string
+				client  *testClient
+				// wantRoomID is the room the follower is told the host
+				// is in
+				wantRoomID int
+			}{
+				"co-host": {session: coHostSession, wantRoomID: roomID},
+				"fan":     {session: fanSession, wantRoomID: roomID},
+			}
+			if locked {
+				f := followers["fan"]
+				f.wantRoomID = 0
+				followers["fan"] = f
+			}
+			for name, f := range followers {
+				f.client = ta.dial(t, f.session, "")
+				f.client.waitEvent(t, "SESSION")
+				followers[name] = f
+			}
+
+			// the presence of the host is sent by the time it has joined
+			joinRoom(t, ta.dial(t, hostSession, ""), roomID)
+
+			for name, f := range followers {
+				// the reply comes after the updates sent before
+				f.client.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+				var got int
+				f.client.mu.Lock()
+				for _, e := range f.client.events {
+					if e.Name != "PRESENCE_UPDATE" {
+						continue
+					}
+					var data struct {
+						Presence types.Presence `json:"presence"`
+					}
+					if err := json.Unmarshal(e.Data, &data); err != nil {
+						t.Fatal(err)
+					}
+					got = data.Presence.RoomID
+				}
+				f.client.mu.Unlock()
+				if got != f.wantRoomID {
+					t.Errorf("%s: got room %d in the update, want %d", name, got, f.wantRoomID)
+				}
+
+				var res struct {
+					Users []struct {
+						ID       int            `json:"id"`
+						Presence types.Presence `json:"presence"`
+					} `json:"users"`
+				}
+				body := ta.get(t, "/relations?relation=following", f.session).Body
+				if err := json.NewDecoder(body).Decode(&res); err != nil {
+					t.Fatal(err)
+				}
+				if len(res.Users) != 1 || res.Users[0].Presence.RoomID != f.wantRoomID {
+					t.Errorf("%s: got relations %+v, want the host in room %d", name, res.Users, f.wantRoomID)
+				}
+			}
+		})
+	}
+}
+
+// presenceUpdates returns the statuses sent to c in PRESENCE_UPDATE.
+func presenceUpdates(tb testing.TB, c *testClient) []types.PresenceStatus {
+	tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var statuses []types.PresenceStatus
+	for _, e := range c.events {
+		if e.Name != "PRESENCE_UPDATE" {
+			continue
+		}
+		var data struct {
+			Presence types.Presence `json:"presence"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			tb.Fatal(err)
+		}
+		statuses = append(statuses, data.Presence.Status)
+	}
+	return statuses
+}
+
+// TestPresenceUpdates checks that the followers are told when the tabs of
+// a user, taken together, change its presence, and only then.
+func TestPresenceUpdates(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		// the sessions end as soon as their websocket is gone
+		conf.Socket.ResumeGrace = 0
+	})
+	alice, aliceSession := ta.user(t, "alice")
+	fan, fanSession := ta.user(t, "fan")
+	_, strangerSession := ta.user(t, "stranger")
+	if err := ta.repo.Follow(ctx, fan.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	fanC := ta.dial(t, fanSession, "")
+	strangerC := ta.dial(t, strangerSession, "")
+	fanC.waitEvent(t, "SESSION")
+	strangerC.waitEvent(t, "SESSION")
+
+	var (
+		first, second *testClient
+		want          []types.PresenceStatus
+	)
+	steps := []struct {
+		name string
+		run  func(t *testing.T)
+		// want is the update sent to the fan, if any
+		want types.PresenceStatus
+	}{
+		{name: "first tab", run: func(t *testing.T) {
+			first = ta.dial(t, aliceSession, "")
+			first.waitEvent(t, "SESSION")
+		}, want: types.PresenceOnline},
+		{name: "second tab", run: func(t *testing.T) {
+			second = ta.dial(t, aliceSession, "")
+			second.waitEvent(t, "SESSION")
+		}},
+		{name: "first tab idle", run: func(t *testing.T) {
+			first.call(t, "SET_PRESENCE", map[string]any{"idle": true})
+		}},
+		{name: "second tab idle", run: func(t *testing.T) {
+			second.call(t, "SET_PRESENCE", map[string]any{"idle": true})
+		}, want: types.PresenceIdle},
+		{name: "first tab active", run: func(t *testing.T) {
+			first.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		}, want: types.PresenceOnline},
+		{name: "first tab closed", run: func(t *testing.T) {
+			first.ws.CloseNow()
+		}, want: types.PresenceIdle},
+		{name: "second tab closed", run: func(t *testing.T) {
+			second.ws.CloseNow()
+		}, want: types.PresenceOffline},
+	}
+	for _, step := range steps {
+		step.run(t)
+		if step.want != "" {
+			want = append(want, step.want)
+			eventually(t, "the fan to be told "+step.name, func() bool {
+				return len(presenceUpdates(t, fanC)) >= len(want)
+			})
+		}
+		// the reply comes after the updates queued before
+		fanC.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		if got := presenceUpdates(t, fanC); !slices.Equal(got, want) {
+			t.Fatalf("%s: got updates %v, want %v", step.name, got, want)
+		}
+	}
+
+	if strangerC.has("PRESENCE_UPDATE") {
+		t.Error("the user who isn't a follower was told the presence")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/time/rate"
+	"nhooyr.io/websocket"
+)
+
+// socketUser holds the local sessions of a user.
+type socketUser struct {
+	sids []string
+}
+
+func newSocketUser() *socketUser {
+	return &socketUser{}
+}
+
+// userLimiters holds the token buckets of a user, shared by all the user's
+// tabs. They are kept apart from the sessions so reconnecting doesn't refill
+// them.
+type userLimiters struct {
+	events   map[string]*rate.Limiter
+	lastUsed time.Time
+}
+
+// rateLimits returns the limits of the events which fan out to a room or
+// are expensive to handle.
+func rateLimits(cfg *t.Config) map[string]t.RateLimit {
+	l := cfg.RateLimits
+	return map[string]t.RateLimit{
+		"NEW_MESSAGE":         l.NewMessage,
+		"REACTION_TO_MESSAGE": l.ReactionToMessage,
+		"SET_STATUS":          l.SetStatus,
+		"PEER_OFFER":          l.PeerOffer,
+		"SET_PRESENCE":        l.SetPresence,
+		"RAISE_HAND":          l.RaiseHand,
+		"MEDIA_QUEUE":         l.MediaQueue,
+		"MEDIA_VOTE_SKIP":     l.MediaVoteSkip,
+	}
+}
+
+// limiterTTL is how long the buckets of an idle user are kept. A bucket
+// left alone for its longest period is full again, so dropping it after that
+// changes nothing.
+func limiterTTL(limits map[string]t.RateLimit) time.Duration {
+	var ttl time.Duration
+	for _, l := range limits {
+		ttl = max(ttl, l.Per)
+	}
+	return ttl
+}
+
+// allow takes a token for the event from the user's bucket. If there's none
+// left it returns how long to wait for the next one.
+func (s *socketServer) allow(userID int, event string) (time.Duration, bool) {
+	limit, ok := s.limits[event]
+	if !ok {
+		return 0, true
+	}
+
+	now := time.Now()
+	s.sweepLimiters(now)
+	u, ok := s.limiters[userID]
+	if !ok {
+		u = &userLimiters{events: make(map[string]*rate.Limiter)}
+		s.limiters[userID] = u
+	}
+	u.lastUsed = now
+
+	l, ok := u.events[event]
+	if !ok {
+		l = rate.NewLimiter(rate.Every(limit.Per/time.Duration(limit.Events)), limit.Events)
+		u.events[event] = l
+	}
+
+	r := l.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return d, false
+	}
+	return 0, true
+}
+
+// sweepLimiters drops the buckets of the users idle for longer than their
+// TTL, at most once per TTL.
+func (s *socketServer) sweepLimiters(now time.Time) {
+	if now.Sub(s.limitersSwept) < s.limiterTTL {
+		return
+	}
+	s.limitersSwept = now
+	for userID, u := range s.limiters {
+		if now.Sub(u.lastUsed) >= s.limiterTTL {
+			delete(s.limiters, userID)
+		}
+	}
+}
+
+// rateLimited tells the client to slow down and counts the violation. Users
+// with too many violations are disconnected. It's called outside of the run
+// loop.
+func (s *socketServer) rateLimited(c *socketConn, userID int, event *t.Event, retryAfter time.Duration) {
+	c.send(&t.Event{
+		Name: "RATE_LIMITED",
+		Data: map[string]any{
+			"id":         event.ID,
+			"event":      event.Name,
+			"retryAfter": retryAfter.Milliseconds(),
+		},
+	})
+
+	cfg := s.cfg.RateLimits
+	n, err := s.repo.AddRateLimitViolation(context.Background(), userID, cfg.ViolationWindow)
+	if err != nil {
+		log.Printf("failed to add rate limit violation: %v", err)
+		return
+	}
+	if n < cfg.MaxViolations {
+		return
+	}
+
+	log.Printf("disconnecting user %d, exceeded rate limits %d times", userID, n)
+	s.do(func() {
+		u, ok := s.users[userID]
+		if !ok {
+			return
+		}
+		for _, conn := range s.conns {
+			for _, sid := range u.sids {
+				if conn.pID == sid {
+					conn.close(websocket.StatusPolicyViolation, "rate limit exceeded")
+				}
+			}
+		}
+	})
+}
+
+// isRateLimited reports whether the user exceeded the limits too often
+// recently and shouldn't be let in.
+func (s *socketServer) isRateLimited(userID int) bool {
+	n, err := s.repo.GetRateLimitViolations(context.Background(), userID)
+	if err != nil {
+		log.Printf("failed to get rate limit violations: %v", err)
+		return false
+	}
+	return n >= s.cfg.RateLimits.MaxViolations
+}
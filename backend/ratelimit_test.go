@@ -0,0 +1,128 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// setPresence sends SET_PRESENCE and reports whether it was rate limited.
+func setPresence(tb testing.TB, c *testClient) bool {
+	tb.Helper()
+	id := c.send(tb, "SET_PRESENCE", map[string]any{"idle": false})
+	e := c.waitFor(tb, "SET_PRESENCE reply", func(e *testEvent) bool {
+		if e.Name != "ACK" && e.Name != "ERROR" && e.Name != "RATE_LIMITED" {
+			return false
+		}
+		var data struct {
+			ID string `json:"id"`
+		}
+		return json.Unmarshal(e.Data, &data) == nil && data.ID == id
+	})
+	return e.Name == "RATE_LIMITED"
+}
+
+func TestRateLimit(t *testing.T) {
+	const burst = 3
+	newApp := func(t *testing.T) *testApp {
+		return newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+			conf.RateLimits.SetPresence = types.RateLimit{Events: burst, Per: time.Hour}
+			// the participants leave as soon as their websocket is gone
+			conf.Socket.ResumeGrace = 0
+		})
+	}
+
+	t.Run("bucket runs out", func(t *testing.T) {
+		ta := newApp(t)
+		_, session := ta.user(t, "alice")
+		c := ta.dial(t, session, "")
+		for i := 0; i < burst; i++ {
+			if setPresence(t, c) {
+				t.Fatalf("event %d was rate limited, want %d allowed", i+1, burst)
+			}
+		}
+		if !setPresence(t, c) {
+			t.Fatal("event wasn't rate limited once the bucket was empty")
+		}
+		e := c.waitEvent(t, "RATE_LIMITED")
+		var data struct {
+			Event      string `json:"event"`
+			RetryAfter int64  `json:"retryAfter"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Event != "SET_PRESENCE" || data.RetryAfter <= 0 {
+			t.Errorf("got %+v, want the event and when to retry", data)
+		}
+	})
+
+	t.Run("tabs share the bucket", func(t *testing.T) {
+		ta := newApp(t)
+		_, session := ta.user(t, "alice")
+		first, second := ta.dial(t, session, ""), ta.dial(t, session, "")
+		for i := 0; i < burst; i++ {
+			setPresence(t, first)
+		}
+		if !setPresence(t, second) {
+			t.Error("the other tab got a full bucket")
+		}
+	})
+
+	t.Run("reconnecting doesn't refill the bucket", func(t *testing.T) {
+		ta := newApp(t)
+		alice, session := ta.user(t, "alice")
+		c := ta.dial(t, session, "")
+		for i := 0; i < burst; i++ {
+			setPresence(t, c)
+		}
+		c.ws.CloseNow()
+		eventually(t, "the session to be removed", func() bool {
+			var ok bool
+			ta.ss.do(func() {
+				_, ok = ta.ss.users[alice.ID]
+			})
+			return !ok
+		})
+
+		if !setPresence(t, ta.dial(t, session, "")) {
+			t.Error("the new session got a full bucket")
+		}
+	})
+}
+
+func TestSweepLimiters(t *testing.T) {
+	now := time.Now()
+	s := &socketServer{
+		limiters: map[int]*userLimiters{
+			1: {events: map[string]*rate.Limiter{}, lastUsed: now.Add(-2 * time.Minute)},
+			2: {events: map[string]*rate.Limiter{}, lastUsed: now.Add(-30 * time.Second)},
+		},
+		limiterTTL: limiterTTL(map[string]types.RateLimit{
+			"SET_STATUS":  {Events: 5, Per: time.Minute},
+			"NEW_MESSAGE": {Events: 10, Per: 10 * time.Second},
+		}),
+	}
+	if s.limiterTTL != time.Minute {
+		t.Fatalf("got ttl %v, want the longest period", s.limiterTTL)
+	}
+
+	s.sweepLimiters(now)
+	if _, ok := s.limiters[1]; ok {
+		t.Error("the idle user's buckets were kept")
+	}
+	if _, ok := s.limiters[2]; !ok {
+		t.Error("the active user's buckets were dropped")
+	}
+
+	// it doesn't sweep again within the ttl
+	s.limiters[2].lastUsed = now.Add(-time.Hour)
+	s.sweepLimiters(now.Add(time.Second))
+	if _, ok := s.limiters[2]; !ok {
+		t.Error("swept twice within the ttl")
+	}
+}
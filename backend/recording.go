@@ -0,0 +1,447 @@
+package main
+
+import (
+	"backend/service"
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"nhooyr.io/websocket"
+)
+
+const manifestFile = "manifest.json"
+
+// trackRecorder writes the packets of a track to an Ogg file. The file is
+// opened and closed by the jobs queued with async, so the run loop doesn't
+// wait for the disk, the packets arriving before it's open are dropped.
+// write is called from the forwarding loop of the track.
+type trackRecorder struct {
+	mu     sync.Mutex
+	w      *oggwriter.OggWriter
+	closed bool
+}
+
+func (r *trackRecorder) open(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	w, err := oggwriter.New(path, 48000, 2)
+	if err != nil {
+		log.Printf("failed to create recorded track: %v", err)
+		r.closed = true
+		return
+	}
+	r.w = w
+}
+
+func (r *trackRecorder) write(pkt *rtp.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.w == nil {
+		return
+	}
+	if err := r.w.WriteRTP(pkt); err != nil {
+		log.Printf("failed to write recorded packet: %v", err)
+	}
+}
+
+func (r *trackRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.w == nil {
+		return
+	}
+	if err := r.w.Close(); err != nil {
+		log.Printf("failed to close recorded track: %v", err)
+	}
+}
+
+// roomRecording records the audio tracks of a room, each track to its own
+// file. Only the tracks published to this instance are recorded.
+type roomRecording struct {
+	t.Recording
+	dir       string
+	tracks    map[*roomTrack]*t.RecordedTrack
+	recorders map[*roomTrack]*trackRecorder
+	// speaking holds the open speaker segments by participant
+	speaking map[string]*t.SpeakerSegment
+}
+
+func (r *roomRecording) offset() int64 {
+	return time.Since(r.StartedAt).Milliseconds()
+}
+
+// setSpeaking opens or closes the speaker segment of the participant, p is
+// only used to open it.
+func (r *roomRecording) setSpeaking(pID string, p *t.Participant, speaking bool) {
+	seg, ok := r.speaking[pID]
+	if speaking == ok {
+		return
+	}
+	if !speaking {
+		to := r.offset()
+		seg.To = &to
+		delete(r.speaking, pID)
+		return
+	}
+	seg = &t.SpeakerSegment{
+		ParticipantID: pID,
+		From:          r.offset(),
+	}
+	if p != nil {
+		u := p.User
+		seg.User = &u
+	}
+	r.Speakers = append(r.Speakers, seg)
+	r.speaking[pID] = seg
+}
+
+// updateSpeakers opens the segments of the participants speaking, by the
+// levels of their microphones, and closes the ones of the others. It's
+// called along with the active speakers, so nothing is recorded as spoken
+// when they are disabled.
+func (r *roomRecording) updateSpeakers(levels map[string]float64, participants map[string]*t.Participant) {
+	for pID := range r.speaking {
+		if _, ok := levels[pID]; !ok {
+			r.setSpeaking(pID, nil, false)
+		}
+	}
+	for pID := range levels {
+		r.setSpeaking(pID, participants[pID], true)
+	}
+}
+
+// writeManifest queues the write of the recording's manifest, it's written
+// when the recording starts so unfinished recordings are listed too. The
+// manifest is marshalled on the run loop, so the job doesn't read the
+// recording while it changes.
+func (s *socketServer) writeManifest(rec *roomRecording) {
+	b, err := json.MarshalIndent(&rec.Recording, "", "  ")
+	if err != nil {
+		log.Printf("failed to marshal recording manifest: %v", err)
+		return
+	}
+	dir := rec.dir
+	s.async(func() {
+		writeManifest(dir, b)
+	})
+}
+
+// writeManifest replaces the manifest in dir.
+func writeManifest(dir string, b []byte) {
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		log.Printf("failed to write recording manifest: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestFile)); err != nil {
+		log.Printf("failed to write recording manifest: %v", err)
+	}
+}
+
+func (s *socketServer) startRecordingHandler(conn *websocket.Conn, data *t.StartRecording) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.svc.CanModerate(context.Background(), data.RoomID, p.ID); err != nil {
+		return nil, err
+	}
+
+	id := shortuuid.New()
+	dir := recordingDir(s.cfg, data.RoomID, id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording dir: %w", err)
+	}
+
+	var res any
+	s.do(func() {
+		res, err = s.startRecording(conn, data.RoomID, id, p)
+	})
+	if err != nil {
+		// nothing was written to it yet
+		if err := os.Remove(dir); err != nil {
+			log.Printf("failed to remove recording dir: %v", err)
+		}
+	}
+	return res, err
+}
+
+// startRecording records the tracks of the room published to this
+// instance to the recording id, p is the moderator starting it. The
+// recording's directory is created beforehand.
+func (s *socketServer) startRecording(conn *websocket.Conn, roomID int, id string, p *t.Participant) (any, error) {
+	if !s.isInRoom(conn, roomID) {
+		return nil, errNotInRoom
+	}
+	room := s.rooms[roomID]
+	if room.recording != nil {
+		return nil, &eventError{Code: codeConflict, Message: "room is being recorded already"}
+	}
+
+	dir := recordingDir(s.cfg, roomID, id)
+	by := p.User
+	rec := &roomRecording{
+		Recording: t.Recording{
+			ID:        id,
+			RoomID:    roomID,
+			StartedBy: &by,
+			StartedAt: time.Now().UTC(),
+			Tracks:    []*t.RecordedTrack{},
+			Speakers:  []*t.SpeakerSegment{},
+		},
+		dir:       dir,
+		tracks:    make(map[*roomTrack]*t.RecordedTrack),
+		recorders: make(map[*roomTrack]*trackRecorder),
+		speaking:  make(map[string]*t.SpeakerSegment),
+	}
+	room.recording = rec
+	for _, rt := range room.tracks {
+		s.recordTrack(rec, rt)
+	}
+	s.writeManifest(rec)
+
+	// everyone in the room is told they are being recorded
+	s.broadcastRoomEvent(roomID, &t.Event{
+		Name: "RECORDING_STARTED",
+		Data: map[string]any{
+			"roomID":      roomID,
+			"recordingID": id,
+			"by":          p.User,
+		},
+	})
+	return map[string]any{"recordingID": id}, nil
+}
+
+func (s *socketServer) stopRecordingHandler(conn *websocket.Conn, data *t.StopRecording) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.svc.CanModerate(context.Background(), data.RoomID, p.ID); err != nil {
+		return nil, err
+	}
+
+	s.do(func() {
+		room, ok := s.rooms[data.RoomID]
+		if !ok || room.recording == nil {
+			err = &eventError{Code: codeConflict, Message: "room isn't being recorded"}
+			return
+		}
+		s.stopRecording(data.RoomID, &p.User)
+	})
+	return nil, err
+}
+
+// stopRecording finishes the files and the manifest of the room's
+// recording. by is nil when the recording stops because the room emptied
+// or the server is shutting down.
+func (s *socketServer) stopRecording(roomID int, by *t.User) {
+	room := s.rooms[roomID]
+	rec := room.recording
+	for rt := range rec.recorders {
+		s.stopRecordingTrack(rec, rt)
+	}
+	for pID := range rec.speaking {
+		rec.setSpeaking(pID, nil, false)
+	}
+	now := time.Now().UTC()
+	rec.StoppedAt = &now
+	s.writeManifest(rec)
+	room.recording = nil
+
+	s.broadcastRoomEvent(roomID, &t.Event{
+		Name: "RECORDING_STOPPED",
+		Data: map[string]any{
+			"roomID":      roomID,
+			"recordingID": rec.ID,
+			"by":          by,
+		},
+	})
+}
+
+// recordTrack starts writing the track to the recording, only Opus tracks
+// are recorded.
+func (s *socketServer) recordTrack(rec *roomRecording, rt *roomTrack) {
+	if !strings.EqualFold(rt.remote.Codec().MimeType, webrtc.MimeTypeOpus) {
+		return
+	}
+
+	file := fmt.Sprintf("%s-%d.ogg", rt.pID, len(rec.Tracks)+1)
+	path := filepath.Join(rec.dir, file)
+	tr := &trackRecorder{}
+	s.async(func() {
+		tr.open(path)
+	})
+	rec.recorders[rt] = tr
+	rt.recorder.Store(tr)
+
+	p := s.participants[rt.pID]
+	var u *t.User
+	if p != nil {
+		user := p.User
+		u = &user
+	}
+	track := &t.RecordedTrack{
+		File:          file,
+		ParticipantID: rt.pID,
+		User:          u,
+		Start:         rec.offset(),
+	}
+	rec.tracks[rt] = track
+	rec.Tracks = append(rec.Tracks, track)
+}
+
+// stopRecordingTrack closes the file of the track, it's called once the
+// track is removed from the room or the recording stops.
+func (s *socketServer) stopRecordingTrack(rec *roomRecording, rt *roomTrack) {
+	tr, ok := rec.recorders[rt]
+	if !ok {
+		return
+	}
+	rt.recorder.Store(nil)
+	// after the job opening it
+	s.async(tr.close)
+	end := rec.offset()
+	rec.tracks[rt].End = &end
+	delete(rec.recorders, rt)
+	delete(rec.tracks, rt)
+}
+
+func recordingDir(cfg *t.Config, roomID int, recordingID string) string {
+	return filepath.Join(cfg.Recording.Dir, strconv.Itoa(roomID), recordingID)
+}
+
+// readRecording reads the manifest of the recording.
+func readRecording(cfg *t.Config, roomID int, recordingID string) (*t.Recording, error) {
+	if recordingID == "" || recordingID != filepath.Base(recordingID) || strings.HasPrefix(recordingID, ".") {
+		return nil, os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(recordingDir(cfg, roomID, recordingID), manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var rec t.Recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// readRecordings returns the recordings of the room, the latest first.
+func readRecordings(cfg *t.Config, roomID int) ([]*t.Recording, error) {
+	entries, err := os.ReadDir(filepath.Join(cfg.Recording.Dir, strconv.Itoa(roomID)))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*t.Recording{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]*t.Recording, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		rec, err := readRecording(cfg, roomID, e.Name())
+		if err != nil {
+			log.Printf("failed to read recording %s: %v", e.Name(), err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].StartedAt.After(recs[j].StartedAt)
+	})
+	return recs, nil
+}
+
+// moderatedRoom returns the room of the request if the user moderates it,
+// only the host and co-hosts can see its recordings and stats.
+func (app *application) moderatedRoom(w http.ResponseWriter, r *http.Request) (int, bool) {
+	roomID, err := strconv.Atoi(r.PathValue("roomID"))
+	if err != nil {
+		notFoundError(w, err)
+		return 0, false
+	}
+
+	u := r.Context().Value("user").(*t.User)
+	err = app.svc.CanModerate(context.Background(), roomID, u.ID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		notFoundError(w, err)
+		return 0, false
+	case errors.Is(err, service.ErrPermissionDenied):
+		forbiddenError(w, err)
+		return 0, false
+	case err != nil:
+		serverError(w, err)
+		return 0, false
+	}
+	return roomID, true
+}
+
+func (app *application) getRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	recs, err := readRecordings(app.conf, roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"recordings": recs,
+	})
+}
+
+func (app *application) downloadRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	rec, err := readRecording(app.conf, roomID, r.PathValue("recordingID"))
+	if err != nil {
+		notFoundError(w, err)
+		return
+	}
+
+	// only the files listed in the manifest are served
+	file := r.PathValue("file")
+	listed := slices.ContainsFunc(rec.Tracks, func(tr *t.RecordedTrack) bool {
+		return tr.File == file
+	})
+	if file != manifestFile && !listed {
+		notFoundError(w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rec.ID+"-"+file))
+	http.ServeFile(w, r, filepath.Join(recordingDir(app.conf, roomID, rec.ID), file))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"backend/db"
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// startRecording starts recording the room as c, it returns the ID of the
+// recording.
+func startRecording(tb testing.TB, c *testClient, roomID int) string {
+	tb.Helper()
+	var res struct {
+		RecordingID string `json:"recordingID"`
+	}
+	if err := json.Unmarshal(c.call(tb, "START_RECORDING", map[string]any{"roomID": roomID}), &res); err != nil {
+		tb.Fatal(err)
+	}
+	return res.RecordingID
+}
+
+func TestJoinRecordedRoom(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	hostC := ta.dial(t, hostSession, "")
+	joinRoom(t, hostC, roomID)
+	id := startRecording(t, hostC, roomID)
+
+	_, guestSession := ta.user(t, "guest")
+	ack := ta.dial(t, guestSession, "").call(t, "JOIN_ROOM", map[string]any{"roomID": roomID})
+	var res struct {
+		Recording *struct {
+			RecordingID string `json:"recordingID"`
+			By          struct {
+				ID int `json:"id"`
+			} `json:"by"`
+		} `json:"recording"`
+	}
+	if err := json.Unmarshal(ack, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Recording == nil || res.Recording.RecordingID != id || res.Recording.By.ID != host.ID {
+		t.Errorf("got join %s, want the recording %s started by the host", ack, id)
+	}
+}
+
+func TestRecordingManifest(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	hostC := ta.dial(t, hostSession, "")
+	joinRoom(t, hostC, roomID)
+	guest, guestSession := ta.user(t, "guest")
+	pub := ta.rtcClient(t, guestSession, roomID)
+	tracks := ta.publish(t, roomID, pub.sid)
+	id := startRecording(t, hostC, roomID)
+
+	// a second recording is refused and leaves no directory behind
+	if e := hostC.callErr(t, "START_RECORDING", map[string]any{"roomID": roomID}); e.Code != codeConflict {
+		t.Fatalf("got error %s: %s, want %s", e.Code, e.Message, codeConflict)
+	}
+	entries, err := os.ReadDir(filepath.Join(ta.conf.Recording.Dir, strconv.Itoa(roomID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d recording dirs, want 1", len(entries))
+	}
+
+	// the manifest of an unfinished recording is listed
+	eventually(t, "the manifest to be written", func() bool {
+		_, err := readRecording(ta.conf, roomID, id)
+		return err == nil
+	})
+
+	// the guest speaks, then goes quiet
+	for _, level := range []float64{10, silentLevel} {
+		ta.ss.do(func() {
+			room := ta.ss.rooms[roomID]
+			room.tracks[tracks[0].ID()].level.Store(math.Float64bits(level))
+			ta.ss.updateActiveSpeakers(roomID, room)
+		})
+	}
+	hostC.call(t, "STOP_RECORDING", map[string]any{"roomID": roomID})
+
+	var rec *struct {
+		StoppedAt *string
+		Speakers  []struct {
+			ParticipantID string
+			User          *struct{ ID int }
+			From          int64
+			To            *int64
+		}
+	}
+	eventually(t, "the manifest to be finished", func() bool {
+		b, err := os.ReadFile(filepath.Join(recordingDir(ta.conf, roomID, id), manifestFile))
+		if err != nil || json.Unmarshal(b, &rec) != nil {
+			return false
+		}
+		return rec.StoppedAt != nil
+	})
+	if len(rec.Speakers) != 1 {
+		t.Fatalf("got %d speaker segments, want 1", len(rec.Speakers))
+	}
+	seg := rec.Speakers[0]
+	if seg.ParticipantID != pub.sid || seg.User == nil || seg.User.ID != guest.ID || seg.To == nil || *seg.To < seg.From {
+		t.Errorf("got segment %+v, want the closed segment of the guest", seg)
+	}
+}
+
+func TestTrackRecorder(t *testing.T) {
+	pkt := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: 1, Timestamp: 960},
+		Payload: []byte{0xf8, 0xff, 0xfe},
+	}
+
+	t.Run("written once open", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "track.ogg")
+		r := &trackRecorder{}
+		// dropped, the file isn't open yet
+		r.write(pkt)
+		r.open(path)
+		r.write(pkt)
+		r.close()
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("OggS")) {
+			t.Errorf("got %q, want an ogg file", b[:min(len(b), 8)])
+		}
+	})
+
+	t.Run("closed before open", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "track.ogg")
+		r := &trackRecorder{}
+		r.close()
+		r.open(path)
+		r.write(pkt)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("got %v, want the file not to be created", err)
+		}
+	})
+}
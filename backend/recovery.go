@@ -0,0 +1,167 @@
+package main
+
+import (
+	t "backend/types"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// states of the PEER_RECONNECTING event
+const (
+	recoveryRestarting = "restarting"
+	recoveryRebuilding = "rebuilding"
+	recoveryRecovered  = "recovered"
+	recoveryFailed     = "failed"
+)
+
+// peerRecovery brings back the media of a connection whose peer dropped.
+// ICE is restarted first, the peer is rebuilt if that doesn't reconnect it,
+// and the participant leaves the room once the timeout is over.
+type peerRecovery struct {
+	since time.Time
+	// restarting is the peer whose ICE is being restarted, rebuild
+	// replaces it if it's still disconnected when it fires
+	restarting *Peer
+	rebuild    *time.Timer
+	giveUp     *time.Timer
+}
+
+// recoverPeer is called when the peer of the connection is disconnected or
+// failed.
+func (s *socketServer) recoverPeer(conn *websocket.Conn, p *Peer, state webrtc.PeerConnectionState) {
+	c, ok := s.conns[conn]
+	if !ok || c.peer != p {
+		return
+	}
+	cfg := s.cfg.RTC
+	if cfg.RecoveryTimeout <= 0 {
+		if state == webrtc.PeerConnectionStateFailed {
+			s.closePeer(c)
+		}
+		return
+	}
+
+	rec := c.recovery
+	if rec == nil {
+		rec = &peerRecovery{since: time.Now()}
+		rec.giveUp = time.AfterFunc(cfg.RecoveryTimeout, func() {
+			s.do(func() {
+				if cur, ok := s.conns[conn]; ok && cur == c && c.recovery == rec {
+					s.giveUpPeer(conn)
+				}
+			})
+		})
+		c.recovery = rec
+		s.broadcastReconnecting(conn, true)
+	}
+
+	// a failed peer won't come back with an ICE restart
+	if state == webrtc.PeerConnectionStateFailed {
+		s.rebuildPeer(conn)
+		return
+	}
+	if rec.restarting == p {
+		return
+	}
+
+	rec.restarting = p
+	if rec.rebuild != nil {
+		rec.rebuild.Stop()
+	}
+	sendRecovery(c, p.roomID, recoveryRestarting)
+	p.iceRestart = true
+	if err := p.negotiate(); err != nil {
+		log.Printf("failed to restart ice: %v", err)
+		s.rebuildPeer(conn)
+		return
+	}
+	rec.rebuild = time.AfterFunc(cfg.ICERestartTimeout, func() {
+		s.do(func() {
+			cur, ok := s.conns[conn]
+			if !ok || cur != c || c.recovery != rec || c.peer != p {
+				return
+			}
+			if p.ConnectionState() != webrtc.PeerConnectionStateConnected {
+				s.rebuildPeer(conn)
+			}
+		})
+	})
+}
+
+// rebuildPeer replaces the peer of the connection by a new one subscribed to
+// the room's tracks, the client creates its own again when it's told to.
+func (s *socketServer) rebuildPeer(conn *websocket.Conn) {
+	c := s.conns[conn]
+	if c.peer == nil {
+		return
+	}
+	roomID := c.peer.roomID
+	if rec := c.recovery; rec != nil {
+		rec.restarting = nil
+		if rec.rebuild != nil {
+			rec.rebuild.Stop()
+		}
+	}
+
+	sendRecovery(c, roomID, recoveryRebuilding)
+	if err := s.connectPeer(conn, roomID); err != nil {
+		log.Printf("failed to rebuild peer: %v", err)
+		s.giveUpPeer(conn)
+	}
+}
+
+// peerRecovered ends the recovery once the peer is connected again.
+func (s *socketServer) peerRecovered(conn *websocket.Conn, p *Peer) {
+	c, ok := s.conns[conn]
+	if !ok || c.peer != p || c.recovery == nil {
+		return
+	}
+	log.Printf("peer of %s recovered after %v", c.pID, time.Since(c.recovery.since))
+	s.endRecovery(c)
+	sendRecovery(c, p.roomID, recoveryRecovered)
+	s.broadcastReconnecting(conn, false)
+}
+
+// giveUpPeer takes the participant whose peer couldn't be recovered out of
+// the room.
+func (s *socketServer) giveUpPeer(conn *websocket.Conn) {
+	c, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+	s.endRecovery(c)
+	roomID := c.roomID
+	if !s.isInRoom(conn, roomID) {
+		return
+	}
+
+	log.Printf("peer of %s couldn't be recovered", c.pID)
+	sendRecovery(c, roomID, recoveryFailed)
+	p := s.getParticipant(conn)
+	s.leaveRoom(conn, &p.User, c.pID, roomID)
+}
+
+func (s *socketServer) endRecovery(c *socketConn) {
+	rec := c.recovery
+	if rec == nil {
+		return
+	}
+	if rec.rebuild != nil {
+		rec.rebuild.Stop()
+	}
+	rec.giveUp.Stop()
+	c.recovery = nil
+}
+
+func sendRecovery(c *socketConn, roomID int, state string) {
+	c.send(&t.Event{
+		Name: "PEER_RECONNECTING",
+		Data: map[string]any{
+			"roomID": roomID,
+			"state":  state,
+		},
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// recoveryStates returns the states of the PEER_RECONNECTING events sent to
+// the client.
+func recoveryStates(tb testing.TB, c *testClient) []string {
+	tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var states []string
+	for _, e := range c.events {
+		if e.Name != "PEER_RECONNECTING" {
+			continue
+		}
+		var data struct {
+			State string `json:"state"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			tb.Fatal(err)
+		}
+		states = append(states, data.State)
+	}
+	return states
+}
+
+// reconnecting returns the PARTICIPANT_RECONNECTING events sent to the
+// client about the participant.
+func reconnecting(tb testing.TB, c *testClient, pID string) []bool {
+	tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var all []bool
+	for _, e := range c.events {
+		if e.Name != "PARTICIPANT_RECONNECTING" {
+			continue
+		}
+		var data struct {
+			ParticipantID string `json:"participantID"`
+			Reconnecting  bool   `json:"reconnecting"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			tb.Fatal(err)
+		}
+		if data.ParticipantID == pID {
+			all = append(all, data.Reconnecting)
+		}
+	}
+	return all
+}
+
+// lastUfrag returns the ICE username fragment of the last offer sent to
+// the client.
+func lastUfrag(tb testing.TB, c *testClient) string {
+	tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.events) - 1; i >= 0; i-- {
+		if c.events[i].Name != "PEER_OFFER" {
+			continue
+		}
+		var data struct {
+			Offer string `json:"offer"`
+		}
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(c.events[i].Data, &data); err != nil {
+			tb.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(data.Offer), &offer); err != nil {
+			tb.Fatal(err)
+		}
+		for _, line := range strings.Split(offer.SDP, "\r\n") {
+			if ufrag, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+				return ufrag
+			}
+		}
+	}
+	tb.Fatal("no offer was sent")
+	return ""
+}
+
+// TestPeerRecovery drives the connection states of the peer by hand, the
+// clients never exchange candidates so the peers don't connect on their
+// own.
+func TestPeerRecovery(t *testing.T) {
+	type room struct {
+		ta    *testApp
+		id    int
+		sub   *rtcClient
+		other *testClient
+	}
+	newRoom := func(t *testing.T, change func(conf *types.Config)) *room {
+		ta := newTestApp(t, db.NewMemoryStore(), change)
+		host, hostSession := ta.user(t, "host")
+		roomID := ta.room(t, host, nil)
+		_, otherSession := ta.user(t, "other")
+		other := ta.dial(t, otherSession, "")
+		joinRoom(t, other, roomID)
+		sub := ta.rtcClient(t, hostSession, roomID)
+		sub.settle(t, ta)
+		return &room{ta: ta, id: roomID, sub: sub, other: other}
+	}
+	setState := func(r *room, state webrtc.PeerConnectionState) {
+		key, p := r.ta.serverPeer(r.sub.sid)
+		r.ta.ss.do(func() {
+			if state == webrtc.PeerConnectionStateConnected {
+				r.ta.ss.peerRecovered(key, p)
+			} else {
+				r.ta.ss.recoverPeer(key, p, state)
+			}
+		})
+		// the replies come after the events sent before
+		r.sub.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		r.other.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+	}
+	inRecovery := func(r *room) bool {
+		key, _ := r.ta.serverPeer(r.sub.sid)
+		var ok bool
+		r.ta.ss.do(func() {
+			ok = r.ta.ss.conns[key].recovery != nil
+		})
+		return ok
+	}
+	hours := func(conf *types.Config) {
+		conf.RTC.ICERestartTimeout = time.Hour
+		conf.RTC.RecoveryTimeout = time.Hour
+	}
+
+	t.Run("ice is restarted first", func(t *testing.T) {
+		r := newRoom(t, hours)
+		_, p := r.ta.serverPeer(r.sub.sid)
+		ufrag := lastUfrag(t, r.sub.testClient)
+		offers := r.sub.count("PEER_OFFER")
+
+		setState(r, webrtc.PeerConnectionStateDisconnected)
+		if got := recoveryStates(t, r.sub.testClient); !slices.Equal(got, []string{recoveryRestarting}) {
+			t.Fatalf("got states %v, want [%s]", got, recoveryRestarting)
+		}
+		if got := reconnecting(t, r.other, r.sub.sid); !slices.Equal(got, []bool{true}) {
+			t.Errorf("the room was told %v, want [true]", got)
+		}
+		if r.sub.count("PEER_OFFER") != offers+1 || lastUfrag(t, r.sub.testClient) == ufrag {
+			t.Fatal("got no offer with new ICE credentials")
+		}
+
+		// a peer being restarted isn't restarted again
+		setState(r, webrtc.PeerConnectionStateDisconnected)
+		if got := recoveryStates(t, r.sub.testClient); len(got) != 1 {
+			t.Errorf("got states %v, want a single restart", got)
+		}
+
+		setState(r, webrtc.PeerConnectionStateConnected)
+		if got := recoveryStates(t, r.sub.testClient); !slices.Equal(got, []string{recoveryRestarting, recoveryRecovered}) {
+			t.Errorf("got states %v, want the peer recovered", got)
+		}
+		if got := reconnecting(t, r.other, r.sub.sid); !slices.Equal(got, []bool{true, false}) {
+			t.Errorf("the room was told %v, want [true false]", got)
+		}
+		if _, cur := r.ta.serverPeer(r.sub.sid); cur != p {
+			t.Error("the peer was replaced")
+		}
+		if inRecovery(r) {
+			t.Error("the recovery wasn't ended")
+		}
+	})
+
+	t.Run("peer is rebuilt when the restart times out", func(t *testing.T) {
+		r := newRoom(t, func(conf *types.Config) {
+			conf.RTC.ICERestartTimeout = 50 * time.Millisecond
+			conf.RTC.RecoveryTimeout = time.Hour
+		})
+		_, p := r.ta.serverPeer(r.sub.sid)
+
+		setState(r, webrtc.PeerConnectionStateDisconnected)
+		eventually(t, "the peer to be rebuilt", func() bool {
+			_, cur := r.ta.serverPeer(r.sub.sid)
+			return cur != nil && cur != p
+		})
+		// the reply comes after the events sent before
+		r.sub.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		if got := recoveryStates(t, r.sub.testClient); !slices.Equal(got, []string{recoveryRestarting, recoveryRebuilding}) {
+			t.Errorf("got states %v, want a restart then a rebuild", got)
+		}
+
+		// the new peer ends the recovery, the old one doesn't
+		key, _ := r.ta.serverPeer(r.sub.sid)
+		r.ta.ss.do(func() {
+			r.ta.ss.peerRecovered(key, p)
+		})
+		if !inRecovery(r) {
+			t.Fatal("the replaced peer ended the recovery")
+		}
+		setState(r, webrtc.PeerConnectionStateConnected)
+		if inRecovery(r) {
+			t.Error("the new peer didn't end the recovery")
+		}
+	})
+
+	t.Run("failed peer is rebuilt at once", func(t *testing.T) {
+		r := newRoom(t, hours)
+		_, p := r.ta.serverPeer(r.sub.sid)
+		offers := r.sub.count("PEER_OFFER")
+
+		setState(r, webrtc.PeerConnectionStateFailed)
+		if got := recoveryStates(t, r.sub.testClient); !slices.Equal(got, []string{recoveryRebuilding}) {
+			t.Fatalf("got states %v, want [%s]", got, recoveryRebuilding)
+		}
+		if _, cur := r.ta.serverPeer(r.sub.sid); cur == nil || cur == p {
+			t.Fatal("the peer wasn't replaced")
+		}
+		if r.sub.count("PEER_OFFER") != offers+1 {
+			t.Error("the new peer sent no offer")
+		}
+	})
+
+	t.Run("participant leaves once the recovery times out", func(t *testing.T) {
+		r := newRoom(t, func(conf *types.Config) {
+			conf.RTC.ICERestartTimeout = time.Hour
+			conf.RTC.RecoveryTimeout = 50 * time.Millisecond
+		})
+
+		setState(r, webrtc.PeerConnectionStateDisconnected)
+		eventually(t, "the participant to leave", func() bool {
+			for _, p := range roomParticipants(t, r.ta.repo, r.id) {
+				if p.SID == r.sub.sid {
+					return false
+				}
+			}
+			return true
+		})
+		// the reply comes after the events sent before
+		r.sub.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+		if got := recoveryStates(t, r.sub.testClient); !slices.Equal(got, []string{recoveryRestarting, recoveryFailed}) {
+			t.Errorf("got states %v, want a restart then a failure", got)
+		}
+		if inRecovery(r) {
+			t.Error("the recovery wasn't ended")
+		}
+	})
+
+	t.Run("recovery disabled", func(t *testing.T) {
+		r := newRoom(t, func(conf *types.Config) {
+			conf.RTC.RecoveryTimeout = 0
+		})
+		_, p := r.ta.serverPeer(r.sub.sid)
+
+		setState(r, webrtc.PeerConnectionStateDisconnected)
+		if _, cur := r.ta.serverPeer(r.sub.sid); cur != p || inRecovery(r) {
+			t.Fatal("a disconnected peer was recovered")
+		}
+
+		setState(r, webrtc.PeerConnectionStateFailed)
+		if _, cur := r.ta.serverPeer(r.sub.sid); cur != nil {
+			t.Error("the failed peer wasn't closed")
+		}
+		if got := recoveryStates(t, r.sub.testClient); len(got) != 0 {
+			t.Errorf("got states %v, want none", got)
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package main
 
-import "net/http"
+import (
+	"expvar"
+	"net/http"
+)
 
 func (app *application) router() http.Handler {
 	router := http.NewServeMux()
@@ -14,8 +17,21 @@ func (app *application) router() http.Handler {
 
 	router.Handle("POST /rooms", ensureAuthed(http.HandlerFunc(app.createRoomHandler)))
 	router.Handle("PUT /rooms/{roomID}", ensureAuthed(http.HandlerFunc(app.updateRoomHandler)))
-	router.HandleFunc("GET /rooms", app.getRoomsHandler)
+	router.Handle("GET /rooms", app.authMiddleware(http.HandlerFunc(app.getRoomsHandler)))
 	router.Handle("GET /rooms/{roomID}/join", ensureAuthed(http.HandlerFunc(app.joinRoomHandler)))
+	router.Handle("GET /rooms/{roomID}/messages", ensureAuthed(http.HandlerFunc(app.getRoomMessagesHandler)))
+	router.Handle("GET /rooms/{roomID}/stats", ensureAuthed(http.HandlerFunc(app.getRoomStatsHandler)))
+	router.Handle("POST /rooms/{roomID}/invites", ensureAuthed(http.HandlerFunc(app.createInviteHandler)))
+	router.Handle("GET /rooms/{roomID}/invites", ensureAuthed(http.HandlerFunc(app.getInvitesHandler)))
+	router.Handle("DELETE /rooms/{roomID}/invites/{code}", ensureAuthed(http.HandlerFunc(app.deleteInviteHandler)))
+	router.Handle("POST /rooms/{roomID}/ingest-token", ensureAuthed(http.HandlerFunc(app.createIngestTokenHandler)))
+	router.Handle("DELETE /rooms/{roomID}/ingest-token", ensureAuthed(http.HandlerFunc(app.revokeIngestTokenHandler)))
+	router.HandleFunc("POST /rooms/{roomID}/whip", app.whipHandler)
+	router.Handle("DELETE /rooms/{roomID}/whip/{sessionID}", app.deleteIngestHandler(ingestWHIP))
+	router.Handle("POST /rooms/{roomID}/whep", app.authMiddleware(http.HandlerFunc(app.whepHandler)))
+	router.Handle("DELETE /rooms/{roomID}/whep/{sessionID}", app.deleteIngestHandler(ingestWHEP))
+	router.Handle("GET /rooms/{roomID}/recordings", ensureAuthed(http.HandlerFunc(app.getRecordingsHandler)))
+	router.Handle("GET /rooms/{roomID}/recordings/{recordingID}/{file}", ensureAuthed(http.HandlerFunc(app.downloadRecordingHandler)))
 
 	router.Handle("GET /profile/{profileID}", app.authMiddleware(http.HandlerFunc(app.profileHandler)))
 	router.Handle("POST /follow", ensureAuthed(http.HandlerFunc(app.followHandler(true))))
@@ -24,7 +40,10 @@ func (app *application) router() http.Handler {
 	router.Handle("GET /dms", ensureAuthed(http.HandlerFunc(app.getDMsHandler)))
 	router.Handle("PUT /dms/{participantID}", ensureAuthed(http.HandlerFunc(app.updateDMsHandler)))
 	router.Handle("POST /messages/{participantID}", ensureAuthed(http.HandlerFunc(app.getMessagesHandler)))
+	router.Handle("GET /rtc/config", ensureAuthed(http.HandlerFunc(app.rtcConfigHandler)))
 	router.Handle("GET /languages", http.HandlerFunc(app.getLanguagesHandler))
+	router.Handle("GET /stats", app.isOperator(http.HandlerFunc(app.getStatsHandler)))
+	router.Handle("GET /debug/vars", app.isOperator(expvar.Handler()))
 
 	v1 := http.NewServeMux()
 	v1.Handle("/api/v1/", http.StripPrefix("/api/v1", core(router)))
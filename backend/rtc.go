@@ -0,0 +1,179 @@
+package main
+
+import (
+	t "backend/types"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtcAPI creates the peer connections of the SFU along with the getters of
+// their stream stats.
+type rtcAPI struct {
+	settingEngine *webrtc.SettingEngine
+}
+
+// newWebRTCAPI checks the network settings of the SFU and opens the ports
+// shared by every peer.
+func newWebRTCAPI(cfg *t.Config) (*rtcAPI, error) {
+	settingEngine, err := newSettingEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &rtcAPI{settingEngine: settingEngine}, nil
+}
+
+// newPeerConnection builds a peer of the SFU. The interceptors retransmit
+// lost packets, send the sender and receiver reports, give the publishers
+// transport wide congestion feedback and record the stream stats. Each peer
+// is built by an API of its own, so the stats interceptor records only the
+// peer's streams.
+func (a *rtcAPI) newPeerConnection(cfg webrtc.Configuration) (*webrtc.PeerConnection, stats.Getter, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	// the audio levels tell who is speaking
+	err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	// NACK generator for the published tracks and responder for the
+	// subscribed ones
+	if err := webrtc.ConfigureNack(mediaEngine, registry); err != nil {
+		return nil, nil, err
+	}
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return nil, nil, err
+	}
+	// feedback for the publishers, and sequence numbers on the forwarded
+	// packets so the subscribers send theirs
+	if err := webrtc.ConfigureTWCCSender(mediaEngine, registry); err != nil {
+		return nil, nil, err
+	}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+		return nil, nil, err
+	}
+
+	statsFactory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, nil, err
+	}
+	// it's called within NewPeerConnection
+	var getter stats.Getter
+	statsFactory.OnNewPeerConnection(func(_ string, g stats.Getter) {
+		getter = g
+	})
+	registry.Add(statsFactory)
+
+	api := webrtc.NewAPI(
+		webrtc.WithSettingEngine(*a.settingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	)
+	pc, err := api.NewPeerConnection(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, getter, nil
+}
+
+// newSettingEngine applies the network settings of the SFU, the ports it
+// listens on and the IPs it advertises.
+func newSettingEngine(cfg *t.Config) (*webrtc.SettingEngine, error) {
+	c := cfg.RTC
+	se := &webrtc.SettingEngine{}
+	se.SetAnsweringDTLSRole(webrtc.DTLSRoleServer)
+
+	if c.UDPPortMin != 0 || c.UDPPortMax != 0 {
+		if err := se.SetEphemeralUDPPortRange(c.UDPPortMin, c.UDPPortMax); err != nil {
+			return nil, fmt.Errorf("invalid udp port range: %w", err)
+		}
+	}
+
+	if len(c.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if c.ICEUDPMuxPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.ICEUDPMuxPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ice udp mux: %w", err)
+		}
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+	if c.ICETCPMuxPort != 0 {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: c.ICETCPMuxPort})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for ice tcp mux: %w", err)
+		}
+		se.SetICETCPMux(webrtc.NewICETCPMux(nil, l, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	se.SetNetworkTypes(networkTypes)
+
+	return se, nil
+}
+
+// iceServers returns the STUN and TURN servers for the user. The TURN
+// credentials follow the TURN REST API: the username carries the expiry and
+// the password is its HMAC with the shared secret.
+func iceServers(cfg *t.Config, user string) []t.ICEServer {
+	c := cfg.RTC
+	var servers []t.ICEServer
+	if len(c.STUNURLs) > 0 {
+		servers = append(servers, t.ICEServer{URLs: c.STUNURLs})
+	}
+	// the config is refused if the TURN servers come without a secret
+	if len(c.TURNURLs) > 0 {
+		s := t.ICEServer{URLs: c.TURNURLs}
+		s.Username, s.Credential = turnCredentials(c.TURNSecret, user, time.Now().Add(c.TURNCredentialTTL))
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// turnCredentials returns the username, which is the expiry and the user,
+// and the password, the base64 HMAC-SHA1 of the username.
+func turnCredentials(secret, user string, expiry time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expiry.Unix(), user)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// webrtcICEServers returns the ICE servers of the server peers.
+func webrtcICEServers(cfg *t.Config) []webrtc.ICEServer {
+	servers := iceServers(cfg, "sfu")
+	res := make([]webrtc.ICEServer, 0, len(servers))
+	for _, s := range servers {
+		is := webrtc.ICEServer{URLs: s.URLs}
+		if s.Username != "" {
+			is.Username = s.Username
+			is.Credential = s.Credential
+			is.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		res = append(res, is)
+	}
+	return res
+}
+
+func (app *application) rtcConfigHandler(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value("user").(*t.User)
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"iceServers": iceServers(app.conf, fmt.Sprint(u.ID)),
+		"ttl":        int(app.conf.RTC.TURNCredentialTTL.Seconds()),
+	})
+}
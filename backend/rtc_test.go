@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// connect negotiates the client with the server peer directly, the client
+// offers an audio track which is returned.
+func connect(tb testing.TB, server, client *webrtc.PeerConnection) *webrtc.TrackLocalStaticRTP {
+	tb.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "client")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := client.AddTrack(track); err != nil {
+		tb.Fatal(err)
+	}
+	server.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := tr.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	exchange := func(from, to *webrtc.PeerConnection, offer bool) {
+		var (
+			sd  webrtc.SessionDescription
+			err error
+		)
+		if offer {
+			sd, err = from.CreateOffer(nil)
+		} else {
+			sd, err = from.CreateAnswer(nil)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		gathered := webrtc.GatheringCompletePromise(from)
+		if err := from.SetLocalDescription(sd); err != nil {
+			tb.Fatal(err)
+		}
+		<-gathered
+		if err := to.SetRemoteDescription(*from.LocalDescription()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	exchange(client, server, true)
+	exchange(server, client, false)
+	return track
+}
+
+// TestPeerStatsAreSeparate builds peers at once and checks that each one's
+// stats getter only records its own streams.
+func TestPeerStatsAreSeparate(t *testing.T) {
+	a, err := newWebRTCAPI(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const peers = 3
+	var (
+		wg      sync.WaitGroup
+		servers [peers]*webrtc.PeerConnection
+		getters [peers]stats.Getter
+		errs    [peers]error
+	)
+	for i := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers[i], getters[i], errs[i] = a.newPeerConnection(webrtc.Configuration{})
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { servers[i].Close() })
+		if getters[i] == nil {
+			t.Fatalf("peer %d has no stats getter", i)
+		}
+	}
+
+	// only the first peer receives anything
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	track := connect(t, servers[0], client)
+	ssrc := uint32(client.GetSenders()[0].GetParameters().Encodings[0].SSRC)
+
+	received := func(g stats.Getter) uint64 {
+		s := g.Get(ssrc)
+		if s == nil {
+			return 0
+		}
+		return s.InboundRTPStreamStats.PacketsReceived
+	}
+	var seq uint16
+	eventually(t, "the packets to be recorded", func() bool {
+		seq++
+		err := track.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: []byte{0xf8, 0xff, 0xfe},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return received(getters[0]) > 0
+	})
+	for i, g := range getters[1:] {
+		if n := received(g); n != 0 {
+			t.Errorf("peer %d recorded %d packets of another peer", i+1, n)
+		}
+	}
+}
+
+func TestTURNCredentials(t *testing.T) {
+	// computed with openssl dgst -sha1 -hmac north -binary | base64
+	username, credential := turnCredentials("north", "alice", time.Unix(1700000000, 0))
+	if username != "1700000000:alice" {
+		t.Errorf("got username %q, want the expiry and the user", username)
+	}
+	if want := "Cd/49soE35ICqcJF/bCTn8Z4OyE="; credential != want {
+		t.Errorf("got credential %q, want %q", credential, want)
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	conf := testConfig(t)
+	conf.RTC.STUNURLs = []string{"stun:stun.example.com:3478"}
+	conf.RTC.TURNURLs = []string{"turn:turn.example.com:3478"}
+	conf.RTC.TURNSecret = "north"
+	conf.RTC.TURNCredentialTTL = time.Hour
+
+	before := time.Now().Unix()
+	servers := iceServers(conf, "alice")
+	after := time.Now().Unix()
+	if len(servers) != 2 || servers[0].Username != "" {
+		t.Fatalf("got servers %+v, want stun without and turn with credentials", servers)
+	}
+	turn := servers[1]
+	expiry, user, ok := strings.Cut(turn.Username, ":")
+	if !ok || user != "alice" {
+		t.Fatalf("got username %q, want the expiry and the user", turn.Username)
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hour := int64(time.Hour / time.Second); exp < before+hour || exp > after+hour {
+		t.Errorf("got expiry %d, want an hour from now", exp)
+	}
+	if _, want := turnCredentials("north", "alice", time.Unix(exp, 0)); turn.Credential != want {
+		t.Errorf("got credential %q, want %q", turn.Credential, want)
+	}
+}
@@ -2,7 +2,7 @@ package service
 
 import (
 	"context"
-	"errors"
+	"fmt"
 )
 
 func (s *Service) GetDM(ctx context.Context, userID, participantID int) (int, error) {
@@ -11,7 +11,7 @@ func (s *Service) GetDM(ctx context.Context, userID, participantID int) (int, er
 		return 0, err
 	}
 	if !ok {
-		return 0, errors.New("should be friends to create a dm")
+		return 0, fmt.Errorf("%w: should be friends to create a dm", ErrPermissionDenied)
 	}
 
 	dmID, err := s.repo.GetDM(context.Background(), userID, participantID)
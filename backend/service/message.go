@@ -4,6 +4,9 @@ import (
 	t "backend/types"
 	"backend/utils"
 	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
 )
 
 func (s *Service) DeleteMessage(ctx context.Context, msgID string, userID, participantID int) error {
@@ -41,7 +44,14 @@ func (s *Service) ReactionToMessage(ctx context.Context, msgID string, userID, p
 	if err != nil {
 		return err
 	}
+	toggleReaction(m, userID, reaction)
+
+	return s.repo.UpdateMessage(ctx, m, true)
+}
 
+// toggleReaction adds the user's reaction to the message, or removes it if
+// the user already reacted with it.
+func toggleReaction(m *t.Message, userID int, reaction string) {
 	reactions := map[string][]int{}
 	if m.Reactions != nil {
 		reactions = *m.Reactions
@@ -62,6 +72,93 @@ func (s *Service) ReactionToMessage(ctx context.Context, msgID string, userID, p
 		reactions[reaction] = append(reactions[reaction], userID)
 	}
 	m.Reactions = &reactions
+}
 
-	return s.repo.UpdateMessage(ctx, m, true)
+// MessageRetention returns how many days the room keeps its messages.
+func (s *Service) MessageRetention(r *t.RoomSettings) int {
+	if r.MessageRetention != nil {
+		return *r.MessageRetention
+	}
+	return s.conf.Messages.Retention
+}
+
+// CreateRoomMessage saves the room message or whisper. The rooms which don't
+// keep their messages only index the latest ones, so that the server knows
+// who may edit, delete or react to them.
+func (s *Service) CreateRoomMessage(ctx context.Context, msg *t.Message) error {
+	r, err := s.repo.GetRoomSettings(ctx, *msg.RoomID)
+	if err != nil {
+		return err
+	}
+	if s.MessageRetention(r) > 0 {
+		return s.repo.CreateRoomMessage(ctx, msg)
+	}
+
+	ref := &t.RoomMessageRef{
+		ID:   msg.ID,
+		From: msg.From,
+	}
+	if msg.Participant != nil {
+		ref.ParticipantID = &msg.Participant.ID
+	}
+	return s.repo.IndexRoomMessage(ctx, *msg.RoomID, ref, s.conf.Messages.IndexSize)
+}
+
+// RoomMessageRef returns who sent the room message and who to, from the
+// saved messages or the index of the rooms which don't keep them. It's nil
+// if the message is unknown.
+func (s *Service) RoomMessageRef(ctx context.Context, roomID int, msgID string) (*t.RoomMessageRef, error) {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if s.MessageRetention(r) == 0 {
+		return s.repo.GetRoomMessageRef(ctx, roomID, msgID)
+	}
+	ref, err := s.repo.GetKeptRoomMessageRef(ctx, roomID, msgID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return ref, err
+}
+
+// the room messages which weren't kept, or aren't anymore, have nothing to
+// update
+func ignoreNotKept(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (s *Service) EditRoomMessage(ctx context.Context, roomID int, msgID, content string, userID int) error {
+	m, err := s.repo.GetRoomMessage(ctx, roomID, msgID, userID, false)
+	if err != nil {
+		return ignoreNotKept(err)
+	}
+	m.IsEdited = true
+	m.Content = content
+
+	return s.repo.UpdateRoomMessage(ctx, m, false)
+}
+
+func (s *Service) DeleteRoomMessage(ctx context.Context, roomID int, msgID string, userID int) error {
+	m, err := s.repo.GetRoomMessage(ctx, roomID, msgID, userID, false)
+	if err != nil {
+		return ignoreNotKept(err)
+	}
+	m.IsDeleted = true
+	m.Content = ""
+
+	return s.repo.UpdateRoomMessage(ctx, m, false)
+}
+
+func (s *Service) ReactionToRoomMessage(ctx context.Context, roomID int, msgID string, userID int, reaction string) error {
+	m, err := s.repo.GetRoomMessage(ctx, roomID, msgID, userID, true)
+	if err != nil {
+		return ignoreNotKept(err)
+	}
+	toggleReaction(m, userID, reaction)
+
+	return s.repo.UpdateRoomMessage(ctx, m, true)
 }
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestReactionToMessage(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	svc := NewService(&types.Config{}, store)
+
+	var alice, bob, eve int
+	for _, u := range []struct {
+		id   *int
+		name string
+	}{{&alice, "alice"}, {&bob, "bob"}, {&eve, "eve"}} {
+		id, err := store.CreateUser(ctx, &types.GoogleUserInfo{ID: u.name, Name: u.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		*u.id = id
+	}
+	// only friends have a dm
+	store.Follow(ctx, alice, bob)
+	store.Follow(ctx, bob, alice)
+
+	msgID, err := svc.CreateMessage(ctx, &types.Message{Content: "hi", From: types.User{ID: alice}}, alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the steps build on each other
+	steps := []struct {
+		name        string
+		user        int
+		participant int
+		reaction    string
+		wantErr     error
+		want        map[string][]int
+	}{
+		{
+			name:        "receiver reacts",
+			user:        bob,
+			participant: alice,
+			reaction:    "👍",
+			want:        map[string][]int{"👍": {bob}},
+		},
+		{
+			name:        "sender reacts with the same emoji",
+			user:        alice,
+			participant: bob,
+			reaction:    "👍",
+			want:        map[string][]int{"👍": {bob, alice}},
+		},
+		{
+			name:        "another emoji",
+			user:        alice,
+			participant: bob,
+			reaction:    "🎉",
+			want:        map[string][]int{"👍": {bob, alice}, "🎉": {alice}},
+		},
+		{
+			name:        "reacting again takes it back",
+			user:        bob,
+			participant: alice,
+			reaction:    "👍",
+			want:        map[string][]int{"👍": {alice}, "🎉": {alice}},
+		},
+		{
+			name:        "last reaction is removed",
+			user:        alice,
+			participant: bob,
+			reaction:    "🎉",
+			want:        map[string][]int{"👍": {alice}},
+		},
+		{
+			name:        "outsider can't react",
+			user:        eve,
+			participant: alice,
+			reaction:    "👍",
+			wantErr:     pgx.ErrNoRows,
+			want:        map[string][]int{"👍": {alice}},
+		},
+		{
+			name:        "outsider can't react with the sender's dm",
+			user:        eve,
+			participant: bob,
+			reaction:    "👍",
+			wantErr:     pgx.ErrNoRows,
+			want:        map[string][]int{"👍": {alice}},
+		},
+	}
+
+	for _, s := range steps {
+		err := svc.ReactionToMessage(ctx, msgID, s.user, s.participant, s.reaction)
+		if !errors.Is(err, s.wantErr) {
+			t.Fatalf("%s: got error %v, want %v", s.name, err, s.wantErr)
+		}
+
+		m, err := store.GetMessage(ctx, msgID, alice, bob, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string][]int
+		if m.Reactions != nil {
+			got = *m.Reactions
+		}
+		if !maps.EqualFunc(got, s.want, slices.Equal) {
+			t.Errorf("%s: got reactions %v, want %v", s.name, got, s.want)
+		}
+		if m.Content != "hi" || m.IsEdited {
+			t.Errorf("%s: a reaction changed the message", s.name)
+		}
+	}
+}
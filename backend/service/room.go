@@ -5,11 +5,18 @@ import (
 	"backend/utils"
 	"context"
 	"errors"
+	"fmt"
 	"time"
 )
 
 var (
-	ErrMaxRoomsHosted = errors.New("reached maximum number of rooms hosted")
+	ErrMaxRoomsHosted   = errors.New("reached maximum number of rooms hosted")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrInvalidRole      = errors.New("invalid role")
+	ErrAlreadyKicked    = errors.New("participant is kicked already")
+	ErrNotStage         = errors.New("room isn't in stage mode")
+	ErrRoomLocked       = errors.New("room is locked, an invite is needed to join it")
+	ErrInvalidInvite    = errors.New("invite is invalid, expired or used up")
 )
 
 func (s *Service) UpdateWelcomeMessage(ctx context.Context, roomID, userID int, wm string) error {
@@ -21,13 +28,83 @@ func (s *Service) UpdateWelcomeMessage(ctx context.Context, roomID, userID int,
 	isHost := r.Host.ID == userID
 	isCoHost := utils.Includes(r.CoHosts, userID)
 	if !isHost && !isCoHost {
-		return errors.New("permission denied")
+		return ErrPermissionDenied
 	}
 
 	r.WelcomeMessage = &wm
 	return s.repo.UpdateRoomSettings(ctx, r)
 }
 
+// CanJoin checks whether the user may join the room. A locked room is only
+// joined with the code of one of its invites, unless the user is the host or
+// a co-host.
+func (s *Service) CanJoin(ctx context.Context, r *t.Room, userID int, key string) error {
+	if !r.Settings.Locked || r.Settings.Host.ID == userID || utils.Includes(r.Settings.CoHosts, userID) {
+		return nil
+	}
+	if key == "" {
+		return ErrRoomLocked
+	}
+	ok, err := s.repo.RedeemInvite(ctx, r.ID, key, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidInvite
+	}
+	return nil
+}
+
+// CanModerate checks whether the user is the host or a co-host of the room.
+func (s *Service) CanModerate(ctx context.Context, roomID, userID int) error {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	isHost := r.Host.ID == userID
+	isCoHost := utils.Includes(r.CoHosts, userID)
+	if !isHost && !isCoHost {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// ForceMute checks whether the user may mute the participants, the host
+// can't be muted and co-hosts can only be muted by the host.
+func (s *Service) ForceMute(ctx context.Context, roomID, userID int, participantIDs []int) error {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	isHost := r.Host.ID == userID
+	isCoHost := utils.Includes(r.CoHosts, userID)
+	if !isHost && !isCoHost {
+		return ErrPermissionDenied
+	}
+	for _, participantID := range participantIDs {
+		isParticipantHost := r.Host.ID == participantID
+		isParticipantCoHost := utils.Includes(r.CoHosts, participantID)
+		if isParticipantHost || (isParticipantCoHost && !isHost) {
+			return ErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+// RoomGuests returns the users who are neither the host nor a co-host.
+func (s *Service) RoomGuests(ctx context.Context, roomID int, userIDs []int) ([]int, error) {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.Filter(userIDs, func(userID int) bool {
+		return r.Host.ID != userID && !utils.Includes(r.CoHosts, userID)
+	}), nil
+}
+
 func (s *Service) CanClearChat(ctx context.Context, roomID, userID, participantID int) error {
 	r, err := s.repo.GetRoomSettings(ctx, roomID)
 	if err != nil {
@@ -38,7 +115,7 @@ func (s *Service) CanClearChat(ctx context.Context, roomID, userID, participantI
 	isCoHost := utils.Includes(r.CoHosts, userID)
 	isParticipantHost := r.Host.ID == participantID
 	if (!isHost && !isCoHost) || isParticipantHost {
-		return errors.New("permission denied")
+		return ErrPermissionDenied
 	}
 
 	return nil
@@ -55,7 +132,7 @@ func (s *Service) AssignRole(ctx context.Context, role t.RoomRole, roomID, userI
 	isParticipantHost := r.Host.ID == participantID
 
 	if !isHost || isParticipantHost {
-		return errors.New("permission denied")
+		return ErrPermissionDenied
 	}
 
 	filter := func(coHost int) bool {
@@ -83,13 +160,13 @@ func (s *Service) AssignRole(ctx context.Context, role t.RoomRole, roomID, userI
 
 	case t.RoomRoleGuest:
 		if !isParticipantCoHost {
-			return errors.New("should be 'co-host' to assign role 'guest'")
+			return fmt.Errorf("%w: should be 'co-host' to assign role 'guest'", ErrInvalidRole)
 		}
 		r.CoHosts = utils.Filter(r.CoHosts, filter)
 
 	case t.RoomRoleCoHost:
 		if isParticipantCoHost {
-			return errors.New("should be 'guest' to assign role 'co-host'")
+			return fmt.Errorf("%w: should be 'guest' to assign role 'co-host'", ErrInvalidRole)
 		}
 		r.CoHosts = append(r.CoHosts, participantID)
 
@@ -108,7 +185,7 @@ func (s *Service) KickParticipant(ctx context.Context, duration time.Duration, r
 	isCoHost := utils.Includes(r.CoHosts, userID)
 	isParticipantHost := r.Host.ID == participantID
 	if (!isHost && !isCoHost) || isParticipantHost {
-		return nil, errors.New("permission denied")
+		return nil, ErrPermissionDenied
 	}
 
 	k := t.Kick{
@@ -123,7 +200,7 @@ func (s *Service) KickParticipant(ctx context.Context, duration time.Duration, r
 
 	_, err = s.repo.GetKick(ctx, roomID, participantID)
 	if nil == err {
-		return nil, errors.New("participant is kicked already")
+		return nil, ErrAlreadyKicked
 	}
 
 	err = s.repo.KickParticipant(ctx, &k)
@@ -133,3 +210,103 @@ func (s *Service) KickParticipant(ctx context.Context, duration time.Duration, r
 
 	return &k, nil
 }
+
+func (s *Service) UpdatePublishSettings(ctx context.Context, roomID, userID int, video, screen t.PublishPolicy) error {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	isHost := r.Host.ID == userID
+	isCoHost := utils.Includes(r.CoHosts, userID)
+	if !isHost && !isCoHost {
+		return ErrPermissionDenied
+	}
+
+	r.VideoPublishers = video
+	r.ScreenPublishers = screen
+	return s.repo.UpdateRoomSettings(ctx, r)
+}
+
+// CanPublish checks the room's publish settings for the track source,
+// everyone may publish their microphone. Only the speakers may publish in
+// stage mode.
+func (s *Service) CanPublish(ctx context.Context, roomID, userID int, source t.TrackSource) error {
+	var policy t.PublishPolicy
+	switch source {
+	case t.TrackMicrophone, t.TrackCamera, t.TrackScreen:
+	default:
+		return fmt.Errorf("%w: unknown track source %q", ErrPermissionDenied, source)
+	}
+
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if !r.IsSpeaker(userID) {
+		return fmt.Errorf("%w: only speakers can publish on stage", ErrPermissionDenied)
+	}
+	if source == t.TrackMicrophone {
+		return nil
+	}
+	policy = r.VideoPublishers
+	if source == t.TrackScreen {
+		policy = r.ScreenPublishers
+	}
+
+	isHost := r.Host.ID == userID
+	isCoHost := utils.Includes(r.CoHosts, userID)
+	switch {
+	case policy == t.PublishEveryone,
+		policy == t.PublishCoHosts && (isHost || isCoHost),
+		policy == t.PublishHost && isHost:
+		return nil
+	}
+	return fmt.Errorf("%w: not allowed to publish %s", ErrPermissionDenied, source)
+}
+
+// CanRaiseHand checks whether the user is a listener of a stage room.
+func (s *Service) CanRaiseHand(ctx context.Context, roomID, userID int) error {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if !r.Stage {
+		return ErrNotStage
+	}
+	if r.IsSpeaker(userID) {
+		return fmt.Errorf("%w: speakers can't raise their hand", ErrInvalidRole)
+	}
+	return nil
+}
+
+// SetSpeaker brings the participant on or off the stage. The host and
+// co-hosts decide who speaks, but speakers may leave the stage on their own.
+func (s *Service) SetSpeaker(ctx context.Context, roomID, userID, participantID int, speaker bool) error {
+	r, err := s.repo.GetRoomSettings(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if !r.Stage {
+		return ErrNotStage
+	}
+	isHost := r.Host.ID == userID
+	isCoHost := utils.Includes(r.CoHosts, userID)
+	leaving := userID == participantID && !speaker
+	if !isHost && !isCoHost && !leaving {
+		return ErrPermissionDenied
+	}
+	if r.Host.ID == participantID || utils.Includes(r.CoHosts, participantID) {
+		return fmt.Errorf("%w: host and co-hosts are always speakers", ErrInvalidRole)
+	}
+
+	r.Speakers = utils.Filter(r.Speakers, func(id int) bool {
+		return id != participantID
+	})
+	if speaker {
+		r.Speakers = append(r.Speakers, participantID)
+	}
+	return s.repo.UpdateRoomSettings(ctx, r)
+}
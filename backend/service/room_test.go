@@ -0,0 +1,510 @@
+package service
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// testRoom is a room of the MemoryStore with a host, a co-host and a guest.
+type testRoom struct {
+	svc   *Service
+	store *db.MemoryStore
+	id    int
+
+	host, coHost, guest int
+}
+
+func newTestRoom(tb testing.TB) *testRoom {
+	tb.Helper()
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	r := &testRoom{
+		svc:   NewService(&types.Config{MaxRoomsHosted: 1}, store),
+		store: store,
+	}
+
+	for i, id := range []*int{&r.host, &r.coHost, &r.guest} {
+		userID, err := store.CreateUser(ctx, &types.GoogleUserInfo{ID: fmt.Sprint("user", i)})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		*id = userID
+	}
+
+	roomID, err := store.CreateRoom(ctx, &types.Room{Topic: "test", CreatedBy: r.host})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r.id = roomID
+	settings := r.settings(tb)
+	settings.CoHosts = []int{r.coHost}
+	if err := store.UpdateRoomSettings(ctx, settings); err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+func (r *testRoom) settings(tb testing.TB) *types.RoomSettings {
+	tb.Helper()
+	s, err := r.store.GetRoomSettings(context.Background(), r.id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+func TestAssignRole(t *testing.T) {
+	tests := []struct {
+		name        string
+		role        types.RoomRole
+		user        func(r *testRoom) int
+		participant func(r *testRoom) int
+		// setup runs before the role is assigned
+		setup   func(tb testing.TB, r *testRoom)
+		wantErr error
+		// check runs if the role was assigned
+		check func(t *testing.T, r *testRoom)
+	}{
+		{
+			name:        "guest can't assign roles",
+			role:        types.RoomRoleCoHost,
+			user:        func(r *testRoom) int { return r.guest },
+			participant: func(r *testRoom) int { return r.guest },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "co-host can't assign roles",
+			role:        types.RoomRoleGuest,
+			user:        func(r *testRoom) int { return r.coHost },
+			participant: func(r *testRoom) int { return r.coHost },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "host can't change its own role",
+			role:        types.RoomRoleGuest,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.host },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "guest becomes co-host",
+			role:        types.RoomRoleCoHost,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+			check: func(t *testing.T, r *testRoom) {
+				if got := r.settings(t).CoHosts; !slices.Equal(got, []int{r.coHost, r.guest}) {
+					t.Errorf("got co-hosts %v", got)
+				}
+			},
+		},
+		{
+			name:        "co-host is a co-host already",
+			role:        types.RoomRoleCoHost,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.coHost },
+			wantErr:     ErrInvalidRole,
+		},
+		{
+			name:        "co-host becomes guest",
+			role:        types.RoomRoleGuest,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.coHost },
+			check: func(t *testing.T, r *testRoom) {
+				if got := r.settings(t).CoHosts; len(got) != 0 {
+					t.Errorf("got co-hosts %v, want none", got)
+				}
+			},
+		},
+		{
+			name:        "guest is a guest already",
+			role:        types.RoomRoleGuest,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+			wantErr:     ErrInvalidRole,
+		},
+		{
+			name:        "co-host becomes host",
+			role:        types.RoomRoleHost,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.coHost },
+			check: func(t *testing.T, r *testRoom) {
+				s := r.settings(t)
+				if s.Host.ID != r.coHost {
+					t.Errorf("got host %d, want %d", s.Host.ID, r.coHost)
+				}
+				if !slices.Equal(s.CoHosts, []int{r.host}) {
+					t.Errorf("got co-hosts %v, want the old host", s.CoHosts)
+				}
+			},
+		},
+		{
+			name:        "new host hosts too many rooms",
+			role:        types.RoomRoleHost,
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+			setup: func(tb testing.TB, r *testRoom) {
+				_, err := r.store.CreateRoom(context.Background(), &types.Room{CreatedBy: r.guest})
+				if err != nil {
+					tb.Fatal(err)
+				}
+			},
+			wantErr: ErrMaxRoomsHosted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			if tt.setup != nil {
+				tt.setup(t, r)
+			}
+			before := r.settings(t)
+
+			err := r.svc.AssignRole(context.Background(), tt.role, r.id, tt.user(r), tt.participant(r))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				after := r.settings(t)
+				if after.Host.ID != before.Host.ID || !slices.Equal(after.CoHosts, before.CoHosts) {
+					t.Errorf("the roles changed although it failed")
+				}
+				return
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
+
+func TestKickParticipant(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        func(r *testRoom) int
+		participant func(r *testRoom) int
+		// kicked kicks the participant before the test
+		kicked  bool
+		wantErr error
+		// wantStored is whether the kick is kept, co-hosts aren't banned
+		wantStored bool
+	}{
+		{
+			name:        "guest can't kick",
+			user:        func(r *testRoom) int { return r.guest },
+			participant: func(r *testRoom) int { return r.coHost },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "host can't be kicked",
+			user:        func(r *testRoom) int { return r.coHost },
+			participant: func(r *testRoom) int { return r.host },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "host kicks guest",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+			wantStored:  true,
+		},
+		{
+			name:        "co-host kicks guest",
+			user:        func(r *testRoom) int { return r.coHost },
+			participant: func(r *testRoom) int { return r.guest },
+			wantStored:  true,
+		},
+		{
+			name:        "host kicks co-host",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.coHost },
+		},
+		{
+			name:        "guest is kicked already",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+			kicked:      true,
+			wantErr:     ErrAlreadyKicked,
+			wantStored:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			r := newTestRoom(t)
+			participantID := tt.participant(r)
+			if tt.kicked {
+				if _, err := r.svc.KickParticipant(ctx, time.Hour, r.id, r.host, participantID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			k, err := r.svc.KickParticipant(ctx, time.Minute, r.id, tt.user(r), participantID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (k.UserID != participantID || k.RoomID != r.id) {
+				t.Errorf("got kick %+v", k)
+			}
+
+			_, err = r.store.GetKick(ctx, r.id, participantID)
+			if stored := !errors.Is(err, pgx.ErrNoRows); stored != tt.wantStored {
+				t.Errorf("got kick stored %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestCanClearChat(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        func(r *testRoom) int
+		participant func(r *testRoom) int
+		wantErr     error
+	}{
+		{
+			name:        "host clears guest",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.guest },
+		},
+		{
+			name:        "host clears co-host",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.coHost },
+		},
+		{
+			name:        "co-host clears guest",
+			user:        func(r *testRoom) int { return r.coHost },
+			participant: func(r *testRoom) int { return r.guest },
+		},
+		{
+			name:        "co-host can't clear host",
+			user:        func(r *testRoom) int { return r.coHost },
+			participant: func(r *testRoom) int { return r.host },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "host can't clear itself",
+			user:        func(r *testRoom) int { return r.host },
+			participant: func(r *testRoom) int { return r.host },
+			wantErr:     ErrPermissionDenied,
+		},
+		{
+			name:        "guest can't clear",
+			user:        func(r *testRoom) int { return r.guest },
+			participant: func(r *testRoom) int { return r.coHost },
+			wantErr:     ErrPermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			err := r.svc.CanClearChat(context.Background(), r.id, tt.user(r), tt.participant(r))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("unknown room", func(t *testing.T) {
+		r := newTestRoom(t)
+		err := r.svc.CanClearChat(context.Background(), r.id+100, r.host, r.guest)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			t.Fatalf("got error %v, want no rows", err)
+		}
+	})
+}
+
+func TestCanPublish(t *testing.T) {
+	tests := []struct {
+		name   string
+		source types.TrackSource
+		user   func(r *testRoom) int
+		// change is applied to the room settings first
+		change  func(r *testRoom, s *types.RoomSettings)
+		wantErr error
+	}{
+		{
+			name:   "guest publishes microphone",
+			source: types.TrackMicrophone,
+			user:   func(r *testRoom) int { return r.guest },
+			change: func(r *testRoom, s *types.RoomSettings) { s.VideoPublishers = types.PublishHost },
+		},
+		{
+			name:   "everyone publishes camera",
+			source: types.TrackCamera,
+			user:   func(r *testRoom) int { return r.guest },
+			change: func(r *testRoom, s *types.RoomSettings) { s.VideoPublishers = types.PublishEveryone },
+		},
+		{
+			name:   "co-host publishes camera",
+			source: types.TrackCamera,
+			user:   func(r *testRoom) int { return r.coHost },
+			change: func(r *testRoom, s *types.RoomSettings) { s.VideoPublishers = types.PublishCoHosts },
+		},
+		{
+			name:    "guest can't publish camera",
+			source:  types.TrackCamera,
+			user:    func(r *testRoom) int { return r.guest },
+			change:  func(r *testRoom, s *types.RoomSettings) { s.VideoPublishers = types.PublishCoHosts },
+			wantErr: ErrPermissionDenied,
+		},
+		{
+			name:   "host shares screen",
+			source: types.TrackScreen,
+			user:   func(r *testRoom) int { return r.host },
+			change: func(r *testRoom, s *types.RoomSettings) { s.ScreenPublishers = types.PublishHost },
+		},
+		{
+			name:   "co-host can't share screen",
+			source: types.TrackScreen,
+			user:   func(r *testRoom) int { return r.coHost },
+			change: func(r *testRoom, s *types.RoomSettings) {
+				s.VideoPublishers = types.PublishEveryone
+				s.ScreenPublishers = types.PublishHost
+			},
+			wantErr: ErrPermissionDenied,
+		},
+		{
+			name:    "unknown source",
+			source:  types.TrackSource("hologram"),
+			user:    func(r *testRoom) int { return r.host },
+			wantErr: ErrPermissionDenied,
+		},
+		{
+			name:   "stage listener can't publish microphone",
+			source: types.TrackMicrophone,
+			user:   func(r *testRoom) int { return r.guest },
+			change: func(r *testRoom, s *types.RoomSettings) {
+				s.Stage = true
+				s.VideoPublishers = types.PublishEveryone
+			},
+			wantErr: ErrPermissionDenied,
+		},
+		{
+			name:   "stage speaker publishes camera",
+			source: types.TrackCamera,
+			user:   func(r *testRoom) int { return r.guest },
+			change: func(r *testRoom, s *types.RoomSettings) {
+				s.Stage = true
+				s.Speakers = []int{r.guest}
+				s.VideoPublishers = types.PublishEveryone
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			if tt.change != nil {
+				settings := r.settings(t)
+				tt.change(r, settings)
+				if err := r.store.UpdateRoomSettings(context.Background(), settings); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := r.svc.CanPublish(context.Background(), r.id, tt.user(r), tt.source)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdatePublishSettings(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		user    func(r *testRoom) int
+		wantErr error
+	}{
+		{name: "host", user: func(r *testRoom) int { return r.host }},
+		{name: "co-host", user: func(r *testRoom) int { return r.coHost }},
+		{name: "guest", user: func(r *testRoom) int { return r.guest }, wantErr: ErrPermissionDenied},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			err := r.svc.UpdatePublishSettings(context.Background(), r.id, tt.user(r), types.PublishHost, types.PublishEveryone)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			s := r.settings(t)
+			updated := s.VideoPublishers == types.PublishHost && s.ScreenPublishers == types.PublishEveryone
+			if updated != (tt.wantErr == nil) {
+				t.Errorf("got publishers %q and %q", s.VideoPublishers, s.ScreenPublishers)
+			}
+		})
+	}
+}
+
+func TestForceMute(t *testing.T) {
+	tests := []struct {
+		name         string
+		user         func(r *testRoom) int
+		participants func(r *testRoom) []int
+		wantErr      error
+	}{
+		{
+			name:         "host mutes guest",
+			user:         func(r *testRoom) int { return r.host },
+			participants: func(r *testRoom) []int { return []int{r.guest} },
+		},
+		{
+			name:         "host mutes co-host",
+			user:         func(r *testRoom) int { return r.host },
+			participants: func(r *testRoom) []int { return []int{r.coHost} },
+		},
+		{
+			name:         "co-host mutes guest",
+			user:         func(r *testRoom) int { return r.coHost },
+			participants: func(r *testRoom) []int { return []int{r.guest} },
+		},
+		{
+			name:         "co-host can't mute co-host",
+			user:         func(r *testRoom) int { return r.coHost },
+			participants: func(r *testRoom) []int { return []int{r.guest, r.coHost} },
+			wantErr:      ErrPermissionDenied,
+		},
+		{
+			name:         "co-host can't mute host",
+			user:         func(r *testRoom) int { return r.coHost },
+			participants: func(r *testRoom) []int { return []int{r.host} },
+			wantErr:      ErrPermissionDenied,
+		},
+		{
+			name:         "guest can't mute",
+			user:         func(r *testRoom) int { return r.guest },
+			participants: func(r *testRoom) []int { return []int{r.guest} },
+			wantErr:      ErrPermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRoom(t)
+			err := r.svc.ForceMute(context.Background(), r.id, tt.user(r), tt.participants(r))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("room guests", func(t *testing.T) {
+		r := newTestRoom(t)
+		guests, err := r.svc.RoomGuests(context.Background(), r.id, []int{r.host, r.coHost, r.guest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(guests, []int{r.guest}) {
+			t.Errorf("got guests %v, want %v", guests, []int{r.guest})
+		}
+	})
+}
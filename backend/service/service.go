@@ -13,10 +13,10 @@ import (
 
 type Service struct {
 	conf *types.Config
-	repo *db.Repo
+	repo db.Store
 }
 
-func NewService(conf *types.Config, repo *db.Repo) *Service {
+func NewService(conf *types.Config, repo db.Store) *Service {
 	return &Service{
 		conf: conf,
 		repo: repo,
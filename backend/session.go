@@ -0,0 +1,107 @@
+package main
+
+import (
+	t "backend/types"
+	"log"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// disconnect is called once the websocket of a session is gone. Unless the
+// client went away on purpose, the session is held for the resume grace
+// period before it leaves its room.
+func (s *socketServer) disconnect(key, ws *websocket.Conn, user *t.User, err error) {
+	c, ok := s.conns[key]
+	if !ok || !c.isAttached(ws) {
+		// the session was resumed on another websocket already
+		return
+	}
+
+	status := websocket.CloseStatus(err)
+	if user == nil || s.cfg.Socket.ResumeGrace <= 0 || s.draining.Load() ||
+		status == websocket.StatusNormalClosure || status == websocket.StatusGoingAway ||
+		status == websocket.StatusPolicyViolation {
+		s.close(key, user)
+		return
+	}
+
+	c.stop()
+	var expiry *time.Timer
+	expiry = time.AfterFunc(s.cfg.Socket.ResumeGrace, func() {
+		s.do(func() {
+			if cur, ok := s.conns[key]; ok && cur == c && c.expiry == expiry {
+				log.Printf("session %s wasn't resumed in time", c.pID)
+				s.close(key, user)
+			}
+		})
+	})
+	c.expiry = expiry
+	s.broadcastReconnecting(key, true)
+}
+
+// resume attaches ws to the session of the token and returns the key of the
+// session. If the session can't be resumed the old one is closed and the
+// client starts a new one.
+func (s *socketServer) resume(ws *websocket.Conn, user *t.User, token string, lastSeq uint64) (*websocket.Conn, bool) {
+	key, ok := s.sessions[token]
+	if !ok || user == nil {
+		return nil, false
+	}
+	c := s.conns[key]
+	p := s.participants[c.pID]
+	if p.ID != user.ID {
+		return nil, false
+	}
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	// the old websocket might not have noticed the drop yet, it's closed so
+	// its read loop ends and the client, if it's still there, knows
+	if old := c.stop(); old != nil {
+		go old.Close(websocket.StatusPolicyViolation, "session resumed elsewhere")
+	}
+
+	if !c.attach(ws, lastSeq) {
+		log.Printf("session %s can't be resumed from seq %d", c.pID, lastSeq)
+		s.close(key, user)
+		return nil, false
+	}
+	resumedConns.Add(1)
+
+	c.send(&t.Event{
+		Name: "SESSION_RESUMED",
+		Data: map[string]any{
+			"sid":    c.pID,
+			"roomID": c.roomID,
+		},
+	})
+
+	if c.peer != nil {
+		// the peer most likely didn't survive the network change, the
+		// client negotiates a new one while staying in the room
+		if err := s.connectPeer(key, c.roomID); err != nil {
+			log.Printf("failed to renegotiate peer of resumed session: %v", err)
+		}
+	}
+	s.broadcastReconnecting(key, false)
+
+	return key, true
+}
+
+func (s *socketServer) broadcastReconnecting(key *websocket.Conn, reconnecting bool) {
+	c := s.conns[key]
+	if !s.isInRoom(key, c.roomID) {
+		return
+	}
+	s.broadcastRoomEvent(c.roomID, &t.Event{
+		Name: "PARTICIPANT_RECONNECTING",
+		Data: map[string]any{
+			"roomID":        c.roomID,
+			"participantID": c.pID,
+			"reconnecting":  reconnecting,
+		},
+	})
+}
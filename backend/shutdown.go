@@ -0,0 +1,165 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+// shutdown stops the socket server from accepting joins, tells every client
+// to reconnect elsewhere, closes the peers and connections and finishes or
+// persists the pending ai requests, all before ctx is done.
+func (s *socketServer) shutdown(ctx context.Context) {
+	var (
+		conns []*socketConn
+		peers []*Peer
+	)
+	s.do(func() {
+		s.draining.Store(true)
+
+		b, err := json.Marshal(&t.Event{
+			Name: "SERVER_SHUTTING_DOWN",
+			Data: map[string]any{
+				"reconnectAfter": s.cfg.ShutdownReconnectHint.Milliseconds(),
+			},
+		})
+		if err != nil {
+			log.Printf("failed to marshal shutdown event: %v", err)
+		}
+
+		for roomID, room := range s.rooms {
+			if room.recording != nil {
+				s.stopRecording(roomID, nil)
+			}
+			s.closeRoomExternal(roomID)
+		}
+
+		for _, c := range s.conns {
+			if b != nil {
+				c.enqueue("SERVER_SHUTTING_DOWN", b)
+			}
+			conns = append(conns, c)
+			// the peers are detached here and closed outside of the run
+			// loop, closing them can take a while
+			if c.peer != nil {
+				peers = append(peers, c.peer)
+				c.peer = nil
+			}
+		}
+	})
+
+	for _, p := range peers {
+		if err := p.Close(); err != nil {
+			log.Printf("failed to close peer connection: %v", err)
+		}
+	}
+
+	// the files of the recordings are finished by the jobs queued before
+	select {
+	case <-s.async(func() {}):
+	case <-ctx.Done():
+	}
+
+	for _, c := range conns {
+		go c.closeAfterFlush(ctx, websocket.StatusGoingAway, "server shutting down")
+	}
+
+	s.drainAIRequests(ctx)
+
+	if err := s.repo.RemoveInstance(context.Background(), s.instanceID); err != nil {
+		log.Printf("failed to remove instance presence: %v", err)
+	}
+}
+
+// drainAIRequests waits for the queued ai requests to be answered. The ones
+// still pending when ctx is done are persisted and picked up on the next
+// start.
+func (s *socketServer) drainAIRequests(ctx context.Context) {
+	s.aiMu.Lock()
+	s.aiClosed = true
+	close(s.aiMsgRequest)
+	s.aiMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-s.aiDone
+		s.aiWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	s.aiMu.Lock()
+	pending := make([]*t.AIMessageRequest, 0, len(s.aiPending))
+	for req := range s.aiPending {
+		pending = append(pending, req)
+	}
+	s.aiMu.Unlock()
+
+	if err := s.repo.SavePendingAIRequests(context.Background(), pending); err != nil {
+		log.Printf("failed to persist %d pending ai requests: %v", len(pending), err)
+		return
+	}
+	log.Printf("persisted %d pending ai requests", len(pending))
+}
+
+// resumeAIRequests queues the ai requests persisted by the last shutdown.
+func (s *socketServer) resumeAIRequests() {
+	reqs, err := s.repo.PopPendingAIRequests(context.Background())
+	if err != nil {
+		log.Printf("failed to get pending ai requests: %v", err)
+		return
+	}
+	for _, req := range reqs {
+		s.queueAIRequest(req)
+	}
+}
+
+func (c *socketConn) closeAfterFlush(ctx context.Context, code websocket.StatusCode, reason string) {
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.queueDepth() > 0 {
+		select {
+		case <-ctx.Done():
+			ws.CloseNow()
+			return
+		case <-ticker.C:
+		}
+	}
+	ws.Close(code, reason)
+}
+
+func (app *application) shutdown(ctx context.Context, server *http.Server) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("failed to shutdown http server: %v", err)
+		}
+	}()
+
+	app.ss.shutdown(ctx)
+	<-done
+}
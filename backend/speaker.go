@@ -0,0 +1,147 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// silentLevel is the audio level of silence in -dBov
+	silentLevel = 127
+	// levelSmoothing is the weight of a packet's level in the smoothed one
+	levelSmoothing = 0.1
+)
+
+// audioLevelExtID returns the ID negotiated for the audio level header
+// extension of the receiver, 0 if it wasn't negotiated.
+func audioLevelExtID(r *webrtc.RTPReceiver) uint8 {
+	for _, ext := range r.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// observeLevel smooths the audio level of the packet into the track's. It's
+// called from the forwarding loop of the track.
+func (rt *roomTrack) observeLevel(pkt *rtp.Packet, extID uint8) {
+	b := pkt.GetExtension(extID)
+	if b == nil {
+		return
+	}
+	var ext rtp.AudioLevelExtension
+	if err := ext.Unmarshal(b); err != nil {
+		return
+	}
+	prev := rt.audioLevel()
+	level := prev + levelSmoothing*(float64(ext.Level)-prev)
+	rt.level.Store(math.Float64bits(level))
+}
+
+// audioLevel is the smoothed level of the track in -dBov, lower is louder.
+func (rt *roomTrack) audioLevel() float64 {
+	return math.Float64frombits(rt.level.Load())
+}
+
+// detectActiveSpeakers sends the loudest participants of every room to the
+// room's connections, only when they change.
+func (s *socketServer) detectActiveSpeakers(ctx context.Context) {
+	cfg := s.cfg.ActiveSpeakers
+	if cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.do(func() {
+				for roomID, room := range s.rooms {
+					s.updateActiveSpeakers(roomID, room)
+					s.updateWHEP(roomID)
+				}
+			})
+		}
+	}
+}
+
+type activeSpeaker struct {
+	ParticipantID string `json:"participantID"`
+	// Level is the loudness from 0 (silence) to 127
+	Level int `json:"level"`
+}
+
+func (s *socketServer) updateActiveSpeakers(roomID int, room *socketRoom) {
+	cfg := s.cfg.ActiveSpeakers
+
+	// the loudest microphone of each participant, the level of a muted
+	// one is left as it was when its packets stopped being forwarded
+	levels := make(map[string]float64)
+	for _, rt := range room.tracks {
+		if rt.source != t.TrackMicrophone || rt.muted.Load() {
+			continue
+		}
+		level := rt.audioLevel()
+		if level > float64(cfg.Threshold) {
+			continue
+		}
+		if l, ok := levels[rt.pID]; !ok || level < l {
+			levels[rt.pID] = level
+		}
+	}
+
+	if room.recording != nil {
+		room.recording.updateSpeakers(levels, s.participants)
+	}
+
+	speakers := make([]activeSpeaker, 0, len(levels))
+	for pID, level := range levels {
+		speakers = append(speakers, activeSpeaker{
+			ParticipantID: pID,
+			Level:         silentLevel - int(math.Round(level)),
+		})
+	}
+	sort.Slice(speakers, func(i, j int) bool {
+		return speakers[i].Level > speakers[j].Level
+	})
+	if len(speakers) > cfg.Max {
+		speakers = speakers[:cfg.Max]
+	}
+
+	pIDs := make([]string, 0, len(speakers))
+	for _, sp := range speakers {
+		pIDs = append(pIDs, sp.ParticipantID)
+	}
+	if slices.Equal(pIDs, room.speakers) {
+		return
+	}
+	room.speakers = pIDs
+
+	b, err := json.Marshal(&t.Event{
+		Name: "ACTIVE_SPEAKERS",
+		Data: map[string]any{
+			"roomID":   roomID,
+			"speakers": speakers,
+		},
+	})
+	if err != nil {
+		log.Printf("failed to marshal active speakers: %v", err)
+		return
+	}
+	// the tracks are forwarded by this instance only, so are the speakers
+	s.deliverRoomEvent(roomID, "ACTIVE_SPEAKERS", b)
+}
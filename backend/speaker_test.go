@@ -0,0 +1,153 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestObserveLevel(t *testing.T) {
+	const extID = 1
+	rt := &roomTrack{}
+	rt.level.Store(math.Float64bits(silentLevel))
+
+	packet := func(level uint8) *rtp.Packet {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2}}
+		b, err := (&rtp.AudioLevelExtension{Level: level, Voice: true}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pkt.SetExtension(extID, b); err != nil {
+			t.Fatal(err)
+		}
+		return pkt
+	}
+
+	// one loud packet doesn't make a speaker
+	rt.observeLevel(packet(0), extID)
+	if got, want := rt.audioLevel(), silentLevel-levelSmoothing*silentLevel; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("got level %v after a packet, want %v", got, want)
+	}
+	for i := 0; i < 100; i++ {
+		rt.observeLevel(packet(20), extID)
+	}
+	if got := rt.audioLevel(); math.Abs(got-20) > 1 {
+		t.Errorf("got level %v after talking, want about 20", got)
+	}
+
+	// packets without the extension are ignored
+	before := rt.audioLevel()
+	rt.observeLevel(&rtp.Packet{Header: rtp.Header{Version: 2}}, extID)
+	if rt.audioLevel() != before {
+		t.Errorf("got level %v after a packet without level, want %v", rt.audioLevel(), before)
+	}
+}
+
+func TestActiveSpeakers(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		conf.ActiveSpeakers.Threshold = 50
+		conf.ActiveSpeakers.Max = 2
+	})
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	listener := ta.rtcClient(t, hostSession, roomID)
+
+	var (
+		sids   []string
+		tracks []string
+	)
+	for i := 0; i < 3; i++ {
+		_, s := ta.user(t, fmt.Sprint("speaker", i))
+		pub := ta.rtcClient(t, s, roomID)
+		sids = append(sids, pub.sid)
+		tracks = append(tracks, ta.publish(t, roomID, pub.sid)[0].ID())
+	}
+
+	// update sets the levels of the microphones and sends the speakers
+	update := func(levels []float64, muted []bool) {
+		ta.ss.do(func() {
+			room := ta.ss.rooms[roomID]
+			for i, level := range levels {
+				rt := room.tracks[tracks[i]]
+				rt.level.Store(math.Float64bits(level))
+				rt.muted.Store(muted != nil && muted[i])
+			}
+			ta.ss.updateActiveSpeakers(roomID, room)
+		})
+		// the reply comes after the speakers sent before
+		listener.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+	}
+	speakers := func() [][]string {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		var all [][]string
+		for _, e := range listener.events {
+			if e.Name != "ACTIVE_SPEAKERS" {
+				continue
+			}
+			var data struct {
+				Speakers []activeSpeaker `json:"speakers"`
+			}
+			if err := json.Unmarshal(e.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+			var pIDs []string
+			for _, sp := range data.Speakers {
+				pIDs = append(pIDs, sp.ParticipantID)
+			}
+			all = append(all, pIDs)
+		}
+		return all
+	}
+
+	steps := []struct {
+		name   string
+		levels []float64
+		muted  []bool
+		// want is the speakers sent, nil if nothing is sent
+		want []string
+	}{
+		{
+			name:   "loudest first up to the max",
+			levels: []float64{30, 10, 20},
+			want:   []string{sids[1], sids[2]},
+		},
+		{
+			name:   "unchanged speakers aren't sent",
+			levels: []float64{30, 12, 22},
+		},
+		{
+			name:   "quieter than the threshold",
+			levels: []float64{60, 10, silentLevel},
+			want:   []string{sids[1]},
+		},
+		{
+			name:   "muted microphones don't speak",
+			levels: []float64{30, 10, silentLevel},
+			muted:  []bool{false, true, false},
+			want:   []string{sids[0]},
+		},
+		{
+			name:   "everyone quiet",
+			levels: []float64{silentLevel, silentLevel, silentLevel},
+			want:   []string{},
+		},
+	}
+	var want [][]string
+	for _, step := range steps {
+		update(step.levels, step.muted)
+		if step.want != nil {
+			want = append(want, step.want)
+		}
+		got := speakers()
+		if !slices.EqualFunc(got, want, func(a, b []string) bool { return slices.Equal(a, b) }) {
+			t.Fatalf("%s: got speakers %v, want %v", step.name, got, want)
+		}
+	}
+}
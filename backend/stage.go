@@ -0,0 +1,248 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+var (
+	stageFullErr = errors.New("max listeners limit reached")
+)
+
+// checkRoomLimit checks the participant limit the user would count against.
+// In stage mode the listeners have their own limit, MaxParticipants only
+// caps the speakers.
+func (s *socketServer) checkRoomLimit(r *t.Room, userID int, participants []*t.Participant) error {
+	// the WHIP publishers don't take a spot
+	var joined, speakers, listeners int
+	for _, p := range participants {
+		if isIngest(p) {
+			continue
+		}
+		joined++
+		if r.Settings.IsSpeaker(p.ID) {
+			speakers++
+		} else {
+			listeners++
+		}
+	}
+	if !r.Settings.Stage {
+		if joined >= r.MaxParticipants {
+			return roomFullErr
+		}
+		return nil
+	}
+	if r.Settings.IsSpeaker(userID) {
+		if speakers >= r.MaxParticipants {
+			return roomFullErr
+		}
+		return nil
+	}
+	if listeners >= s.cfg.Stage.MaxListeners {
+		return stageFullErr
+	}
+	return nil
+}
+
+// raisedHands returns the users queued to speak in the room, the earliest
+// first.
+func (s *socketServer) raisedHands(roomID int) []*t.User {
+	userIDs, err := s.repo.GetRaisedHands(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get raised hands: %v", err)
+	}
+	users := make([]*t.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if u := s.getUser(userID); u != nil {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+func (s *socketServer) raiseHandHandler(conn *websocket.Conn, data *t.RaiseHand) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed bool
+	if data.Raise {
+		if err := s.svc.CanRaiseHand(context.Background(), data.RoomID, p.ID); err != nil {
+			return nil, err
+		}
+		changed, err = s.repo.RaiseHand(context.Background(), data.RoomID, p.ID)
+	} else {
+		changed, err = s.repo.LowerHand(context.Background(), data.RoomID, p.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to raise hand: %w", err)
+	}
+	if changed {
+		s.broadcastHand(data.RoomID, &p.User, nil, data.Raise)
+	}
+	return nil, nil
+}
+
+func (s *socketServer) approveHandHandler(conn *websocket.Conn, data *t.HandRequest) (any, error) {
+	p, err := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
+	if err != nil {
+		return nil, err
+	}
+
+	hands, err := s.repo.GetRaisedHands(context.Background(), data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(hands, data.ParticipantID) {
+		return nil, &eventError{Code: codeConflict, Message: "hand isn't raised"}
+	}
+	return nil, s.setSpeaker(p, data.RoomID, data.ParticipantID, true)
+}
+
+func (s *socketServer) dismissHandHandler(conn *websocket.Conn, data *t.HandRequest) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.svc.CanModerate(context.Background(), data.RoomID, p.ID); err != nil {
+		return nil, err
+	}
+	lowered, err := s.repo.LowerHand(context.Background(), data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dismiss hand: %w", err)
+	}
+	if !lowered {
+		return nil, &eventError{Code: codeConflict, Message: "hand isn't raised"}
+	}
+	s.broadcastHand(data.RoomID, s.getUser(data.ParticipantID), &p.User, false)
+	return nil, nil
+}
+
+func (s *socketServer) setSpeakerHandler(conn *websocket.Conn, data *t.SetSpeaker) (any, error) {
+	p, err := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.setSpeaker(p, data.RoomID, data.ParticipantID, data.Speaker)
+}
+
+// setSpeaker brings the participant on or off the stage, p is the moderator
+// doing it. A new speaker publishes by renegotiating its peer, the tracks of
+// a former one are removed from the room on every instance.
+func (s *socketServer) setSpeaker(p *t.Participant, roomID, participantID int, speaker bool) error {
+	err := s.svc.SetSpeaker(context.Background(), roomID, p.ID, participantID, speaker)
+	if err != nil {
+		return fmt.Errorf("failed to set speaker: %w", err)
+	}
+
+	lowered, err := s.repo.LowerHand(context.Background(), roomID, participantID)
+	if err != nil {
+		log.Printf("failed to lower hand: %v", err)
+	}
+	participant := s.getUser(participantID)
+	if lowered {
+		s.broadcastHand(roomID, participant, &p.User, false)
+	}
+	if !speaker {
+		s.updateStage(roomID)
+	}
+
+	s.do(func() {
+		s.broadcastRoomEvent(roomID, &t.Event{
+			Name: "SPEAKER_UPDATED",
+			Data: map[string]any{
+				"roomID":      roomID,
+				"by":          p.User,
+				"participant": participant,
+				"speaker":     speaker,
+			},
+		})
+	})
+	return nil
+}
+
+// broadcastHand tells the room the participant's hand is raised or lowered,
+// by is the moderator who dismissed it. It's called outside of the run
+// loop.
+func (s *socketServer) broadcastHand(roomID int, participant, by *t.User, raised bool) {
+	s.do(func() {
+		s.broadcastRoomEvent(roomID, &t.Event{
+			Name: "HAND_RAISED",
+			Data: map[string]any{
+				"roomID":      roomID,
+				"participant": participant,
+				"by":          by,
+				"raised":      raised,
+			},
+		})
+	})
+}
+
+// updateStage removes the tracks of the room's participants who may not
+// publish anymore, on every instance.
+func (s *socketServer) updateStage(roomID int) {
+	s.enforceStage(roomID)
+	s.publish(&t.ClusterEvent{
+		Kind:   t.ClusterStageChanged,
+		RoomID: roomID,
+	})
+}
+
+// enforceStage removes the tracks published to this instance by the
+// participants who aren't speakers. Their packets are dropped until the
+// clients stop sending them. It's called outside of the run loop.
+func (s *socketServer) enforceStage(roomID int) {
+	var hasTracks bool
+	s.do(func() {
+		room, ok := s.rooms[roomID]
+		hasTracks = ok && len(room.tracks) > 0
+	})
+	if !hasTracks {
+		return
+	}
+
+	r, err := s.repo.GetRoomSettings(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get room settings: %v", err)
+		return
+	}
+
+	s.do(func() {
+		room, ok := s.rooms[roomID]
+		if !ok {
+			return
+		}
+		var tracks []*webrtc.TrackLocalStaticRTP
+		for _, rt := range room.tracks {
+			p, ok := s.participants[rt.pID]
+			if !ok || r.IsSpeaker(p.ID) {
+				continue
+			}
+			rt.muted.Store(true)
+			tracks = append(tracks, rt.track)
+		}
+		s.removeTracks(roomID, tracks...)
+	})
+}
+
+// leaveStage lowers the hand of the participant leaving the room, it's
+// queued with async by leaveRoom.
+func (s *socketServer) leaveStage(roomID int, user *t.User) {
+	lowered, err := s.repo.LowerHand(context.Background(), roomID, user.ID)
+	if err != nil {
+		log.Printf("failed to lower hand: %v", err)
+		return
+	}
+	if lowered {
+		s.broadcastHand(roomID, user, nil, false)
+	}
+}
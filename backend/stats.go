@@ -0,0 +1,347 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// thresholds of the connection quality, a link is fair once it's past
+	// any of the good ones and poor past any of the poor ones
+	goodRTT        = 150 * time.Millisecond
+	poorRTT        = 400 * time.Millisecond
+	goodPacketLoss = 0.02
+	poorPacketLoss = 0.1
+	goodJitter     = 30 * time.Millisecond
+	poorJitter     = 100 * time.Millisecond
+)
+
+// statsSample holds the counters of the previous poll, the rates are the
+// difference between two samples.
+type statsSample struct {
+	at            time.Time
+	bytesReceived uint64
+	bytesSent     uint64
+	// packets received and lost by inbound SSRC
+	received map[uint32]uint64
+	lost     map[uint32]int64
+}
+
+// statsTarget is a peer to poll, it's snapshotted on the run loop as the
+// tracks can't be read outside of it.
+type statsTarget struct {
+	conn     *socketConn
+	peer     *Peer
+	user     *t.User
+	inbound  []uint32
+	outbound []uint32
+}
+
+// pollStats measures the connection of every peer, the host and co-hosts
+// can see them for their room and each participant is told about their
+// own if CONNECTION_QUALITY is enabled. The stats are published to redis
+// so that they're seen from every instance.
+func (s *socketServer) pollStats(ctx context.Context) {
+	cfg := s.cfg.Stats
+	if cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var targets []*statsTarget
+			s.do(func() {
+				targets = s.statsTargets()
+			})
+
+			results := make(map[*socketConn]*t.PeerStats, len(targets))
+			for _, st := range targets {
+				results[st.conn] = st.measure()
+			}
+
+			var published []*t.PeerStats
+			s.do(func() {
+				for _, st := range targets {
+					c := st.conn
+					// the peer may have been replaced while polling
+					if c.peer != st.peer {
+						continue
+					}
+					c.stats = results[c]
+					published = append(published, c.stats)
+					if cfg.ConnectionQuality {
+						c.send(&t.Event{
+							Name: "CONNECTION_QUALITY",
+							Data: c.stats,
+						})
+					}
+				}
+			})
+			// they outlive a missed poll, not a stopped instance
+			if err := s.repo.SetPeerStats(ctx, s.instanceID, published, 3*cfg.Interval); err != nil {
+				log.Printf("failed to set peer stats: %v", err)
+			}
+		}
+	}
+}
+
+func (s *socketServer) statsTargets() []*statsTarget {
+	var targets []*statsTarget
+	for _, c := range s.conns {
+		if c.peer == nil {
+			continue
+		}
+		p := c.peer
+		st := &statsTarget{conn: c, peer: p}
+		if participant, ok := s.participants[c.pID]; ok {
+			u := participant.User
+			st.user = &u
+		}
+		if room, ok := s.rooms[p.roomID]; ok {
+			for _, rt := range room.tracks {
+				if rt.publisher == p {
+					st.inbound = append(st.inbound, uint32(rt.remote.SSRC()))
+				}
+			}
+		}
+		for _, sender := range p.senders {
+			for _, enc := range sender.GetParameters().Encodings {
+				st.outbound = append(st.outbound, uint32(enc.SSRC))
+			}
+		}
+		targets = append(targets, st)
+	}
+	return targets
+}
+
+// measure reads the stats of the peer. The RTT, bitrate and candidate type
+// come from the selected candidate pair, the packet loss and jitter from the
+// streams in both directions.
+func (st *statsTarget) measure() *t.PeerStats {
+	p := st.peer
+	now := time.Now()
+	ps := &t.PeerStats{
+		ParticipantID: st.conn.pID,
+		User:          st.user,
+		RoomID:        p.roomID,
+		UpdatedAt:     now.UTC(),
+	}
+	sample := &statsSample{
+		at:       now,
+		received: make(map[uint32]uint64),
+		lost:     make(map[uint32]int64),
+	}
+	prev := p.prevStats
+	if prev == nil {
+		prev = &statsSample{}
+	}
+
+	var rtt time.Duration
+	report := p.GetStats()
+	if pair, ok := selectedPair(report); ok {
+		rtt = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+		sample.bytesReceived = pair.BytesReceived
+		sample.bytesSent = pair.BytesSent
+		ps.CandidateType = candidatePairType(report, pair)
+
+		if !prev.at.IsZero() && pair.BytesReceived >= prev.bytesReceived && pair.BytesSent >= prev.bytesSent {
+			secs := now.Sub(prev.at).Seconds()
+			ps.BitrateIn = uint64(float64(pair.BytesReceived-prev.bytesReceived) * 8 / secs)
+			ps.BitrateOut = uint64(float64(pair.BytesSent-prev.bytesSent) * 8 / secs)
+		}
+	}
+
+	var (
+		jitter   float64
+		received uint64
+		lost     int64
+		lossIn   float64
+		lossOut  float64
+	)
+	if p.stats != nil {
+		for _, ssrc := range st.inbound {
+			in := p.stats.Get(ssrc)
+			if in == nil {
+				continue
+			}
+			jitter = max(jitter, in.InboundRTPStreamStats.Jitter)
+			sample.received[ssrc] = in.InboundRTPStreamStats.PacketsReceived
+			sample.lost[ssrc] = in.InboundRTPStreamStats.PacketsLost
+			if r := in.InboundRTPStreamStats.PacketsReceived; r >= prev.received[ssrc] {
+				received += r - prev.received[ssrc]
+			}
+			if l := in.InboundRTPStreamStats.PacketsLost; l >= prev.lost[ssrc] {
+				lost += l - prev.lost[ssrc]
+			}
+		}
+		for _, ssrc := range st.outbound {
+			out := p.stats.Get(ssrc)
+			if out == nil {
+				continue
+			}
+			remote := out.RemoteInboundRTPStreamStats
+			jitter = max(jitter, remote.Jitter)
+			lossOut = max(lossOut, remote.FractionLost)
+			if rtt == 0 {
+				rtt = remote.RoundTripTime
+			}
+		}
+	}
+	if received+uint64(lost) > 0 {
+		lossIn = float64(lost) / float64(received+uint64(lost))
+	}
+	p.prevStats = sample
+
+	ps.RTT = float64(rtt.Microseconds()) / 1000
+	ps.Jitter = jitter * 1000
+	ps.PacketLoss = max(lossIn, lossOut)
+	ps.Quality = connectionQuality(rtt, time.Duration(jitter*float64(time.Second)), ps.PacketLoss)
+	return ps
+}
+
+// selectedPair returns the nominated candidate pair of the peer.
+func selectedPair(report webrtc.StatsReport) (webrtc.ICECandidatePairStats, bool) {
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+			return pair, true
+		}
+	}
+	return webrtc.ICECandidatePairStats{}, false
+}
+
+// candidatePairType is relay when either side of the pair is relayed,
+// otherwise it's the type of the participant's candidate.
+func candidatePairType(report webrtc.StatsReport, pair webrtc.ICECandidatePairStats) string {
+	local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+	remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+	if local.CandidateType == webrtc.ICECandidateTypeRelay || remote.CandidateType == webrtc.ICECandidateTypeRelay {
+		return webrtc.ICECandidateTypeRelay.String()
+	}
+	if remote.CandidateType == webrtc.ICECandidateType(0) {
+		return ""
+	}
+	return remote.CandidateType.String()
+}
+
+func connectionQuality(rtt, jitter time.Duration, loss float64) t.ConnectionQuality {
+	switch {
+	case rtt > poorRTT || jitter > poorJitter || loss > poorPacketLoss:
+		return t.QualityPoor
+	case rtt > goodRTT || jitter > goodJitter || loss > goodPacketLoss:
+		return t.QualityFair
+	default:
+		return t.QualityGood
+	}
+}
+
+// roomStats returns the last stats of the peers in the room, whichever
+// instance they're connected to.
+func (s *socketServer) roomStats(ctx context.Context, roomID int) ([]*t.PeerStats, error) {
+	peers, err := s.repo.GetPeerStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps := []*t.PeerStats{}
+	for _, p := range peers {
+		if p.RoomID == roomID {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].ParticipantID < ps[j].ParticipantID
+	})
+	return ps, nil
+}
+
+type roomStatsSummary struct {
+	RoomID int `json:"roomID"`
+	Peers  int `json:"peers"`
+	// RTT is in milliseconds, it's averaged like PacketLoss
+	RTT        float64                     `json:"rtt"`
+	PacketLoss float64                     `json:"packetLoss"`
+	BitrateIn  uint64                      `json:"bitrateIn"`
+	BitrateOut uint64                      `json:"bitrateOut"`
+	Relayed    int                         `json:"relayed"`
+	Quality    map[t.ConnectionQuality]int `json:"quality"`
+}
+
+// summarize aggregates the peer stats by room and across every room.
+func summarize(peers []*t.PeerStats) ([]*roomStatsSummary, *roomStatsSummary) {
+	rooms := make(map[int]*roomStatsSummary)
+	total := &roomStatsSummary{Quality: make(map[t.ConnectionQuality]int)}
+	for _, ps := range peers {
+		room, ok := rooms[ps.RoomID]
+		if !ok {
+			room = &roomStatsSummary{RoomID: ps.RoomID, Quality: make(map[t.ConnectionQuality]int)}
+			rooms[ps.RoomID] = room
+		}
+		for _, sum := range []*roomStatsSummary{room, total} {
+			sum.Peers++
+			sum.RTT += ps.RTT
+			sum.PacketLoss += ps.PacketLoss
+			sum.BitrateIn += ps.BitrateIn
+			sum.BitrateOut += ps.BitrateOut
+			sum.Quality[ps.Quality]++
+			if ps.CandidateType == webrtc.ICECandidateTypeRelay.String() {
+				sum.Relayed++
+			}
+		}
+	}
+
+	summaries := make([]*roomStatsSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, room)
+	}
+	for _, sum := range append(summaries, total) {
+		if sum.Peers > 0 {
+			sum.RTT /= float64(sum.Peers)
+			sum.PacketLoss /= float64(sum.Peers)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].RoomID < summaries[j].RoomID
+	})
+	return summaries, total
+}
+
+func (app *application) getRoomStatsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+	stats, err := app.ss.roomStats(r.Context(), roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"stats": stats,
+	})
+}
+
+// getStatsHandler aggregates the stats of every room across the instances
+// for the operator.
+func (app *application) getStatsHandler(w http.ResponseWriter, r *http.Request) {
+	peers, err := app.repo.GetPeerStats(r.Context())
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	rooms, total := summarize(peers)
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"rooms": rooms,
+		"total": total,
+	})
+}
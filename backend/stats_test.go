@@ -0,0 +1,167 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	peers := []*types.PeerStats{
+		{RoomID: 2, RTT: 100, PacketLoss: 0.1, BitrateIn: 1000, BitrateOut: 500, CandidateType: "relay", Quality: types.QualityFair},
+		{RoomID: 1, RTT: 20, BitrateIn: 300, BitrateOut: 100, CandidateType: "host", Quality: types.QualityGood},
+		{RoomID: 2, RTT: 300, PacketLoss: 0.3, BitrateIn: 200, BitrateOut: 100, CandidateType: "srflx", Quality: types.QualityPoor},
+	}
+	rooms, total := summarize(peers)
+
+	if len(rooms) != 2 || rooms[0].RoomID != 1 || rooms[1].RoomID != 2 {
+		t.Fatalf("got rooms %+v, want 1 and 2 in order", rooms)
+	}
+	tests := []struct {
+		name    string
+		got     *roomStatsSummary
+		peers   int
+		rtt     float64
+		loss    float64
+		in, out uint64
+		relayed int
+		quality map[types.ConnectionQuality]int
+	}{
+		{
+			name:    "single peer",
+			got:     rooms[0],
+			peers:   1,
+			rtt:     20,
+			in:      300,
+			out:     100,
+			quality: map[types.ConnectionQuality]int{types.QualityGood: 1},
+		},
+		{
+			name:    "averaged room",
+			got:     rooms[1],
+			peers:   2,
+			rtt:     200,
+			loss:    0.2,
+			in:      1200,
+			out:     600,
+			relayed: 1,
+			quality: map[types.ConnectionQuality]int{types.QualityFair: 1, types.QualityPoor: 1},
+		},
+		{
+			name:    "total",
+			got:     total,
+			peers:   3,
+			rtt:     140,
+			loss:    0.4 / 3,
+			in:      1500,
+			out:     700,
+			relayed: 1,
+			quality: map[types.ConnectionQuality]int{types.QualityGood: 1, types.QualityFair: 1, types.QualityPoor: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.got
+			if s.Peers != tt.peers || math.Abs(s.RTT-tt.rtt) > 1e-9 || math.Abs(s.PacketLoss-tt.loss) > 1e-9 {
+				t.Errorf("got %d peers, rtt %v and loss %v, want %d, %v and %v", s.Peers, s.RTT, s.PacketLoss, tt.peers, tt.rtt, tt.loss)
+			}
+			if s.BitrateIn != tt.in || s.BitrateOut != tt.out || s.Relayed != tt.relayed {
+				t.Errorf("got bitrates %d/%d and %d relayed, want %d/%d and %d", s.BitrateIn, s.BitrateOut, s.Relayed, tt.in, tt.out, tt.relayed)
+			}
+			for q, n := range tt.quality {
+				if s.Quality[q] != n {
+					t.Errorf("got quality %v, want %v", s.Quality, tt.quality)
+				}
+			}
+		})
+	}
+
+	t.Run("no peers", func(t *testing.T) {
+		rooms, total := summarize(nil)
+		if len(rooms) != 0 || total.Peers != 0 || total.RTT != 0 {
+			t.Errorf("got %+v and %+v, want nothing", rooms, total)
+		}
+	})
+}
+
+func TestStatsHandlers(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		conf.Stats.OperatorToken = "secret"
+	})
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	otherRoomID := ta.room(t, host, nil)
+
+	// the peers are spread over this and another instance
+	ctx := context.Background()
+	published := map[string][]*types.PeerStats{
+		ta.ss.instanceID: {
+			{ParticipantID: "b", RoomID: roomID, RTT: 10, Quality: types.QualityGood},
+		},
+		"other-instance": {
+			{ParticipantID: "a", RoomID: roomID, RTT: 30, CandidateType: "relay", Quality: types.QualityGood},
+			{ParticipantID: "c", RoomID: otherRoomID, RTT: 500, Quality: types.QualityPoor},
+		},
+	}
+	for instance, stats := range published {
+		if err := ta.repo.TouchInstance(ctx, instance); err != nil {
+			t.Fatal(err)
+		}
+		if err := ta.repo.SetPeerStats(ctx, instance, stats, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("operator sees every instance", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ta.srv.URL+"/api/v1/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var body struct {
+			Rooms []*roomStatsSummary `json:"rooms"`
+			Total *roomStatsSummary   `json:"total"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Total == nil || body.Total.Peers != 3 || body.Total.Relayed != 1 {
+			t.Fatalf("got total %+v, want the 3 peers of both instances", body.Total)
+		}
+		if len(body.Rooms) != 2 || body.Rooms[0].RoomID != roomID || body.Rooms[0].Peers != 2 || body.Rooms[0].RTT != 20 {
+			t.Errorf("got rooms %+v, want the room averaged over both instances", body.Rooms)
+		}
+	})
+
+	t.Run("host sees the peers of the room", func(t *testing.T) {
+		res := ta.get(t, fmt.Sprintf("/rooms/%d/stats", roomID), hostSession)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		var body struct {
+			Stats []*types.PeerStats `json:"stats"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		var sids []string
+		for _, ps := range body.Stats {
+			sids = append(sids, ps.ParticipantID)
+		}
+		if len(sids) != 2 || sids[0] != "a" || sids[1] != "b" {
+			t.Errorf("got stats of %v, want [a b]", sids)
+		}
+	})
+}
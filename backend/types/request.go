@@ -2,13 +2,20 @@ package types
 
 import (
 	v "backend/validator"
+	"fmt"
 	"net/url"
+	"time"
 )
 
 const (
 	minTopicLen = 3
 	maxTopicLen = 128
 	maxBioLen   = 128
+	// days a room may keep its messages
+	maxMessageRetention = 90
+	minInviteExpiry     = time.Minute
+	maxInviteExpiry     = 30 * 24 * time.Hour
+	maxInviteUses       = 1000
 )
 
 var (
@@ -19,6 +26,10 @@ type CreateRoomRequest struct {
 	Topic           string   `json:"topic"`
 	MaxParticipants int      `json:"maxParticipants"`
 	Languages       []string `json:"languages"`
+	Stage           bool     `json:"stage"`
+	// days the messages are kept, nil uses the default
+	MessageRetention *int `json:"messageRetention"`
+	Locked           bool `json:"locked"`
 }
 
 func (r *CreateRoomRequest) Validate() (bool, error) {
@@ -32,10 +43,36 @@ func (r *CreateRoomRequest) Validate() (bool, error) {
 	if !IsInAllowedLanguages(r.Languages) {
 		vd.Errors["language"] = "invalid language"
 	}
+	if r.MessageRetention != nil && (*r.MessageRetention < 0 || *r.MessageRetention > maxMessageRetention) {
+		vd.Errors["messageRetention"] = fmt.Sprintf("should be between 0 and %d days", maxMessageRetention)
+	}
 
 	return vd.IsValid(), vd
 }
 
+type CreateInviteRequest struct {
+	// ExpiresIn is a duration, the invite doesn't expire when it's empty
+	ExpiresIn string `json:"expiresIn"`
+	// MaxUses is how many users may join with the invite, 0 for any number
+	MaxUses int `json:"maxUses"`
+}
+
+func (r *CreateInviteRequest) Validate() (bool, error) {
+	vd := v.NewValidator()
+	if r.ExpiresIn != "" {
+		d, err := time.ParseDuration(r.ExpiresIn)
+		if err != nil {
+			vd.Errors["expiresIn"] = "invalid duration"
+		} else if d < minInviteExpiry || d > maxInviteExpiry {
+			vd.Errors["expiresIn"] = "should be between 1 minute and 30 days"
+		}
+	}
+	if r.MaxUses < 0 || r.MaxUses > maxInviteUses {
+		vd.Errors["maxUses"] = fmt.Sprintf("should be between 0 and %d", maxInviteUses)
+	}
+	return vd.IsValid(), vd
+}
+
 type OAuthState struct {
 	RedirectURL string `json:"redirectURL"`
 }
@@ -1,6 +1,13 @@
 package types
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type User struct {
 	ID       int    `json:"id"`
@@ -24,6 +31,41 @@ type Participant struct {
 	SID      string    `json:"sid"`
 	Status   string    `json:"status,omitempty"`
 	JoinedAt time.Time `json:"joinedAt"`
+	// RoomID is the room the session is in, if any
+	RoomID int  `json:"roomID,omitempty"`
+	Idle   bool `json:"idle,omitempty"`
+}
+
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceIdle    PresenceStatus = "idle"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+type Presence struct {
+	Status PresenceStatus `json:"status"`
+	RoomID int            `json:"roomID,omitempty"`
+}
+
+// PresenceOf collapses the sessions of a user. The user is online if any
+// session is active and in the room of the session which joined last.
+func PresenceOf(sessions []*Participant) Presence {
+	p := Presence{Status: PresenceOffline}
+	var joinedAt time.Time
+	for _, s := range sessions {
+		if !s.Idle {
+			p.Status = PresenceOnline
+		} else if p.Status == PresenceOffline {
+			p.Status = PresenceIdle
+		}
+		if s.RoomID != 0 && s.JoinedAt.After(joinedAt) {
+			p.RoomID = s.RoomID
+			joinedAt = s.JoinedAt
+		}
+	}
+	return p
 }
 
 type Room struct {
@@ -37,10 +79,112 @@ type Room struct {
 }
 
 type RoomSettings struct {
-	RoomID         int     `json:"-"`
-	WelcomeMessage *string `json:"welcomeMessage,omitempty"`
-	Host           User    `json:"host"`
-	CoHosts        []int   `json:"coHosts,omitempty"`
+	RoomID           int           `json:"-"`
+	WelcomeMessage   *string       `json:"welcomeMessage,omitempty"`
+	Host             User          `json:"host"`
+	CoHosts          []int         `json:"coHosts,omitempty"`
+	VideoPublishers  PublishPolicy `json:"videoPublishers"`
+	ScreenPublishers PublishPolicy `json:"screenPublishers"`
+	// Stage lets only the host, co-hosts and Speakers publish, everyone
+	// else joins as a listener
+	Stage    bool  `json:"stage"`
+	Speakers []int `json:"speakers,omitempty"`
+	// Locked rooms are only joined with an invite, except by the host
+	// and co-hosts
+	Locked bool `json:"locked"`
+	// MessageRetention is how many days the room's messages are kept, 0
+	// doesn't keep them and nil uses the default
+	MessageRetention *int `json:"messageRetention,omitempty"`
+}
+
+// IsSpeaker reports whether the user may publish in the room, everyone
+// may unless the room is in stage mode.
+func (s *RoomSettings) IsSpeaker(userID int) bool {
+	return !s.Stage ||
+		s.Host.ID == userID ||
+		slices.Contains(s.CoHosts, userID) ||
+		slices.Contains(s.Speakers, userID)
+}
+
+// PublishPolicy is who may publish a kind of track in a room
+type PublishPolicy string
+
+const (
+	PublishHost     PublishPolicy = "host"
+	PublishCoHosts  PublishPolicy = "coHosts"
+	PublishEveryone PublishPolicy = "everyone"
+)
+
+// TrackSource labels a published track
+type TrackSource string
+
+const (
+	TrackMicrophone TrackSource = "microphone"
+	TrackCamera     TrackSource = "camera"
+	TrackScreen     TrackSource = "screen"
+)
+
+// MediaItem is a video of a room's watch party
+type MediaItem struct {
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	Title string `json:"title,omitempty"`
+	// Duration is in seconds, it's 0 when unknown
+	Duration float64 `json:"duration,omitempty"`
+	AddedBy  User    `json:"addedBy"`
+}
+
+// MediaState is the playback of a room's watch party. Position is in
+// seconds at UpdatedAt, it advances at Rate unless Paused.
+type MediaState struct {
+	Current   *MediaItem   `json:"current"`
+	Position  float64      `json:"position"`
+	Rate      float64      `json:"rate"`
+	Paused    bool         `json:"paused"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	Queue     []*MediaItem `json:"queue"`
+	// Skips are the users who voted to skip the current item
+	Skips []int `json:"skips"`
+}
+
+// PositionAt returns the playback position at the time, it stops at the end
+// of the current item.
+func (m *MediaState) PositionAt(at time.Time) float64 {
+	pos := m.Position
+	if !m.Paused && at.After(m.UpdatedAt) {
+		pos += at.Sub(m.UpdatedAt).Seconds() * m.Rate
+	}
+	if m.Current != nil && m.Current.Duration > 0 {
+		pos = min(pos, m.Current.Duration)
+	}
+	return pos
+}
+
+// Settle moves Position to the time, so the playback can be changed from
+// there.
+func (m *MediaState) Settle(at time.Time) {
+	m.Position = m.PositionAt(at)
+	m.UpdatedAt = at
+}
+
+// Ended reports whether the current item has played to its end, it's never
+// the case when the duration is unknown.
+func (m *MediaState) Ended(at time.Time) bool {
+	return m.Current != nil && m.Current.Duration > 0 && m.PositionAt(at) >= m.Current.Duration
+}
+
+// Next plays the first queued item from the start, or nothing if the queue
+// is empty.
+func (m *MediaState) Next(at time.Time) {
+	m.Current = nil
+	if len(m.Queue) > 0 {
+		m.Current = m.Queue[0]
+		m.Queue = m.Queue[1:]
+	}
+	m.Position = 0
+	m.Paused = false
+	m.UpdatedAt = at
+	m.Skips = nil
 }
 
 type GoogleOAuthToken struct {
@@ -56,6 +200,18 @@ type GoogleUserInfo struct {
 	Picture       string `json:"picture"`
 }
 
+// RoomInvite lets the users who have its code join a locked room.
+type RoomInvite struct {
+	Code      string `json:"code"`
+	RoomID    int    `json:"-"`
+	CreatedBy int    `json:"createdBy"`
+	// MaxUses is how many users may join with it, nil for any number
+	MaxUses   *int       `json:"maxUses,omitempty"`
+	Uses      int        `json:"uses"`
+	ExpiredAt *time.Time `json:"expiredAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
 type Kick struct {
 	RoomID    int
 	UserID    int
@@ -66,6 +222,8 @@ type Config struct {
 	CookieExpiration        time.Duration `env:"COOKIE_EXPIRATION,required"`
 	RoomInactivityThreshold time.Duration `env:"ROOM_INACTIVITY_THRESHOLD,required"`
 	MaxRoomsHosted          int           `env:"MAX_ROOMS_HOSTED,required"`
+	ShutdownTimeout         time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	ShutdownReconnectHint   time.Duration `env:"SHUTDOWN_RECONNECT_HINT" envDefault:"3s"`
 
 	GoogleOAuth struct {
 		RedirectURL  string `env:"GOOGLE_OAUTH_REDIRECT_URL,required"`
@@ -81,6 +239,224 @@ type Config struct {
 		APIKey  string `env:"GEMINI_API_KEY,required"`
 		AIModel string `env:"GEMINI_AI_MODEL,required"`
 	}
+
+	Socket struct {
+		QueueSize    int           `env:"WS_QUEUE_SIZE" envDefault:"256"`
+		WriteTimeout time.Duration `env:"WS_WRITE_TIMEOUT" envDefault:"10s"`
+		// what to do when a client's outbound queue is full: OverflowDrop or
+		// OverflowDisconnect
+		OverflowPolicy string `env:"WS_OVERFLOW_POLICY" envDefault:"disconnect"`
+		// how long a dropped connection is held so the client can resume it
+		ResumeGrace time.Duration `env:"WS_RESUME_GRACE" envDefault:"30s"`
+		// number of recent events kept for replay on resume
+		ResumeBufferSize int `env:"WS_RESUME_BUFFER_SIZE" envDefault:"256"`
+	}
+
+	RateLimits struct {
+		NewMessage        RateLimit `env:"RATE_LIMIT_NEW_MESSAGE" envDefault:"10/10s"`
+		ReactionToMessage RateLimit `env:"RATE_LIMIT_REACTION_TO_MESSAGE" envDefault:"20/10s"`
+		SetStatus         RateLimit `env:"RATE_LIMIT_SET_STATUS" envDefault:"5/1m"`
+		PeerOffer         RateLimit `env:"RATE_LIMIT_PEER_OFFER" envDefault:"10/1m"`
+		SetPresence       RateLimit `env:"RATE_LIMIT_SET_PRESENCE" envDefault:"10/1m"`
+		RaiseHand         RateLimit `env:"RATE_LIMIT_RAISE_HAND" envDefault:"5/1m"`
+		MediaQueue        RateLimit `env:"RATE_LIMIT_MEDIA_QUEUE" envDefault:"5/1m"`
+		MediaVoteSkip     RateLimit `env:"RATE_LIMIT_MEDIA_VOTE_SKIP" envDefault:"5/1m"`
+		// users exceeding a limit this many times within the window are
+		// disconnected and can't connect until the window is over
+		MaxViolations   int           `env:"RATE_LIMIT_MAX_VIOLATIONS" envDefault:"30"`
+		ViolationWindow time.Duration `env:"RATE_LIMIT_VIOLATION_WINDOW" envDefault:"10m"`
+	}
+
+	RTC struct {
+		STUNURLs []string `env:"RTC_STUN_URLS" envDefault:"stun:stun.l.google.com:19302"`
+		TURNURLs []string `env:"RTC_TURN_URLS"`
+		// shared secret of the TURN server's REST API (coturn's
+		// static-auth-secret), the credentials are derived from it. It's
+		// required with TURNURLs
+		TURNSecret        string        `env:"RTC_TURN_SECRET"`
+		TURNCredentialTTL time.Duration `env:"RTC_TURN_CREDENTIAL_TTL" envDefault:"12h"`
+		// range of the UDP ports used for ICE, 0 lets the OS pick them
+		UDPPortMin uint16 `env:"RTC_UDP_PORT_MIN"`
+		UDPPortMax uint16 `env:"RTC_UDP_PORT_MAX"`
+		// public IPs advertised instead of the host's when behind a 1:1 NAT
+		NAT1To1IPs []string `env:"RTC_NAT_1TO1_IPS"`
+		// single ports shared by every peer for ICE, 0 disables them
+		ICEUDPMuxPort int `env:"RTC_ICE_UDP_MUX_PORT"`
+		ICETCPMuxPort int `env:"RTC_ICE_TCP_MUX_PORT"`
+		// a disconnected peer gets this long to reconnect with an ICE
+		// restart before it's rebuilt
+		ICERestartTimeout time.Duration `env:"RTC_ICE_RESTART_TIMEOUT" envDefault:"10s"`
+		// the participant leaves the room once its peer couldn't be
+		// recovered for this long, 0 closes the peer when it fails
+		RecoveryTimeout time.Duration `env:"RTC_RECOVERY_TIMEOUT" envDefault:"30s"`
+	}
+
+	ActiveSpeakers struct {
+		// how often the active speakers are sent, 0 disables them
+		Interval time.Duration `env:"ACTIVE_SPEAKERS_INTERVAL" envDefault:"500ms"`
+		// participants quieter than this, in -dBov, aren't speaking
+		Threshold int `env:"ACTIVE_SPEAKERS_THRESHOLD" envDefault:"50"`
+		Max       int `env:"ACTIVE_SPEAKERS_MAX" envDefault:"3"`
+	}
+
+	Stage struct {
+		// listeners of a stage room don't count against its
+		// MaxParticipants, they have their own limit
+		MaxListeners int `env:"STAGE_MAX_LISTENERS" envDefault:"200"`
+	}
+
+	Stats struct {
+		// how often the peers' stats are polled, 0 disables them
+		Interval time.Duration `env:"STATS_INTERVAL" envDefault:"5s"`
+		// send every participant the quality of their own connection
+		ConnectionQuality bool `env:"STATS_CONNECTION_QUALITY" envDefault:"false"`
+		// bearer token of the operator stats endpoint, it's disabled
+		// when empty
+		OperatorToken string `env:"STATS_OPERATOR_TOKEN"`
+	}
+
+	Recording struct {
+		// directory the recordings are stored in, one per room
+		Dir string `env:"RECORDING_DIR" envDefault:"recordings"`
+	}
+	Media struct {
+		// how often the playing position is sent for the clients to
+		// correct their drift, 0 disables it along with the queue
+		// advancing on its own
+		SyncInterval time.Duration `env:"MEDIA_SYNC_INTERVAL" envDefault:"5s"`
+		MaxQueue     int           `env:"MEDIA_MAX_QUEUE" envDefault:"50"`
+		// share of the room's participants voting to skip the current
+		// item, the host and co-hosts skip it on their own
+		SkipRatio float64 `env:"MEDIA_SKIP_RATIO" envDefault:"0.5"`
+	}
+
+	Messages struct {
+		// days the room messages are kept, for the rooms which don't
+		// set their own retention
+		Retention int `env:"ROOM_MESSAGE_RETENTION" envDefault:"7"`
+		// recent messages of each room which doesn't keep them the
+		// server knows the author of, the older ones can't be edited,
+		// deleted or reacted to
+		IndexSize int `env:"ROOM_MESSAGE_INDEX_SIZE" envDefault:"500"`
+	}
+
+	Ingest struct {
+		// audio tracks a WHEP viewer receives at most, they carry the
+		// loudest microphones of the room
+		WHEPSlots int `env:"INGEST_WHEP_SLOTS" envDefault:"3"`
+		// how long the server gathers ICE candidates for the answer
+		GatherTimeout time.Duration `env:"INGEST_GATHER_TIMEOUT" envDefault:"5s"`
+	}
+}
+
+const (
+	OverflowDrop       = "drop"
+	OverflowDisconnect = "disconnect"
+)
+
+// Validate checks the settings env can't, like the values a setting is one of.
+func (c *Config) Validate() error {
+	switch c.Socket.OverflowPolicy {
+	case OverflowDrop, OverflowDisconnect:
+	default:
+		return fmt.Errorf("WS_OVERFLOW_POLICY must be %q or %q, got %q", OverflowDrop, OverflowDisconnect, c.Socket.OverflowPolicy)
+	}
+	// the TURN servers would refuse the clients without credentials
+	if len(c.RTC.TURNURLs) > 0 && c.RTC.TURNSecret == "" {
+		return errors.New("RTC_TURN_SECRET is required with RTC_TURN_URLS")
+	}
+	return nil
+}
+
+// PeerStats is the media quality of a participant's peer connection
+type PeerStats struct {
+	ParticipantID string `json:"participantID"`
+	User          *User  `json:"user"`
+	RoomID        int    `json:"roomID"`
+	// RTT and Jitter are in milliseconds
+	RTT    float64 `json:"rtt"`
+	Jitter float64 `json:"jitter"`
+	// PacketLoss is the fraction of the packets lost, in either direction
+	PacketLoss float64 `json:"packetLoss"`
+	// bits per second received from and sent to the participant
+	BitrateIn  uint64 `json:"bitrateIn"`
+	BitrateOut uint64 `json:"bitrateOut"`
+	// CandidateType is the type of the selected ICE candidate pair: host,
+	// srflx, prflx or relay
+	CandidateType string            `json:"candidateType"`
+	Quality       ConnectionQuality `json:"quality"`
+	UpdatedAt     time.Time         `json:"updatedAt"`
+}
+
+type ConnectionQuality string
+
+const (
+	QualityGood ConnectionQuality = "good"
+	QualityFair ConnectionQuality = "fair"
+	QualityPoor ConnectionQuality = "poor"
+)
+
+// Recording is the manifest of a room recording. The offsets are in
+// milliseconds from the start of the recording.
+type Recording struct {
+	ID        string            `json:"id"`
+	RoomID    int               `json:"roomID"`
+	StartedBy *User             `json:"startedBy"`
+	StartedAt time.Time         `json:"startedAt"`
+	StoppedAt *time.Time        `json:"stoppedAt,omitempty"`
+	Tracks    []*RecordedTrack  `json:"tracks"`
+	Speakers  []*SpeakerSegment `json:"speakers"`
+}
+
+// RecordedTrack is a track of a participant written to File
+type RecordedTrack struct {
+	File          string `json:"file"`
+	ParticipantID string `json:"participantID"`
+	User          *User  `json:"user"`
+	Start         int64  `json:"start"`
+	End           *int64 `json:"end,omitempty"`
+}
+
+// SpeakerSegment is a span of the recording the participant was speaking
+// in, as told by the audio level of its microphone
+type SpeakerSegment struct {
+	ParticipantID string `json:"participantID"`
+	User          *User  `json:"user"`
+	From          int64  `json:"from"`
+	To            *int64 `json:"to,omitempty"`
+}
+
+// ICEServer is sent to the clients in the RTC config, it matches the
+// RTCIceServer dictionary of the browsers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// RateLimit is a token bucket holding Events tokens, which are refilled
+// over Per. It's configured as "events/duration", e.g. "10/1m".
+type RateLimit struct {
+	Events int
+	Per    time.Duration
+}
+
+func (l *RateLimit) UnmarshalText(text []byte) error {
+	events, per, ok := strings.Cut(string(text), "/")
+	if !ok {
+		return fmt.Errorf("invalid rate limit %q, should be events/duration", text)
+	}
+	n, err := strconv.Atoi(events)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid rate limit events %q", events)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid rate limit duration %q", per)
+	}
+	l.Events = n
+	l.Per = d
+	return nil
 }
 
 type RoomsResponse struct {
@@ -109,6 +485,33 @@ type Message struct {
 	IsEdited    bool              `json:"isEdited"`
 }
 
+// RoomMessageRef is what the server remembers of a recent room message to
+// check who may edit, delete or react to it.
+type RoomMessageRef struct {
+	ID   string `json:"id"`
+	From User   `json:"from"`
+	// ParticipantID is who a whisper is sent to, nil for the messages to
+	// the whole room
+	ParticipantID *int `json:"participantID,omitempty"`
+}
+
+// IsPartOf reports whether the message is a whisper between the user and
+// the participant.
+func (r *RoomMessageRef) IsPartOf(userID, participantID int) bool {
+	if r.ParticipantID == nil {
+		return false
+	}
+	return (r.From.ID == userID && *r.ParticipantID == participantID) ||
+		(r.From.ID == participantID && *r.ParticipantID == userID)
+}
+
+// MessageCursor is the last message of the page before, the messages sent
+// at the same time are told apart by their ID.
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
 type MessageResponse struct {
 	Message
 	Reactions *map[string]map[int]struct{} `json:"reactions,omitempty"`
@@ -133,7 +536,8 @@ const (
 
 type RelationRes struct {
 	User
-	IsFriend bool `json:"isFriend"`
+	IsFriend bool     `json:"isFriend"`
+	Presence Presence `json:"presence"`
 }
 
 type DMResponse struct {
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr bool
+	}{
+		{name: "drop", change: func(c *Config) { c.Socket.OverflowPolicy = OverflowDrop }},
+		{name: "disconnect", change: func(c *Config) { c.Socket.OverflowPolicy = OverflowDisconnect }},
+		{name: "unknown overflow policy", change: func(c *Config) { c.Socket.OverflowPolicy = "coalesce" }, wantErr: true},
+		{name: "empty overflow policy", change: func(c *Config) { c.Socket.OverflowPolicy = "" }, wantErr: true},
+		{
+			name: "turn with a secret",
+			change: func(c *Config) {
+				c.RTC.TURNURLs = []string{"turn:turn.example.com:3478"}
+				c.RTC.TURNSecret = "north"
+			},
+		},
+		{
+			name:    "turn without a secret",
+			change:  func(c *Config) { c.RTC.TURNURLs = []string{"turn:turn.example.com:3478"} },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			c.Socket.OverflowPolicy = OverflowDisconnect
+			tt.change(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPresenceOf(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		sessions []*Participant
+		want     Presence
+	}{
+		{name: "no sessions", want: Presence{Status: PresenceOffline}},
+		{
+			name:     "idle tabs",
+			sessions: []*Participant{{Idle: true}, {Idle: true}},
+			want:     Presence{Status: PresenceIdle},
+		},
+		{
+			name:     "one active tab",
+			sessions: []*Participant{{Idle: true}, {}, {Idle: true}},
+			want:     Presence{Status: PresenceOnline},
+		},
+		{
+			name: "room of the latest join",
+			sessions: []*Participant{
+				{RoomID: 1, JoinedAt: now.Add(-time.Minute)},
+				{RoomID: 2, JoinedAt: now, Idle: true},
+				{JoinedAt: now.Add(time.Minute)},
+			},
+			want: Presence{Status: PresenceOnline, RoomID: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PresenceOf(tt.sessions); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,41 @@
 package types
 
+import (
+	v "backend/validator"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	minMsgContentLen = 1
+	maxMsgContentLen = 1024
+	maxWelcomeMsgLen = 512
+	minKickDuration  = time.Minute
+	maxMediaURLLen   = 2048
+	maxMediaTitleLen = 256
+	minMediaRate     = 0.25
+	maxMediaRate     = 4
+)
+
+var (
+	allowedStatus   = []string{"None", "AFK", "BRB", "Busy", ".zZ"}
+	trackSources    = []string{string(TrackMicrophone), string(TrackCamera), string(TrackScreen)}
+	publishPolicies = []string{string(PublishHost), string(PublishCoHosts), string(PublishEveryone)}
+)
+
 type Event struct {
+	// ID is set by the client to correlate the ACK or ERROR sent in reply
+	ID   string `json:"id,omitempty"`
 	Name string `json:"name"`
 	Data any    `json:"data"`
 }
 
 type JoinRoom struct {
-	RoomID int    `json:"roomID"`
-	Key    string `json:"key"`
+	RoomID int `json:"roomID"`
+	// Key is the invite code of a locked room
+	Key string `json:"key"`
 }
 
 type LeaveRoom struct {
@@ -21,6 +49,16 @@ type NewMessage struct {
 	ParticipantID *int    `json:"participantID"`
 }
 
+func (r *NewMessage) Validate() (bool, error) {
+	vd := v.NewValidator().
+		Count("content", &r.Content, "min", minMsgContentLen).
+		Count("content", &r.Content, "max", maxMsgContentLen)
+	if r.RoomID == nil && r.ParticipantID == nil {
+		vd.Errors["roomID"] = "either roomID or participantID is required"
+	}
+	return vd.IsValid(), vd
+}
+
 type EditMessage struct {
 	ID            string `json:"id"`
 	Content       string `json:"content"`
@@ -28,12 +66,30 @@ type EditMessage struct {
 	ParticipantID *int   `json:"participantID"`
 }
 
+func (r *EditMessage) Validate() (bool, error) {
+	vd := v.NewValidator().
+		Count("content", &r.Content, "min", minMsgContentLen).
+		Count("content", &r.Content, "max", maxMsgContentLen)
+	if r.RoomID == nil && r.ParticipantID == nil {
+		vd.Errors["roomID"] = "either roomID or participantID is required"
+	}
+	return vd.IsValid(), vd
+}
+
 type DeleteMessage struct {
 	ID            string `json:"id"`
 	RoomID        *int   `json:"roomID"`
 	ParticipantID *int   `json:"participantID"`
 }
 
+func (r *DeleteMessage) Validate() (bool, error) {
+	vd := v.NewValidator()
+	if r.RoomID == nil && r.ParticipantID == nil {
+		vd.Errors["roomID"] = "either roomID or participantID is required"
+	}
+	return vd.IsValid(), vd
+}
+
 type ReactionToMessage struct {
 	ID            string `json:"id"`
 	Reaction      string `json:"reaction"`
@@ -41,6 +97,14 @@ type ReactionToMessage struct {
 	RoomID        *int   `json:"roomID"`
 }
 
+func (r *ReactionToMessage) Validate() (bool, error) {
+	vd := v.NewValidator()
+	if r.RoomID == nil && r.ParticipantID == nil {
+		vd.Errors["roomID"] = "either roomID or participantID is required"
+	}
+	return vd.IsValid(), vd
+}
+
 type ClearChat struct {
 	ParticipantID int `json:"participantId"`
 	RoomID        int `json:"roomID"`
@@ -57,11 +121,27 @@ type UpdateWelcomeMessage struct {
 	WelcomeMessage string `json:"welcomeMessage"`
 }
 
+func (r *UpdateWelcomeMessage) Validate() (bool, error) {
+	vd := v.NewValidator().
+		Count("welcomeMessage", &r.WelcomeMessage, "max", maxWelcomeMsgLen)
+	return vd.IsValid(), vd
+}
+
 type SetStatus struct {
 	RoomID int    `json:"roomID"`
 	Status string `json:"status"`
 }
 
+func (r *SetStatus) Validate() (bool, error) {
+	vd := v.NewValidator().
+		IsInStr("status", &r.Status, allowedStatus)
+	return vd.IsValid(), vd
+}
+
+type SetPresence struct {
+	Idle bool `json:"idle"`
+}
+
 type KickParticipant struct {
 	RoomID        int    `json:"roomID"`
 	ParticipantID int    `json:"participantID"`
@@ -69,6 +149,17 @@ type KickParticipant struct {
 	ClearChat     bool   `json:"clearChat"`
 }
 
+func (r *KickParticipant) Validate() (bool, error) {
+	vd := v.NewValidator()
+	d, err := time.ParseDuration(r.Duration)
+	if err != nil {
+		vd.Errors["duration"] = "invalid duration"
+	} else if d < minKickDuration {
+		vd.Errors["duration"] = "should be atleast 1 minute"
+	}
+	return vd.IsValid(), vd
+}
+
 type ICECandiate struct {
 	RoomID    int    `json:"roomID"`
 	Candidate string `json:"candidate"`
@@ -77,6 +168,17 @@ type ICECandiate struct {
 type PeerOffer struct {
 	RoomID int    `json:"roomID"`
 	Offer  string `json:"offer"`
+	// Tracks labels the published tracks by their ID
+	Tracks map[string]TrackSource `json:"tracks,omitempty"`
+}
+
+func (r *PeerOffer) Validate() (bool, error) {
+	vd := v.NewValidator()
+	for id, source := range r.Tracks {
+		src := string(source)
+		vd.IsInStr("tracks."+id, &src, trackSources)
+	}
+	return vd.IsValid(), vd
 }
 
 type PeerAnswer struct {
@@ -84,6 +186,159 @@ type PeerAnswer struct {
 	Answer string `json:"answer"`
 }
 
+type UpdatePublishSettings struct {
+	RoomID           int           `json:"roomID"`
+	VideoPublishers  PublishPolicy `json:"videoPublishers"`
+	ScreenPublishers PublishPolicy `json:"screenPublishers"`
+}
+
+func (r *UpdatePublishSettings) Validate() (bool, error) {
+	vd := v.NewValidator()
+	video, screen := string(r.VideoPublishers), string(r.ScreenPublishers)
+	vd.IsInStr("videoPublishers", &video, publishPolicies)
+	vd.IsInStr("screenPublishers", &screen, publishPolicies)
+	return vd.IsValid(), vd
+}
+
+type ForceMute struct {
+	RoomID        int  `json:"roomID"`
+	ParticipantID *int `json:"participantID"`
+	// AllGuests mutes every participant but the host and co-hosts
+	AllGuests bool `json:"allGuests"`
+	Mute      bool `json:"mute"`
+}
+
+func (r *ForceMute) Validate() (bool, error) {
+	vd := v.NewValidator()
+	if (r.ParticipantID == nil) == !r.AllGuests {
+		vd.Errors["participantID"] = "either participantID or allGuests is required"
+	}
+	return vd.IsValid(), vd
+}
+
+type RaiseHand struct {
+	RoomID int `json:"roomID"`
+	// Raise is false to lower the hand
+	Raise bool `json:"raise"`
+}
+
+// HandRequest approves or dismisses the raised hand of ParticipantID
+type HandRequest struct {
+	RoomID        int `json:"roomID"`
+	ParticipantID int `json:"participantID"`
+}
+
+type SetSpeaker struct {
+	RoomID        int  `json:"roomID"`
+	ParticipantID int  `json:"participantID"`
+	Speaker       bool `json:"speaker"`
+}
+
+// MediaLoad plays URL in the room from the start, an empty URL plays the
+// next queued item
+type MediaLoad struct {
+	RoomID   int     `json:"roomID"`
+	URL      string  `json:"url"`
+	Title    string  `json:"title"`
+	Duration float64 `json:"duration"`
+}
+
+func (r *MediaLoad) Validate() (bool, error) {
+	vd := v.NewValidator()
+	if r.URL != "" {
+		validateMedia(vd, &r.URL, &r.Title, r.Duration)
+	}
+	return vd.IsValid(), vd
+}
+
+// MediaPlay resumes the playback, from Position at Rate when they're set
+type MediaPlay struct {
+	RoomID   int      `json:"roomID"`
+	Position *float64 `json:"position"`
+	Rate     *float64 `json:"rate"`
+}
+
+func (r *MediaPlay) Validate() (bool, error) {
+	vd := v.NewValidator()
+	validatePosition(vd, r.Position)
+	if r.Rate != nil && (*r.Rate < minMediaRate || *r.Rate > maxMediaRate) {
+		vd.Errors["rate"] = fmt.Sprintf("should be between %v and %v", minMediaRate, maxMediaRate)
+	}
+	return vd.IsValid(), vd
+}
+
+// MediaPause pauses the playback, at Position when it's set
+type MediaPause struct {
+	RoomID   int      `json:"roomID"`
+	Position *float64 `json:"position"`
+}
+
+func (r *MediaPause) Validate() (bool, error) {
+	vd := v.NewValidator()
+	validatePosition(vd, r.Position)
+	return vd.IsValid(), vd
+}
+
+type MediaSeek struct {
+	RoomID   int     `json:"roomID"`
+	Position float64 `json:"position"`
+}
+
+func (r *MediaSeek) Validate() (bool, error) {
+	vd := v.NewValidator()
+	validatePosition(vd, &r.Position)
+	return vd.IsValid(), vd
+}
+
+type MediaQueue struct {
+	RoomID   int     `json:"roomID"`
+	URL      string  `json:"url"`
+	Title    string  `json:"title"`
+	Duration float64 `json:"duration"`
+}
+
+func (r *MediaQueue) Validate() (bool, error) {
+	vd := v.NewValidator()
+	validateMedia(vd, &r.URL, &r.Title, r.Duration)
+	return vd.IsValid(), vd
+}
+
+// MediaDequeue removes the item ID from the queue
+type MediaDequeue struct {
+	RoomID int    `json:"roomID"`
+	ID     string `json:"id"`
+}
+
+type MediaVoteSkip struct {
+	RoomID int `json:"roomID"`
+}
+
+func validateMedia(vd *v.Validator, mediaURL, title *string, duration float64) {
+	vd.Count("url", mediaURL, "max", maxMediaURLLen).
+		Count("title", title, "max", maxMediaTitleLen)
+	u, err := url.Parse(*mediaURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		vd.Errors["url"] = "should be a http or https url"
+	}
+	if duration < 0 {
+		vd.Errors["duration"] = "shouldn't be negative"
+	}
+}
+
+func validatePosition(vd *v.Validator, position *float64) {
+	if position != nil && *position < 0 {
+		vd.Errors["position"] = "shouldn't be negative"
+	}
+}
+
+type StartRecording struct {
+	RoomID int `json:"roomID"`
+}
+
+type StopRecording struct {
+	RoomID int `json:"roomID"`
+}
+
 type PeerMute struct {
 	RoomID int  `json:"roomID"`
 	Mute   bool `json:"mute"`
@@ -96,3 +351,38 @@ type AIMessageRequest struct {
 	MsgID   string
 	AIReply string
 }
+
+type ClusterEventKind string
+
+const (
+	// ClusterAll is delivered to every connection
+	ClusterAll ClusterEventKind = "all"
+	// ClusterRoom is delivered to every connection in RoomID
+	ClusterRoom ClusterEventKind = "room"
+	// ClusterUsers is delivered to every connection of UserIDs
+	ClusterUsers ClusterEventKind = "users"
+	// ClusterKick removes UserIDs from RoomID
+	ClusterKick ClusterEventKind = "kick"
+	// ClusterRoomCreated adds RoomID to the instance
+	ClusterRoomCreated ClusterEventKind = "roomCreated"
+	// ClusterRoomsDeleted removes RoomIDs from the instance
+	ClusterRoomsDeleted ClusterEventKind = "roomsDeleted"
+	// ClusterForceMute mutes or unmutes UserIDs in RoomID
+	ClusterForceMute ClusterEventKind = "forceMute"
+	// ClusterStageChanged removes the tracks of RoomID's participants who
+	// aren't speakers anymore
+	ClusterStageChanged ClusterEventKind = "stageChanged"
+)
+
+// ClusterEvent is published over redis so every backend instance can
+// deliver it to the connections it owns.
+type ClusterEvent struct {
+	Origin  string           `json:"origin"`
+	Kind    ClusterEventKind `json:"kind"`
+	Name    string           `json:"name,omitempty"`
+	Event   json.RawMessage  `json:"event,omitempty"`
+	RoomID  int              `json:"roomID,omitempty"`
+	RoomIDs []int            `json:"roomIDs,omitempty"`
+	UserIDs []int            `json:"userIDs,omitempty"`
+	Mute    bool             `json:"mute,omitempty"`
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	t "backend/types"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lithammer/shortuuid/v4"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	ingestWHIP = "whip"
+	ingestWHEP = "whep"
+
+	defaultIngestName = "Ingest"
+	maxIngestName     = 32
+	maxOfferSize      = 64 << 10
+)
+
+var (
+	errInvalidOffer  = errors.New("invalid sdp offer")
+	errSessionClosed = errors.New("ingest session closed")
+)
+
+// externalPeer is a WHIP publisher or a WHEP viewer. Its peer is negotiated
+// once over HTTP, it has no socket connection and never renegotiates.
+type externalPeer struct {
+	id     string
+	roomID int
+	kind   string
+	peer   *Peer
+	// participant is the WHIP publisher shown in the room
+	participant *t.Participant
+	// slots are the audio tracks sent to a WHEP viewer, video is the only
+	// video one if the viewer asked for it
+	slots []*whepSlot
+	video *whepSlot
+}
+
+// isIngest reports whether the participant is a WHIP publisher. It has no
+// user account, it doesn't take a spot in the room and can't be moderated.
+func isIngest(p *t.Participant) bool {
+	return p.ID == 0
+}
+
+// whepSlot is a transceiver of a WHEP viewer, the room track it carries is
+// swapped without renegotiating. An empty slot sends its idle track, which
+// never has any packet.
+type whepSlot struct {
+	sender *webrtc.RTPSender
+	idle   webrtc.TrackLocal
+	// track is read by readRTCP to pass on the keyframe requests
+	track atomic.Pointer[roomTrack]
+}
+
+// newExternalPeer creates the peer of a WHIP or WHEP session, it's closed
+// once its connection fails.
+func (s *socketServer) newExternalPeer(roomID int, kind string) (*externalPeer, error) {
+	pc, statsGetter, err := s.webrtcAPI.newPeerConnection(webrtc.Configuration{
+		ICEServers: webrtcICEServers(s.cfg),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e := &externalPeer{
+		id:     shortuuid.New(),
+		roomID: roomID,
+		kind:   kind,
+		peer: &Peer{
+			roomID:         roomID,
+			PeerConnection: pc,
+			stats:          statsGetter,
+			sources:        make(map[string]t.TrackSource),
+			subscribed:     make(map[string]*roomTrack),
+			senders:        make(map[string]*webrtc.RTPSender),
+		},
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.do(func() {
+				s.closeExternal(e)
+			})
+		}
+	})
+	return e, nil
+}
+
+// answer accepts the offer and returns the answer with every gathered
+// candidate, the peer doesn't trickle them.
+func (e *externalPeer) answer(offer string, timeout time.Duration) (string, error) {
+	err := e.peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+	answer, err := e.peer.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(e.peer.PeerConnection)
+	if err := e.peer.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(timeout):
+		log.Printf("ingest %s: answering before ice gathering is complete", e.id)
+	}
+	return e.peer.LocalDescription().SDP, nil
+}
+
+// startWHIP publishes the tracks of the offer to the room as a new
+// participant named name.
+func (s *socketServer) startWHIP(roomID int, name, offer string) (*externalPeer, string, error) {
+	if s.draining.Load() {
+		return nil, "", errShuttingDown
+	}
+	e, err := s.newExternalPeer(roomID, ingestWHIP)
+	if err != nil {
+		return nil, "", err
+	}
+	e.participant = &t.Participant{
+		User: t.User{
+			Username: name,
+			Avatar:   s.bot.Avatar,
+		},
+		SID:      "whip-" + e.id,
+		JoinedAt: time.Now().UTC(),
+		RoomID:   roomID,
+	}
+
+	e.peer.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		log.Printf("ingest %s: received %s track", e.id, tr.Kind())
+
+		// the track and stream IDs of the encoder may collide with the
+		// room's, the tracks of the session share the participant's stream
+		track, err := webrtc.NewTrackLocalStaticRTP(tr.Codec().RTPCodecCapability, shortuuid.New(), e.participant.SID)
+		if err != nil {
+			log.Printf("failed to create ingest track: %v", err)
+			return
+		}
+		rt := &roomTrack{
+			pID:       e.participant.SID,
+			source:    e.peer.trackSource(tr),
+			track:     track,
+			remote:    tr,
+			publisher: e.peer,
+		}
+		s.do(func() {
+			if room, ok := s.rooms[roomID]; !ok || room.external[e.id] != e {
+				err = errSessionClosed
+				return
+			}
+			s.publishTrack(roomID, nil, rt, false)
+		})
+		if err != nil {
+			if err := r.Stop(); err != nil {
+				log.Printf("failed to stop rejected track: %v", err)
+			}
+			return
+		}
+		s.forwardTrack(roomID, rt, r)
+	})
+
+	answer, err := e.answer(offer, s.cfg.Ingest.GatherTimeout)
+	if err != nil {
+		e.peer.Close()
+		return nil, "", err
+	}
+
+	s.do(func() {
+		err = s.addExternal(e)
+	})
+	if err != nil {
+		e.peer.Close()
+		return nil, "", err
+	}
+	return e, answer, nil
+}
+
+// startWHEP sends the room's tracks to a receive-only viewer. The audio
+// slots carry the loudest microphones and the video one the screen share or
+// the active speaker's camera, as many slots as the offer has m-lines.
+func (s *socketServer) startWHEP(roomID int, offer string) (*externalPeer, string, error) {
+	if s.draining.Load() {
+		return nil, "", errShuttingDown
+	}
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+	var audio, video int
+	for _, m := range desc.MediaDescriptions {
+		switch m.MediaName.Media {
+		case webrtc.RTPCodecTypeAudio.String():
+			audio++
+		case webrtc.RTPCodecTypeVideo.String():
+			video++
+		}
+	}
+	audio = min(audio, s.cfg.Ingest.WHEPSlots)
+	video = min(video, 1)
+	if audio+video == 0 {
+		return nil, "", fmt.Errorf("%w: no audio or video to receive", errInvalidOffer)
+	}
+
+	e, err := s.newExternalPeer(roomID, ingestWHEP)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := 0; i < audio+video; i++ {
+		kind := webrtc.RTPCodecTypeAudio
+		if i >= audio {
+			kind = webrtc.RTPCodecTypeVideo
+		}
+		tr, err := e.peer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			e.peer.Close()
+			return nil, "", err
+		}
+		slot := &whepSlot{sender: tr.Sender(), idle: tr.Sender().Track()}
+		go slot.readRTCP()
+		if kind == webrtc.RTPCodecTypeAudio {
+			e.slots = append(e.slots, slot)
+		} else {
+			e.video = slot
+		}
+	}
+
+	answer, err := e.answer(offer, s.cfg.Ingest.GatherTimeout)
+	if err != nil {
+		e.peer.Close()
+		return nil, "", err
+	}
+
+	s.do(func() {
+		err = s.addExternal(e)
+		if err == nil {
+			s.updateWHEP(roomID)
+		}
+	})
+	if err != nil {
+		e.peer.Close()
+		return nil, "", err
+	}
+	return e, answer, nil
+}
+
+// addExternal registers the session in its room, a WHIP publisher joins the
+// room as a participant.
+func (s *socketServer) addExternal(e *externalPeer) error {
+	if s.draining.Load() {
+		return errShuttingDown
+	}
+	room, ok := s.rooms[e.roomID]
+	if !ok {
+		// the room was created on another instance
+		room = s.addRoom(e.roomID)
+	}
+	room.external[e.id] = e
+
+	if e.participant == nil {
+		return nil
+	}
+	s.async(func() {
+		err := s.repo.AddRoomParticipant(context.Background(), s.instanceID, e.roomID, e.participant)
+		if err != nil {
+			log.Printf("failed to add ingest participant: %v", err)
+		}
+		locked := s.isLocked(e.roomID)
+		s.do(func() {
+			s.broadcastMembership(e.roomID, locked, &t.Event{
+				Name: "JOINED_ROOM_BROADCAST",
+				Data: map[string]any{
+					"roomID": e.roomID,
+					"user":   e.participant.User,
+					"sid":    e.participant.SID,
+				},
+			})
+		})
+	})
+	return nil
+}
+
+// closeExternal ends the session, the tracks of a WHIP publisher are removed
+// from the room and it leaves.
+func (s *socketServer) closeExternal(e *externalPeer) {
+	room, ok := s.rooms[e.roomID]
+	if !ok || room.external[e.id] != e {
+		return
+	}
+	delete(room.external, e.id)
+
+	var tracks []*webrtc.TrackLocalStaticRTP
+	for _, rt := range room.tracks {
+		if rt.publisher == e.peer {
+			tracks = append(tracks, rt.track)
+		}
+	}
+	s.removeTracks(e.roomID, tracks...)
+
+	if err := e.peer.Close(); err != nil {
+		log.Printf("failed to close ingest peer connection: %v", err)
+	}
+
+	if e.participant == nil {
+		return
+	}
+	s.async(func() {
+		err := s.repo.RemoveRoomParticipant(context.Background(), s.instanceID, e.roomID, e.participant.SID)
+		if err != nil {
+			log.Printf("failed to remove ingest participant: %v", err)
+		}
+		locked := s.isLocked(e.roomID)
+		s.do(func() {
+			s.broadcastMembership(e.roomID, locked, &t.Event{
+				Name: "LEFT_ROOM_BROADCAST",
+				Data: map[string]any{
+					"roomID": e.roomID,
+					"user":   e.participant.User,
+				},
+			})
+		})
+	})
+}
+
+// closeRoomExternal ends every WHIP and WHEP session of the room.
+func (s *socketServer) closeRoomExternal(roomID int) {
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return
+	}
+	for _, e := range room.external {
+		s.closeExternal(e)
+	}
+}
+
+// updateWHEP assigns the room's tracks to the slots of its WHEP viewers. A
+// slot keeps its track while it's still among the loudest, so the viewers
+// don't hop between tracks of the same loudness.
+func (s *socketServer) updateWHEP(roomID int) {
+	room, ok := s.rooms[roomID]
+	if !ok || len(room.external) == 0 {
+		return
+	}
+
+	var mics, screens, cameras []*roomTrack
+	for _, rt := range room.tracks {
+		switch rt.source {
+		case t.TrackMicrophone:
+			mics = append(mics, rt)
+		case t.TrackScreen:
+			screens = append(screens, rt)
+		case t.TrackCamera:
+			cameras = append(cameras, rt)
+		}
+	}
+	byID := func(tracks []*roomTrack) {
+		sort.Slice(tracks, func(i, j int) bool {
+			return tracks[i].track.ID() < tracks[j].track.ID()
+		})
+	}
+	byID(mics)
+	byID(screens)
+	byID(cameras)
+	sort.SliceStable(mics, func(i, j int) bool {
+		return mics[i].audioLevel() < mics[j].audioLevel()
+	})
+
+	var video *roomTrack
+	switch {
+	case len(screens) > 0:
+		video = screens[0]
+	case len(cameras) > 0:
+		video = cameras[0]
+		for _, rt := range cameras {
+			if len(room.speakers) > 0 && rt.pID == room.speakers[0] {
+				video = rt
+				break
+			}
+		}
+	}
+
+	for _, e := range room.external {
+		if e.kind != ingestWHEP {
+			continue
+		}
+		wanted := mics[:min(len(mics), len(e.slots))]
+		var free []*whepSlot
+		for _, slot := range e.slots {
+			i := -1
+			if rt := slot.track.Load(); rt != nil {
+				i = indexTrack(wanted, rt)
+			}
+			if i < 0 {
+				free = append(free, slot)
+				continue
+			}
+			wanted = append(wanted[:i:i], wanted[i+1:]...)
+		}
+		for i, slot := range free {
+			var rt *roomTrack
+			if i < len(wanted) {
+				rt = wanted[i]
+			}
+			slot.assign(rt)
+		}
+		if e.video != nil {
+			e.video.assign(video)
+		}
+	}
+}
+
+func indexTrack(tracks []*roomTrack, rt *roomTrack) int {
+	for i, tr := range tracks {
+		if tr == rt {
+			return i
+		}
+	}
+	return -1
+}
+
+// assign swaps the track sent by the slot, nil empties it.
+func (slot *whepSlot) assign(rt *roomTrack) {
+	if slot.track.Load() == rt {
+		return
+	}
+	var track webrtc.TrackLocal = slot.idle
+	if rt != nil {
+		track = rt.track
+	}
+	if err := slot.sender.ReplaceTrack(track); err != nil {
+		log.Printf("failed to assign track to whep slot: %v", err)
+		return
+	}
+	slot.track.Store(rt)
+	if rt != nil {
+		rt.requestKeyframe()
+	}
+}
+
+// readRTCP passes the keyframe requests of the viewer on to the publisher
+// of the slot's current track.
+func (slot *whepSlot) readRTCP() {
+	for {
+		pkts, _, err := slot.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if rt := slot.track.Load(); rt != nil {
+					rt.requestKeyframe()
+				}
+			}
+		}
+	}
+}
+
+// hashIngestToken is how the ingest tokens are stored, they are random so
+// a plain hash is enough.
+func hashIngestToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validIngestToken reports whether the request bears the room's ingest
+// token.
+func (app *application) validIngestToken(r *http.Request, roomID int) (bool, error) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false, nil
+	}
+	hash, err := app.repo.GetIngestToken(context.Background(), roomID)
+	if err != nil || hash == nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hashIngestToken(bearer)), []byte(*hash)) == 1, nil
+}
+
+func (app *application) createIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		serverError(w, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash := hashIngestToken(token)
+	if err := app.repo.SetIngestToken(context.Background(), roomID, &hash); err != nil {
+		serverError(w, err)
+		return
+	}
+	// the token is only shown once, a new one replaces it
+	jsonResponse(w, http.StatusCreated, map[string]any{
+		"token": token,
+	})
+}
+
+// revokeIngestTokenHandler stops the token from starting new sessions, the
+// running ones are left alone.
+func (app *application) revokeIngestTokenHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.moderatedRoom(w, r)
+	if !ok {
+		return
+	}
+	if err := app.repo.SetIngestToken(context.Background(), roomID, nil); err != nil {
+		serverError(w, err)
+		return
+	}
+	msgResponse(w, "ingest token revoked")
+}
+
+// ingestRoom returns the room of the WHIP or WHEP request, it writes the
+// error response if the room doesn't exist.
+func (app *application) ingestRoom(w http.ResponseWriter, r *http.Request) (int, bool) {
+	roomID, err := strconv.Atoi(r.PathValue("roomID"))
+	if err != nil {
+		notFoundError(w, err)
+		return 0, false
+	}
+	if _, err := app.repo.GetRoomSettings(context.Background(), roomID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			notFoundError(w, err)
+		} else {
+			serverError(w, err)
+		}
+		return 0, false
+	}
+	return roomID, true
+}
+
+// readOffer reads the SDP offer of a WHIP or WHEP request.
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/sdp" {
+		errorResponse(w, http.StatusUnsupportedMediaType, err)
+		return "", false
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOfferSize))
+	if err != nil {
+		badRequest(w, err)
+		return "", false
+	}
+	return string(b), true
+}
+
+// answerResponse sends the SDP answer of the new session, its Location is
+// where the session is ended.
+func answerResponse(w http.ResponseWriter, e *externalPeer, answer string, err error) {
+	switch {
+	case errors.Is(err, errInvalidOffer):
+		badRequest(w, err)
+		return
+	case errors.Is(err, errShuttingDown):
+		errorResponse(w, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("%s/%s", e.kind, e.id))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// whipHandler publishes a stream to the room, it's authorized by the room's
+// ingest token. The participant is named by the name query parameter.
+func (app *application) whipHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.ingestRoom(w, r)
+	if !ok {
+		return
+	}
+	valid, err := app.validIngestToken(r, roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !valid {
+		unauthRequest(w, errors.New("invalid ingest token"))
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = defaultIngestName
+	}
+	if utf8.RuneCountInString(name) > maxIngestName {
+		badRequest(w, errors.New("ingest name is too long"))
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	e, answer, err := app.ss.startWHIP(roomID, name, offer)
+	answerResponse(w, e, answer, err)
+}
+
+// whepHandler sends the room's tracks to a receive-only viewer, it's
+// authorized by the room's ingest token or the session of a user who isn't
+// kicked from the room.
+func (app *application) whepHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := app.ingestRoom(w, r)
+	if !ok {
+		return
+	}
+	valid, err := app.validIngestToken(r, roomID)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !valid {
+		u, ok := r.Context().Value("user").(*t.User)
+		if !ok {
+			unauthRequest(w, errors.New("invalid ingest token"))
+			return
+		}
+		if _, err := app.repo.GetKick(context.Background(), roomID, u.ID); err == nil {
+			forbiddenError(w, errors.New("kicked from the room"))
+			return
+		}
+		room, err := app.repo.GetRoom(context.Background(), roomID)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		if !app.canJoin(w, r, room, u.ID) {
+			return
+		}
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	e, answer, err := app.ss.startWHEP(roomID, offer)
+	answerResponse(w, e, answer, err)
+}
+
+// deleteIngestHandler ends a WHIP or WHEP session, its unguessable ID in the
+// Location of the answer is what authorizes it.
+func (app *application) deleteIngestHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID, err := strconv.Atoi(r.PathValue("roomID"))
+		if err != nil {
+			notFoundError(w, err)
+			return
+		}
+		id := r.PathValue("sessionID")
+
+		var found bool
+		app.ss.do(func() {
+			room, ok := app.ss.rooms[roomID]
+			if !ok {
+				return
+			}
+			e, ok := room.external[id]
+			if !ok || e.kind != kind {
+				return
+			}
+			found = true
+			app.ss.closeExternal(e)
+		})
+		if !found {
+			notFoundError(w, nil)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
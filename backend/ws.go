@@ -10,9 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"math"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lithammer/shortuuid/v4"
@@ -23,45 +28,98 @@ import (
 )
 
 type roomTrack struct {
-	pID   string
-	track *webrtc.TrackLocalStaticRTP
+	pID    string
+	source t.TrackSource
+	track  *webrtc.TrackLocalStaticRTP
+	// remote is the published track, its publisher is asked for keyframes
+	// when a new subscriber attaches
+	remote    *webrtc.TrackRemote
+	publisher *Peer
+	// lastKeyframeReq is the unix nano time of the last keyframe request,
+	// the subscribers' requests are coalesced
+	lastKeyframeReq atomic.Int64
+	// recorder is set while the track is being recorded
+	recorder atomic.Pointer[trackRecorder]
+	// level is the smoothed audio level of the track, see audioLevel
+	level atomic.Uint64
+	// muted is set when the publisher is muted by a moderator, the
+	// packets are dropped
+	muted atomic.Bool
 }
 
 type socketRoom struct {
-	conns        map[*websocket.Conn]struct{}
-	lastActivity time.Time
-	tracks       map[string]*roomTrack
-}
-
-type socketConn struct {
-	pID  string
-	peer *Peer
+	conns  map[*websocket.Conn]struct{}
+	tracks map[string]*roomTrack
+	// recording of the room's tracks published to this instance
+	recording *roomRecording
+	// speakers are the participants last sent as the active speakers
+	speakers []string
+	// forceMuted are the users muted by a moderator
+	forceMuted map[int]struct{}
+	// external are the WHIP and WHEP sessions of the room, by ID
+	external map[string]*externalPeer
 }
 
 type socketServer struct {
 	bot          *t.User
 	conns        map[*websocket.Conn]*socketConn
 	participants map[string]*t.Participant
-	users        map[int][]string
+	users        map[int]*socketUser
 	rooms        map[int]*socketRoom
-	repo         *db.Repo
+	repo         db.Store
 	emojis       map[string]struct{}
 	svc          *service.Service
 	cfg          *t.Config
 	aiMsgRequest chan *t.AIMessageRequest
-	webrtcAPI    *webrtc.API
+	webrtcAPI    *rtcAPI
+
+	// aiPending holds the ai requests being answered, so they can be
+	// persisted if the server shuts down before they are done
+	aiPending map[*t.AIMessageRequest]struct{}
+	aiMu      sync.Mutex
+	aiWG      sync.WaitGroup
+	aiDone    chan struct{}
+	// aiClosed is set, under aiMu, once aiMsgRequest is closed
+	aiClosed bool
+
+	// draining is set once the server starts shutting down
+	draining atomic.Bool
+
+	// cmds is consumed by run, which is the only goroutine allowed to
+	// touch conns, participants, users, rooms and limiters
+	cmds chan func()
+	// jobs holds the redis and postgres calls queued by the run loop,
+	// runJobs executes them in order outside of it
+	jobsMu    sync.Mutex
+	jobs      []func()
+	jobsReady chan struct{}
+
+	// instanceID identifies this backend among the others sharing redis
+	instanceID string
+	// cluster holds the events waiting to be published to other instances
+	cluster chan *t.ClusterEvent
+	// sessions maps resume tokens to the key of their session in conns
+	sessions map[string]*websocket.Conn
+	// limits holds the rate limit of the events which have one
+	limits map[string]t.RateLimit
+	// limiters holds the token buckets of the users by ID, the ones idle
+	// for limiterTTL are dropped when limitersSwept is that old
+	limiters      map[int]*userLimiters
+	limiterTTL    time.Duration
+	limitersSwept time.Time
 }
 
 var (
 	roomFullErr = errors.New("max participants limit reached")
 )
 
-func newSocketServer(repo *db.Repo, svc *service.Service, webrtcAPI *webrtc.API, cfg *t.Config, bot *t.User, emojis map[string]struct{}) *socketServer {
+func newSocketServer(repo db.Store, svc *service.Service, webrtcAPI *rtcAPI, cfg *t.Config, bot *t.User, emojis map[string]struct{}) *socketServer {
+	limits := rateLimits(cfg)
 	return &socketServer{
 		conns:        make(map[*websocket.Conn]*socketConn),
 		rooms:        make(map[int]*socketRoom),
 		participants: make(map[string]*t.Participant),
-		users:        make(map[int][]string),
+		users:        make(map[int]*socketUser),
 		emojis:       emojis,
 		repo:         repo,
 		svc:          svc,
@@ -70,6 +128,77 @@ func newSocketServer(repo *db.Repo, svc *service.Service, webrtcAPI *webrtc.API,
 		aiMsgRequest: make(chan *t.AIMessageRequest, 1000),
 		bot:          bot,
 		webrtcAPI:    webrtcAPI,
+		aiPending:    make(map[*t.AIMessageRequest]struct{}),
+		aiDone:       make(chan struct{}),
+		cmds:         make(chan func()),
+		jobsReady:    make(chan struct{}, 1),
+		instanceID:   shortuuid.New(),
+		cluster:      make(chan *t.ClusterEvent, 1000),
+		sessions:     make(map[string]*websocket.Conn),
+		limits:       limits,
+		limiters:     make(map[int]*userLimiters),
+		limiterTTL:   limiterTTL(limits),
+	}
+}
+
+// run owns the socket server state. Every change to conns, participants,
+// users and rooms is sent here as a command and executed one at a time.
+func (s *socketServer) run() {
+	for cmd := range s.cmds {
+		cmd()
+	}
+}
+
+// do executes fn on the run loop and waits for it to finish. It must not be
+// called from within a command, as that would deadlock the loop. The event
+// handlers call redis and postgres outside of do and only enter the loop to
+// read or change the state, so a slow query doesn't hold up every room.
+func (s *socketServer) do(fn func()) {
+	done := make(chan struct{})
+	s.cmds <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// async queues fn to run outside the run loop, it's how the loop makes the
+// redis and postgres calls it doesn't wait for. The queued functions run one
+// at a time in the order they were queued, so the writes of a session can't
+// overtake each other. The returned channel is closed once fn is done.
+//
+// fn may call do, but it must not wait for another queued function.
+func (s *socketServer) async(fn func()) <-chan struct{} {
+	done := make(chan struct{})
+	s.jobsMu.Lock()
+	s.jobs = append(s.jobs, func() {
+		defer close(done)
+		fn()
+	})
+	s.jobsMu.Unlock()
+
+	select {
+	case s.jobsReady <- struct{}{}:
+	default:
+	}
+	return done
+}
+
+// runJobs executes the functions queued by async.
+func (s *socketServer) runJobs() {
+	for range s.jobsReady {
+		for {
+			s.jobsMu.Lock()
+			if len(s.jobs) == 0 {
+				s.jobsMu.Unlock()
+				break
+			}
+			job := s.jobs[0]
+			s.jobs[0] = nil
+			s.jobs = s.jobs[1:]
+			s.jobsMu.Unlock()
+			job()
+		}
 	}
 }
 
@@ -83,23 +212,91 @@ func (s *socketServer) accept(conn *websocket.Conn, user *t.User) {
 	if user != nil {
 		p.User = *user
 
-		if _, ok := s.users[user.ID]; !ok {
-			s.users[user.ID] = []string{p.SID}
-		} else {
-			s.users[user.ID] = append(s.users[user.ID], p.SID)
+		u, ok := s.users[user.ID]
+		if !ok {
+			u = newSocketUser()
+			s.users[user.ID] = u
 		}
+		u.sids = append(u.sids, p.SID)
+		s.saveSession(p)
 	}
 
-	s.conns[conn] = &socketConn{
-		pID: p.SID,
-	}
+	c := newSocketConn(conn, p.SID, s.cfg)
+	s.conns[conn] = c
 	s.participants[p.SID] = p
+	c.start()
+
+	if user != nil {
+		s.sessions[c.token] = conn
+		c.send(&t.Event{
+			Name: "SESSION",
+			Data: map[string]any{
+				"sid":         p.SID,
+				"token":       c.token,
+				"resumeGrace": s.cfg.Socket.ResumeGrace.Milliseconds(),
+			},
+		})
+	}
 }
 
-func (s *socketServer) close(conn *websocket.Conn, roomID int, user *t.User) {
-	pID := s.conns[conn].pID
+func (s *socketServer) close(conn *websocket.Conn, user *t.User) {
+	c, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+	s.leaveRoom(conn, user, c.pID, c.roomID)
+	s.endRecovery(c)
+	c.stop()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	delete(s.sessions, c.token)
 	delete(s.conns, conn)
-	s.leaveRoom(conn, user, pID, roomID)
+	delete(s.participants, c.pID)
+	if user != nil {
+		s.removeSession(user, c.pID)
+	}
+}
+
+func (s *socketServer) removeSession(user *t.User, pID string) {
+	u, ok := s.users[user.ID]
+	if !ok {
+		return
+	}
+	u.sids = utils.Filter(u.sids, func(val string) bool {
+		return val != pID
+	})
+	if len(u.sids) == 0 {
+		delete(s.users, user.ID)
+	}
+
+	session := *user
+	s.async(func() {
+		s.changePresence(session, func() {
+			if err := s.repo.RemoveUserSession(context.Background(), s.instanceID, session.ID, pID); err != nil {
+				log.Printf("failed to remove user session: %v", err)
+			}
+		})
+	})
+}
+
+// isOnline reports whether the user has a session on any instance. It's
+// called outside of the run loop.
+func (s *socketServer) isOnline(userID int) bool {
+	var local bool
+	s.do(func() {
+		_, local = s.users[userID]
+	})
+	if local {
+		return true
+	}
+	sessions, err := s.repo.GetUserSessions(context.Background(), userID)
+	if err != nil {
+		log.Printf("failed to get user sessions: %v", err)
+		return false
+	}
+	return len(sessions) > 0
 }
 
 func (s *socketServer) isInRoom(conn *websocket.Conn, roomID int) bool {
@@ -119,165 +316,420 @@ func (s *socketServer) leaveRoom(conn *websocket.Conn, user *t.User, pID string,
 		return
 	}
 
-	// remove participants from users map
-	if _, ok := s.users[user.ID]; ok {
-		s.users[user.ID] = utils.Filter(s.users[user.ID], func(val string) bool {
-			return val != pID
-		})
-
-		if len(s.users[user.ID]) == 0 {
-			delete(s.users, user.ID)
-		}
+	p := s.participants[pID]
+	if c, ok := s.conns[conn]; ok {
+		s.endRecovery(c)
 	}
+	p.RoomID = 0
+	s.saveSession(p)
 
+	if c := s.conns[conn]; c.peer != nil && c.peer.roomID == roomID {
+		s.closePeer(c)
+	}
 	delete(room.conns, conn)
-	room.lastActivity = time.Now().UTC()
-
-	s.broadcastEvent(&t.Event{
-		Name: "LEFT_ROOM_BROADCAST",
-		Data: map[string]any{
-			"roomID": roomID,
-			"user":   user,
-		},
+	if len(room.conns) == 0 && room.recording != nil {
+		s.stopRecording(roomID, nil)
+	}
+	u := *user
+	s.async(func() {
+		s.leaveStage(roomID, &u)
+		if err := s.repo.RemoveRoomParticipant(context.Background(), s.instanceID, roomID, pID); err != nil {
+			log.Printf("failed to remove room participant: %v", err)
+		}
+		locked := s.isLocked(roomID)
+		s.do(func() {
+			s.broadcastMembership(roomID, locked, &t.Event{
+				Name: "LEFT_ROOM_BROADCAST",
+				Data: map[string]any{
+					"roomID": roomID,
+					"user":   u,
+				},
+			})
+		})
 	})
 }
 
+// isLocked reports whether the room is locked, it's taken as locked if the
+// settings can't be read. It's called outside of the run loop.
+func (s *socketServer) isLocked(roomID int) bool {
+	settings, err := s.repo.GetRoomSettings(context.Background(), roomID)
+	if err != nil {
+		log.Printf("failed to get room settings: %v", err)
+		return true
+	}
+	return settings.Locked
+}
+
+// broadcastMembership sends who joined or left the room to everyone, or
+// only to the room's participants if it's locked.
+func (s *socketServer) broadcastMembership(roomID int, locked bool, event *t.Event) {
+	if locked {
+		s.broadcastRoomEvent(roomID, event)
+		return
+	}
+	s.broadcastEvent(event)
+}
+
 func (s *socketServer) broadcastEvent(event *t.Event) {
-	for conn := range s.conns {
-		utils.WriteEvent(conn, event)
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal %q event: %v", event.Name, err)
+		return
 	}
+	s.deliverEvent(event.Name, b)
+	s.publish(&t.ClusterEvent{
+		Kind:  t.ClusterAll,
+		Name:  event.Name,
+		Event: b,
+	})
 }
 
 func (s *socketServer) broadcastMsgEvent(userIDs []int, event *t.Event) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal %q event: %v", event.Name, err)
+		return
+	}
+	s.deliverMsgEvent(userIDs, event.Name, b)
+	s.publish(&t.ClusterEvent{
+		Kind:    t.ClusterUsers,
+		Name:    event.Name,
+		Event:   b,
+		UserIDs: userIDs,
+	})
+}
+
+func (s *socketServer) broadcastRoomEvent(roomID int, event *t.Event) {
+	if _, ok := s.rooms[roomID]; !ok {
+		log.Printf("broadcast to room failed, room not found: %d", roomID)
+		return
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal %q event: %v", event.Name, err)
+		return
+	}
+	s.deliverRoomEvent(roomID, event.Name, b)
+	s.publish(&t.ClusterEvent{
+		Kind:   t.ClusterRoom,
+		Name:   event.Name,
+		Event:  b,
+		RoomID: roomID,
+	})
+}
+
+func (s *socketServer) deliverEvent(name string, b []byte) {
+	for _, c := range s.conns {
+		c.enqueue(name, b)
+	}
+}
+
+func (s *socketServer) deliverMsgEvent(userIDs []int, name string, b []byte) {
 	var sIDs []string
-	for u, ids := range s.users {
-		if utils.Includes(userIDs, u) {
-			sIDs = append(sIDs, ids...)
+	for _, userID := range userIDs {
+		if u, ok := s.users[userID]; ok {
+			sIDs = append(sIDs, u.sids...)
 		}
 	}
 
-	for conn, val := range s.conns {
-		if utils.Includes(sIDs, val.pID) {
-			utils.WriteEvent(conn, event)
+	for _, c := range s.conns {
+		if utils.Includes(sIDs, c.pID) {
+			c.enqueue(name, b)
 		}
 	}
 }
 
-func (s *socketServer) broadcastRoomEvent(roomID int, event *t.Event) {
+func (s *socketServer) deliverRoomEvent(roomID int, name string, b []byte) {
 	r, ok := s.rooms[roomID]
 	if !ok {
-		log.Printf("broadcast to room failed, room not found: %d", roomID)
 		return
 	}
-
 	for conn := range r.conns {
-		utils.WriteEvent(conn, event)
+		if c, ok := s.conns[conn]; ok {
+			c.enqueue(name, b)
+		}
 	}
 }
 
-func (s *socketServer) getParticipantsInRoom(roomID int) []*t.Participant {
-	participants := make([]*t.Participant, 0)
-	if _, ok := s.rooms[roomID]; ok {
-		for conn := range s.rooms[roomID].conns {
-			if val, ok := s.conns[conn]; ok {
-				participants = append(participants, s.participants[val.pID])
-			}
+// publish queues the event for the other instances, it never blocks the
+// run loop.
+func (s *socketServer) publish(e *t.ClusterEvent) {
+	e.Origin = s.instanceID
+	select {
+	case s.cluster <- e:
+	default:
+		log.Printf("cluster queue full, dropped %q event", e.Name)
+	}
+}
+
+// publishEvents sends the queued events to redis in order.
+func (s *socketServer) publishEvents() {
+	for e := range s.cluster {
+		if err := s.repo.PublishEvent(context.Background(), e); err != nil {
+			log.Printf("failed to publish %q cluster event: %v", e.Name, err)
 		}
 	}
+}
 
-	sort.Slice(participants, func(i, j int) bool {
-		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
-	})
+// subscribeEvents delivers the events published by the other instances to
+// the connections owned by this one.
+func (s *socketServer) subscribeEvents(ctx context.Context) {
+	for e := range s.repo.SubscribeEvents(ctx) {
+		if e.Origin == s.instanceID {
+			continue
+		}
+		s.do(func() {
+			s.handleClusterEvent(e)
+		})
+	}
+}
 
-	return participants
+func (s *socketServer) handleClusterEvent(e *t.ClusterEvent) {
+	switch e.Kind {
+	case t.ClusterAll:
+		s.deliverEvent(e.Name, e.Event)
+	case t.ClusterRoom:
+		s.deliverRoomEvent(e.RoomID, e.Name, e.Event)
+	case t.ClusterUsers:
+		s.deliverMsgEvent(e.UserIDs, e.Name, e.Event)
+	case t.ClusterKick:
+		for _, userID := range e.UserIDs {
+			s.removeFromRoom(e.RoomID, userID)
+		}
+	case t.ClusterForceMute:
+		s.forceMute(e.RoomID, e.UserIDs, e.Mute)
+	case t.ClusterStageChanged:
+		roomID := e.RoomID
+		s.async(func() {
+			s.enforceStage(roomID)
+		})
+	case t.ClusterRoomCreated:
+		if _, ok := s.rooms[e.RoomID]; !ok {
+			s.addRoom(e.RoomID)
+		}
+	case t.ClusterRoomsDeleted:
+		for _, rID := range e.RoomIDs {
+			s.closeRoomExternal(rID)
+			delete(s.rooms, rID)
+		}
+	}
 }
 
-func (s *socketServer) joinRoomHandler(conn *websocket.Conn, b []byte) (int, error) {
-	data, err := utils.ParseJSON[t.JoinRoom](b)
+// getParticipantsInRooms returns the participants of the rooms across every
+// instance. It reads from redis only, so it's safe to call outside of the
+// run loop.
+func (s *socketServer) getParticipantsInRooms(roomIDs []int) (map[int][]*t.Participant, error) {
+	participants, err := s.repo.GetRoomParticipants(context.Background(), roomIDs)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	room, ok := s.rooms[data.RoomID]
-	if !ok {
-		return 0, errors.New("room doesn't exist")
-	}
-	if _, ok := room.conns[conn]; ok {
-		return 0, errors.New("joined room already")
+	for _, ps := range participants {
+		sort.Slice(ps, func(i, j int) bool {
+			return ps[i].JoinedAt.Before(ps[j].JoinedAt)
+		})
 	}
 
-	r, err := s.repo.GetRoom(context.Background(), data.RoomID)
+	return participants, nil
+}
+
+func (s *socketServer) getParticipantsInRoom(roomID int) ([]*t.Participant, error) {
+	participants, err := s.getParticipantsInRooms([]int{roomID})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return participants[roomID], nil
+}
 
-	if len(s.rooms[data.RoomID].conns) >= r.MaxParticipants {
-		return data.RoomID, roomFullErr
+// withJoining adds the participants that joined the room on this instance
+// but aren't listed yet. It's called on the run loop.
+func (s *socketServer) withJoining(room *socketRoom, participants []*t.Participant) []*t.Participant {
+	listed := make(map[string]struct{}, len(participants))
+	for _, p := range participants {
+		listed[p.SID] = struct{}{}
 	}
+	for conn := range room.conns {
+		c, ok := s.conns[conn]
+		if !ok {
+			continue
+		}
+		if _, ok := listed[c.pID]; ok {
+			continue
+		}
+		if p, ok := s.participants[c.pID]; ok {
+			participants = append(participants, p)
+		}
+	}
+	return participants
+}
 
-	p, err := s.NewPeer(data.RoomID, conn)
+func (s *socketServer) joinRoomHandler(conn *websocket.Conn, data *t.JoinRoom) (any, error) {
+	if s.draining.Load() {
+		return nil, errShuttingDown
+	}
+	self, err := s.self(conn)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create peer: %v", err)
+		return nil, err
 	}
 
-	s.conns[conn].peer = p
-	room.conns[conn] = struct{}{}
-	room.lastActivity = time.Now().UTC()
-
-	p.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		// NOTE:: to prevent empty track/stream id
-		time.Sleep(time.Second * 2)
-		log.Printf("Received track: Track ID: %q, Stream ID: %q", tr.ID(), tr.StreamID())
+	r, err := s.repo.GetRoom(context.Background(), data.RoomID)
+	if err != nil {
+		return nil, fmt.Errorf("room doesn't exist: %w", err)
+	}
+	// data.Key is the invite code of a locked room
+	if err := s.svc.CanJoin(context.Background(), r, self.ID, data.Key); err != nil {
+		return nil, err
+	}
+	participants, err := s.getParticipantsInRoom(data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRoomLimit(r, self.ID, participants); err != nil {
+		return nil, err
+	}
 
-		track, err := s.addTrack(data.RoomID, conn, tr)
-		if err != nil {
-			log.Printf("failed to add track: %v", err)
+	var (
+		sid       string
+		added     <-chan struct{}
+		recording map[string]any
+	)
+	s.do(func() {
+		c, ok := s.conns[conn]
+		if !ok {
+			err = errConnClosed
+			return
+		}
+		room, ok := s.rooms[data.RoomID]
+		if !ok {
+			// the room was created on another instance
+			room = s.addRoom(data.RoomID)
+		}
+		if _, ok := room.conns[conn]; ok {
+			err = &eventError{Code: codeConflict, Message: "joined room already"}
+			return
+		}
+		// the participants listed before may miss the joins in between
+		if err = s.checkRoomLimit(r, self.ID, s.withJoining(room, participants)); err != nil {
 			return
 		}
-		defer s.removeTrack(data.RoomID, tr.ID())
-
-		buf := make([]byte, 1500)
-		rtpPkt := &rtp.Packet{}
 
-		for {
-			i, _, err := tr.Read(buf)
+		c.roomID = data.RoomID
+		room.conns[conn] = struct{}{}
+		p := s.participants[c.pID]
+		p.RoomID = data.RoomID
+		s.saveSession(p)
+		participant := *p
+		added = s.async(func() {
+			err := s.repo.AddRoomParticipant(context.Background(), s.instanceID, data.RoomID, &participant)
 			if err != nil {
-				log.Printf("failed to read remote track: %v", err)
-				return
+				log.Printf("failed to add room participant: %v", err)
 			}
+		})
+
+		if err = s.connectPeer(conn, data.RoomID); err != nil {
+			s.leaveRoom(conn, &p.User, c.pID, data.RoomID)
+			return
+		}
 
-			if err = rtpPkt.Unmarshal(buf[:i]); err != nil {
-				log.Printf("failed to unmarshal rtp packet: %v", err)
-				return
+		sid = c.pID
+		// the joiner missed RECORDING_STARTED
+		if rec := room.recording; rec != nil {
+			recording = map[string]any{
+				"recordingID": rec.ID,
+				"by":          rec.StartedBy,
+				"startedAt":   rec.StartedAt,
 			}
-			rtpPkt.Extension = false
-			rtpPkt.Extensions = nil
+		}
+		s.broadcastMembership(data.RoomID, r.Settings.Locked, &t.Event{
+			Name: "JOINED_ROOM_BROADCAST",
+			Data: map[string]any{
+				"roomID": data.RoomID,
+				"user":   p.User,
+				"sid":    sid,
+			},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the participant is listed by the time the client is told it joined
+	<-added
+
+	res := map[string]any{"roomID": r.ID, "sid": sid}
+	if r.Settings.Stage {
+		res["raisedHands"] = s.raisedHands(r.ID)
+	}
+	if m := s.roomMedia(r.ID); m != nil {
+		res["media"] = m
+	}
+	if recording != nil {
+		res["recording"] = recording
+	}
+	return res, nil
+}
+
+// connectPeer creates the peer of the connection for the room, subscribes
+// it to the room's tracks and sends the offer.
+func (s *socketServer) connectPeer(conn *websocket.Conn, roomID int) error {
+	c := s.conns[conn]
+	s.closePeer(c)
+	p, err := s.NewPeer(roomID, c)
+	if err != nil {
+		return fmt.Errorf("failed to create peer: %v", err)
+	}
+	c.peer = p
 
-			if err = track.WriteRTP(rtpPkt); err != nil {
-				log.Printf("failed to write rtp packet: %v", err)
-				return
+	p.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		// NOTE:: to prevent empty track/stream id
+		time.Sleep(time.Second * 2)
+		log.Printf("Received track: Track ID: %q, Stream ID: %q", tr.ID(), tr.StreamID())
+
+		var (
+			rt     *roomTrack
+			source t.TrackSource
+			userID int
+		)
+		s.do(func() {
+			source = p.trackSource(tr)
+			if participant, ok := s.participants[c.pID]; ok {
+				userID = participant.ID
 			}
+		})
+		err := s.svc.CanPublish(context.Background(), roomID, userID, source)
+		if err != nil {
+			s.sendError(c, &t.Event{Name: "PEER_OFFER"}, nil, err)
+		} else {
+			s.do(func() {
+				rt, err = s.addTrack(roomID, conn, tr, source)
+			})
 		}
+		if err != nil {
+			log.Printf("failed to add track: %v", err)
+			if err := r.Stop(); err != nil {
+				log.Printf("failed to stop rejected track: %v", err)
+			}
+			return
+		}
+		s.forwardTrack(roomID, rt, r)
 	})
 
-	streamMap := make(map[string]string)
-	for _, t := range s.rooms[data.RoomID].tracks {
-		if _, err := p.AddTrack(t.track); err != nil {
+	var tracks []*roomTrack
+	for _, rt := range s.rooms[roomID].tracks {
+		// a resumed session keeps publishing its own tracks
+		if rt.pID == c.pID {
+			continue
+		}
+		if err := p.subscribe(rt); err != nil {
 			log.Printf("failed to add track to new peer: %v", err)
 			continue
 		}
-		streamMap[t.pID] = t.track.StreamID()
+		tracks = append(tracks, rt)
 	}
 
-	utils.WriteEvent(conn, &t.Event{
-		Name: "PEER_STREAMS",
-		Data: map[string]any{
-			"roomID":  data.RoomID,
-			"streams": streamMap,
-		},
-	})
+	c.send(peerStreamsEvent(roomID, tracks...))
 
-	err = p.makeOffer()
+	err = p.negotiate()
 	if err != nil {
 		log.Printf("failed to make offer: %v", err)
 	}
@@ -285,51 +737,28 @@ func (s *socketServer) joinRoomHandler(conn *websocket.Conn, b []byte) (int, err
 	p.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("connection state: %v", state)
 		switch state {
-		case webrtc.PeerConnectionStateFailed:
-			if err := p.Close(); err != nil {
-				log.Printf("failed to close failed peer connection: %v", err)
-			}
+		case webrtc.PeerConnectionStateConnected:
+			s.do(func() {
+				p.requestKeyframes()
+				s.peerRecovered(conn, p)
+			})
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+			s.do(func() {
+				s.recoverPeer(conn, p, state)
+			})
 		}
 	})
 
-	s.broadcastEvent(&t.Event{
-		Name: "JOINED_ROOM_BROADCAST",
-		Data: map[string]any{
-			"roomID": data.RoomID,
-			"user":   s.getParticipant(conn).User,
-			"sid":    s.conns[conn].pID,
-			"key":    data.Key,
-		},
-	})
-
-	return r.ID, nil
+	return nil
 }
 
-func (s *socketServer) newMessageHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.NewMessage](b)
-	if err != nil {
-		log.Printf("failed to unmarshal NEW_MESSAGE data: %v", err)
-		return
-	}
-
+func (s *socketServer) newMessageHandler(conn *websocket.Conn, data *t.NewMessage) (any, error) {
 	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
-	if msgType == t.UnknowMsg {
-		log.Printf("new message event: unknown msg type")
-		return
-	}
-
-	ok, err := utils.ValidateContent(&data.Content)
-	if !ok {
-		log.Printf("message content validation failed: %v", err)
-		return
-	}
-
-	if (msgType == t.RoomMsg || msgType == t.PrivateRoomMsg) &&
-		!s.participantsInRoom(conn, *data.RoomID, data.ParticipantID) {
-		return
+	p, err := s.messageSender(conn, msgType, data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
 	msg := s.createMessage(
 		&p.User,
 		msgType,
@@ -343,19 +772,20 @@ func (s *socketServer) newMessageHandler(conn *websocket.Conn, b []byte) {
 
 	if msgType == t.DMMsg {
 		mID, err := s.svc.CreateMessage(context.Background(), msg, p.ID, *data.ParticipantID)
-		msg.ID = mID
 		if err != nil {
-			log.Printf("new message event: failed to create message: %v", err)
-			return
+			return nil, fmt.Errorf("failed to create message: %w", err)
 		}
+		msg.ID = mID
 	} else {
+		if err := s.svc.CreateRoomMessage(context.Background(), msg); err != nil {
+			return nil, fmt.Errorf("failed to create message: %w", err)
+		}
 		isAIMsgReq = utils.IsAIMsgReq(&msg.Content)
 		if data.ReplyTo != nil {
 			var err error
 			aiReply, err = s.repo.IsReplyToAI(context.Background(), *data.RoomID, *data.ReplyTo)
 			if err != nil {
-				log.Printf("new message event: failed to check if reply is from ai: %v", err)
-				return
+				return nil, fmt.Errorf("failed to check if reply is from ai: %w", err)
 			}
 			if len(aiReply) != 0 {
 				isAIMsgReq = true
@@ -363,201 +793,226 @@ func (s *socketServer) newMessageHandler(conn *websocket.Conn, b []byte) {
 		}
 	}
 
-	event := &t.Event{
+	s.broadcastMessage(msgType, data.RoomID, p.ID, data.ParticipantID, &t.Event{
 		Name: "NEW_MESSAGE_BROADCAST",
 		Data: msg,
-	}
-
-	if msgType == t.RoomMsg {
-		s.broadcastRoomEvent(*data.RoomID, event)
-	} else {
-		pIDs := []int{p.ID, *data.ParticipantID}
-		s.broadcastMsgEvent(pIDs, event)
-	}
+	})
 
-	if isAIMsgReq {
-		s.aiMsgRequest <- &t.AIMessageRequest{
+	if isAIMsgReq && !s.draining.Load() {
+		s.queueAIRequest(&t.AIMessageRequest{
 			MsgType:    msgType,
 			NewMessage: data,
 			MsgID:      msg.ID,
 			From:       p.ID,
 			AIReply:    aiReply,
-		}
+		})
 	}
+
+	return map[string]any{"id": msg.ID}, nil
 }
 
-func (s *socketServer) participantsInRoom(conn *websocket.Conn, roomID int, participantID *int) bool {
-	if !s.isInRoom(conn, roomID) {
-		return false
+// broadcastMessage sends the event of a message to the room, or to the
+// sender and the participant of a whisper or DM.
+func (s *socketServer) broadcastMessage(msgType t.MsgType, roomID *int, from int, participantID *int, event *t.Event) {
+	s.do(func() {
+		if msgType == t.RoomMsg {
+			s.broadcastRoomEvent(*roomID, event)
+		} else {
+			pIDs := []int{from, *participantID}
+			s.broadcastMsgEvent(pIDs, event)
+		}
+	})
+}
+
+// self returns a copy of the participant of the connection, so it can be
+// read outside of the run loop.
+func (s *socketServer) self(conn *websocket.Conn) (*t.Participant, error) {
+	var (
+		p   t.Participant
+		err error
+	)
+	s.do(func() {
+		c, ok := s.conns[conn]
+		if !ok {
+			err = errConnClosed
+			return
+		}
+		p = *s.participants[c.pID]
+	})
+	if err != nil {
+		return nil, err
 	}
-	if participantID == nil {
-		return true
+	return &p, nil
+}
+
+// member returns a copy of the participant of the connection if it's in
+// the room.
+func (s *socketServer) member(conn *websocket.Conn, roomID int) (*t.Participant, error) {
+	var p *t.Participant
+	s.do(func() {
+		if s.isInRoom(conn, roomID) {
+			participant := *s.getParticipant(conn)
+			p = &participant
+		}
+	})
+	if p == nil {
+		return nil, errNotInRoom
 	}
-	_, ok := s.users[*participantID]
-	return ok
+	return p, nil
 }
 
-func (s *socketServer) editMessageHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.EditMessage](b)
+// participantsInRoom returns the participant of the connection if it's in
+// the room and the other participant, if any, is online.
+func (s *socketServer) participantsInRoom(conn *websocket.Conn, roomID int, participantID *int) (*t.Participant, error) {
+	p, err := s.member(conn, roomID)
 	if err != nil {
-		log.Printf("failed to unmarshal EDIT_MESSAGE data: %v", err)
-		return
+		return nil, err
 	}
-
-	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
-	if msgType == t.UnknowMsg {
-		log.Printf("edit message event: unknown msg type")
-		return
+	if participantID != nil && !s.isOnline(*participantID) {
+		return nil, errNotInRoom
 	}
+	return p, nil
+}
 
-	ok, err := utils.ValidateContent(&data.Content)
-	if !ok {
-		log.Printf("edit message event: message content validation failed: %v", err)
-		return
+// messageSender returns the participant sending a message event, the sender
+// of a room message or whisper has to be in the room.
+func (s *socketServer) messageSender(conn *websocket.Conn, msgType t.MsgType, roomID, participantID *int) (*t.Participant, error) {
+	if msgType == t.RoomMsg || msgType == t.PrivateRoomMsg {
+		return s.participantsInRoom(conn, *roomID, participantID)
 	}
+	return s.self(conn)
+}
 
-	if (msgType == t.RoomMsg || msgType == t.PrivateRoomMsg) &&
-		!s.participantsInRoom(conn, *data.RoomID, data.ParticipantID) {
+func (s *socketServer) editMessageHandler(conn *websocket.Conn, data *t.EditMessage) (any, error) {
+	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
+	p, err := s.messageSender(conn, msgType, data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
 	if msgType == t.DMMsg {
 		err := s.svc.EditMessage(context.Background(), data.ID, data.Content, p.ID, *data.ParticipantID)
 		if err != nil {
-			log.Printf("edit message event: failed to edit message: %v", err)
-			return
+			return nil, fmt.Errorf("failed to edit message: %w", err)
+		}
+	} else {
+		ref, err := s.roomMessage(*data.RoomID, data.ID, msgType, p.ID, data.ParticipantID)
+		if err != nil {
+			return nil, err
+		}
+		if ref.From.ID != p.ID {
+			return nil, errNotAuthor
+		}
+		err = s.svc.EditRoomMessage(context.Background(), *data.RoomID, data.ID, data.Content, p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to edit message: %w", err)
 		}
 	}
 
-	event := t.Event{
+	s.broadcastMessage(msgType, data.RoomID, p.ID, data.ParticipantID, &t.Event{
 		Name: "EDIT_MESSAGE_BROADCAST",
 		Data: s.createMsgData(map[string]any{
 			"id":      data.ID,
 			"content": data.Content,
 			"from":    p.User,
 		}, msgType, data.RoomID, data.ParticipantID),
-	}
-
-	if msgType == t.RoomMsg {
-		s.broadcastRoomEvent(*data.RoomID, &event)
-	} else {
-		pIDs := []int{p.ID, *data.ParticipantID}
-		s.broadcastMsgEvent(pIDs, &event)
-	}
+	})
+	return nil, nil
 }
 
-func (s *socketServer) reactionToMsgHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.ReactionToMessage](b)
-	if err != nil {
-		log.Printf("failed to unmarshal REACTION_TO_MESSAGE data: %v", err)
-		return
-	}
-
+func (s *socketServer) reactionToMsgHandler(conn *websocket.Conn, data *t.ReactionToMessage) (any, error) {
 	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
-	if msgType == t.UnknowMsg {
-		log.Printf("reaction msg event: unknown msg type")
-		return
-	}
-
-	if (msgType == t.RoomMsg || msgType == t.PrivateRoomMsg) &&
-		!s.participantsInRoom(conn, *data.RoomID, data.ParticipantID) {
-		return
+	p, err := s.messageSender(conn, msgType, data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, err
 	}
 
 	if _, ok := s.emojis[data.Reaction]; !ok {
-		log.Printf("emoji not supported: %q", data.Reaction)
-		return
+		return nil, &eventError{Code: codeValidationFailed, Message: fmt.Sprintf("emoji not supported: %q", data.Reaction)}
 	}
 
-	p := s.getParticipant(conn)
 	if msgType == t.DMMsg {
 		err := s.svc.ReactionToMessage(context.Background(), data.ID, p.ID, *data.ParticipantID, data.Reaction)
 		if err != nil {
-			log.Printf("reaction msg event: failed to update message: %v", err)
-			return
+			return nil, fmt.Errorf("failed to update message: %w", err)
+		}
+	} else {
+		if _, err := s.roomMessage(*data.RoomID, data.ID, msgType, p.ID, data.ParticipantID); err != nil {
+			return nil, err
+		}
+		err := s.svc.ReactionToRoomMessage(context.Background(), *data.RoomID, data.ID, p.ID, data.Reaction)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update message: %w", err)
 		}
 	}
 
-	event := t.Event{
+	s.broadcastMessage(msgType, data.RoomID, p.ID, data.ParticipantID, &t.Event{
 		Name: "REACTION_TO_MESSAGE_BROADCAST",
 		Data: s.createMsgData(map[string]any{
 			"id":       data.ID,
 			"reaction": data.Reaction,
 			"from":     p.User,
 		}, msgType, data.RoomID, data.ParticipantID),
-	}
-
-	if msgType == t.RoomMsg {
-		s.broadcastRoomEvent(*data.RoomID, &event)
-	} else {
-		pIDs := []int{p.ID, *data.ParticipantID}
-		s.broadcastMsgEvent(pIDs, &event)
-	}
+	})
+	return nil, nil
 }
 
-func (s *socketServer) clearChatHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.ClearChat](b)
+func (s *socketServer) clearChatHandler(conn *websocket.Conn, data *t.ClearChat) (any, error) {
+	p, err := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
 	if err != nil {
-		log.Printf("failed to unmarshal CLEAR_CHAT data: %v", err)
-		return
-	}
-
-	ok := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
-	if !ok {
-		log.Printf("clear chat event: participants not in room")
-		return
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
 	err = s.svc.CanClearChat(context.Background(), data.RoomID, p.ID, data.ParticipantID)
 	if err != nil {
-		log.Printf("failed to clear chat: %v", err)
-		return
+		return nil, fmt.Errorf("failed to clear chat: %w", err)
+	}
+	err = s.repo.ClearRoomMessages(context.Background(), data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clear chat: %w", err)
 	}
 
-	s.broadcastRoomEvent(data.RoomID, &t.Event{
+	event := &t.Event{
 		Name: "CLEAR_CHAT_BROADCAST",
 		Data: map[string]any{
 			"roomID":      data.RoomID,
 			"participant": s.getUser(data.ParticipantID),
 			"by":          p.User,
 		},
+	}
+	s.do(func() {
+		s.broadcastRoomEvent(data.RoomID, event)
 	})
+	return nil, nil
 }
 
-func (s *socketServer) assignRoleHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.AssignRole](b)
+func (s *socketServer) assignRoleHandler(conn *websocket.Conn, data *t.AssignRole) (any, error) {
+	p, err := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
 	if err != nil {
-		log.Printf("failed to unmarshal ASSIGN_ROLE data: %v", err)
-		return
-	}
-
-	ok := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
-	if !ok {
-		log.Printf("assign role event: participants not in room")
-		return
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
 	err = s.svc.AssignRole(context.Background(), data.Role, data.RoomID, p.ID, data.ParticipantID)
-	if err != nil {
-		if errors.Is(err, service.ErrMaxRoomsHosted) {
-			username := s.getUser(data.ParticipantID).Username
-			msg := fmt.Sprintf("%s is already hosting %d rooms", username, s.cfg.MaxRoomsHosted)
-			s.broadcastMsgEvent([]int{p.ID}, &t.Event{
-				Name: "ERROR_BROADCAST",
-				Data: map[string]any{
-					"roomID":  data.RoomID,
-					"title":   "Transfer Room",
-					"content": msg,
-				},
-			})
+	if errors.Is(err, service.ErrMaxRoomsHosted) {
+		var username string
+		if u := s.getUser(data.ParticipantID); u != nil {
+			username = u.Username
 		}
-		log.Printf("failed to assign role: %v", err)
-		return
+		return nil, &eventError{
+			Code:    codeMaxRoomsHosted,
+			Title:   "Transfer Room",
+			Message: fmt.Sprintf("%s is already hosting %d rooms", username, s.cfg.MaxRoomsHosted),
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign role: %w", err)
+	}
+	// a co-host made a guest leaves the stage, unless they're a speaker
+	if data.Role == t.RoomRoleGuest {
+		s.updateStage(data.RoomID)
 	}
 
-	s.broadcastRoomEvent(data.RoomID, &t.Event{
+	event := &t.Event{
 		Name: "ASSIGN_ROLE_BROADCAST",
 		Data: map[string]any{
 			"roomID":      data.RoomID,
@@ -565,61 +1020,51 @@ func (s *socketServer) assignRoleHandler(conn *websocket.Conn, b []byte) {
 			"role":        data.Role,
 			"participant": s.getUser(data.ParticipantID),
 		},
+	}
+	s.do(func() {
+		s.broadcastRoomEvent(data.RoomID, event)
 	})
+	return nil, nil
 }
 
-func (s *socketServer) updateWelcomeMsgHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.UpdateWelcomeMessage](b)
+func (s *socketServer) updateWelcomeMsgHandler(conn *websocket.Conn, data *t.UpdateWelcomeMessage) (any, error) {
+	p, err := s.member(conn, data.RoomID)
 	if err != nil {
-		log.Printf("failed to unmarshal UPDATE_WELCOME_MESSAGE data: %v", err)
-		return
-	}
-
-	ok, err := utils.ValidateWelcomeMsg(&data.WelcomeMessage)
-	if !ok {
-		log.Printf("welcome message validation failed: %v", err)
-		return
-	}
-
-	if !s.isInRoom(conn, data.RoomID) {
-		return
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
 	err = s.svc.UpdateWelcomeMessage(context.Background(), data.RoomID, p.ID, data.WelcomeMessage)
 	if err != nil {
-		log.Printf("failed to update welcome message: %v", err)
+		return nil, fmt.Errorf("failed to update welcome message: %w", err)
 	}
 
-	s.broadcastRoomEvent(data.RoomID, &t.Event{
-		Name: "UPDATE_WELCOME_MESSAGE_BROADCAST",
-		Data: map[string]any{
-			"by":             p.User,
-			"welcomeMessage": data.WelcomeMessage,
-			"roomID":         data.RoomID,
-		},
+	s.do(func() {
+		s.broadcastRoomEvent(data.RoomID, &t.Event{
+			Name: "UPDATE_WELCOME_MESSAGE_BROADCAST",
+			Data: map[string]any{
+				"by":             p.User,
+				"welcomeMessage": data.WelcomeMessage,
+				"roomID":         data.RoomID,
+			},
+		})
 	})
+	return nil, nil
 }
 
-func (s *socketServer) setStatusHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.SetStatus](b)
-	if err != nil {
-		log.Printf("failed to unmarshal SET_STATUS data: %v", err)
-		return
-	}
-
-	ok, err := utils.ValidateStatus(&data.Status)
-	if !ok {
-		log.Printf("set status event: validation failed: %v", err)
-		return
-	}
-
+// setStatusHandler is run on the run loop, see onLoop.
+func (s *socketServer) setStatusHandler(conn *websocket.Conn, data *t.SetStatus) (any, error) {
 	if !s.isInRoom(conn, data.RoomID) {
-		return
+		return nil, errNotInRoom
 	}
 
 	p := s.getParticipant(conn)
 	p.Status = data.Status
+	participant := *p
+	s.async(func() {
+		if err := s.repo.UpdateRoomParticipant(context.Background(), data.RoomID, &participant); err != nil {
+			log.Printf("failed to update room participant: %v", err)
+		}
+	})
 
 	s.broadcastRoomEvent(data.RoomID, &t.Event{
 		Name: "SET_STATUS_BROADCAST",
@@ -629,20 +1074,22 @@ func (s *socketServer) setStatusHandler(conn *websocket.Conn, b []byte) {
 			"by":     p.User,
 		},
 	})
+	return nil, nil
 }
 
-func (s *socketServer) peerMuteHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.PeerMute](b)
-	if err != nil {
-		log.Printf("failed to unmarshal PEER_MUTE data: %v", err)
-		return
-	}
-
+// peerMuteHandler is run on the run loop, see onLoop.
+func (s *socketServer) peerMuteHandler(conn *websocket.Conn, data *t.PeerMute) (any, error) {
 	if !s.isInRoom(conn, data.RoomID) {
-		return
+		return nil, errNotInRoom
 	}
 
+	c := s.conns[conn]
 	p := s.getParticipant(conn)
+	if _, ok := s.rooms[data.RoomID].forceMuted[p.ID]; ok && !data.Mute {
+		return nil, &eventError{Code: codePermissionDenied, Message: "muted by a moderator", Title: "Muted"}
+	}
+	c.muted = data.Mute
+
 	s.broadcastRoomEvent(data.RoomID, &t.Event{
 		Name: "PEER_MUTE_BROADCAST",
 		Data: map[string]any{
@@ -651,36 +1098,127 @@ func (s *socketServer) peerMuteHandler(conn *websocket.Conn, b []byte) {
 			"mute":          data.Mute,
 		},
 	})
+	return nil, nil
+}
+
+func (s *socketServer) forceMuteHandler(conn *websocket.Conn, data *t.ForceMute) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	participants, err := s.getParticipantsInRoom(data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []int
+	for _, participant := range participants {
+		if !isIngest(participant) && !utils.Includes(userIDs, participant.ID) {
+			userIDs = append(userIDs, participant.ID)
+		}
+	}
+
+	if data.AllGuests {
+		userIDs, err = s.svc.RoomGuests(context.Background(), data.RoomID, userIDs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !utils.Includes(userIDs, *data.ParticipantID) {
+			return nil, errNotInRoom
+		}
+		userIDs = []int{*data.ParticipantID}
+	}
+
+	err = s.svc.ForceMute(context.Background(), data.RoomID, p.ID, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to force mute: %w", err)
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	users := make([]*t.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if u := s.getUser(userID); u != nil {
+			users = append(users, u)
+		}
+	}
+	s.do(func() {
+		s.forceMute(data.RoomID, userIDs, data.Mute)
+		s.broadcastRoomEvent(data.RoomID, &t.Event{
+			Name: "PARTICIPANT_FORCE_MUTED",
+			Data: map[string]any{
+				"roomID":       data.RoomID,
+				"by":           p.User,
+				"participants": users,
+				"mute":         data.Mute,
+			},
+		})
+	})
+	s.publish(&t.ClusterEvent{
+		Kind:    t.ClusterForceMute,
+		RoomID:  data.RoomID,
+		UserIDs: userIDs,
+		Mute:    data.Mute,
+	})
+	return nil, nil
 }
 
-func (s *socketServer) kickParticipantHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.KickParticipant](b)
-	if err != nil {
-		log.Printf("failed to unmarshal KICK_PARTICIPANT data: %v", err)
+// forceMute makes the SFU drop the microphone packets of the users in the
+// room, until they are unmuted by a moderator.
+func (s *socketServer) forceMute(roomID int, userIDs []int, mute bool) {
+	room, ok := s.rooms[roomID]
+	if !ok {
 		return
 	}
+	for _, userID := range userIDs {
+		if mute {
+			room.forceMuted[userID] = struct{}{}
+		} else {
+			delete(room.forceMuted, userID)
+		}
+	}
 
-	duration, err := time.ParseDuration(data.Duration)
-	if err != nil {
-		log.Printf("kick participant event: invalid duration: %v", err)
-		return
+	for _, rt := range room.tracks {
+		if p, ok := s.participants[rt.pID]; ok && rt.source == t.TrackMicrophone && utils.Includes(userIDs, p.ID) {
+			rt.muted.Store(mute)
+			// the dropped packets don't bring the level down
+			rt.level.Store(math.Float64bits(silentLevel))
+		}
 	}
-	if duration.Seconds() < 60 {
-		log.Printf("kick participant event: duration should be atleast 1 minute")
+	if !mute {
 		return
 	}
+	for conn := range room.conns {
+		c := s.conns[conn]
+		if !utils.Includes(userIDs, s.participants[c.pID].ID) {
+			continue
+		}
+		c.muted = true
+		s.broadcastRoomEvent(roomID, &t.Event{
+			Name: "PEER_MUTE_BROADCAST",
+			Data: map[string]any{
+				"roomID":        roomID,
+				"participantID": c.pID,
+				"mute":          true,
+			},
+		})
+	}
+}
 
-	ok := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
-	if !ok {
-		log.Printf("kick participant event: participants not in room")
-		return
+func (s *socketServer) kickParticipantHandler(conn *websocket.Conn, data *t.KickParticipant) (any, error) {
+	p, err := s.participantsInRoom(conn, data.RoomID, &data.ParticipantID)
+	if err != nil {
+		return nil, err
 	}
 
-	p := s.getParticipant(conn)
+	// the duration is checked by Validate
+	duration, _ := time.ParseDuration(data.Duration)
+
 	k, err := s.svc.KickParticipant(context.Background(), duration, data.RoomID, p.ID, data.ParticipantID)
 	if err != nil {
-		log.Printf("failed to kick participant: %v", err)
-		return
+		return nil, fmt.Errorf("failed to kick participant: %w", err)
 	}
 
 	d := map[string]any{
@@ -689,71 +1227,100 @@ func (s *socketServer) kickParticipantHandler(conn *websocket.Conn, b []byte) {
 		"roomID":      data.RoomID,
 	}
 
+	var events []*t.Event
 	if data.ClearChat {
-		s.broadcastRoomEvent(data.RoomID, &t.Event{
+		err := s.repo.ClearRoomMessages(context.Background(), data.RoomID, data.ParticipantID)
+		if err != nil {
+			log.Printf("failed to clear chat: %v", err)
+		}
+		events = append(events, &t.Event{
 			Name: "CLEAR_CHAT_BROADCAST",
-			Data: d,
+			Data: maps.Clone(d),
 		})
 	}
 
 	d["expiredAt"] = k.ExpiredAt
-	s.broadcastRoomEvent(data.RoomID, &t.Event{
+	events = append(events, &t.Event{
 		Name: "KICK_PARTICIPANT_BROADCAST",
 		Data: d,
 	})
 
-	sIDs := s.users[data.ParticipantID]
-	for conn := range s.rooms[data.RoomID].conns {
-		pID := s.conns[conn].pID
-		if utils.Includes(sIDs, pID) {
-			s.leaveRoom(conn, &s.participants[pID].User, pID, data.RoomID)
+	s.do(func() {
+		for _, event := range events {
+			s.broadcastRoomEvent(data.RoomID, event)
 		}
-	}
+		s.removeFromRoom(data.RoomID, data.ParticipantID)
+	})
+	s.publish(&t.ClusterEvent{
+		Kind:    t.ClusterKick,
+		RoomID:  data.RoomID,
+		UserIDs: []int{data.ParticipantID},
+	})
+	return nil, nil
 }
 
-func (s *socketServer) deleteMessageHandler(conn *websocket.Conn, b []byte) {
-	data, err := utils.ParseJSON[t.DeleteMessage](b)
-	if err != nil {
-		log.Printf("failed to unmarshal DELETE_MESSAGE data: %v", err)
+// removeFromRoom makes every local session of the user leave the room.
+func (s *socketServer) removeFromRoom(roomID, userID int) {
+	room, ok := s.rooms[roomID]
+	if !ok {
 		return
 	}
-
-	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
-	if msgType == t.UnknowMsg {
-		log.Printf("delete msg event: unknown msg type")
+	u, ok := s.users[userID]
+	if !ok {
 		return
 	}
-
-	if msgType == t.RoomMsg || msgType == t.PrivateRoomMsg {
-		ok := s.participantsInRoom(conn, *data.RoomID, data.ParticipantID)
-		if !ok {
-			return
+	for conn := range room.conns {
+		pID := s.conns[conn].pID
+		if utils.Includes(u.sids, pID) {
+			s.leaveRoom(conn, &s.participants[pID].User, pID, roomID)
 		}
 	}
+}
 
-	p := s.getParticipant(conn)
+func (s *socketServer) deleteMessageHandler(conn *websocket.Conn, data *t.DeleteMessage) (any, error) {
+	msgType := utils.GetMsgType(data.RoomID, data.ParticipantID)
+	p, err := s.messageSender(conn, msgType, data.RoomID, data.ParticipantID)
+	if err != nil {
+		return nil, err
+	}
+
+	from := p.User
 	if msgType == t.DMMsg {
 		err := s.svc.DeleteMessage(context.Background(), data.ID, p.ID, *data.ParticipantID)
 		if err != nil {
-			log.Printf("delete msg event: failed to delete message: %v", err)
-			return
+			return nil, fmt.Errorf("failed to delete message: %w", err)
+		}
+	} else {
+		ref, err := s.roomMessage(*data.RoomID, data.ID, msgType, p.ID, data.ParticipantID)
+		if err != nil {
+			return nil, err
+		}
+		// the host and co-hosts may delete anyone's message to the room,
+		// whispers are deleted by their author only
+		if ref.From.ID != p.ID {
+			if msgType == t.PrivateRoomMsg {
+				return nil, errNotAuthor
+			}
+			if err := s.svc.CanModerate(context.Background(), *data.RoomID, p.ID); err != nil {
+				return nil, err
+			}
+		}
+		from = ref.From
+		err = s.svc.DeleteRoomMessage(context.Background(), *data.RoomID, data.ID, from.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete message: %w", err)
 		}
 	}
 
-	event := t.Event{
+	s.broadcastMessage(msgType, data.RoomID, p.ID, data.ParticipantID, &t.Event{
 		Name: "DELETE_MESSAGE_BROADCAST",
 		Data: s.createMsgData(map[string]any{
 			"id":   data.ID,
-			"from": p.User,
+			"from": from,
+			"by":   p.User,
 		}, msgType, data.RoomID, data.ParticipantID),
-	}
-
-	if msgType == t.RoomMsg {
-		s.broadcastRoomEvent(*data.RoomID, &event)
-	} else {
-		pIDs := []int{p.ID, *data.ParticipantID}
-		s.broadcastMsgEvent(pIDs, &event)
-	}
+	})
+	return nil, nil
 }
 
 func (s *socketServer) populateRooms() error {
@@ -761,26 +1328,56 @@ func (s *socketServer) populateRooms() error {
 	if err != nil {
 		return err
 	}
-	for _, r := range rooms {
-		s.rooms[r.ID] = &socketRoom{
-			lastActivity: time.Now().UTC(),
-			conns:        make(map[*websocket.Conn]struct{}),
-			tracks:       make(map[string]*roomTrack),
+	s.do(func() {
+		for _, r := range rooms {
+			s.addRoom(r.ID)
 		}
-	}
+	})
 	return nil
 }
 
+func (s *socketServer) addRoom(roomID int) *socketRoom {
+	r := &socketRoom{
+		conns:      make(map[*websocket.Conn]struct{}),
+		tracks:     make(map[string]*roomTrack),
+		forceMuted: make(map[int]struct{}),
+		external:   make(map[string]*externalPeer),
+	}
+	s.rooms[roomID] = r
+	s.async(func() {
+		if err := s.repo.TouchRoom(context.Background(), roomID); err != nil {
+			log.Printf("failed to touch room: %v", err)
+		}
+	})
+	return r
+}
+
 func (s *socketServer) getParticipant(conn *websocket.Conn) *t.Participant {
 	return s.participants[s.conns[conn].pID]
 }
 
+// getUser returns the user if they are online, it's called outside of the
+// run loop.
 func (s *socketServer) getUser(userID int) *t.User {
-	for u, participants := range s.users {
-		if u == userID {
-			pID := participants[0]
-			return &s.participants[pID].User
+	var local *t.User
+	s.do(func() {
+		if u, ok := s.users[userID]; ok {
+			user := s.participants[u.sids[0]].User
+			local = &user
 		}
+	})
+	if local != nil {
+		return local
+	}
+
+	// the user might be connected to another instance
+	sessions, err := s.repo.GetUserSessions(context.Background(), userID)
+	if err != nil {
+		log.Printf("failed to get user sessions: %v", err)
+		return nil
+	}
+	if len(sessions) > 0 {
+		return &sessions[0].User
 	}
 	return nil
 }
@@ -836,58 +1433,133 @@ func (s *socketServer) sendAIReply(req *t.AIMessageRequest) {
 	})
 
 	s.repo.SetAIReply(context.Background(), *req.RoomID, msg.ID, req.From, []string{req.Content, reply})
+	if err := s.svc.CreateRoomMessage(context.Background(), msg); err != nil {
+		log.Printf("failed to save ai reply: %v", err)
+	}
 
-	event := &t.Event{
+	s.broadcastMessage(req.MsgType, req.RoomID, req.From, req.ParticipantID, &t.Event{
 		Name: "NEW_MESSAGE_BROADCAST",
 		Data: msg,
-	}
+	})
+}
 
-	if req.MsgType == t.RoomMsg {
-		s.broadcastRoomEvent(*req.RoomID, event)
-	} else if req.MsgType == t.PrivateRoomMsg {
-		pIDs := []int{req.From, *req.ParticipantID}
-		s.broadcastMsgEvent(pIDs, event)
+// queueAIRequest queues the request for processAIMsgRequest. It never
+// blocks, the request is dropped if the queue is full or closed.
+func (s *socketServer) queueAIRequest(req *t.AIMessageRequest) {
+	s.aiMu.Lock()
+	defer s.aiMu.Unlock()
+	if s.aiClosed {
+		return
+	}
+	select {
+	case s.aiMsgRequest <- req:
+	default:
+		log.Printf("ai queue full, dropped request for msg %q", req.MsgID)
 	}
 }
 
 func (s *socketServer) processAIMsgRequest() {
+	defer close(s.aiDone)
 	for req := range s.aiMsgRequest {
-		go s.sendAIReply(req)
+		s.aiMu.Lock()
+		s.aiPending[req] = struct{}{}
+		s.aiMu.Unlock()
+
+		s.aiWG.Add(1)
+		go func(req *t.AIMessageRequest) {
+			defer s.aiWG.Done()
+			s.sendAIReply(req)
+
+			s.aiMu.Lock()
+			delete(s.aiPending, req)
+			s.aiMu.Unlock()
+		}(req)
 	}
 }
 
-func (s *socketServer) addTrack(roomID int, conn *websocket.Conn, tr *webrtc.TrackRemote) (*webrtc.TrackLocalStaticRTP, error) {
-	track, err := webrtc.NewTrackLocalStaticRTP(tr.Codec().RTPCodecCapability, tr.ID(), tr.StreamID())
-	if err != nil {
-		return nil, err
+// forwardTrack writes the packets of the published track to its subscribers
+// until the track ends, then removes it from the room.
+func (s *socketServer) forwardTrack(roomID int, rt *roomTrack, r *webrtc.RTPReceiver) {
+	defer s.do(func() {
+		s.removeTracks(roomID, rt.track)
+	})
+
+	buf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
+	levelExtID := audioLevelExtID(r)
+
+	for {
+		i, _, err := rt.remote.Read(buf)
+		if err != nil {
+			log.Printf("failed to read remote track: %v", err)
+			return
+		}
+
+		if err = rtpPkt.Unmarshal(buf[:i]); err != nil {
+			log.Printf("failed to unmarshal rtp packet: %v", err)
+			return
+		}
+		if rt.muted.Load() {
+			continue
+		}
+		if levelExtID != 0 {
+			rt.observeLevel(rtpPkt, levelExtID)
+		}
+		if rec := rt.recorder.Load(); rec != nil {
+			rec.write(rtpPkt)
+		}
+		rtpPkt.Extension = false
+		rtpPkt.Extensions = nil
+
+		if err = rt.track.WriteRTP(rtpPkt); err != nil {
+			log.Printf("failed to write rtp packet: %v", err)
+			return
+		}
 	}
+}
 
+func (s *socketServer) addTrack(roomID int, conn *websocket.Conn, tr *webrtc.TrackRemote, source t.TrackSource) (*roomTrack, error) {
 	c, ok := s.conns[conn]
 	if !ok {
 		return nil, errors.New("socket conn is missing for track's peer")
 	}
 
-	s.rooms[roomID].tracks[tr.ID()] = &roomTrack{
-		pID:   c.pID,
-		track: track,
+	track, err := webrtc.NewTrackLocalStaticRTP(tr.Codec().RTPCodecCapability, tr.ID(), tr.StreamID())
+	if err != nil {
+		return nil, err
+	}
+	_, muted := s.rooms[roomID].forceMuted[s.participants[c.pID].ID]
+	return s.publishTrack(roomID, conn, &roomTrack{
+		pID:       c.pID,
+		source:    source,
+		track:     track,
+		remote:    tr,
+		publisher: c.peer,
+	}, muted), nil
+}
+
+// publishTrack adds the track to the room and forwards it to the room's
+// peers. conn is the publisher's connection, it's nil for ingested tracks.
+func (s *socketServer) publishTrack(roomID int, conn *websocket.Conn, rt *roomTrack, muted bool) *roomTrack {
+	rt.level.Store(math.Float64bits(silentLevel))
+	if muted && rt.source == t.TrackMicrophone {
+		rt.muted.Store(true)
 	}
+	s.rooms[roomID].tracks[rt.track.ID()] = rt
 
-	s.broadcastRoomEvent(roomID, &t.Event{
-		Name: "PEER_STREAMS",
-		Data: map[string]any{
-			"roomID": roomID,
-			"streams": map[string]string{
-				c.pID: tr.StreamID(),
-			},
-		},
-	})
+	s.broadcastRoomEvent(roomID, peerStreamsEvent(roomID, rt))
+
+	s.broadcastTracks(roomID, conn, rt)
 
-	s.broadcastTracks(roomID, conn, track)
+	if rec := s.rooms[roomID].recording; rec != nil {
+		s.recordTrack(rec, rt)
+	}
+	s.updateWHEP(roomID)
 
-	return track, nil
+	return rt
 }
 
-func (s *socketServer) broadcastTracks(roomID int, c *websocket.Conn, tr *webrtc.TrackLocalStaticRTP) {
+func (s *socketServer) broadcastTracks(roomID int, c *websocket.Conn, rt *roomTrack) {
 	for conn := range s.rooms[roomID].conns {
 		if c == conn {
 			continue
@@ -898,13 +1570,13 @@ func (s *socketServer) broadcastTracks(roomID int, c *websocket.Conn, tr *webrtc
 			continue
 		}
 
-		_, err := peer.AddTrack(tr)
+		err := peer.subscribe(rt)
 		if err != nil {
 			log.Printf("broadcast tracks: failed to add track to peer: %v", err)
 			continue
 		}
 
-		err = peer.makeOffer()
+		err = peer.negotiate()
 		if err != nil {
 			log.Printf("broadcast tracks: failed to make offer: %v", err)
 			continue
@@ -912,21 +1584,216 @@ func (s *socketServer) broadcastTracks(roomID int, c *websocket.Conn, tr *webrtc
 	}
 }
 
-func (s *socketServer) removeTrack(roomID int, trackID string) {
-	log.Println("removing track", trackID)
-	delete(s.rooms[roomID].tracks, trackID)
+// removeTracks removes the published tracks from the room. The subscribers
+// stop receiving them and renegotiate.
+func (s *socketServer) removeTracks(roomID int, tracks ...*webrtc.TrackLocalStaticRTP) {
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return
+	}
+
+	var removed []*roomTrack
+	for _, track := range tracks {
+		// the track might've been replaced by a newer one with the same ID
+		if rt, ok := room.tracks[track.ID()]; ok && rt.track == track {
+			log.Println("removing track", track.ID())
+			delete(room.tracks, track.ID())
+			removed = append(removed, rt)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	if room.recording != nil {
+		for _, rt := range removed {
+			s.stopRecordingTrack(room.recording, rt)
+		}
+	}
+	s.updateWHEP(roomID)
+
+	for conn := range room.conns {
+		c, ok := s.conns[conn]
+		if !ok || c.peer == nil {
+			continue
+		}
+		var renegotiate bool
+		for _, rt := range removed {
+			ok, err := c.peer.unsubscribe(rt)
+			if err != nil {
+				log.Printf("failed to remove track from peer: %v", err)
+			}
+			renegotiate = renegotiate || ok
+		}
+		if !renegotiate {
+			continue
+		}
+		if err := c.peer.negotiate(); err != nil {
+			log.Printf("remove tracks: failed to make offer: %v", err)
+		}
+	}
+
+	for _, rt := range removed {
+		s.broadcastRoomEvent(roomID, &t.Event{
+			Name: "PEER_STREAM_REMOVED",
+			Data: map[string]any{
+				"roomID":        roomID,
+				"participantID": rt.pID,
+				"streamID":      rt.track.StreamID(),
+				"trackID":       rt.track.ID(),
+				"source":        rt.source,
+			},
+		})
+	}
 }
 
-func (s *socketServer) NewPeer(roomID int, conn *websocket.Conn) (*Peer, error) {
-	p, err := s.webrtcAPI.NewPeerConnection(webrtc.Configuration{
-		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{
-					"stun:stun.l.google.com:19302",
-				},
+// closePeer closes the peer of the connection and removes the tracks it
+// published from the room.
+func (s *socketServer) closePeer(c *socketConn) {
+	p := c.peer
+	if p == nil {
+		return
+	}
+	c.peer = nil
+
+	if room, ok := s.rooms[p.roomID]; ok {
+		var tracks []*webrtc.TrackLocalStaticRTP
+		for _, rt := range room.tracks {
+			if rt.publisher == p {
+				tracks = append(tracks, rt.track)
+			}
+		}
+		s.removeTracks(p.roomID, tracks...)
+	}
+
+	if err := p.Close(); err != nil {
+		log.Printf("failed to close peer connection: %v", err)
+	}
+}
+
+// peer returns the peer of the connection if it is in the room.
+func (s *socketServer) peer(conn *websocket.Conn, roomID int) (*Peer, error) {
+	c, ok := s.conns[conn]
+	if !ok || c.peer == nil || c.peer.roomID != roomID {
+		return nil, errNotInRoom
+	}
+	return c.peer, nil
+}
+
+// peerICECandidateHandler is run on the run loop, see onLoop.
+func (s *socketServer) peerICECandidateHandler(conn *websocket.Conn, data *t.ICECandiate) (any, error) {
+	p, err := s.peer(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	return nil, p.addICECandidate(data)
+}
+
+func (s *socketServer) peerOfferHandler(conn *websocket.Conn, data *t.PeerOffer) (any, error) {
+	var (
+		p      *Peer
+		userID int
+		err    error
+	)
+	s.do(func() {
+		if p, err = s.peer(conn, data.RoomID); err == nil {
+			userID = s.getParticipant(conn).ID
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// reject the offer early instead of dropping the tracks once they arrive
+	for _, source := range data.Tracks {
+		if err := s.svc.CanPublish(context.Background(), data.RoomID, userID, source); err != nil {
+			return nil, err
+		}
+	}
+
+	s.do(func() {
+		// the peer might have been replaced while checking
+		if cur, _ := s.peer(conn, data.RoomID); cur != p {
+			err = errNotInRoom
+			return
+		}
+		for id, source := range data.Tracks {
+			p.sources[id] = source
+		}
+		err = p.acceptOffer(data)
+	})
+	return nil, err
+}
+
+// peerAnswerHandler is run on the run loop, see onLoop.
+func (s *socketServer) peerAnswerHandler(conn *websocket.Conn, data *t.PeerAnswer) (any, error) {
+	p, err := s.peer(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.acceptAnswer(data); err != nil {
+		return nil, err
+	}
+	// the answer might have attached new subscriptions
+	p.requestKeyframes()
+	return nil, nil
+}
+
+func (s *socketServer) updatePublishSettingsHandler(conn *websocket.Conn, data *t.UpdatePublishSettings) (any, error) {
+	p, err := s.member(conn, data.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.svc.UpdatePublishSettings(context.Background(), data.RoomID, p.ID, data.VideoPublishers, data.ScreenPublishers)
+	if err != nil {
+		return nil, err
+	}
+
+	s.do(func() {
+		s.broadcastRoomEvent(data.RoomID, &t.Event{
+			Name: "UPDATE_PUBLISH_SETTINGS_BROADCAST",
+			Data: map[string]any{
+				"roomID":           data.RoomID,
+				"by":               p,
+				"videoPublishers":  data.VideoPublishers,
+				"screenPublishers": data.ScreenPublishers,
 			},
+		})
+	})
+	return nil, nil
+}
+
+// peerStreamsEvent tells the clients which participant published the tracks.
+// streams only has the microphone streams, older clients expect one stream
+// per participant.
+func peerStreamsEvent(roomID int, tracks ...*roomTrack) *t.Event {
+	streams := make(map[string]string)
+	list := make([]map[string]any, 0, len(tracks))
+	for _, rt := range tracks {
+		if rt.source == t.TrackMicrophone {
+			streams[rt.pID] = rt.track.StreamID()
+		}
+		list = append(list, map[string]any{
+			"participantID": rt.pID,
+			"streamID":      rt.track.StreamID(),
+			"trackID":       rt.track.ID(),
+			"kind":          rt.track.Kind().String(),
+			"source":        rt.source,
+		})
+	}
+	return &t.Event{
+		Name: "PEER_STREAMS",
+		Data: map[string]any{
+			"roomID":  roomID,
+			"streams": streams,
+			"tracks":  list,
 		},
+	}
+}
+
+func (s *socketServer) NewPeer(roomID int, conn *socketConn) (*Peer, error) {
+	p, statsGetter, err := s.webrtcAPI.newPeerConnection(webrtc.Configuration{
+		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
+		ICEServers:   webrtcICEServers(s.cfg),
 	})
 	if err != nil {
 		return nil, err
@@ -936,13 +1803,19 @@ func (s *socketServer) NewPeer(roomID int, conn *websocket.Conn) (*Peer, error)
 		roomID:         roomID,
 		PeerConnection: p,
 		conn:           conn,
+		stats:          statsGetter,
+		sources:        make(map[string]t.TrackSource),
+		subscribed:     make(map[string]*roomTrack),
+		senders:        make(map[string]*webrtc.RTPSender),
 	}
 
-	_, err = peer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionRecvonly,
-	})
-	if err != nil {
-		return nil, err
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		_, err = peer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	p.OnICECandidate(func(i *webrtc.ICECandidate) {
@@ -956,7 +1829,7 @@ func (s *socketServer) NewPeer(roomID int, conn *websocket.Conn) (*Peer, error)
 			return
 		}
 
-		utils.WriteEvent(conn, &t.Event{
+		conn.send(&t.Event{
 			Name: "PEER_ICE_CANDIDATE",
 			Data: map[string]any{
 				"roomID":    roomID,
@@ -969,6 +1842,11 @@ func (s *socketServer) NewPeer(roomID int, conn *websocket.Conn) (*Peer, error)
 }
 
 func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.ss.draining.Load() {
+		errorResponse(w, http.StatusServiceUnavailable, errShuttingDown)
+		return
+	}
+
 	host := strings.Split(app.conf.WebURL, "//")[1]
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{host},
@@ -979,11 +1857,6 @@ func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var (
-		// last joined room
-		roomID int
-	)
-
 	ip := r.RemoteAddr
 	forwarded := r.Header.Get("X-Forwarded-For")
 	if forwarded != "" {
@@ -995,80 +1868,60 @@ func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
 		user = nil
 	}
 
+	if user != nil && app.ss.isRateLimited(user.ID) {
+		conn.Close(websocket.StatusPolicyViolation, "rate limit exceeded")
+		return
+	}
+
+	var (
+		// key identifies the session in the socket server, it's the first
+		// websocket of a resumed session
+		key     = conn
+		readErr error
+	)
+
 	defer func() {
-		app.ss.close(conn, roomID, user)
+		app.ss.do(func() {
+			app.ss.disconnect(key, conn, user, readErr)
+		})
 		conn.CloseNow()
 	}()
 
-	app.ss.accept(conn, user)
+	resumed := false
+	if token := r.URL.Query().Get("resume"); token != "" {
+		lastSeq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		app.ss.do(func() {
+			var k *websocket.Conn
+			if k, resumed = app.ss.resume(conn, user, token, lastSeq); resumed {
+				key = k
+			}
+		})
+	}
+	if !resumed {
+		app.ss.do(func() {
+			app.ss.accept(conn, user)
+		})
+	}
 
 	for {
 		var event t.Event
-		err := wsjson.Read(context.Background(), conn, &event)
-		if err != nil {
-			log.Printf("error reading message from socket: ip: %s err: %v", ip, err)
+		readErr = wsjson.Read(context.Background(), conn, &event)
+		if readErr != nil {
+			log.Printf("error reading message from socket: ip: %s err: %v", ip, readErr)
 			return
 		}
 
-		// only users who are authenticated can send event
-		if user == nil {
-			log.Printf("only authenticated users can send socket event")
-			continue
-		}
-
 		b, err := json.Marshal(event.Data)
 		if err != nil {
 			log.Printf("failed to marshal 'data' in event: %v", err)
 			return
 		}
 
-		switch event.Name {
-		case "JOIN_ROOM":
-			roomID, err = app.ss.joinRoomHandler(conn, b)
-			if err != nil {
-				log.Printf("failed to join room: %v", err)
-				if errors.Is(err, roomFullErr) {
-					utils.WriteEvent(conn, &t.Event{
-						Name: "ERROR_BROADCAST",
-						Data: map[string]any{
-							"roomID": roomID,
-							"title":  "Room Full",
-						},
-					})
-				}
-			}
-		case "NEW_MESSAGE":
-			app.ss.newMessageHandler(conn, b)
-		case "EDIT_MESSAGE":
-			app.ss.editMessageHandler(conn, b)
-		case "DELETE_MESSAGE":
-			app.ss.deleteMessageHandler(conn, b)
-		case "REACTION_TO_MESSAGE":
-			app.ss.reactionToMsgHandler(conn, b)
-		case "CLEAR_CHAT":
-			app.ss.clearChatHandler(conn, b)
-		case "ASSIGN_ROLE":
-			app.ss.assignRoleHandler(conn, b)
-		case "UPDATE_WELCOME_MESSAGE":
-			app.ss.updateWelcomeMsgHandler(conn, b)
-		case "SET_STATUS":
-			app.ss.setStatusHandler(conn, b)
-		case "KICK_PARTICIPANT":
-			app.ss.kickParticipantHandler(conn, b)
-		case "PEER_ICE_CANDIDATE":
-			if val, ok := app.ss.conns[conn]; ok && val != nil {
-				val.peer.addICECandidate(b)
-			}
-		case "PEER_MUTE":
-			app.ss.peerMuteHandler(conn, b)
-		case "PEER_OFFER":
-			if val, ok := app.ss.conns[conn]; ok && val.peer != nil {
-				val.peer.acceptOffer(b)
-			}
-		case "PEER_ANSWER":
-			if val, ok := app.ss.conns[conn]; ok && val.peer != nil {
-				val.peer.acceptAnswer(b)
-			}
+		// the event is handled on this goroutine, the handlers only enter
+		// the run loop to read or change the state
+		if err := app.ss.handleEvent(key, conn, user, &event, b); err != nil {
+			log.Printf("stopped reading from socket: ip: %s err: %v", ip, err)
+			return
 		}
 	}
 }
@@ -0,0 +1,895 @@
+package main
+
+import (
+	"backend/db"
+	"backend/types"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// joinRoom joins the room and waits for the ACK.
+func joinRoom(tb testing.TB, c *testClient, roomID int) {
+	tb.Helper()
+	c.call(tb, "JOIN_ROOM", map[string]any{"roomID": roomID})
+}
+
+func roomParticipants(tb testing.TB, repo db.Store, roomID int) []*types.Participant {
+	tb.Helper()
+	participants, err := repo.GetRoomParticipants(context.Background(), []int{roomID})
+	if err != nil {
+		tb.Fatalf("failed to get room participants: %v", err)
+	}
+	return participants[roomID]
+}
+
+// TestConcurrentRoomEvents runs the events of several clients at once, it's
+// meant to be run with -race.
+func TestConcurrentRoomEvents(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		// the participants leave as soon as their websocket is gone
+		conf.Socket.ResumeGrace = 0
+	})
+	host, _ := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+
+	const (
+		users    = 6
+		messages = 3
+	)
+	clients := make([]*testClient, users)
+	for i := range clients {
+		_, session := ta.user(t, fmt.Sprintf("user%d", i))
+		clients[i] = ta.dial(t, session, "")
+		clients[i].waitEvent(t, "SESSION")
+	}
+
+	t.Run("join", func(t *testing.T) {
+		for i, c := range clients {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				joinRoom(t, c, roomID)
+			})
+		}
+	})
+	if n := len(roomParticipants(t, ta.repo, roomID)); n != users {
+		t.Fatalf("got %d participants, want %d", n, users)
+	}
+
+	t.Run("events", func(t *testing.T) {
+		for i, c := range clients {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				for j := 0; j < messages; j++ {
+					c.call(t, "NEW_MESSAGE", map[string]any{
+						"roomID":  roomID,
+						"content": fmt.Sprintf("message %d", j),
+					})
+				}
+				c.call(t, "SET_STATUS", map[string]any{"roomID": roomID, "status": "AFK"})
+				c.call(t, "SET_PRESENCE", map[string]any{"idle": true})
+				c.call(t, "PEER_MUTE", map[string]any{"roomID": roomID, "mute": false})
+			})
+		}
+	})
+	for i, c := range clients {
+		eventually(t, fmt.Sprintf("messages of client %d", i), func() bool {
+			return c.count("NEW_MESSAGE_BROADCAST") == users*messages
+		})
+	}
+
+	// half the clients leave while the others keep on chatting
+	t.Run("leave", func(t *testing.T) {
+		for i, c := range clients {
+			t.Run(fmt.Sprint(i), func(t *testing.T) {
+				t.Parallel()
+				if i%2 == 0 {
+					c.ws.CloseNow()
+					return
+				}
+				c.call(t, "NEW_MESSAGE", map[string]any{"roomID": roomID, "content": "bye"})
+				c.call(t, "SET_STATUS", map[string]any{"roomID": roomID, "status": "None"})
+			})
+		}
+	})
+	eventually(t, "participants to leave", func() bool {
+		return len(roomParticipants(t, ta.repo, roomID)) == users/2
+	})
+}
+
+// slowStore blocks GetRoom of a room until it's released, it stands for a
+// slow postgres query.
+type slowStore struct {
+	*db.MemoryStore
+	roomID  int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) GetRoom(ctx context.Context, roomID int) (*types.Room, error) {
+	if roomID == s.roomID {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	return s.MemoryStore.GetRoom(ctx, roomID)
+}
+
+func TestSlowQueryDoesNotStallOtherRooms(t *testing.T) {
+	store := &slowStore{
+		MemoryStore: db.NewMemoryStore(),
+		entered:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	ta := newTestApp(t, store, nil)
+	host, _ := ta.user(t, "host")
+	slowRoom := ta.room(t, host, nil)
+	fastRoom := ta.room(t, host, nil)
+	store.roomID = slowRoom
+
+	_, s1 := ta.user(t, "alice")
+	_, s2 := ta.user(t, "bob")
+	alice := ta.dial(t, s1, "")
+	bob := ta.dial(t, s2, "")
+
+	alice.send(t, "JOIN_ROOM", map[string]any{"roomID": slowRoom})
+	select {
+	case <-store.entered:
+	case <-time.After(testTimeout):
+		t.Fatal("join of the slow room didn't query the room")
+	}
+
+	// the query of alice's join is still running
+	joinRoom(t, bob, fastRoom)
+	bob.call(t, "NEW_MESSAGE", map[string]any{"roomID": fastRoom, "content": "hi"})
+
+	close(store.release)
+	alice.waitFor(t, "join ACK", func(e *testEvent) bool {
+		return e.Name == "ACK"
+	})
+}
+
+func TestQueueAIRequestDoesNotBlock(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	s := ta.ss
+	roomID := 1
+
+	// nothing consumes the queue, as if every request was being answered
+	for i := 0; i < cap(s.aiMsgRequest)+10; i++ {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.queueAIRequest(&types.AIMessageRequest{
+				MsgType:    types.RoomMsg,
+				NewMessage: &types.NewMessage{RoomID: &roomID},
+				MsgID:      fmt.Sprint(i),
+			})
+		}()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatalf("request %d blocked", i)
+		}
+	}
+	if n := len(s.aiMsgRequest); n != cap(s.aiMsgRequest) {
+		t.Fatalf("got %d queued requests, want %d", n, cap(s.aiMsgRequest))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.drainAIRequests(ctx)
+	// the queue is closed, the request is dropped instead of panicking
+	s.queueAIRequest(&types.AIMessageRequest{MsgType: types.RoomMsg, NewMessage: &types.NewMessage{RoomID: &roomID}})
+}
+
+func TestAsyncRunsInOrder(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	s := ta.ss
+
+	var (
+		got  []int
+		last <-chan struct{}
+	)
+	s.do(func() {
+		for i := 0; i < 100; i++ {
+			last = s.async(func() {
+				// the jobs may enter the run loop
+				s.do(func() {
+					got = append(got, i)
+				})
+			})
+		}
+	})
+	select {
+	case <-last:
+	case <-time.After(testTimeout):
+		t.Fatal("jobs didn't run")
+	}
+
+	var want []int
+	for i := 0; i < 100; i++ {
+		want = append(want, i)
+	}
+	s.do(func() {
+		if !slices.Equal(got, want) {
+			t.Errorf("jobs ran out of order: %v", got)
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	go ta.ss.processAIMsgRequest()
+	host, _ := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+
+	var clients []*testClient
+	for i := 0; i < 3; i++ {
+		_, session := ta.user(t, fmt.Sprintf("user%d", i))
+		c := ta.dial(t, session, "")
+		joinRoom(t, c, roomID)
+		clients = append(clients, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	ta.ss.shutdown(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("shutdown didn't finish in time")
+	}
+
+	for i, c := range clients {
+		c.waitEvent(t, "SERVER_SHUTTING_DOWN")
+		eventually(t, fmt.Sprintf("client %d to be closed", i), func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.closed
+		})
+	}
+	if !ta.ss.draining.Load() {
+		t.Error("the server isn't draining")
+	}
+}
+
+// moderatedRoom is a room with a host, a co-host and two guests, all of
+// them joined.
+type moderatedRoom struct {
+	id int
+
+	host, coHost, guest, other     *types.User
+	hostC, coHostC, guestC, otherC *testClient
+	sessions                       map[int]string
+}
+
+func newModeratedRoom(tb testing.TB, ta *testApp) *moderatedRoom {
+	tb.Helper()
+	r := &moderatedRoom{}
+	var sessions [4]string
+	r.host, sessions[0] = ta.user(tb, "host")
+	r.coHost, sessions[1] = ta.user(tb, "cohost")
+	r.guest, sessions[2] = ta.user(tb, "guest")
+	r.other, sessions[3] = ta.user(tb, "other")
+	r.id = ta.room(tb, r.host, nil)
+	r.sessions = map[int]string{
+		r.host.ID:   sessions[0],
+		r.coHost.ID: sessions[1],
+		r.guest.ID:  sessions[2],
+		r.other.ID:  sessions[3],
+	}
+
+	ctx := context.Background()
+	settings, err := ta.repo.GetRoomSettings(ctx, r.id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	settings.CoHosts = []int{r.coHost.ID}
+	if err := ta.repo.UpdateRoomSettings(ctx, settings); err != nil {
+		tb.Fatal(err)
+	}
+
+	for i, c := range []**testClient{&r.hostC, &r.coHostC, &r.guestC, &r.otherC} {
+		*c = ta.dial(tb, sessions[i], "")
+		joinRoom(tb, *c, r.id)
+	}
+	return r
+}
+
+func TestModerationHandlers(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		data  func(r *moderatedRoom) map[string]any
+		from  func(r *moderatedRoom) *testClient
+		// wantCode is the code of the ERROR, the event succeeds if it's
+		// empty
+		wantCode string
+		// wantBroadcast is sent to the other participants on success
+		wantBroadcast string
+		// check runs if the event succeeded
+		check func(t *testing.T, ta *testApp, r *moderatedRoom)
+	}{
+		{
+			name:  "host makes guest co-host",
+			event: "ASSIGN_ROLE",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.guest.ID, "role": "coHost"}
+			},
+			from:          func(r *moderatedRoom) *testClient { return r.hostC },
+			wantBroadcast: "ASSIGN_ROLE_BROADCAST",
+			check: func(t *testing.T, ta *testApp, r *moderatedRoom) {
+				settings, err := ta.repo.GetRoomSettings(context.Background(), r.id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Contains(settings.CoHosts, r.guest.ID) {
+					t.Errorf("got co-hosts %v, want the guest", settings.CoHosts)
+				}
+			},
+		},
+		{
+			name:  "co-host can't assign roles",
+			event: "ASSIGN_ROLE",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.guest.ID, "role": "coHost"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.coHostC },
+			wantCode: codePermissionDenied,
+		},
+		{
+			name:  "guest is no co-host to demote",
+			event: "ASSIGN_ROLE",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.guest.ID, "role": "guest"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.hostC },
+			wantCode: codeValidationFailed,
+		},
+		{
+			name:  "assign role of an offline user",
+			event: "ASSIGN_ROLE",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.other.ID + 100, "role": "coHost"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.hostC },
+			wantCode: codeNotInRoom,
+		},
+		{
+			name:  "co-host kicks guest",
+			event: "KICK_PARTICIPANT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.guest.ID, "duration": "10m", "clearChat": true}
+			},
+			from:          func(r *moderatedRoom) *testClient { return r.coHostC },
+			wantBroadcast: "KICK_PARTICIPANT_BROADCAST",
+			check: func(t *testing.T, ta *testApp, r *moderatedRoom) {
+				r.otherC.waitEvent(t, "CLEAR_CHAT_BROADCAST")
+				r.guestC.waitEvent(t, "KICK_PARTICIPANT_BROADCAST")
+				eventually(t, "the guest to be removed", func() bool {
+					for _, p := range roomParticipants(t, ta.repo, r.id) {
+						if p.ID == r.guest.ID {
+							return false
+						}
+					}
+					return true
+				})
+				// the guest can't join again while kicked
+				res := ta.get(t, fmt.Sprintf("/rooms/%d/join", r.id), r.sessions[r.guest.ID])
+				if res.StatusCode != http.StatusForbidden {
+					t.Errorf("got status %d joining while kicked, want %d", res.StatusCode, http.StatusForbidden)
+				}
+			},
+		},
+		{
+			name:  "guest can't kick",
+			event: "KICK_PARTICIPANT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.other.ID, "duration": "10m"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.guestC },
+			wantCode: codePermissionDenied,
+		},
+		{
+			name:  "host can't be kicked",
+			event: "KICK_PARTICIPANT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.host.ID, "duration": "10m"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.coHostC },
+			wantCode: codePermissionDenied,
+		},
+		{
+			name:  "kick is at least a minute",
+			event: "KICK_PARTICIPANT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.guest.ID, "duration": "1s"}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.hostC },
+			wantCode: codeValidationFailed,
+		},
+		{
+			name:  "host clears chat of guest",
+			event: "CLEAR_CHAT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.guest.ID}
+			},
+			from:          func(r *moderatedRoom) *testClient { return r.hostC },
+			wantBroadcast: "CLEAR_CHAT_BROADCAST",
+		},
+		{
+			name:  "co-host can't clear chat of host",
+			event: "CLEAR_CHAT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.host.ID}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.coHostC },
+			wantCode: codePermissionDenied,
+		},
+		{
+			name:  "guest can't clear chat",
+			event: "CLEAR_CHAT",
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantId": r.other.ID}
+			},
+			from:     func(r *moderatedRoom) *testClient { return r.guestC },
+			wantCode: codePermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t, db.NewMemoryStore(), nil)
+			r := newModeratedRoom(t, ta)
+
+			from := tt.from(r)
+			if tt.wantCode != "" {
+				if e := from.callErr(t, tt.event, tt.data(r)); e.Code != tt.wantCode {
+					t.Fatalf("got error %s: %s, want %s", e.Code, e.Message, tt.wantCode)
+				}
+				return
+			}
+			from.call(t, tt.event, tt.data(r))
+			r.otherC.waitEvent(t, tt.wantBroadcast)
+			if tt.check != nil {
+				tt.check(t, ta, r)
+			}
+		})
+	}
+}
+
+func TestForceMuteSkipsIngest(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	r := newModeratedRoom(t, ta)
+	addIngest(t, ta, r.id)
+
+	if e := r.hostC.callErr(t, "FORCE_MUTE", map[string]any{
+		"roomID": r.id, "participantID": 0, "mute": true,
+	}); e.Code != codeNotInRoom {
+		t.Fatalf("got error %s: %s muting the whip publisher, want %s", e.Code, e.Message, codeNotInRoom)
+	}
+
+	r.hostC.call(t, "FORCE_MUTE", map[string]any{"roomID": r.id, "allGuests": true, "mute": true})
+	r.otherC.waitEvent(t, "PARTICIPANT_FORCE_MUTED")
+	var muted []int
+	ta.ss.do(func() {
+		for userID := range ta.ss.rooms[r.id].forceMuted {
+			muted = append(muted, userID)
+		}
+	})
+	slices.Sort(muted)
+	want := []int{r.guest.ID, r.other.ID}
+	slices.Sort(want)
+	if !slices.Equal(muted, want) {
+		t.Errorf("got force muted users %v, want the guests %v", muted, want)
+	}
+}
+
+// TestLockedRoomMembership checks that only the participants of a locked
+// room are told who joins and leaves it.
+func TestLockedRoomMembership(t *testing.T) {
+	for _, locked := range []bool{false, true} {
+		t.Run(fmt.Sprint("locked ", locked), func(t *testing.T) {
+			ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+				conf.Socket.ResumeGrace = 0
+			})
+			host, hostSession := ta.user(t, "host")
+			coHost, coHostSession := ta.user(t, "cohost")
+			_, outsiderSession := ta.user(t, "outsider")
+			roomID := ta.room(t, host, func(r *types.Room) {
+				r.Settings.Locked = locked
+			})
+			// the host and co-hosts join a locked room without an invite
+			ctx := context.Background()
+			settings, err := ta.repo.GetRoomSettings(ctx, roomID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings.CoHosts = []int{coHost.ID}
+			if err := ta.repo.UpdateRoomSettings(ctx, settings); err != nil {
+				t.Fatal(err)
+			}
+
+			outsider := ta.dial(t, outsiderSession, "")
+			outsider.waitEvent(t, "SESSION")
+			member := ta.dial(t, hostSession, "")
+			joinRoom(t, member, roomID)
+			joiner := ta.dial(t, coHostSession, "")
+			joinRoom(t, joiner, roomID)
+			eventually(t, "the co-host to join", func() bool {
+				return member.count("JOINED_ROOM_BROADCAST") == 2
+			})
+			joiner.ws.CloseNow()
+			member.waitEvent(t, "LEFT_ROOM_BROADCAST")
+
+			// the reply comes after anything the outsider was sent before
+			outsider.call(t, "SET_PRESENCE", map[string]any{"idle": false})
+			wantJoined, wantLeft := 2, 1
+			if locked {
+				wantJoined, wantLeft = 0, 0
+			}
+			joined, left := outsider.count("JOINED_ROOM_BROADCAST"), outsider.count("LEFT_ROOM_BROADCAST")
+			if joined != wantJoined || left != wantLeft {
+				t.Errorf("outsider got %d joins and %d leaves, want %d and %d", joined, left, wantJoined, wantLeft)
+			}
+		})
+	}
+}
+
+func TestReactionToMessageHandler(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	r := newModeratedRoom(t, ta)
+
+	var msg struct {
+		ID string `json:"id"`
+	}
+	ack := r.guestC.call(t, "NEW_MESSAGE", map[string]any{"roomID": r.id, "content": "hi"})
+	if err := json.Unmarshal(ack, &msg); err != nil || msg.ID == "" {
+		t.Fatalf("got ACK %s, want the message ID", ack)
+	}
+	whisper := r.guestC.call(t, "NEW_MESSAGE", map[string]any{
+		"roomID": r.id, "participantID": r.host.ID, "content": "psst",
+	})
+	var whisperMsg struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(whisper, &whisperMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		from     func(r *moderatedRoom) *testClient
+		data     func(r *moderatedRoom) map[string]any
+		wantCode string
+	}{
+		{
+			name: "participant reacts",
+			from: func(r *moderatedRoom) *testClient { return r.otherC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "id": msg.ID, "reaction": "👍"}
+			},
+		},
+		{
+			name: "unsupported emoji",
+			from: func(r *moderatedRoom) *testClient { return r.otherC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "id": msg.ID, "reaction": "🦄"}
+			},
+			wantCode: codeValidationFailed,
+		},
+		{
+			name: "unknown message",
+			from: func(r *moderatedRoom) *testClient { return r.otherC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "id": "nope", "reaction": "👍"}
+			},
+			wantCode: codeNotFound,
+		},
+		{
+			name: "receiver reacts to whisper",
+			from: func(r *moderatedRoom) *testClient { return r.hostC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.guest.ID, "id": whisperMsg.ID, "reaction": "👍"}
+			},
+		},
+		{
+			name: "outsider can't see the whisper",
+			from: func(r *moderatedRoom) *testClient { return r.otherC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "participantID": r.guest.ID, "id": whisperMsg.ID, "reaction": "👍"}
+			},
+			wantCode: codeNotFound,
+		},
+		{
+			name: "whisper isn't a room message",
+			from: func(r *moderatedRoom) *testClient { return r.otherC },
+			data: func(r *moderatedRoom) map[string]any {
+				return map[string]any{"roomID": r.id, "id": whisperMsg.ID, "reaction": "👍"}
+			},
+			wantCode: codeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCode != "" {
+				if e := tt.from(r).callErr(t, "REACTION_TO_MESSAGE", tt.data(r)); e.Code != tt.wantCode {
+					t.Fatalf("got error %s: %s, want %s", e.Code, e.Message, tt.wantCode)
+				}
+				return
+			}
+			tt.from(r).call(t, "REACTION_TO_MESSAGE", tt.data(r))
+		})
+	}
+
+	// the reactions reach the sender and are kept
+	eventually(t, "the reactions", func() bool {
+		return r.guestC.count("REACTION_TO_MESSAGE_BROADCAST") == 2
+	})
+	messages, err := ta.repo.GetRoomMessages(context.Background(), r.id, r.other.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		if m.ID != msg.ID {
+			continue
+		}
+		var got map[int]struct{}
+		if m.Reactions != nil {
+			got = (*m.Reactions)["👍"]
+		}
+		if _, ok := got[r.other.ID]; !ok || len(got) != 1 {
+			t.Errorf("got 👍 of %v, want the other's", got)
+		}
+	}
+}
+
+func TestResumeClosesOldWebsocket(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, _ := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+	u, session := ta.user(t, "alice")
+
+	old := ta.dial(t, session, "")
+	var s struct {
+		SID   string `json:"sid"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(old.waitEvent(t, "SESSION").Data, &s); err != nil {
+		t.Fatal(err)
+	}
+	joinRoom(t, old, roomID)
+
+	// the old websocket is still open, as if the client didn't notice the
+	// network change yet
+	old.mu.Lock()
+	seq := old.events[len(old.events)-1].Seq
+	old.mu.Unlock()
+	resumed := ta.dial(t, session, fmt.Sprintf("resume=%s&seq=%d", s.Token, seq))
+	resumed.waitEvent(t, "SESSION_RESUMED")
+
+	eventually(t, "the old websocket to be closed", func() bool {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		return old.closed
+	})
+	old.mu.Lock()
+	status := websocket.CloseStatus(old.closeErr)
+	old.mu.Unlock()
+	if status != websocket.StatusPolicyViolation {
+		t.Errorf("got close status %v, want %v", status, websocket.StatusPolicyViolation)
+	}
+
+	// closing the old websocket doesn't end the session
+	resumed.call(t, "SET_STATUS", map[string]any{"roomID": roomID, "status": "AFK"})
+	participants := roomParticipants(t, ta.repo, roomID)
+	if len(participants) != 1 || participants[0].ID != u.ID || participants[0].SID != s.SID {
+		t.Errorf("got participants %+v, want the resumed session", participants)
+	}
+}
+
+// TestJoinRoomPeerFailure checks that a join whose peer can't be created
+// leaves nothing behind.
+func TestJoinRoomPeerFailure(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+		// the peer connection refuses the malformed url
+		conf.RTC.STUNURLs = []string{"not a url"}
+	})
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, nil)
+
+	c := ta.dial(t, hostSession, "")
+	c.callErr(t, "JOIN_ROOM", map[string]any{"roomID": roomID})
+	eventually(t, "the participant to be removed", func() bool {
+		return len(roomParticipants(t, ta.repo, roomID)) == 0
+	})
+	// the conn isn't left in the room
+	if evErr := c.callErr(t, "JOIN_ROOM", map[string]any{"roomID": roomID}); evErr.Code == codeConflict {
+		t.Errorf("got %q joining again, want the peer error", evErr.Message)
+	}
+}
+
+// TestConcurrentJoinRoomLimit joins a room with a single spot left from
+// several clients at once, only one of them may get in.
+func TestConcurrentJoinRoomLimit(t *testing.T) {
+	const guests = 5
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	host, hostSession := ta.user(t, "host")
+	roomID := ta.room(t, host, func(r *types.Room) {
+		r.MaxParticipants = 2
+	})
+	joinRoom(t, ta.dial(t, hostSession, ""), roomID)
+
+	clients := make([]*testClient, guests)
+	for i := range clients {
+		_, session := ta.user(t, fmt.Sprint("guest", i))
+		clients[i] = ta.dial(t, session, "")
+	}
+	var (
+		wg           sync.WaitGroup
+		joined, full atomic.Int32
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, evErr := c.reply(t, "JOIN_ROOM", map[string]any{"roomID": roomID})
+			switch {
+			case evErr == nil:
+				joined.Add(1)
+			case evErr.Code == codeRoomFull:
+				full.Add(1)
+			default:
+				t.Errorf("JOIN_ROOM failed: %s: %s", evErr.Code, evErr.Message)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if joined.Load() != 1 || full.Load() != guests-1 {
+		t.Errorf("got %d joined and %d refused, want 1 and %d", joined.Load(), full.Load(), guests-1)
+	}
+	if ps := roomParticipants(t, ta.repo, roomID); len(ps) != 2 {
+		t.Errorf("got %d participants, want 2", len(ps))
+	}
+}
+
+// TestForceMute checks that the SFU drops the microphone of a participant
+// muted by a moderator, until a moderator unmutes it.
+func TestForceMute(t *testing.T) {
+	ta := newTestApp(t, db.NewMemoryStore(), nil)
+	r := newModeratedRoom(t, ta)
+	var sid string
+	ta.ss.do(func() {
+		for conn := range ta.ss.rooms[r.id].conns {
+			if c := ta.ss.conns[conn]; ta.ss.participants[c.pID].ID == r.guest.ID {
+				sid = c.pID
+			}
+		}
+	})
+	tracks := ta.publish(t, r.id, sid)
+	muted := func() []bool {
+		var m []bool
+		ta.ss.do(func() {
+			for _, track := range tracks {
+				m = append(m, ta.ss.rooms[r.id].tracks[track.ID()].muted.Load())
+			}
+		})
+		return m
+	}
+	forceMute := func(c *testClient, mute bool) *eventError {
+		_, e := c.reply(t, "FORCE_MUTE", map[string]any{"roomID": r.id, "participantID": r.guest.ID, "mute": mute})
+		return e
+	}
+
+	if e := forceMute(r.otherC, true); e == nil || e.Code != codePermissionDenied {
+		t.Fatalf("got error %v muting as a guest, want %s", e, codePermissionDenied)
+	}
+
+	if e := forceMute(r.coHostC, true); e != nil {
+		t.Fatalf("FORCE_MUTE failed: %s: %s", e.Code, e.Message)
+	}
+	// only the microphone is dropped
+	if m := muted(); !slices.Equal(m, []bool{true, false}) {
+		t.Fatalf("got microphone and camera muted %v, want only the microphone", m)
+	}
+	e := r.otherC.waitEvent(t, "PARTICIPANT_FORCE_MUTED")
+	var data struct {
+		Participants []types.User `json:"participants"`
+		Mute         bool         `json:"mute"`
+	}
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Participants) != 1 || data.Participants[0].ID != r.guest.ID || !data.Mute {
+		t.Errorf("got broadcast %s, want the guest muted", e.Data)
+	}
+	r.otherC.waitEvent(t, "PEER_MUTE_BROADCAST")
+
+	// the guest can't unmute itself
+	if e := r.guestC.callErr(t, "PEER_MUTE", map[string]any{"roomID": r.id, "mute": false}); e.Code != codePermissionDenied {
+		t.Errorf("got error %s: %s unmuting, want %s", e.Code, e.Message, codePermissionDenied)
+	}
+
+	if e := forceMute(r.hostC, false); e != nil {
+		t.Fatalf("FORCE_MUTE failed: %s: %s", e.Code, e.Message)
+	}
+	if m := muted(); !slices.Equal(m, []bool{false, false}) {
+		t.Errorf("got microphone and camera muted %v after the unmute, want neither", m)
+	}
+	r.guestC.call(t, "PEER_MUTE", map[string]any{"roomID": r.id, "mute": false})
+}
+
+func TestRoomMessageOwnership(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+		// wantOld is the error for a message older than the index, if any
+		wantOld string
+	}{
+		{name: "kept messages", retention: 7},
+		{name: "messages not kept", retention: 0, wantOld: codeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t, db.NewMemoryStore(), func(conf *types.Config) {
+				conf.Messages.Retention = tt.retention
+				conf.Messages.IndexSize = 2
+			})
+			r := newModeratedRoom(t, ta)
+			send := func(c *testClient, content string) string {
+				t.Helper()
+				var msg struct {
+					ID string `json:"id"`
+				}
+				ack := c.call(t, "NEW_MESSAGE", map[string]any{"roomID": r.id, "content": content})
+				if err := json.Unmarshal(ack, &msg); err != nil || msg.ID == "" {
+					t.Fatalf("got ACK %s, want the message ID", ack)
+				}
+				return msg.ID
+			}
+			old := send(r.guestC, "old")
+			first, second := send(r.guestC, "first"), send(r.guestC, "second")
+
+			steps := []struct {
+				name     string
+				from     *testClient
+				event    string
+				id       string
+				wantCode string
+			}{
+				{name: "someone else edits", from: r.otherC, event: "EDIT_MESSAGE", id: first, wantCode: codePermissionDenied},
+				{name: "author edits", from: r.guestC, event: "EDIT_MESSAGE", id: first},
+				{name: "someone else deletes", from: r.otherC, event: "DELETE_MESSAGE", id: first, wantCode: codePermissionDenied},
+				{name: "co-host deletes", from: r.coHostC, event: "DELETE_MESSAGE", id: first},
+				{name: "author deletes", from: r.guestC, event: "DELETE_MESSAGE", id: second},
+				{name: "unknown message", from: r.guestC, event: "EDIT_MESSAGE", id: "nope", wantCode: codeNotFound},
+				{name: "message older than the index", from: r.guestC, event: "EDIT_MESSAGE", id: old, wantCode: tt.wantOld},
+			}
+			for _, step := range steps {
+				data := map[string]any{"roomID": r.id, "id": step.id, "content": "edited"}
+				if step.wantCode == "" {
+					step.from.call(t, step.event, data)
+					continue
+				}
+				if e := step.from.callErr(t, step.event, data); e.Code != step.wantCode {
+					t.Fatalf("%s: got error %s: %s, want %s", step.name, e.Code, e.Message, step.wantCode)
+				}
+			}
+
+			// only the rooms which don't keep their messages index them
+			ref, err := ta.repo.GetRoomMessageRef(context.Background(), r.id, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if indexed := ref != nil; indexed != (tt.retention == 0) {
+				t.Errorf("got message indexed %v with a retention of %d days", indexed, tt.retention)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ import { useScroll } from './hooks/useScroll'
 import { useReadMessage } from './hooks/useReadMessage'
 import { BottomPanel } from './BottomPanel'
 import { useFocus } from './hooks/useFocus'
+import { useAppStore } from '@/stores/appStore'
 
 type Props = {
 	pm: User | null
@@ -38,6 +39,11 @@ export const Messages = React.forwardRef((props: Props, _ref) => {
 	const textareaRef = useRef<HTMLTextAreaElement>(null)
 	const [editMsgID, setEditMsgID] = useState<string | undefined>(undefined)
 	const [replyTo, setReplyTo] = useState<string | undefined>(undefined)
+	const user = useAppStore().user
+	const canModerate =
+		props.room !== null &&
+		(props.room.settings.host.id === user?.id ||
+			(props.room.settings.coHosts?.includes(user?.id ?? 0) ?? false))
 
 	const viewRef = useReadMessage(props.dm?.id, initialMessages, props.messages)
 	useScroll(
@@ -92,6 +98,7 @@ export const Messages = React.forwardRef((props: Props, _ref) => {
 									setReplyTo={setReplyTo}
 									setPM={props.setPM}
 									dm={props.dm}
+									canModerate={canModerate}
 								/>
 							)
 						})}
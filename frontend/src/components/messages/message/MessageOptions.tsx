@@ -23,6 +23,9 @@ export function MessageOptions(props: MessageOptionsProps) {
 	const [open, setOpen] = useState(false)
 	const user = useAppStore().user
 	const isMyMessage = user?.id === props.message.from.id
+	// whispers can only be deleted by their author
+	const canDelete =
+		isMyMessage || (props.canModerate === true && !props.message.participant)
 
 	function handleReply() {
 		props.setEditMsgID(undefined)
@@ -72,28 +75,28 @@ export function MessageOptions(props: MessageOptionsProps) {
 					onCloseAutoFocus={(e) => e.preventDefault()}
 				>
 					{isMyMessage && (
-						<>
-							<Dropdown.Item
-								className="flex gap-3 items-center data-[highlighted]:outline-none data-[highlighted]:bg-accent px-2 py-1 rounded-md"
-								onClick={handleEdit}
-							>
-								<PencilIcon size={20} className="text-muted" />
-								<span>Edit</span>
-							</Dropdown.Item>
-							<Dropdown.Item
-								className="flex gap-3 items-center data-[highlighted]:outline-none data-[highlighted]:bg-accent px-2 py-1 rounded-md"
-								onClick={() => {
-									ws.deleteMsg(
-										props.message.id,
-										props.message.participant?.id || props.dm?.id,
-										props.dm !== null
-									)
-								}}
-							>
-								<TrashIcon size={20} className="text-muted" />
-								<span>Delete</span>
-							</Dropdown.Item>
-						</>
+						<Dropdown.Item
+							className="flex gap-3 items-center data-[highlighted]:outline-none data-[highlighted]:bg-accent px-2 py-1 rounded-md"
+							onClick={handleEdit}
+						>
+							<PencilIcon size={20} className="text-muted" />
+							<span>Edit</span>
+						</Dropdown.Item>
+					)}
+					{canDelete && (
+						<Dropdown.Item
+							className="flex gap-3 items-center data-[highlighted]:outline-none data-[highlighted]:bg-accent px-2 py-1 rounded-md"
+							onClick={() => {
+								ws.deleteMsg(
+									props.message.id,
+									props.message.participant?.id || props.dm?.id,
+									props.dm !== null
+								)
+							}}
+						>
+							<TrashIcon size={20} className="text-muted" />
+							<span>Delete</span>
+						</Dropdown.Item>
 					)}
 					<Dropdown.Item
 						className="flex gap-3 items-center data-[highlighted]:outline-none data-[highlighted]:bg-accent px-2 py-1 rounded-md"
@@ -21,6 +21,8 @@ export type Props = {
 	setPM: (pm: User | null) => void
 	messages: TMessage[]
 	dm: User | null
+	// the host and co-hosts may delete anyone's message to the room
+	canModerate?: boolean
 }
 
 export function Message(props: Props) {
@@ -61,9 +61,17 @@ export const RelationList = React.forwardRef((props: Props, _ref) => {
 								}))
 							}}
 						/>
-						<p className="ellipsis" role="button" onClick={() => openDM(u)}>
-							{u.username}
-						</p>
+						<div className="min-w-0">
+							<p className="ellipsis" role="button" onClick={() => openDM(u)}>
+								{u.username}
+							</p>
+							{u.presence.status !== 'offline' && (
+								<p className="text-xs text-muted">
+									{u.presence.status === 'idle' ? 'Idle' : 'Online'}
+									{u.presence.roomID ? ` · in room #${u.presence.roomID}` : ''}
+								</p>
+							)}
+						</div>
 					</div>
 				)
 			})}
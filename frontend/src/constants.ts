@@ -12,6 +12,16 @@ export const maxParticipants = [
 	{ value: '10', label: '10' },
 ]
 
+// days the room's messages are kept, the server's default when empty
+export const messageRetention = [
+	{ value: '', label: 'Default' },
+	{ value: '0', label: "Don't keep" },
+	{ value: '1', label: '1 day' },
+	{ value: '7', label: '7 days' },
+	{ value: '30', label: '30 days' },
+	{ value: '90', label: '90 days' },
+]
+
 export const status = ['None', 'AFK', 'BRB', 'Busy', '.zZ']
 
 export const durationUnits = [
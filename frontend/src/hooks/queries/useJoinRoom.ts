@@ -1,10 +1,14 @@
 import { api } from '@/lib/api'
 import { useQuery } from 'react-query'
 
-export function useJoinRoom(roomID: number, hasUser: boolean) {
+export function useJoinRoom(
+	roomID: number,
+	hasUser: boolean,
+	key?: string
+) {
 	return useQuery({
 		queryKey: ['room', roomID],
-		queryFn: () => api.joinRoom(roomID),
+		queryFn: () => api.joinRoom(roomID, key),
 		enabled: hasUser,
 		staleTime: Infinity,
 		cacheTime: Infinity,
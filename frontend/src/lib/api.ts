@@ -8,6 +8,10 @@ import {
 	Profile,
 	RelationRes,
 	DMsRes,
+	RTCConfig,
+	Recording,
+	PeerStats,
+	RoomInvite,
 } from '@/types'
 import { Message } from '@/types'
 import { Option } from '@/components/Select'
@@ -60,8 +64,11 @@ export const api = {
 		return data.rooms
 	},
 
-	async joinRoom(roomID: number) {
-		const url = config.apiURL + `/rooms/${roomID}/join`
+	async joinRoom(roomID: number, key?: string) {
+		let url = config.apiURL + `/rooms/${roomID}/join`
+		if (key) {
+			url += `?key=${encodeURIComponent(key)}`
+		}
 		const data = await fetchWrapper<'room', Room>(url)
 		return data.room
 	},
@@ -110,6 +117,20 @@ export const api = {
 		return data.messages
 	},
 
+	// before is the oldest message loaded, the ones sent before it are
+	// returned
+	async getRoomMessages(
+		roomID: number,
+		before?: Pick<Message, 'id' | 'createdAt'>
+	) {
+		const query = before
+			? `?cursor=${encodeURIComponent(before.createdAt)}&cursorID=${encodeURIComponent(before.id)}`
+			: ''
+		const url = config.apiURL + `/rooms/${roomID}/messages${query}`
+		const data = await fetchWrapper<'messages', Message[]>(url)
+		return data.messages
+	},
+
 	async emoji() {
 		const url = 'https://cdn.jsdelivr.net/npm/@emoji-mart/data'
 		const res = await fetch(url)
@@ -117,6 +138,66 @@ export const api = {
 		return data
 	},
 
+	async getRecordings(roomID: number) {
+		const url = config.apiURL + `/rooms/${roomID}/recordings`
+		const data = await fetchWrapper<'recordings', Recording[]>(url)
+		return data.recordings
+	},
+
+	async getRoomStats(roomID: number) {
+		const url = config.apiURL + `/rooms/${roomID}/stats`
+		const data = await fetchWrapper<'stats', PeerStats[]>(url)
+		return data.stats
+	},
+
+	async createIngestToken(roomID: number) {
+		const url = config.apiURL + `/rooms/${roomID}/ingest-token`
+		const data = await fetchWrapper<'token', string>(url, {
+			method: 'POST',
+		})
+		return data.token
+	},
+
+	async revokeIngestToken(roomID: number) {
+		const url = config.apiURL + `/rooms/${roomID}/ingest-token`
+		const data = await fetchWrapper<'message', string>(url, {
+			method: 'DELETE',
+		})
+		return data.message
+	},
+
+	async createInvite(
+		roomID: number,
+		invite: { expiresIn?: string; maxUses?: number }
+	) {
+		const url = config.apiURL + `/rooms/${roomID}/invites`
+		const data = await fetchWrapper<'invite', RoomInvite>(url, {
+			method: 'POST',
+			body: JSON.stringify(invite),
+		})
+		return data.invite
+	},
+
+	async getInvites(roomID: number) {
+		const url = config.apiURL + `/rooms/${roomID}/invites`
+		const data = await fetchWrapper<'invites', RoomInvite[]>(url)
+		return data.invites
+	},
+
+	async revokeInvite(roomID: number, code: string) {
+		const url = config.apiURL + `/rooms/${roomID}/invites/${code}`
+		const data = await fetchWrapper<'message', string>(url, {
+			method: 'DELETE',
+		})
+		return data.message
+	},
+
+	async getRTCConfig() {
+		const url = config.apiURL + '/rtc/config'
+		const data = await fetchWrapper<'iceServers', RTCIceServer[]>(url)
+		return data as RTCConfig
+	},
+
 	async getLanguages() {
 		const url = config.apiURL + '/languages'
 		const data = await fetchWrapper<'languages', Option[]>(url)
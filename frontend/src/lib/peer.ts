@@ -1,12 +1,27 @@
 import { useAppStore } from '@/stores/appStore'
 import { ws } from './ws'
+import { api } from './api'
 import { monitorStream } from './utils'
+import { TrackSource } from '@/types/peer'
 
 class Peer {
 	private static instance: Peer
 	pc: RTCPeerConnection | null = null
 	track: MediaStreamTrack | null = null
 
+	// set when the session was resumed while speaking, the microphone is
+	// published again once the server's offer is answered
+	private republish = false
+
+	// the ICE servers are shared with the server's peer, the TURN
+	// credentials are refreshed once half of their lifetime is over
+	private iceServers: RTCIceServer[] = []
+	private iceServersExpireAt = 0
+	private rtcConfig: Promise<void> = Promise.resolve()
+
+	private makingOffer = false
+	private candidates: RTCIceCandidateInit[] = []
+
 	static getInstance(): Peer {
 		if (!Peer.instance) {
 			this.instance = new Peer()
@@ -25,11 +40,11 @@ class Peer {
 			this.track = null
 		}
 
-		const configuration = {
-			iceServers: [{ urls: 'stun:stun.l.google.com:19302' }],
-		}
-		const pc = new RTCPeerConnection(configuration)
+		const pc = new RTCPeerConnection({ iceServers: this.iceServers })
 		this.pc = pc
+		this.rtcConfig = this.loadRTCConfig(pc)
+		this.makingOffer = false
+		this.candidates = []
 
 		pc.ontrack = (e) => {
 			if (e.track.kind !== 'audio') {
@@ -49,8 +64,8 @@ class Peer {
 			}
 
 			const [pID, value] = entry
+			// the server tells who is speaking in the other streams
 			this.playStream(pID, value.volume ?? 100, stream)
-			monitorStream(stream)
 		}
 
 		pc.onconnectionstatechange = (e) => {
@@ -59,6 +74,10 @@ class Peer {
 			useAppStore.getState().setPeerConnected(isConnected)
 		}
 
+		pc.onnegotiationneeded = () => {
+			this.makeOffer()
+		}
+
 		pc.onicecandidate = (e) => {
 			if (!e.candidate) {
 				return
@@ -67,6 +86,25 @@ class Peer {
 		}
 	}
 
+	private async loadRTCConfig(pc: RTCPeerConnection) {
+		if (Date.now() < this.iceServersExpireAt) {
+			return
+		}
+		try {
+			const config = await api.getRTCConfig()
+			this.iceServers = config.iceServers
+			this.iceServersExpireAt = Date.now() + (config.ttl * 1000) / 2
+			pc.setConfiguration({ iceServers: this.iceServers })
+		} catch (err) {
+			console.error('failed to get rtc config', err)
+		}
+	}
+
+	resume() {
+		this.republish = this.track !== null
+		this.createPeer()
+	}
+
 	async playStream(pID: string, volume: number, stream: MediaStream) {
 		const existingAudio = document.querySelector(`audio[data-pid="${pID}"]`)
 		if (existingAudio) {
@@ -110,36 +148,103 @@ class Peer {
 				monitorStream(stream)
 				this.track = track
 			})
-			this.makeOffer()
 		} catch (err) {
 			throw err
 		}
 	}
 
+	// stopSpeaking unpublishes the microphone, e.g. when we're moved off the
+	// stage. Removing the track renegotiates the peer.
+	stopSpeaking() {
+		const pc = this.pc
+		const track = this.track
+		if (!pc || !track) {
+			return
+		}
+		const sender = pc.getSenders().find((s) => s.track === track)
+		if (sender) {
+			pc.removeTrack(sender)
+		}
+		track.stop()
+		this.track = null
+	}
+
+	// the client is the polite peer, it offers only when negotiation is
+	// needed and gives way to the server's offer when the offers collide
 	async makeOffer() {
-		if (!this.pc) {
+		const pc = this.pc
+		if (!pc) {
 			return
 		}
 		try {
-			const offer = await this.pc.createOffer()
-			await this.pc.setLocalDescription(offer)
-			ws.peerOffer(JSON.stringify(offer))
+			this.makingOffer = true
+			await this.rtcConfig
+			await pc.setLocalDescription()
+			const tracks: Record<string, TrackSource> = {}
+			if (this.track) {
+				tracks[this.track.id] = 'microphone'
+			}
+			ws.peerOffer(JSON.stringify(pc.localDescription), tracks)
 		} catch (err) {
 			console.error('failed to make offer', err)
+		} finally {
+			this.makingOffer = false
 		}
 	}
 
 	async acceptOffer(data: string) {
 		const pc = this.pc!
 		try {
+			// rolls back our own offer if it collided with the server's
 			await pc.setRemoteDescription(JSON.parse(data))
-			const answer = await pc.createAnswer()
-			await pc.setLocalDescription(answer)
-			ws.peerAnswer(JSON.stringify(answer))
+			// ICE gathering starts with the local description
+			await this.rtcConfig
+			await pc.setLocalDescription()
+			ws.peerAnswer(JSON.stringify(pc.localDescription))
+			this.flushCandidates()
+			if (this.republish) {
+				this.republish = false
+				this.speak()
+			}
 		} catch (err) {
 			console.error('failed to accept offer', err)
 		}
 	}
+
+	async acceptAnswer(data: string) {
+		const pc = this.pc!
+		// our offer was rolled back, the answer is stale
+		if (pc.signalingState !== 'have-local-offer') {
+			return
+		}
+		try {
+			await pc.setRemoteDescription(JSON.parse(data))
+			this.flushCandidates()
+		} catch (err) {
+			console.error('failed to accept answer', err)
+		}
+	}
+
+	// candidates which arrive before the remote description are added once
+	// it is set
+	async addICECandidate(candidate: RTCIceCandidateInit) {
+		const pc = this.pc!
+		if (!pc.remoteDescription) {
+			this.candidates.push(candidate)
+			return
+		}
+		try {
+			await pc.addIceCandidate(candidate)
+		} catch (err) {
+			console.error('failed to add ice candidate', err)
+		}
+	}
+
+	private flushCandidates() {
+		const candidates = this.candidates
+		this.candidates = []
+		candidates.forEach((candidate) => this.addICECandidate(candidate))
+	}
 }
 
 export const peer = Peer.getInstance()
@@ -1,10 +1,12 @@
 import { config } from '@/config'
 import { ClientEvent } from '@/types/client-event'
 import { ServerEvent } from '@/types/server-event'
-import { generateRandomID, queryClient, removeAudioStreams } from './utils'
+import { queryClient, removeAudioStreams } from './utils'
 import { useAppStore } from '@/stores/appStore'
-import { RoomRole } from '@/types'
+import { MediaState, PublishPolicy, RoomRole, User } from '@/types'
+import { TrackSource } from '@/types/peer'
 import { peer } from '@/lib/peer'
+import { api } from '@/lib/api'
 
 class WS {
 	private socket: WebSocket | null = null
@@ -12,7 +14,13 @@ class WS {
 	private isClosedByClient = false
 
 	roomID: number | null = null
-	joinRoomKey: string | null = null
+	// invite code of the locked room, it's sent again when rejoining
+	roomKey: string | undefined = undefined
+
+	// the session is resumed with the token after a dropped connection, the
+	// server replays the events after lastSeq
+	private sessionToken: string | null = null
+	private lastSeq = 0
 
 	// retries backoff: https://encore.dev/blog/retries
 	private maxReconnectDelay = 30
@@ -33,7 +41,11 @@ class WS {
 
 	establishSocketConn() {
 		this.socket = null
-		const socket = new WebSocket(config.wsURL)
+		let url = config.wsURL
+		if (this.sessionToken) {
+			url += `?resume=${this.sessionToken}&seq=${this.lastSeq}`
+		}
+		const socket = new WebSocket(url)
 
 		socket.onclose = (e: CloseEvent) => {
 			console.error('socket connection closed', e.code)
@@ -47,26 +59,170 @@ class WS {
 		socket.onopen = () => {
 			useAppStore.getState().setSocketConnected(true)
 			this.reconnectAttempts = 0
-
-			// if the socket established after reconnection
-			// rejoin room
-			if (this.roomID) {
-				const roomID = this.roomID
-				this.roomID = null
-				ws.joinRoom(roomID)
-				queryClient.invalidateQueries({
-					queryKey: [
-						['room', roomID],
-						['dms', roomID],
-					],
-				})
-			}
 		}
 
 		socket.onmessage = (e: MessageEvent) => {
 			try {
-				const event: ServerEvent = JSON.parse(e.data)
+				const event: ServerEvent & { seq?: number } = JSON.parse(e.data)
+				if (event.seq) {
+					this.lastSeq = event.seq
+				}
 				switch (event.name) {
+					case 'SESSION':
+						this.sessionToken = event.data.token
+						// if the socket established after reconnection
+						// rejoin room
+						if (this.roomID) {
+							const roomID = this.roomID
+							this.roomID = null
+							ws.joinRoom(roomID, this.roomKey)
+							queryClient.invalidateQueries({
+								queryKey: [
+									['room', roomID],
+									['dms', roomID],
+								],
+							})
+						}
+						break
+					case 'SESSION_RESUMED':
+						// still in the room, only the peer is negotiated again
+						if (this.roomID) {
+							peer.resume()
+						}
+						break
+					case 'ACK':
+						if (event.data.event === 'JOIN_ROOM') {
+							const data = event.data.data as {
+								sid?: string
+								raisedHands?: User[]
+								media?: MediaState
+								recording?: { recordingID: string; by: User }
+							}
+							if (data?.sid) {
+								useAppStore.getState().setSid(data.sid)
+							}
+							useAppStore.getState().setRaisedHands(data?.raisedHands ?? [])
+							useAppStore.getState().setMedia(data?.media ?? null)
+							// the room was being recorded before joining
+							if (data?.recording) {
+								useAppStore.getState().setToast(true, {
+									type: 'info',
+									title: 'Recording',
+									description: `${data.recording.by.username} is recording this room`,
+								})
+							}
+							const roomID = this.roomID
+							if (roomID) {
+								api
+									.getRoomMessages(roomID)
+									.then((messages) => {
+										if (this.roomID === roomID) {
+											useAppStore.getState().setRoomMessages(messages)
+										}
+									})
+									.catch(() => {})
+							}
+						}
+						break
+					case 'PARTICIPANT_RECONNECTING':
+						break
+					case 'PEER_RECONNECTING':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						if (event.data.state === 'rebuilding') {
+							// the server's offer for the new peer follows
+							peer.resume()
+						} else if (event.data.state === 'failed') {
+							useAppStore.getState().setToast(true, {
+								type: 'error',
+								title: 'Connection Lost',
+								description: "Couldn't reconnect to the room's audio",
+							})
+							useAppStore.getState().setLeftRoom(true)
+						}
+						break
+					case 'PRESENCE_UPDATE':
+						queryClient.invalidateQueries({ queryKey: ['relations'] })
+						break
+					case 'RATE_LIMITED':
+						useAppStore.getState().setToast(true, {
+							type: 'error',
+							title: 'Slow Down',
+							description: `Try again in ${Math.ceil(event.data.retryAfter / 1000)}s`,
+						})
+						break
+					case 'PARTICIPANT_FORCE_MUTED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().forceMuted(event)
+						break
+					case 'ACTIVE_SPEAKERS':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().setActiveSpeakers(event)
+						break
+					case 'HAND_RAISED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().handRaised(event)
+						break
+					case 'SPEAKER_UPDATED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						// listeners don't publish, the microphone is removed
+						// from the peer which renegotiates
+						if (
+							!event.data.speaker &&
+							event.data.participant.id === useAppStore.getState().user?.id
+						) {
+							peer.stopSpeaking()
+						}
+						useAppStore.getState().speakerUpdated(event)
+						queryClient.invalidateQueries({ queryKey: ['rooms'] })
+						break
+					case 'MEDIA_STATE':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().setMedia(event.data.media)
+						break
+					case 'MEDIA_SYNC':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().syncMedia(event)
+						break
+					case 'CONNECTION_QUALITY':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().setConnectionQuality(event.data)
+						break
+					case 'RECORDING_STARTED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().setToast(true, {
+							type: 'info',
+							title: 'Recording Started',
+							description: `${event.data.by.username} is recording this room`,
+						})
+						break
+					case 'RECORDING_STOPPED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						useAppStore.getState().setToast(true, {
+							type: 'info',
+							title: 'Recording Stopped',
+							description: 'This room is no longer being recorded',
+						})
+						break
 					case 'JOINED_ROOM_BROADCAST':
 					case 'LEFT_ROOM_BROADCAST':
 					case 'ROOMS_DELETED_BROADCAST':
@@ -74,13 +230,8 @@ class WS {
 					case 'UPDATE_ROOM_BROADCAST':
 					case 'ASSIGN_ROLE_BROADCAST':
 					case 'UPDATE_WELCOME_MESSAGE_BROADCAST':
+					case 'UPDATE_PUBLISH_SETTINGS_BROADCAST':
 					case 'SET_STATUS_BROADCAST':
-						if (
-							event.name === 'JOINED_ROOM_BROADCAST' &&
-							event.data.key === this.joinRoomKey
-						) {
-							useAppStore.getState().joinedRoom(event)
-						}
 						// react-query handles deduplication. sometimes (when user just joined a room)
 						// we want to still make an API call and fetch the current state in the server.
 						// https://github.com/TanStack/query/discussions/608
@@ -114,8 +265,11 @@ class WS {
 						}
 						useAppStore.getState().kickParticipant(event)
 						break
-					case 'ERROR_BROADCAST':
-						if (event.data.roomID !== this.roomID) {
+					case 'ERROR':
+						if (
+							event.data.roomID !== undefined &&
+							event.data.roomID !== this.roomID
+						) {
 							return
 						}
 						useAppStore.getState().error(event)
@@ -130,15 +284,14 @@ class WS {
 						if (event.data.roomID !== this.roomID) {
 							return
 						}
-						const candiate = JSON.parse(event.data.candidate)
-						peer.pc!.addIceCandidate(candiate)
+						peer.addICECandidate(JSON.parse(event.data.candidate))
 						break
 					case 'PEER_ANSWER':
 						if (event.data.roomID !== this.roomID) {
 							return
 						}
 
-						peer.pc!.setRemoteDescription(JSON.parse(event.data.answer))
+						peer.acceptAnswer(event.data.answer)
 						break
 					case 'PEER_OFFER':
 						if (event.data.roomID !== this.roomID) {
@@ -152,6 +305,22 @@ class WS {
 						}
 						useAppStore.getState().addToRoomStreams(event.data.streams)
 						break
+					case 'PEER_STREAM_REMOVED':
+						if (event.data.roomID !== this.roomID) {
+							return
+						}
+						if (event.data.source === 'microphone') {
+							document
+								.querySelector(`audio[data-id="${event.data.streamID}"]`)
+								?.remove()
+							useAppStore
+								.getState()
+								.removeFromRoomStreams(
+									event.data.participantID,
+									event.data.streamID
+								)
+						}
+						break
 					default:
 						console.error('unknown event', event)
 				}
@@ -188,20 +357,20 @@ class WS {
 		removeAudioStreams()
 	}
 
-	joinRoom(roomID: number) {
+	joinRoom(roomID: number, key?: string) {
 		if (this.roomID) {
 			return
 		}
 
 		this.roomID = roomID
-		this.joinRoomKey = generateRandomID()
+		this.roomKey = key
 
 		peer.createPeer()
 		this.sendClientEvent({
 			name: 'JOIN_ROOM',
 			data: {
 				roomID: roomID,
-				key: this.joinRoomKey,
+				key,
 			},
 		})
 	}
@@ -305,6 +474,32 @@ class WS {
 		})
 	}
 
+	updatePublishSettings(
+		videoPublishers: PublishPolicy,
+		screenPublishers: PublishPolicy
+	) {
+		this.sendClientEvent({
+			name: 'UPDATE_PUBLISH_SETTINGS',
+			data: {
+				roomID: this.roomID!,
+				videoPublishers,
+				screenPublishers,
+			},
+		})
+	}
+
+	setPresence(idle: boolean) {
+		if (this.socket?.readyState !== WebSocket.OPEN) {
+			return
+		}
+		this.sendClientEvent({
+			name: 'SET_PRESENCE',
+			data: {
+				idle,
+			},
+		})
+	}
+
 	setStatus(status: string) {
 		this.sendClientEvent({
 			name: 'SET_STATUS',
@@ -337,12 +532,13 @@ class WS {
 		})
 	}
 
-	peerOffer(offer: string) {
+	peerOffer(offer: string, tracks?: Record<string, TrackSource>) {
 		this.sendClientEvent({
 			name: 'PEER_OFFER',
 			data: {
 				offer,
 				roomID: this.roomID!,
+				tracks,
 			},
 		})
 	}
@@ -367,6 +563,158 @@ class WS {
 		})
 	}
 
+	forceMute(participantID: number, mute: boolean) {
+		this.sendClientEvent({
+			name: 'FORCE_MUTE',
+			data: {
+				roomID: this.roomID!,
+				participantID,
+				mute,
+			},
+		})
+	}
+
+	muteAllGuests(mute: boolean) {
+		this.sendClientEvent({
+			name: 'FORCE_MUTE',
+			data: {
+				roomID: this.roomID!,
+				allGuests: true,
+				mute,
+			},
+		})
+	}
+
+	startRecording() {
+		this.sendClientEvent({
+			name: 'START_RECORDING',
+			data: {
+				roomID: this.roomID!,
+			},
+		})
+	}
+
+	stopRecording() {
+		this.sendClientEvent({
+			name: 'STOP_RECORDING',
+			data: {
+				roomID: this.roomID!,
+			},
+		})
+	}
+
+	raiseHand(raise: boolean) {
+		this.sendClientEvent({
+			name: 'RAISE_HAND',
+			data: {
+				roomID: this.roomID!,
+				raise,
+			},
+		})
+	}
+
+	approveHand(participantID: number) {
+		this.sendClientEvent({
+			name: 'APPROVE_HAND',
+			data: {
+				roomID: this.roomID!,
+				participantID,
+			},
+		})
+	}
+
+	dismissHand(participantID: number) {
+		this.sendClientEvent({
+			name: 'DISMISS_HAND',
+			data: {
+				roomID: this.roomID!,
+				participantID,
+			},
+		})
+	}
+
+	setSpeaker(participantID: number, speaker: boolean) {
+		this.sendClientEvent({
+			name: 'SET_SPEAKER',
+			data: {
+				roomID: this.roomID!,
+				participantID,
+				speaker,
+			},
+		})
+	}
+
+	mediaLoad(url: string, title?: string) {
+		this.sendClientEvent({
+			name: 'MEDIA_LOAD',
+			data: {
+				roomID: this.roomID!,
+				url,
+				title,
+			},
+		})
+	}
+
+	mediaPlay(position?: number) {
+		this.sendClientEvent({
+			name: 'MEDIA_PLAY',
+			data: {
+				roomID: this.roomID!,
+				position,
+			},
+		})
+	}
+
+	mediaPause(position?: number) {
+		this.sendClientEvent({
+			name: 'MEDIA_PAUSE',
+			data: {
+				roomID: this.roomID!,
+				position,
+			},
+		})
+	}
+
+	mediaSeek(position: number) {
+		this.sendClientEvent({
+			name: 'MEDIA_SEEK',
+			data: {
+				roomID: this.roomID!,
+				position,
+			},
+		})
+	}
+
+	mediaQueue(url: string, title?: string) {
+		this.sendClientEvent({
+			name: 'MEDIA_QUEUE',
+			data: {
+				roomID: this.roomID!,
+				url,
+				title,
+			},
+		})
+	}
+
+	mediaDequeue(id: string) {
+		this.sendClientEvent({
+			name: 'MEDIA_DEQUEUE',
+			data: {
+				roomID: this.roomID!,
+				id,
+			},
+		})
+	}
+
+	mediaVoteSkip() {
+		this.sendClientEvent({
+			name: 'MEDIA_VOTE_SKIP',
+			data: {
+				roomID: this.roomID!,
+			},
+		})
+	}
+
 	sendClientEvent(event: ClientEvent) {
 		this.socket!.send(JSON.stringify(event))
 	}
@@ -378,3 +726,7 @@ class WS {
 }
 
 export const ws = WS.getInstance()
+
+document.addEventListener('visibilitychange', () => {
+	ws.setPresence(document.visibilityState === 'hidden')
+})
@@ -19,6 +19,9 @@ const createRoomSchema = z.object({
 		.max(128, { message: 'Exceeded maximum of 128 characters' }),
 	maxParticipants: z.number({ message: 'Provide a value' }),
 	languages: z.string().array().min(1, { message: 'Provide a value' }),
+	stage: z.boolean().optional(),
+	locked: z.boolean().optional(),
+	messageRetention: z.number().int().min(0).max(90).optional(),
 })
 
 export function CreateRoom() {
@@ -35,6 +38,11 @@ export function CreateRoom() {
 		topic: string
 		maxParticipants?: SingleValue<Option>
 		languages: MultiValue<Option>
+		// only the host, co-hosts and invited speakers talk on stage
+		stage?: boolean
+		// only joined with an invite link
+		locked?: boolean
+		messageRetention?: SingleValue<Option>
 	}>({
 		topic: '',
 		languages: [],
@@ -61,6 +69,11 @@ export function CreateRoom() {
 				? Number(room.maxParticipants.value)
 				: undefined,
 			languages: room.languages.map((el) => el.value),
+			stage: room.stage ?? false,
+			locked: room.locked ?? false,
+			messageRetention: room.messageRetention?.value
+				? Number(room.messageRetention.value)
+				: undefined,
 		}
 		const result = createRoomSchema.safeParse(payload)
 		if (result.success) {
@@ -103,6 +116,9 @@ export function CreateRoom() {
 				topic: '',
 				languages: [],
 				maxParticipants: undefined,
+				stage: false,
+				locked: false,
+				messageRetention: undefined,
 			})
 			setErrors({
 				topic: '',
@@ -124,6 +140,11 @@ export function CreateRoom() {
 				topic: editRoom.topic,
 				maxParticipants,
 				languages: selectedLanguages,
+				stage: editRoom.settings.stage,
+				locked: editRoom.settings.locked,
+				messageRetention: constants.messageRetention.find(
+					(r) => r.value === String(editRoom.settings.messageRetention ?? '')
+				),
 			})
 		}
 	}, [editRoom])
@@ -197,6 +218,45 @@ export function CreateRoom() {
 						) : null}
 					</div>
 
+					<div className="flex flex-col gap-3 flex-1 mt-8">
+						<Label className="self-start" htmlFor="messageRetention">
+							Keep Chat History
+						</Label>
+						<Select
+							id="messageRetention"
+							placeholder="Default"
+							value={room.messageRetention}
+							setValue={(retention) => {
+								onChange('messageRetention', retention ?? undefined)
+							}}
+							options={constants.messageRetention}
+						/>
+					</div>
+
+					<div className="flex gap-3 items-center mt-6">
+						<input
+							id="stage"
+							type="checkbox"
+							checked={room.stage ?? false}
+							onChange={(e) => onChange('stage', e.target.checked)}
+						/>
+						<Label htmlFor="stage">
+							Stage mode: everyone else listens until invited to speak
+						</Label>
+					</div>
+
+					<div className="flex gap-3 items-center mt-3">
+						<input
+							id="locked"
+							type="checkbox"
+							checked={room.locked ?? false}
+							onChange={(e) => onChange('locked', e.target.checked)}
+						/>
+						<Label htmlFor="locked">
+							Locked: only people with an invite link can join
+						</Label>
+					</div>
+
 					<div className="justify-end flex justify-end gap-4 items-center mt-12">
 						<button
 							type="button"
@@ -6,6 +6,7 @@ import {
 	SquarePen as PencilIcon,
 	Ban as BanIcon,
 	Users as UsersIcon,
+	Lock as LockIcon,
 } from 'lucide-react'
 import { Profile } from '@/components/Profile'
 import { useState } from 'react'
@@ -51,6 +52,11 @@ export function RoomCard(props: Props) {
 					</p>
 				</Tooltip>
 				<div className="ml-auto flex gap-2.5 items-center">
+					{room.settings.locked && (
+						<Tooltip title="Only joined with an invite link">
+							<LockIcon size={18} className="text-muted" />
+						</Tooltip>
+					)}
 					{room.participants.length > 10 && (
 						<Tooltip
 							title={`Room occupied by ${room.participants.length} people`}
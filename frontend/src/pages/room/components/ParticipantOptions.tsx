@@ -9,6 +9,7 @@ import {
 	VolumeX as VolumeOffIcon,
 	Heart as HeartIcon,
 	HeartOff as HeartBrokeIcon,
+	Mic as SpeakerIcon,
 } from 'lucide-react'
 import * as Popover from '@radix-ui/react-popover'
 import { RoomRes, User } from '@/types'
@@ -47,6 +48,7 @@ export function ParticipantOptions(props: Props) {
 	const isParticipantCoHost = settings.coHosts?.includes(props.participant.id)
 	const isParticipantHost = props.participant.id === settings.host.id
 	const hasPermissions = (isHost || isCoHost) && !isParticipantHost
+	const isParticipantSpeaker = settings.speakers?.includes(props.participant.id)
 
 	const { data: profile } = useProfile(
 		props.participant.id,
@@ -148,6 +150,23 @@ export function ParticipantOptions(props: Props) {
 								<p>Transfer Room</p>
 							</button>
 						)}
+						{settings.stage &&
+							hasPermissions &&
+							!isMe &&
+							!isParticipantCoHost && (
+								<button
+									className="flex gap-3 items-center px-2 py-1 rounded-md focus:ring-0 focus:bg-accent hover:bg-accent"
+									onClick={() => {
+										ws.setSpeaker(props.participant.id, !isParticipantSpeaker)
+										props.setOpen(false)
+									}}
+								>
+									<SpeakerIcon size={18} className="text-muted" />
+									<p>
+										{isParticipantSpeaker ? 'Move to Audience' : 'Invite to Speak'}
+									</p>
+								</button>
+							)}
 						{hasPermissions && !isMe && (
 							<button
 								className="flex gap-3 items-center px-2 py-1 rounded-md focus:ring-0 focus:bg-accent hover:bg-accent"
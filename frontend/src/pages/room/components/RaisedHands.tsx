@@ -0,0 +1,39 @@
+import { ws } from '@/lib/ws'
+import { useAppStore } from '@/stores/appStore'
+import { Check as ApproveIcon, X as DismissIcon } from 'lucide-react'
+
+// RaisedHands is the queue of listeners waiting to speak, shown to the host
+// and co-hosts of a stage room
+export function RaisedHands() {
+	const raisedHands = useAppStore().raisedHands
+
+	if (raisedHands.length === 0) {
+		return null
+	}
+
+	return (
+		<div className="flex flex-col gap-1 px-3 py-2 text-sm">
+			<p className="text-muted">Raised Hands</p>
+			{raisedHands.map((u) => (
+				<div key={u.id} className="flex items-center gap-2">
+					<img src={u.avatar} className="w-6 h-6 rounded-full" />
+					<p className="flex-1 truncate">{u.username}</p>
+					<button
+						title="Invite to speak"
+						className="focus:ring-0 p-1"
+						onClick={() => ws.approveHand(u.id)}
+					>
+						<ApproveIcon size={16} className="text-muted" />
+					</button>
+					<button
+						title="Dismiss"
+						className="focus:ring-0 p-1"
+						onClick={() => ws.dismissHand(u.id)}
+					>
+						<DismissIcon size={16} className="text-muted" />
+					</button>
+				</div>
+			))}
+		</div>
+	)
+}
@@ -6,11 +6,17 @@ import {
 	Mic as MicIcon,
 	MicOff as MicOffIcon,
 	LogOut as LeaveRoom,
+	Hand as HandIcon,
 } from 'lucide-react'
 import { useEffect, useRef, useState } from 'react'
 import * as Popover from '@radix-ui/react-popover'
+import { RoomRes } from '@/types'
 
-export function RoomControls() {
+type Props = {
+	room: RoomRes | undefined
+}
+
+export function RoomControls(props: Props) {
 	const [mic, setMic] = useState(false)
 	const hasStream = useRef(false)
 	const setToast = useAppStore().setToast
@@ -19,6 +25,19 @@ export function RoomControls() {
 	const peerConnected = useAppStore().peerConnected
 	const socketConnected = useAppStore().socketConnected
 	const isConnected = peerConnected && socketConnected
+	const isForceMuted = useAppStore().isForceMuted
+	const user = useAppStore().user
+	const raisedHands = useAppStore().raisedHands
+	const leftStageAt = useAppStore().leftStageAt
+	const settings = props.room?.settings
+	const userID = user?.id ?? 0
+	// listeners of a stage room can't publish until they're invited
+	const isListener =
+		settings?.stage === true &&
+		settings.host.id !== userID &&
+		!settings.coHosts?.includes(userID) &&
+		!settings.speakers?.includes(userID)
+	const isHandRaised = raisedHands.some((u) => u.id === userID)
 
 	async function handleMic() {
 		if (!hasStream.current) {
@@ -46,6 +65,22 @@ export function RoomControls() {
 		}
 	}
 
+	// the server drops our audio anyway, the microphone is turned off to match
+	useEffect(() => {
+		if (isForceMuted && peer.track) {
+			peer.track.enabled = false
+			setMic(false)
+		}
+	}, [isForceMuted])
+
+	// the microphone was unpublished when we left the stage
+	useEffect(() => {
+		if (leftStageAt) {
+			setMic(false)
+			hasStream.current = false
+		}
+	}, [leftStageAt])
+
 	useEffect(() => {
 		if (!isConnected) {
 			setMic(false)
@@ -56,15 +91,34 @@ export function RoomControls() {
 	return (
 		<div className="flex justify-center">
 			<div className="flex justify-center items-center gap-1 py-[2px] min-w-[140px] bg-bg-2 border border-border rounded-b-md border-t-0">
+				{isListener && (
+					<Tooltip title={isHandRaised ? 'Lower hand' : 'Raise hand to speak'}>
+						<button
+							disabled={!isConnected}
+							className="focus:ring-0 p-2 disabled:opacity-70"
+							onClick={() => ws.raiseHand(!isHandRaised)}
+						>
+							<HandIcon
+								className={isHandRaised ? 'text-muted stroke-brand' : 'text-muted'}
+								strokeWidth={1.5}
+								size={20}
+							/>
+						</button>
+					</Tooltip>
+				)}
 				<Tooltip
 					title={
 						!isConnected
 							? 'Connecting...'
-							: `Turn ${mic ? 'off' : 'on'} microphone`
+							: isListener
+								? 'Only speakers can talk'
+								: isForceMuted
+								? 'Muted by a moderator'
+								: `Turn ${mic ? 'off' : 'on'} microphone`
 					}
 				>
 					<button
-						disabled={!isConnected}
+						disabled={!isConnected || isForceMuted || isListener}
 						className="focus:ring-0 p-2 disabled:opacity-70 "
 						onClick={handleMic}
 					>
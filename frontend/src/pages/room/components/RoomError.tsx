@@ -7,6 +7,7 @@ import {
 	BatteryFull as FullIcon,
 	TabletSmartphone as RoomIcon,
 	UserX as UserIcon,
+	Lock as LockIcon,
 } from 'lucide-react'
 import { useEffect } from 'react'
 import { ws } from '@/lib/ws'
@@ -46,6 +47,10 @@ export function RoomError(props: Props) {
 		return <Error status={418} />
 	}
 
+	if (error?.status === 403 && error.errors?.locked) {
+		return <Error status={423} />
+	}
+
 	if (error?.status === 403 || isKicked) {
 		const errors = error?.errors ?? {}
 		return <Kicked expiredAt={errors.expiredAt ?? isKicked?.expiredAt ?? ''} />
@@ -80,6 +85,11 @@ export function Error(props: { status: number }) {
 			desc: "You've joined a room in another tab.",
 			icon: <RoomIcon className="stroke-orange-500 mb-2 h-12 w-12" />,
 		},
+		423: {
+			title: 'Room is locked',
+			desc: 'You need a valid invite link from the host to join this room',
+			icon: <LockIcon className="stroke-danger mb-2 h-12 w-12" />,
+		},
 		418: {
 			// teapot :)
 			title: 'Left Room',
@@ -2,6 +2,8 @@ import { RoomRes, User } from '@/types'
 import { Participants } from './Participants'
 import { useAppStore } from '@/stores/appStore'
 import { RoomControls } from './RoomControls'
+import { RaisedHands } from './RaisedHands'
+import { WatchParty } from './WatchParty'
 
 type Props = {
 	room: RoomRes | undefined
@@ -12,10 +14,13 @@ type Props = {
 export function RoomStagingArea(props: Props) {
 	const user = useAppStore().user
 	const { room, isLoading, setPM } = props
+	const isModerator =
+		room?.settings.host.id === user?.id ||
+		room?.settings.coHosts?.includes(user?.id ?? 0)
 
 	return (
 		<div className="h-full md:border md:border-border rounded-md bg-bg flex flex-col">
-			<RoomControls />
+			<RoomControls room={room} />
 			<div className="flex-1 flex items-center justify-center">
 				{room?.settings.welcomeMessage && (
 					<p className="text-yellow-500 max-w-[500px] px-4 whitespace-pre-wrap">
@@ -26,6 +31,8 @@ export function RoomStagingArea(props: Props) {
 					</p>
 				)}
 			</div>
+			{room && <WatchParty isModerator={isModerator ?? false} />}
+			{room?.settings.stage && isModerator && <RaisedHands />}
 			{!isLoading && room && <Participants room={room} setPM={setPM} />}
 		</div>
 	)
@@ -0,0 +1,179 @@
+import { ws } from '@/lib/ws'
+import { useAppStore } from '@/stores/appStore'
+import {
+	Play as PlayIcon,
+	Pause as PauseIcon,
+	Rewind as RewindIcon,
+	FastForward as ForwardIcon,
+	SkipForward as SkipIcon,
+	X as RemoveIcon,
+} from 'lucide-react'
+import { useEffect, useRef, useState } from 'react'
+
+// seconds the video may drift from the server's clock before it's moved
+const maxDrift = 1
+const seekStep = 10
+
+type Props = {
+	isModerator: boolean
+}
+
+// WatchParty plays the room's video in sync with everyone. The host and
+// co-hosts control it, anyone can queue a video or vote to skip one.
+export function WatchParty(props: Props) {
+	const { isModerator } = props
+	const media = useAppStore().media
+	const user = useAppStore().user
+	const videoRef = useRef<HTMLVideoElement>(null)
+	const [url, setURL] = useState('')
+
+	useEffect(() => {
+		const video = videoRef.current
+		if (!video || !media?.current) {
+			return
+		}
+		const elapsed = media.paused
+			? 0
+			: ((Date.now() - media.receivedAt) / 1000) * media.rate
+		const position = media.position + elapsed
+		if (Math.abs(video.currentTime - position) > maxDrift) {
+			video.currentTime = position
+		}
+		video.playbackRate = media.rate
+		if (media.paused) {
+			video.pause()
+		} else {
+			// autoplay might be blocked until we interact with the page
+			video.play().catch(() => {})
+		}
+	}, [media])
+
+	if (!media && !isModerator) {
+		return null
+	}
+
+	const current = media?.current
+	const queue = media?.queue ?? []
+	const paused = media?.paused ?? true
+	const skips = media?.skips ?? []
+	const hasVoted = skips.includes(user?.id ?? 0)
+
+	function submit(e: React.FormEvent) {
+		e.preventDefault()
+		if (!url.trim()) {
+			return
+		}
+		if (isModerator && !current) {
+			ws.mediaLoad(url.trim())
+		} else {
+			ws.mediaQueue(url.trim())
+		}
+		setURL('')
+	}
+
+	function position() {
+		return videoRef.current?.currentTime ?? 0
+	}
+
+	return (
+		<div className="flex flex-col gap-2 px-3 py-2 text-sm">
+			{current && (
+				<>
+					<video
+						key={current.id}
+						ref={videoRef}
+						src={current.url}
+						className="w-full max-h-[320px] rounded-md bg-black"
+						playsInline
+					/>
+					<div className="flex items-center gap-1">
+						<p className="flex-1 truncate" title={current.url}>
+							{current.title || current.url}
+						</p>
+						{isModerator && (
+							<>
+								<button
+									title="Back"
+									className="focus:ring-0 p-1"
+									onClick={() => ws.mediaSeek(Math.max(position() - seekStep, 0))}
+								>
+									<RewindIcon size={16} className="text-muted" />
+								</button>
+								<button
+									title={paused ? 'Play' : 'Pause'}
+									className="focus:ring-0 p-1"
+									onClick={() =>
+										paused
+											? ws.mediaPlay(position())
+											: ws.mediaPause(position())
+									}
+								>
+									{paused ? (
+										<PlayIcon size={16} className="text-muted" />
+									) : (
+										<PauseIcon size={16} className="text-muted" />
+									)}
+								</button>
+								<button
+									title="Forward"
+									className="focus:ring-0 p-1"
+									onClick={() => ws.mediaSeek(position() + seekStep)}
+								>
+									<ForwardIcon size={16} className="text-muted" />
+								</button>
+							</>
+						)}
+						<button
+							title={isModerator ? 'Skip' : 'Vote to skip'}
+							disabled={hasVoted}
+							className="focus:ring-0 p-1 flex items-center gap-1 disabled:opacity-70"
+							onClick={() => ws.mediaVoteSkip()}
+						>
+							<SkipIcon size={16} className="text-muted" />
+							{skips.length > 0 && (
+								<span className="text-muted">{skips.length}</span>
+							)}
+						</button>
+					</div>
+				</>
+			)}
+			{queue.length > 0 && <p className="text-muted">Up Next</p>}
+			{queue.map((item) => (
+				<div key={item.id} className="flex items-center gap-2">
+					<img src={item.addedBy.avatar} className="w-5 h-5 rounded-full" />
+					<p className="flex-1 truncate" title={item.url}>
+						{item.title || item.url}
+					</p>
+					{(isModerator || item.addedBy.id === user?.id) && (
+						<button
+							title="Remove"
+							className="focus:ring-0 p-1"
+							onClick={() => ws.mediaDequeue(item.id)}
+						>
+							<RemoveIcon size={16} className="text-muted" />
+						</button>
+					)}
+				</div>
+			))}
+			<form className="flex gap-2" onSubmit={submit}>
+				<input
+					type="url"
+					className="flex-1 border border-border bg-transparent rounded-md p-1 px-2 focus:border-transparent"
+					autoComplete="off"
+					placeholder={isModerator && !current ? 'Play a video url' : 'Queue a video url'}
+					value={url}
+					onChange={(e) => setURL(e.target.value)}
+				/>
+				{isModerator && !current && queue.length > 0 && (
+					<button
+						type="button"
+						className="bg-muted/20 px-3 rounded-md"
+						onClick={() => ws.mediaLoad('')}
+					>
+						Play Next
+					</button>
+				)}
+			</form>
+		</div>
+	)
+}
@@ -1,7 +1,7 @@
 import { useJoinRoom } from '@/hooks/queries/useJoinRoom'
 import { ws } from '@/lib/ws'
 import { useEffect, useState } from 'react'
-import { useParams } from 'react-router-dom'
+import { useParams, useSearchParams } from 'react-router-dom'
 import { Onboarding } from '@/pages/room/components/Onboarding'
 import { RoomError } from '@/pages/room/components/RoomError'
 import { Room } from '@/pages/room/components/Room'
@@ -13,6 +13,8 @@ import { LoadingIcon } from '../home/components/LoadingIcon'
 export function RoomPage() {
 	const [isOnboarding, setIsOnBoarding] = useState(true)
 	const roomID = Number(useParams().roomID)
+	// invite code of a locked room
+	const key = useSearchParams()[0].get('key') ?? undefined
 	const user = useAppStore().user
 	const isKicked = useAppStore().isKicked
 	const joinedAnotherRoom = useAppStore().joinedAnotherRoom
@@ -22,12 +24,13 @@ export function RoomPage() {
 	const sid = useAppStore().sid
 	const { isLoading, error } = useJoinRoom(
 		roomID!,
-		user !== null && user !== undefined
+		user !== null && user !== undefined,
+		key
 	)
 
 	useEffect(() => {
 		if (!isOnboarding && user) {
-			ws.joinRoom(roomID!)
+			ws.joinRoom(roomID!, key)
 		}
 	}, [isOnboarding, user])
 
@@ -1,12 +1,16 @@
 import { getDMParticipant, queryClient } from '@/lib/utils'
 import { ws } from '@/lib/ws'
-import { DMsRes, Room, User } from '@/types'
+import { DMsRes, MediaState, PeerStats, Room, User } from '@/types'
 import {
+	ActiveSpeakersEvent,
+	HandRaisedEvent,
+	SpeakerUpdatedEvent,
+	MediaSyncEvent,
+	ParticipantForceMutedEvent,
 	ClearChatBroadcastEvent,
 	DeleteMsgBroadcastEvent,
 	EditMsgBroadcastEvent,
-	ErrorBroadcastEvent,
-	JoinedRoomBroadcastEvent,
+	ErrorEvent,
 	KickParticipantBroadcastEvent,
 	NewMsgBroadcastEvent,
 	PeerMuteBroadcastEvent,
@@ -44,6 +48,17 @@ type State = {
 	user: User | null | undefined
 
 	sid: string | null
+	// set while a moderator keeps us muted
+	isForceMuted: boolean
+	// the last measure of our connection to the server
+	connectionQuality: PeerStats | null
+	// the listeners waiting to speak in a stage room, the earliest first
+	raisedHands: User[]
+	// bumped when we're moved off the stage, so the controls reset
+	leftStageAt: number
+	// the watch party of the room, receivedAt is when its position was
+	// current
+	media: (MediaState & { receivedAt: number }) | null
 
 	messages: Message[]
 	roomTab: string
@@ -81,13 +96,24 @@ type Actions = {
 	setUser: (user: User | null | undefined) => void
 	setPopup: (popup: keyof State['popups'], visibility: boolean) => void
 	clearMessages: () => void
+	// the messages sent before we joined, they go before the ones we got
+	setRoomMessages: (messages: Message[]) => void
 	setToast: (open: boolean, content?: State['toast']['content']) => void
 	setCreateOrUpdateRoom: (open: boolean, room?: Room) => void
 	setJoinedAnotherRoom: (isJoined: boolean) => void
 	setRoomTab: (tab: string) => void
 	setUnreadCount: (count: number) => void
 	addToRoomStreams: (streams: Record<string, string>) => void
+	removeFromRoomStreams: (pID: string, streamID: string) => void
 	setSpeaking: (streamID: string, speaking: boolean) => void
+	setActiveSpeakers: (event: ActiveSpeakersEvent) => void
+	forceMuted: (event: ParticipantForceMutedEvent) => void
+	setConnectionQuality: (stats: PeerStats) => void
+	setRaisedHands: (users: User[]) => void
+	handRaised: (event: HandRaisedEvent) => void
+	speakerUpdated: (event: SpeakerUpdatedEvent) => void
+	setMedia: (media: MediaState | null) => void
+	syncMedia: (event: MediaSyncEvent) => void
 	setVolume: (pID: string, volume: number) => void
 	setLeftRoom: (left: boolean) => void
 	setSocketConnected: (status: boolean) => void
@@ -105,14 +131,14 @@ type Actions = {
 	setDMReadForParticipant: (participantID: number) => void
 
 	// broadcast events
-	joinedRoom: (event: JoinedRoomBroadcastEvent) => void
+	setSid: (sid: string | null) => void
 	addMsg: (event: NewMsgBroadcastEvent) => void
 	editMsg: (event: EditMsgBroadcastEvent) => void
 	deleteMsg: (event: DeleteMsgBroadcastEvent) => void
 	reactionToMsg: (event: ReactionToMsgBroadcastEvent) => void
 	clearChat: (event: ClearChatBroadcastEvent) => void
 	kickParticipant: (event: KickParticipantBroadcastEvent) => void
-	error: (event: ErrorBroadcastEvent) => void
+	error: (event: ErrorEvent) => void
 	setMute: (event: PeerMuteBroadcastEvent) => void
 }
 
@@ -129,6 +155,11 @@ export const useAppStore = create<State & Actions>()(
 		user: undefined,
 
 		sid: null,
+		isForceMuted: false,
+		connectionQuality: null,
+		raisedHands: [],
+		leftStageAt: 0,
+		media: null,
 
 		messages: [],
 		roomTab: 'messages',
@@ -192,6 +223,10 @@ export const useAppStore = create<State & Actions>()(
 		clearRoomStreams: () =>
 			set((state) => {
 				state.roomStreams = {}
+				state.isForceMuted = false
+				state.connectionQuality = null
+				state.raisedHands = []
+				state.media = null
 			}),
 
 		setLeftRoom: (left) =>
@@ -219,6 +254,15 @@ export const useAppStore = create<State & Actions>()(
 				state.messages = []
 			}),
 
+		setRoomMessages: (messages) =>
+			set((state) => {
+				const ids = new Set(state.messages.map((msg) => msg.id))
+				state.messages = [
+					...messages.filter((msg) => !ids.has(msg.id)),
+					...state.messages,
+				]
+			}),
+
 		setToast: (open, content) =>
 			set((state) => {
 				state.toast = { open, content }
@@ -244,11 +288,9 @@ export const useAppStore = create<State & Actions>()(
 				state.createOrUpdateRoom.room = room
 			}),
 
-		joinedRoom: (event) =>
+		setSid: (sid) =>
 			set((state) => {
-				if (event.data.user.id === state.user?.id) {
-					state.sid = event.data.sid
-				}
+				state.sid = sid
 			}),
 
 		addToRoomStreams: (streams) =>
@@ -267,6 +309,15 @@ export const useAppStore = create<State & Actions>()(
 				})
 			}),
 
+		removeFromRoomStreams: (pID, streamID) =>
+			set((state) => {
+				const stream = state.roomStreams[pID]
+				if (stream?.streamID === streamID) {
+					stream.streamID = null
+					stream.speaking = false
+				}
+			}),
+
 		addMsg: (event) =>
 			set((state) => {
 				const isFromMe = event.data.from.id === state.user?.id
@@ -403,7 +454,7 @@ export const useAppStore = create<State & Actions>()(
 		clearChat: (event) =>
 			set((state) => {
 				state.messages.forEach((msg) => {
-					if (msg.from.id === event.data.participant.id && !msg.participant) {
+					if (msg.from.id === event.data.participant.id) {
 						msg.isDeleted = true
 						msg.content = ''
 					}
@@ -456,6 +507,115 @@ export const useAppStore = create<State & Actions>()(
 				}
 			}),
 
+		forceMuted: (event) =>
+			set((state) => {
+				const isMe = event.data.participants.some(
+					(p) => p.id === state.user?.id
+				)
+				if (!isMe) {
+					return
+				}
+				state.isForceMuted = event.data.mute
+				state.toast = {
+					open: true,
+					content: {
+						type: 'info',
+						title: event.data.mute ? 'Muted' : 'Unmuted',
+						description: event.data.mute
+							? `${event.data.by.username} muted you`
+							: `${event.data.by.username} allowed you to speak`,
+					},
+				}
+			}),
+
+		setRaisedHands: (users) =>
+			set((state) => {
+				state.raisedHands = users
+			}),
+
+		handRaised: (event) =>
+			set((state) => {
+				const { participant, raised, by } = event.data
+				state.raisedHands = state.raisedHands.filter(
+					(u) => u.id !== participant.id
+				)
+				if (raised) {
+					state.raisedHands.push(participant)
+					return
+				}
+				if (by && participant.id === state.user?.id) {
+					state.toast = {
+						open: true,
+						content: {
+							type: 'info',
+							title: 'Hand Lowered',
+							description: `${by.username} dismissed your raised hand`,
+						},
+					}
+				}
+			}),
+
+		speakerUpdated: (event) =>
+			set((state) => {
+				const { participant, speaker, by } = event.data
+				if (participant.id !== state.user?.id) {
+					return
+				}
+				if (!speaker) {
+					state.leftStageAt = Date.now()
+				}
+				if (by.id === participant.id) {
+					return
+				}
+				state.toast = {
+					open: true,
+					content: {
+						type: 'info',
+						title: speaker ? 'On Stage' : 'Off Stage',
+						description: speaker
+							? `${by.username} invited you to speak`
+							: `${by.username} moved you to the audience`,
+					},
+				}
+			}),
+
+		setMedia: (media) =>
+			set((state) => {
+				state.media = media && { ...media, receivedAt: Date.now() }
+			}),
+
+		syncMedia: (event) =>
+			set((state) => {
+				const { itemID, position, rate } = event.data
+				if (state.media?.current?.id !== itemID) {
+					return
+				}
+				state.media.position = position
+				state.media.rate = rate
+				state.media.paused = false
+				state.media.receivedAt = Date.now()
+			}),
+
+		setConnectionQuality: (stats) =>
+			set((state) => {
+				state.connectionQuality = stats
+			}),
+
+		setActiveSpeakers: (event) =>
+			set((state) => {
+				const speakers = event.data.speakers.map((s) => s.participantID)
+				Object.entries(state.roomStreams).forEach(([pID, stream]) => {
+					// our own stream is monitored locally
+					if (pID === state.sid) {
+						return
+					}
+					stream.speaking = speakers.includes(pID)
+					if (stream.speaking) {
+						stream.mute = false
+					}
+				})
+			}),
+
 		setMute: (event) =>
 			set((state) => {
 				const { mute, participantID: pID } = event.data
@@ -472,17 +632,22 @@ export const useAppStore = create<State & Actions>()(
 
 		error: (event) =>
 			set((state) => {
-				if (event.data.title === 'Room Full') {
+				if (event.data.code === 'room_full') {
 					state.roomFull = true
 					return
 				}
 
+				// only the errors with a title are meant for the user
+				if (!event.data.title) {
+					return
+				}
+
 				state.toast = {
 					open: true,
 					content: {
 						type: 'error',
 						title: event.data.title,
-						description: event.data.content,
+						description: event.data.message,
 					},
 				}
 			}),
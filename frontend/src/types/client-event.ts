@@ -1,4 +1,4 @@
-import { RoomRole } from '.'
+import { PublishPolicy, RoomRole } from '.'
 import {
 	PeerICECandidateEvent,
 	PeerOfferEvent,
@@ -15,7 +15,23 @@ export type ClientEvent =
 	| ClearChatEvent
 	| AssignRoleEvent
 	| UpdateWelcomeMsgEvent
+	| UpdatePublishSettingsEvent
+	| StartRecordingEvent
+	| ForceMuteEvent
+	| RaiseHandEvent
+	| ApproveHandEvent
+	| DismissHandEvent
+	| SetSpeakerEvent
+	| MediaLoadEvent
+	| MediaPlayEvent
+	| MediaPauseEvent
+	| MediaSeekEvent
+	| MediaQueueEvent
+	| MediaDequeueEvent
+	| MediaVoteSkipEvent
+	| StopRecordingEvent
 	| SetStatusEvent
+	| SetPresenceEvent
 	| KickPartcipantEvent
 	| PeerICECandidateEvent
 	| PeerOfferEvent
@@ -26,7 +42,8 @@ export type JoinRoomEvent = {
 	name: 'JOIN_ROOM'
 	data: {
 		roomID: number
-		key: string
+		// invite code of a locked room
+		key?: string
 	}
 }
 
@@ -94,6 +111,140 @@ export type UpdateWelcomeMsgEvent = {
 	}
 }
 
+export type UpdatePublishSettingsEvent = {
+	name: 'UPDATE_PUBLISH_SETTINGS'
+	data: {
+		roomID: number
+		videoPublishers: PublishPolicy
+		screenPublishers: PublishPolicy
+	}
+}
+
+export type ForceMuteEvent = {
+	name: 'FORCE_MUTE'
+	data: {
+		roomID: number
+		participantID?: number
+		allGuests?: boolean
+		mute: boolean
+	}
+}
+
+export type RaiseHandEvent = {
+	name: 'RAISE_HAND'
+	data: {
+		roomID: number
+		raise: boolean
+	}
+}
+
+export type ApproveHandEvent = {
+	name: 'APPROVE_HAND'
+	data: {
+		roomID: number
+		participantID: number
+	}
+}
+
+export type DismissHandEvent = {
+	name: 'DISMISS_HAND'
+	data: {
+		roomID: number
+		participantID: number
+	}
+}
+
+export type SetSpeakerEvent = {
+	name: 'SET_SPEAKER'
+	data: {
+		roomID: number
+		participantID: number
+		speaker: boolean
+	}
+}
+
+// an empty url plays the next queued item
+export type MediaLoadEvent = {
+	name: 'MEDIA_LOAD'
+	data: {
+		roomID: number
+		url: string
+		title?: string
+		duration?: number
+	}
+}
+
+export type MediaPlayEvent = {
+	name: 'MEDIA_PLAY'
+	data: {
+		roomID: number
+		position?: number
+		rate?: number
+	}
+}
+
+export type MediaPauseEvent = {
+	name: 'MEDIA_PAUSE'
+	data: {
+		roomID: number
+		position?: number
+	}
+}
+
+export type MediaSeekEvent = {
+	name: 'MEDIA_SEEK'
+	data: {
+		roomID: number
+		position: number
+	}
+}
+
+export type MediaQueueEvent = {
+	name: 'MEDIA_QUEUE'
+	data: {
+		roomID: number
+		url: string
+		title?: string
+		duration?: number
+	}
+}
+
+export type MediaDequeueEvent = {
+	name: 'MEDIA_DEQUEUE'
+	data: {
+		roomID: number
+		id: string
+	}
+}
+
+export type MediaVoteSkipEvent = {
+	name: 'MEDIA_VOTE_SKIP'
+	data: {
+		roomID: number
+	}
+}
+
+export type StartRecordingEvent = {
+	name: 'START_RECORDING'
+	data: {
+		roomID: number
+	}
+}
+
+export type StopRecordingEvent = {
+	name: 'STOP_RECORDING'
+	data: {
+		roomID: number
+	}
+}
+
+export type SetPresenceEvent = {
+	name: 'SET_PRESENCE'
+	data: {
+		idle: boolean
+	}
+}
+
 export type SetStatusEvent = {
 	name: 'SET_STATUS'
 	data: {
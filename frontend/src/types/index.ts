@@ -24,8 +24,79 @@ export type RoomSettings = {
 	host: User
 	coHosts?: number[]
 	welcomeMessage?: string
+	videoPublishers: PublishPolicy
+	screenPublishers: PublishPolicy
+	// only the host, co-hosts and speakers publish in stage mode
+	stage: boolean
+	speakers?: number[]
+	// locked rooms are only joined with an invite
+	locked: boolean
+	// days the messages are kept, 0 doesn't keep them
+	messageRetention?: number
 }
 
+export type Recording = {
+	id: string
+	roomID: number
+	startedBy: User
+	startedAt: string
+	stoppedAt?: string
+	tracks: {
+		file: string
+		participantID: string
+		user: User
+		start: number // ms since the start of the recording
+		end?: number
+	}[]
+	speakers: {
+		participantID: string
+		user: User
+		from: number
+		to?: number
+	}[]
+}
+
+export type RTCConfig = {
+	iceServers: RTCIceServer[]
+	ttl: number // seconds the TURN credentials are valid for
+}
+
+export type MediaItem = {
+	id: string
+	url: string
+	title?: string
+	duration?: number // seconds, missing when unknown
+	addedBy: User
+}
+
+// the watch party of a room, position is in seconds when it was received
+export type MediaState = {
+	current: MediaItem | null
+	position: number
+	rate: number
+	paused: boolean
+	queue: MediaItem[] | null
+	skips: number[] | null // the users who voted to skip the current item
+}
+
+export type ConnectionQuality = 'good' | 'fair' | 'poor'
+
+export type PeerStats = {
+	participantID: string
+	user: User
+	roomID: number
+	rtt: number // ms
+	jitter: number // ms
+	packetLoss: number // fraction of the packets lost, from 0 to 1
+	bitrateIn: number // bps
+	bitrateOut: number
+	candidateType: 'host' | 'srflx' | 'prflx' | 'relay' | ''
+	quality: ConnectionQuality
+	updatedAt: string
+}
+
+export type PublishPolicy = 'host' | 'coHosts' | 'everyone'
+
 export type Message = {
 	id: string
 	content: string
@@ -43,6 +114,19 @@ export type CreateRoom = {
 	topic: string
 	maxParticipants: number
 	languages: string[]
+	stage?: boolean
+	locked?: boolean
+	messageRetention?: number
+}
+
+export type RoomInvite = {
+	code: string
+	createdBy: number
+	// any number of users may join when it's not set
+	maxUses?: number
+	uses: number
+	expiredAt?: string
+	createdAt: string
 }
 
 export type RoomRes = Room & {
@@ -51,7 +135,12 @@ export type RoomRes = Room & {
 
 export type RoomRole = 'host' | 'coHost' | 'guest'
 
-export type RelationRes = { isFriend: boolean } & User
+export type Presence = {
+	status: 'online' | 'idle' | 'offline'
+	roomID?: number
+}
+
+export type RelationRes = { isFriend: boolean; presence: Presence } & User
 
 export type DMsRes = {
 	dmID: number
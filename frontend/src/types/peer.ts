@@ -6,11 +6,15 @@ export type PeerICECandidateEvent = {
 	}
 }
 
+export type TrackSource = 'microphone' | 'camera' | 'screen'
+
 export type PeerOfferEvent = {
 	name: 'PEER_OFFER'
 	data: {
 		offer: string
 		roomID: number
+		// labels the published tracks by their id
+		tracks?: Record<string, TrackSource>
 	}
 }
 
@@ -27,6 +31,26 @@ export type PeerStreamsEvent = {
 	data: {
 		roomID: number
 		streams: Record<string, string>
+		tracks: PeerTrack[]
+	}
+}
+
+export type PeerTrack = {
+	participantID: string
+	streamID: string
+	trackID: string
+	kind: 'audio' | 'video'
+	source: TrackSource
+}
+
+export type PeerStreamRemovedEvent = {
+	name: 'PEER_STREAM_REMOVED'
+	data: {
+		roomID: number
+		participantID: string
+		streamID: string
+		trackID: string
+		source: TrackSource
 	}
 }
 
@@ -1,9 +1,18 @@
-import { Message, RoomRole, User } from '@/types'
+import {
+	MediaState,
+	Message,
+	PeerStats,
+	Presence,
+	PublishPolicy,
+	RoomRole,
+	User,
+} from '@/types'
 import {
 	PeerICECandidateEvent,
 	PeerAnswerEvent,
 	PeerOfferEvent,
 	PeerStreamsEvent,
+	PeerStreamRemovedEvent,
 } from './peer'
 
 // ServerEvent comprises of 'BroadcastEvent' and 'SFUEvent'
@@ -22,14 +31,32 @@ export type ServerEvent =
 	| ClearChatBroadcastEvent
 	| AssignRoleBroadcastEvent
 	| UpdateWelcomeMsgBroadcastEvent
+	| UpdatePublishSettingsBroadcastEvent
+	| RecordingStartedEvent
+	| ActiveSpeakersEvent
+	| ConnectionQualityEvent
+	| HandRaisedEvent
+	| SpeakerUpdatedEvent
+	| MediaStateEvent
+	| PeerReconnectingEvent
+	| MediaSyncEvent
+	| ParticipantForceMutedEvent
+	| RecordingStoppedEvent
 	| SetStatusBroadcastEvent
 	| KickParticipantBroadcastEvent
-	| ErrorBroadcastEvent
+	| ErrorEvent
+	| SessionEvent
+	| SessionResumedEvent
+	| AckEvent
+	| ParticipantReconnectingEvent
+	| RateLimitedEvent
+	| PresenceUpdateEvent
 	| PeerMuteBroadcastEvent
 	| PeerICECandidateEvent
 	| PeerAnswerEvent
 	| PeerOfferEvent
 	| PeerStreamsEvent
+	| PeerStreamRemovedEvent
 
 export type JoinedRoomBroadcastEvent = {
 	name: 'JOINED_ROOM_BROADCAST'
@@ -37,7 +64,6 @@ export type JoinedRoomBroadcastEvent = {
 		roomID: number
 		user: User
 		sid: string
-		key: string
 	}
 }
 
@@ -106,6 +132,16 @@ export type UpdateWelcomeMsgBroadcastEvent = {
 	}
 }
 
+export type UpdatePublishSettingsBroadcastEvent = {
+	name: 'UPDATE_PUBLISH_SETTINGS_BROADCAST'
+	data: {
+		roomID: number
+		by: User
+		videoPublishers: PublishPolicy
+		screenPublishers: PublishPolicy
+	}
+}
+
 export type SetStatusBroadcastEvent = {
 	name: 'SET_STATUS_BROADCAST'
 	data: {
@@ -123,12 +159,172 @@ export type KickParticipantBroadcastEvent = {
 	}
 }
 
-export type ErrorBroadcastEvent = {
-	name: 'ERROR_BROADCAST'
+export type SessionEvent = {
+	name: 'SESSION'
+	data: {
+		sid: string
+		token: string
+		resumeGrace: number
+	}
+}
+
+export type SessionResumedEvent = {
+	name: 'SESSION_RESUMED'
+	data: {
+		sid: string
+		roomID: number
+	}
+}
+
+export type ParticipantForceMutedEvent = {
+	name: 'PARTICIPANT_FORCE_MUTED'
 	data: {
-		content: string
 		roomID: number
-		title: string
+		by: User
+		participants: User[]
+		mute: boolean
+	}
+}
+
+export type HandRaisedEvent = {
+	name: 'HAND_RAISED'
+	data: {
+		roomID: number
+		participant: User
+		by: User | null // the moderator who dismissed the hand
+		raised: boolean
+	}
+}
+
+export type SpeakerUpdatedEvent = {
+	name: 'SPEAKER_UPDATED'
+	data: {
+		roomID: number
+		by: User
+		participant: User
+		speaker: boolean
+	}
+}
+
+export type MediaStateEvent = {
+	name: 'MEDIA_STATE'
+	data: {
+		roomID: number
+		action:
+			| 'load'
+			| 'play'
+			| 'pause'
+			| 'seek'
+			| 'queue'
+			| 'dequeue'
+			| 'voteSkip'
+			| 'skip'
+			| 'ended'
+		by: User | null // null when the server played the next item
+		media: MediaState
+	}
+}
+
+// the position of the playing item, sent to correct the drift
+export type MediaSyncEvent = {
+	name: 'MEDIA_SYNC'
+	data: {
+		roomID: number
+		itemID: string
+		position: number
+		rate: number
+	}
+}
+
+// sent about our own peer while the server recovers it. It restarts ICE
+// first and rebuilds the peer if that didn't work, failed means we were
+// taken out of the room.
+export type PeerReconnectingEvent = {
+	name: 'PEER_RECONNECTING'
+	data: {
+		roomID: number
+		state: 'restarting' | 'rebuilding' | 'recovered' | 'failed'
+	}
+}
+
+// sent only about our own connection
+export type ConnectionQualityEvent = {
+	name: 'CONNECTION_QUALITY'
+	data: PeerStats
+}
+
+export type ActiveSpeakersEvent = {
+	name: 'ACTIVE_SPEAKERS'
+	data: {
+		roomID: number
+		// the loudest first, level goes from 0 (silence) to 127
+		speakers: { participantID: string; level: number }[]
+	}
+}
+
+export type RecordingStartedEvent = {
+	name: 'RECORDING_STARTED'
+	data: {
+		roomID: number
+		recordingID: string
+		by: User
+	}
+}
+
+export type RecordingStoppedEvent = {
+	name: 'RECORDING_STOPPED'
+	data: {
+		roomID: number
+		recordingID: string
+		by: User | null // null when the room emptied
+	}
+}
+
+export type AckEvent = {
+	name: 'ACK'
+	data: {
+		id: string
+		event: string
+		data: unknown
+	}
+}
+
+export type ParticipantReconnectingEvent = {
+	name: 'PARTICIPANT_RECONNECTING'
+	data: {
+		roomID: number
+		participantID: string
+		reconnecting: boolean
+	}
+}
+
+export type PresenceUpdateEvent = {
+	name: 'PRESENCE_UPDATE'
+	data: {
+		user: User
+		presence: Presence
+	}
+}
+
+export type RateLimitedEvent = {
+	name: 'RATE_LIMITED'
+	data: {
+		id?: string
+		event: string
+		retryAfter: number
+	}
+}
+
+export type ErrorEvent = {
+	name: 'ERROR'
+	data: {
+		id?: string
+		event: string
+		code: string
+		message: string
+		title?: string
+		roomID?: number
+		errors?: Record<string, string>
 	}
 }
 
@@ -152,6 +348,8 @@ export type EditMessage = {
 export type DeleteMessage = {
 	id: string
 	from: User
+	// who deleted it, the host or a co-host might delete someone else's
+	by?: User
 	roomID?: number
 	participant?: User
 }